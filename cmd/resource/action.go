@@ -3,6 +3,11 @@ package resource
 import (
 	"fmt"
 	"log"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/aws-cloudformation/cloudformation-cli-go-plugin/cfn/handler"
@@ -14,27 +19,73 @@ import (
 type Stage string
 
 const (
-	InitStage        Stage = "Init"
-	ReleaseStabilize Stage = "ReleaseStabilize"
-	UninstallRelease Stage = "UninstallRelease"
-	LambdaStabilize  Stage = "LambdaStabilize"
-	CompleteStage    Stage = "Complete"
-	NoStage          Stage = "NoStage"
+	InitStage         Stage = "Init"
+	ReleaseStabilize  Stage = "ReleaseStabilize"
+	UninstallRelease  Stage = "UninstallRelease"
+	LambdaStabilize   Stage = "LambdaStabilize"
+	VerifyStabilize   Stage = "VerifyStabilize"
+	ApprovalStabilize Stage = "ApprovalStabilize"
+	CompleteStage     Stage = "Complete"
+	NoStage           Stage = "NoStage"
 )
 
+// Approvals of an install or upgrade read from the ApprovalParameter
 const (
-	retryCount = 3
+	approvalGranted = "Approved"
+	approvalDenied  = "Denied"
+	approvalPending = "Pending"
+	// maxDiffResources is the number of changed resources listed in the status message of a pending approval
+	maxDiffResources = 10
+)
+
+const (
+	retryCount               = 3
+	defaultHealthCheckStatus = 200
+	healthCheckTimeout       = 10 * time.Second
 )
 
 func initialize(session *session.Session, currentModel *Model, action Action) handler.ProgressEvent {
 	vpc := false
 	var err error
-	client, err := NewClients(currentModel.ClusterID, currentModel.KubeConfig, currentModel.Namespace, session, currentModel.RoleArn, nil, currentModel.VPCConfiguration)
+	if aws.BoolValue(currentModel.Explain) && action == UninstallReleaseAction {
+		log.Printf("Explain mode, nothing to uninstall")
+		return makeEvent(nil, CompleteStage, nil)
+	}
+	if _, err := timeOutDuration(currentModel.TimeOut, currentModel.TimeOutUnit); err != nil {
+		return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error()))
+	}
+	if aws.BoolValue(currentModel.Explain) {
+		// The inputs are resolved with the AWS clients only, without connecting to the cluster
+		client, err := NewAWSClients(session)
+		if err != nil {
+			return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error()))
+		}
+		e, err := client.newEvent(currentModel, action)
+		if err != nil {
+			return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error()))
+		}
+		return client.explain(session, currentModel, e)
+	}
+	Phase = TimeOutChartDownload
+	if action == UninstallReleaseAction {
+		Phase = TimeOutUninstall
+	}
+	role := operationRole(currentModel, false)
+	client, err := NewClients(currentModel.ClusterID, currentModel.KubeConfig, currentModel.Namespace, session, role, nil, currentModel.VPCConfiguration, currentModel.KubeAuthExec, stageDeadline(currentModel))
 	if err != nil {
 		return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error()))
 	}
+	client.captureCallerIdentity(currentModel, role)
+	if mode := aws.StringValue(currentModel.KubeConfigCACheck); mode != "" && currentModel.KubeConfig != nil {
+		if err := client.checkKubeConfigCA(KubeConfigLocalPath); err != nil {
+			if mode == caCheckFail {
+				return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error()))
+			}
+			log.Printf("Warning: %s", err)
+		}
+	}
 	if IsZero(currentModel.VPCConfiguration) && currentModel.ClusterID != nil {
-		currentModel.VPCConfiguration, err = getVpcConfig(client.AWSClients.EKSClient(nil, nil), client.AWSClients.EC2Client(nil, nil), currentModel)
+		currentModel.VPCConfiguration, err = getVpcConfig(client.AWSClients.EKSClient(nil, nil), client.AWSClients.EC2Client(nil, nil), client.AWSClients.STSClient(nil, nil), currentModel)
 		if err != nil {
 			return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error()))
 		}
@@ -43,18 +94,10 @@ func initialize(session *session.Session, currentModel *Model, action Action) ha
 			client.LambdaResource = newLambdaResource(client.AWSClients.STSClient(nil, nil), currentModel.ClusterID, currentModel.KubeConfig, currentModel.VPCConfiguration)
 		}
 	}
-	e := &Event{}
-	e.Inputs = new(Inputs)
-	e.Inputs.Config = new(Config)
-	e.Action = action
-	e.Model = currentModel
-	e.Inputs.ChartDetails, err = client.getChartDetails(currentModel)
+	e, err := client.newEvent(currentModel, action)
 	if err != nil {
 		return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error()))
 	}
-	e.Inputs.Config.Name = getReleaseName(currentModel.Name, e.Inputs.ChartDetails.ChartName)
-	currentModel.Name = e.Inputs.Config.Name
-	e.Inputs.Config.Namespace = getReleaseNameSpace(currentModel.Namespace)
 	if currentModel.ID == nil {
 		currentModel.ID, err = generateID(currentModel, *e.Inputs.Config.Name, aws.StringValue(session.Config.Region), *e.Inputs.Config.Namespace)
 		if err != nil {
@@ -68,6 +111,8 @@ func initialize(session *session.Session, currentModel *Model, action Action) ha
 		if err != nil {
 			return makeEvent(currentModel, NoStage, NewError(ErrCodeKubeException, err.Error()))
 		}
+		phase := Phase
+		Phase = TimeOutVPCConnector
 		u, err := client.initializeLambda(client.LambdaResource)
 		if err != nil {
 			return makeEvent(currentModel, NoStage, NewError(ErrCodeLambdaException, err.Error()))
@@ -75,34 +120,69 @@ func initialize(session *session.Session, currentModel *Model, action Action) ha
 		if !u {
 			return makeEvent(currentModel, LambdaStabilize, nil)
 		}
+		Phase = phase
 	}
-	switch e.Action {
-	case InstallReleaseAction:
-		e.Inputs.ValueOpts, err = client.processValues(currentModel)
+	if e.Action == InstallReleaseAction || e.Action == UpdateReleaseAction {
+		e.Inputs.ValueOpts, e.Inputs.ResolvedValuePaths, err = client.processValues(currentModel)
 		if err != nil {
 			return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error()))
 		}
+	}
+	if !IsZero(currentModel.ApprovalParameter) && action != UninstallReleaseAction {
+		Phase = TimeOutApproval
+		approval, err := getApproval(client.AWSClients.SSMClient(nil, nil), *currentModel.ApprovalParameter, operationStart())
+		if err != nil {
+			return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error()))
+		}
+		chart := fmt.Sprintf("%s %s", aws.StringValue(e.Inputs.ChartDetails.ChartName), aws.StringValue(e.Inputs.ChartDetails.ChartVersion))
+		switch approval {
+		case approvalDenied:
+			return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, fmt.Sprintf("release %s with chart %s was denied by SSM parameter %s, nothing was applied", *e.Inputs.Config.Name, strings.TrimSpace(chart), *currentModel.ApprovalParameter)))
+		case approvalPending:
+			// The changes to approve are rendered and diffed against the deployed release, applying nothing
+			diff, err := client.helmDiffWrapper(e, client.LambdaResource.functionName, vpc)
+			if err != nil {
+				return makeEvent(currentModel, NoStage, NewError(ErrCodeHelmActionException, err.Error()))
+			}
+			log.Printf("Waiting for approval to apply release %s in namespace %s with chart %s, set SSM parameter %s to %s or %s. Changes: %s", *e.Inputs.Config.Name, *e.Inputs.Config.Namespace, strings.TrimSpace(chart), *currentModel.ApprovalParameter, approvalGranted, approvalDenied, diffSummary(diff, len(diff)))
+			ProgressDetail = fmt.Sprintf("set SSM parameter %s to %s or %s, changes: %s", *currentModel.ApprovalParameter, approvalGranted, approvalDenied, diffSummary(diff, maxDiffResources))
+			return makeEvent(currentModel, ApprovalStabilize, nil)
+		}
+		log.Printf("Release %s approved by SSM parameter %s", *e.Inputs.Config.Name, *currentModel.ApprovalParameter)
+		Phase = TimeOutChartDownload
+	}
+	switch e.Action {
+	case InstallReleaseAction:
 		data, err := DecodeID(currentModel.ID)
 		if err != nil {
 			return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error()))
 		}
 		currentModel.Name = data.Name
 		e.Model = currentModel
+		Phase = TimeOutHooks
 		err = client.helmInstallWrapper(e, client.LambdaResource.functionName, vpc)
 		if err != nil {
+			if retryableError(err, e.Inputs.Config.RetryableErrors) {
+				return retryInstall(currentModel, err)
+			}
 			return makeEvent(currentModel, NoStage, NewError(ErrCodeHelmActionException, err.Error()))
 		}
 		return makeEvent(currentModel, ReleaseStabilize, nil)
 	case UpdateReleaseAction:
-		e.Inputs.ValueOpts, err = client.processValues(currentModel)
-		if err != nil {
-			return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error()))
-		}
 		data, err := DecodeID(currentModel.ID)
 		if err != nil {
 			return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error()))
 		}
+		if aws.BoolValue(currentModel.PinChartVersion) {
+			e.Action = CheckReleaseAction
+			s, err := client.helmStatusWrapper(data.Name, e, client.LambdaResource.functionName, vpc)
+			if err != nil {
+				return makeEvent(currentModel, NoStage, NewError(ErrCodeHelmActionException, err.Error()))
+			}
+			pinChartVersion(e.Inputs.ChartDetails, s)
+		}
 		e.Action = UpdateReleaseAction
+		Phase = TimeOutHooks
 		err = client.helmUpgradeWrapper(data.Name, e, client.LambdaResource.functionName, vpc)
 		if err != nil {
 			return makeEvent(currentModel, NoStage, NewError(ErrCodeHelmActionException, err.Error()))
@@ -114,6 +194,17 @@ func initialize(session *session.Session, currentModel *Model, action Action) ha
 		if err != nil {
 			return makeEvent(nil, NoStage, NewError(ErrCodeHelmActionException, err.Error()))
 		}
+		if aws.BoolValue(currentModel.PreviewDelete) {
+			resources, err := client.helmDeletePreviewWrapper(data.Name, e, client.LambdaResource.functionName, vpc)
+			if err != nil {
+				if err.Error() == ErrCodeNotFound {
+					return makeEvent(nil, NoStage, NewError(ErrCodeNotFound, err.Error()))
+				}
+				return makeEvent(nil, NoStage, NewError(ErrCodeHelmActionException, err.Error()))
+			}
+			msg := fmt.Sprintf("Delete preview, uninstalling release %s in namespace %s would delete %d resources: %s. Unset PreviewDelete to delete the release", aws.StringValue(data.Name), aws.StringValue(data.Namespace), len(resources), strings.Join(resources, ", "))
+			return makeEvent(nil, NoStage, NewError(ErrCodeInvalidException, msg))
+		}
 		err = client.helmDeleteWrapper(data.Name, e, client.LambdaResource.functionName, vpc)
 		if err != nil {
 			if err.Error() == ErrCodeNotFound {
@@ -126,15 +217,112 @@ func initialize(session *session.Session, currentModel *Model, action Action) ha
 	return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, fmt.Sprintf("unhandled stage %s", action)))
 }
 
+// diffSummary joins the first max resources of the diff, counting the others
+func diffSummary(diff []string, max int) string {
+	if len(diff) == 0 {
+		return "none"
+	}
+	if len(diff) <= max {
+		return strings.Join(diff, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(diff[:max], ", "), len(diff)-max)
+}
+
+// retryInstall calls the install stage back after the backoff delay of the retry. The failed install was removed
+// and the release lock kept for the retry.
+func retryInstall(currentModel *Model, err error) handler.ProgressEvent {
+	delay := installRetryDelay()
+	InstallRetries++
+	log.Printf("Install of release %s failed with a retryable error: %s. Retry %d of %d in %s...", aws.StringValue(currentModel.Name), err, InstallRetries, retryCount, delay)
+	LastKnownErrors = append(LastKnownErrors, err.Error())
+	event := makeEvent(currentModel, InitStage, nil)
+	if event.OperationStatus == handler.InProgress {
+		event.CallbackDelaySeconds = int64(delay / time.Second)
+	}
+	return event
+}
+
+// installRetryDelay returns the backoff delay of the next install retry, doubled with each retry.
+func installRetryDelay() time.Duration {
+	return installRetryBackoff * time.Duration(1<<uint(InstallRetries))
+}
+
+// newEvent builds the event of the action from the model, resolving the chart details and the release name and config.
+func (c *Clients) newEvent(currentModel *Model, action Action) (*Event, error) {
+	var err error
+	e := &Event{}
+	e.Inputs = new(Inputs)
+	e.Inputs.Config = new(Config)
+	e.Action = action
+	e.Model = currentModel
+	e.Inputs.ChartDetails, err = c.getChartDetails(currentModel)
+	if err != nil {
+		return nil, err
+	}
+	if ResolvedChart != nil {
+		pinChartVersion(e.Inputs.ChartDetails, ResolvedChart)
+	}
+	switch {
+	case currentModel.Name == nil && action != InstallReleaseAction && currentModel.ID != nil:
+		// The release keeps the name it was installed with
+		data, err := DecodeID(currentModel.ID)
+		if err != nil {
+			return nil, err
+		}
+		e.Inputs.Config.Name = data.Name
+	case currentModel.Name == nil && currentModel.GenerateNamePrefix != nil && action == InstallReleaseAction:
+		e.Inputs.Config.Name, err = generateReleaseName(*currentModel.GenerateNamePrefix)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		e.Inputs.Config.Name = getReleaseName(currentModel.Name, e.Inputs.ChartDetails.ChartName)
+	}
+	currentModel.Name = e.Inputs.Config.Name
+	e.Inputs.Config.Namespace = getReleaseNameSpace(currentModel.Namespace)
+	e.Inputs.Config.HelmFlags = currentModel.HelmFlags
+	e.Inputs.Config.RequireExisting = currentModel.RequireExisting
+	e.Inputs.Config.LogPhysicalID = currentModel.LogPhysicalID
+	e.Inputs.Config.NetworkPolicy = currentModel.NetworkPolicy
+	e.Inputs.Config.SkipHooks = currentModel.SkipHooks
+	e.Inputs.Config.APIVersions = currentModel.APIVersions
+	e.Inputs.Config.KubeVersionOverride = currentModel.KubeVersionOverride
+	e.Inputs.Config.CleanupOnDelete = currentModel.CleanupOnDelete
+	e.Inputs.Config.CommonAnnotations = currentModel.CommonAnnotations
+	e.Inputs.Config.CommonLabels = currentModel.CommonLabels
+	e.Inputs.Config.CheckPermissions = currentModel.CheckPermissions
+	e.Inputs.Config.OverlappingResources = currentModel.OverlappingResources
+	e.Inputs.Config.Suspend = currentModel.Suspend
+	e.Inputs.Config.PreservedSecretValues = currentModel.PreservedSecretValues
+	e.Inputs.Config.ValuesStrategy = currentModel.ValuesStrategy
+	e.Inputs.Config.Kustomization = currentModel.Kustomization
+	e.Inputs.Config.ChartWarnings = currentModel.ChartWarnings
+	e.Inputs.Config.Deadline = operationDeadline(os.Getenv("StartTime"), currentModel.TimeOut, currentModel.TimeOutUnit)
+	if InstallRetries < retryCount && beforeDeadline(e.Inputs.Config.Deadline, installRetryDelay()) {
+		// Once no retry remains, a retryable error fails the install like any other
+		e.Inputs.Config.RetryableErrors = currentModel.RetryableErrors
+	}
+	if id := os.Getenv("OperationID"); id != "" {
+		e.Inputs.Config.OperationID = aws.String(id)
+	}
+	if id := os.Getenv("StackID"); id != "" {
+		e.Inputs.Config.StackID = aws.String(id)
+	}
+	e.Inputs.Config.OverrideOwnership = currentModel.OverrideStackOwnership
+	e.Inputs.Config.ExternallyManagedAnnotation = currentModel.ExternallyManagedAnnotation
+	e.Inputs.Config.OverrideExternallyManaged = currentModel.OverrideExternallyManaged
+	return e, nil
+}
+
 func checkReleaseStatus(session *session.Session, currentModel *Model, successStage Stage) handler.ProgressEvent {
 	vpc := false
 	var err error
-	client, err := NewClients(currentModel.ClusterID, currentModel.KubeConfig, currentModel.Namespace, session, currentModel.RoleArn, nil, currentModel.VPCConfiguration)
+	client, err := NewClients(currentModel.ClusterID, currentModel.KubeConfig, currentModel.Namespace, session, operationRole(currentModel, false), nil, currentModel.VPCConfiguration, currentModel.KubeAuthExec, stageDeadline(currentModel))
 	if err != nil {
 		return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error()))
 	}
 	if IsZero(currentModel.VPCConfiguration) && currentModel.ClusterID != nil {
-		currentModel.VPCConfiguration, err = getVpcConfig(client.AWSClients.EKSClient(nil, nil), client.AWSClients.EC2Client(nil, nil), currentModel)
+		currentModel.VPCConfiguration, err = getVpcConfig(client.AWSClients.EKSClient(nil, nil), client.AWSClients.EC2Client(nil, nil), client.AWSClients.STSClient(nil, nil), currentModel)
 		if err != nil {
 			return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error()))
 		}
@@ -147,6 +335,7 @@ func checkReleaseStatus(session *session.Session, currentModel *Model, successSt
 		if err != nil {
 			return makeEvent(currentModel, NoStage, NewError(ErrCodeKubeException, err.Error()))
 		}
+		Phase = TimeOutVPCConnector
 		u, err := client.initializeLambda(client.LambdaResource)
 		if err != nil {
 			return makeEvent(currentModel, NoStage, NewError(ErrCodeLambdaException, err.Error()))
@@ -155,11 +344,18 @@ func checkReleaseStatus(session *session.Session, currentModel *Model, successSt
 			return makeEvent(currentModel, LambdaStabilize, nil)
 		}
 	}
+	Phase = TimeOutResources
 	e.Action = CheckReleaseAction
 	s, err := client.helmStatusWrapper(currentModel.Name, e, client.LambdaResource.functionName, vpc)
 	if err != nil {
 		return makeEvent(currentModel, NoStage, NewError(ErrCodeHelmActionException, err.Error()))
 	}
+	if s.ChartVersion != "" {
+		ResolvedChart = &HelmStatusData{ChartName: s.ChartName, ChartVersion: s.ChartVersion, ChartDigest: s.ChartDigest}
+		if hash, err := valuesHash(s.Values); err == nil {
+			ResolvedChart.ValuesHash = aws.StringValue(hash)
+		}
+	}
 	switch s.Status {
 	case release.StatusDeployed:
 		e.ReleaseData = &ReleaseData{
@@ -168,27 +364,289 @@ func checkReleaseStatus(session *session.Session, currentModel *Model, successSt
 			Chart:     s.Chart,
 			Manifest:  s.Manifest,
 		}
+		e.ReleaseData.ServiceAccount = aws.StringValue(currentModel.WaitForServiceAccountSecret)
+		e.ReleaseData.ReadinessThreshold = aws.IntValue(currentModel.ReadinessThreshold)
 		e.Action = GetPendingAction
 		pending, err := client.kubePendingWrapper(e, client.LambdaResource.functionName, vpc)
+		if err != nil && inGracePeriod(os.Getenv("StartTime"), currentModel.StartupGracePeriod) {
+			log.Printf("Release %s resources not ready within startup grace period: %v", e.ReleaseData.Name, err)
+			return makeEvent(currentModel, ReleaseStabilize, nil)
+		}
 		if err != nil {
 			return makeEvent(currentModel, NoStage, NewError(ErrCodeKubeException, err.Error()))
 		}
 		if pending {
 			log.Printf("Release %s have pending resources", e.ReleaseData.Name)
+			// The description is informational only and does not fail the stage
+			if err := client.helmSetDescriptionWrapper(e, DescriptionPending, client.LambdaResource.functionName, vpc); err != nil {
+				log.Printf("Failed to set release %s description: %v", e.ReleaseData.Name, err)
+			}
 			return makeEvent(currentModel, ReleaseStabilize, nil)
 		}
 		log.Printf("Release %s have no pending resources.", e.ReleaseData.Name)
+		if err := client.setReleaseAttributes(currentModel, s); err != nil {
+			return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error()))
+		}
+		if err := client.helmSetDescriptionWrapper(e, DescriptionComplete, client.LambdaResource.functionName, vpc); err != nil {
+			log.Printf("Failed to set release %s description: %v", e.ReleaseData.Name, err)
+		}
+		client.unlockReleaseWrapper(e, client.LambdaResource.functionName, vpc)
+		if currentModel.HealthCheckURL != nil {
+			return makeEvent(currentModel, VerifyStabilize, nil)
+		}
 		return makeEvent(currentModel, successStage, nil)
 	case release.StatusPendingInstall, release.StatusPendingUpgrade:
 		pushLastKnownError(fmt.Sprintf("Release %s/%s in %s state", s.Namespace, *currentModel.Name, s.Status))
 		return makeEvent(currentModel, ReleaseStabilize, nil)
 	default:
 		pushLastKnownError(fmt.Sprintf("Release %s/%s in %s state", s.Namespace, *currentModel.Name, s.Status))
+		e.ReleaseData = &ReleaseData{Name: *currentModel.Name, Namespace: s.Namespace}
+		client.unlockReleaseWrapper(e, client.LambdaResource.functionName, vpc)
 		return makeEvent(currentModel, NoStage, NewError(ErrCodeHelmActionException, "release failed"))
 
 	}
 }
 
+// operationRole returns the role the handler assumes, ReadRoleArn for reads and WriteRoleArn for changes, falling back
+// to RoleArn when the operation has no role of its own.
+func operationRole(currentModel *Model, read bool) *string {
+	role := currentModel.WriteRoleArn
+	if read {
+		role = currentModel.ReadRoleArn
+	}
+	if IsZero(role) {
+		return currentModel.RoleArn
+	}
+	return role
+}
+
+// captureCallerIdentity logs the identity the operation is performed as, after assuming the role, and returns its ARN
+// as the CallerIdentity attribute when it is in ReturnAttributes. Failing to get the identity does not fail the operation.
+func (c *Clients) captureCallerIdentity(currentModel *Model, role *string) {
+	currentModel.CallerIdentity = nil
+	arn, account, err := getCallerIdentity(c.AWSClients.STSClient(nil, role))
+	if err != nil {
+		log.Printf("Unable to get the caller identity: %s", err)
+		return
+	}
+	log.Printf("Operating as %s in account %s", aws.StringValue(arn), aws.StringValue(account))
+	if stringInSlice("CallerIdentity", currentModel.ReturnAttributes) {
+		currentModel.CallerIdentity = arn
+	}
+}
+
+// setReleaseAttributes populates the read-only attributes selected by ReturnAttributes from the release status.
+func (c *Clients) setReleaseAttributes(currentModel *Model, s *HelmStatusData) error {
+	attributes := currentModel.ReturnAttributes
+	if attributes == nil {
+		attributes = []string{"Notes", "ResolvedChartDigest", "ResolvedChartVersion", "Revision", "Status", "ValuesSummary"}
+	}
+	currentModel.Notes, currentModel.Revision, currentModel.Status, currentModel.Resources = nil, nil, nil, nil
+	currentModel.ResolvedChartVersion, currentModel.ResolvedChartDigest, currentModel.ComputedValues = nil, nil, nil
+	currentModel.ValuesSummary = nil
+	for _, a := range attributes {
+		switch a {
+		case "Notes":
+			notes, err := releaseNotes(s.Notes, currentModel.NotesRedactPattern)
+			if err != nil {
+				return err
+			}
+			currentModel.Notes = notes
+		case "Revision":
+			if s.Revision != 0 {
+				currentModel.Revision = aws.Int(s.Revision)
+			}
+		case "Status":
+			if s.Status != "" {
+				currentModel.Status = aws.String(s.Status.String())
+			}
+		case "ResolvedChartVersion":
+			if s.ChartVersion != "" {
+				currentModel.ResolvedChartVersion = aws.String(s.ChartVersion)
+			}
+		case "ResolvedChartDigest":
+			if s.ChartDigest != "" {
+				currentModel.ResolvedChartDigest = aws.String(s.ChartDigest)
+			}
+		case "Resources":
+			if s.Manifest != "" {
+				currentModel.Resources = manifestResources(s.Manifest, s.Namespace)
+			}
+		case "CallerIdentity":
+			// set from the caller identity when the clients are created
+		case "ComputedValues":
+			values, err := c.computedValues(currentModel, s)
+			if err != nil {
+				return err
+			}
+			currentModel.ComputedValues = values
+		case "ValuesSummary":
+			summary, err := valuesSummary(s.Values)
+			if err != nil {
+				return err
+			}
+			currentModel.ValuesSummary = summary
+		default:
+			return fmt.Errorf("unsupported return attribute %s", a)
+		}
+	}
+	return nil
+}
+
+// valuesSummary summarizes the release values by their top-level keys, their number and their hash, leaving out the
+// values themselves.
+func valuesSummary(values map[string]interface{}) (*string, error) {
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+	hash, err := valuesHash(values)
+	if err != nil {
+		return nil, genericError("Values summary", err)
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	count := 0
+	if len(values) > 0 {
+		count = countValues(values)
+	}
+	return aws.String(fmt.Sprintf("%d values under [%s], hash %s", count, strings.Join(keys, ", "), aws.StringValue(hash))), nil
+}
+
+// countValues counts the leaf values, an empty map or list counting as one
+func countValues(v interface{}) int {
+	n := 0
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for _, e := range t {
+			n += countValues(e)
+		}
+	case []interface{}:
+		for _, e := range t {
+			n += countValues(e)
+		}
+	default:
+		return 1
+	}
+	if n == 0 {
+		return 1
+	}
+	return n
+}
+
+// computedValues returns the canonical JSON of the computed values of the release, with the SecretValuePaths and the
+// MaskValuePaths redacted.
+// Past ComputedValuesMaxSize, the full values are offloaded to an object under ComputedValuesS3URI and the object URI is
+// returned instead, or without ComputedValuesS3URI the top-level values that do not fit are truncated.
+func (c *Clients) computedValues(currentModel *Model, s *HelmStatusData) (*string, error) {
+	values := s.Values
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+	paths := make([][]string, 0, len(currentModel.SecretValuePaths))
+	for _, p := range currentModel.SecretValuePaths {
+		paths = append(paths, strings.Split(p, "."))
+	}
+	if paths = maskValuePaths(currentModel, paths); len(paths) > 0 {
+		values = redactValuePaths(values, paths)
+	}
+	b, err := canonicalJSON(values)
+	if err != nil {
+		return nil, genericError("Computed values", err)
+	}
+	size := defaultComputedValuesMaxSize
+	if currentModel.ComputedValuesMaxSize != nil {
+		size = *currentModel.ComputedValuesMaxSize
+	}
+	if len(b) <= size {
+		return aws.String(string(b)), nil
+	}
+	if IsZero(currentModel.ComputedValuesS3URI) {
+		log.Printf("Computed values of %d bytes exceed the %d bytes limit, truncating them", len(b), size)
+		b, err = truncateValues(values, size)
+		if err != nil {
+			return nil, genericError("Computed values", err)
+		}
+		return aws.String(string(b)), nil
+	}
+	u, err := url.Parse(*currentModel.ComputedValuesS3URI)
+	if err != nil || strings.ToLower(u.Scheme) != "s3" || u.Host == "" {
+		return nil, genericError("Computed values", fmt.Errorf("invalid ComputedValuesS3URI %q, expected s3://bucket/prefix", *currentModel.ComputedValuesS3URI))
+	}
+	key := path.Join(strings.Trim(u.Path, "/"), s.Namespace, aws.StringValue(currentModel.Name), fmt.Sprintf("%d.json", s.Revision))
+	region, err := getBucketRegion(c.AWSClients.S3Client(nil, nil), u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if err := uploadS3(c.AWSClients.S3Client(region, nil), u.Host, key, b); err != nil {
+		return nil, genericError("Computed values", err)
+	}
+	ref := fmt.Sprintf("s3://%s/%s", u.Host, key)
+	log.Printf("Computed values of %d bytes exceed the %d bytes limit, offloaded them to %s", len(b), size, ref)
+	return aws.String(ref), nil
+}
+
+// verifyRelease waits for the health check URL to return the expected status before completing.
+func verifyRelease(currentModel *Model, successStage Stage) handler.ProgressEvent {
+	Phase = TimeOutHealthCheck
+	expected := defaultHealthCheckStatus
+	if currentModel.HealthCheckExpectedStatus != nil {
+		expected = *currentModel.HealthCheckExpectedStatus
+	}
+	ok, err := checkHealth(*currentModel.HealthCheckURL, expected)
+	if err != nil {
+		pushLastKnownError(err.Error())
+		return makeEvent(currentModel, VerifyStabilize, nil)
+	}
+	if !ok {
+		pushLastKnownError(fmt.Sprintf("Health check %s did not return %v", *currentModel.HealthCheckURL, expected))
+		return makeEvent(currentModel, VerifyStabilize, nil)
+	}
+	log.Printf("Health check %s passed", *currentModel.HealthCheckURL)
+	return makeEvent(currentModel, successStage, nil)
+}
+
+// explain sets the Explanation attribute to the resolved inputs of the event and completes without acting on the cluster.
+func (c *Clients) explain(session *session.Session, currentModel *Model, e *Event) handler.ProgressEvent {
+	var err error
+	if currentModel.ID == nil {
+		currentModel.ID, err = generateID(currentModel, *e.Inputs.Config.Name, aws.StringValue(session.Config.Region), *e.Inputs.Config.Namespace)
+		if err != nil {
+			return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error()))
+		}
+	}
+	data, err := DecodeID(currentModel.ID)
+	if err != nil {
+		return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error()))
+	}
+	e.Inputs.ValueOpts, e.Inputs.ResolvedValuePaths, err = c.processValues(currentModel)
+	if err != nil {
+		return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error()))
+	}
+	hash, err := valuesHash(e.Inputs.ValueOpts)
+	if err != nil {
+		return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error()))
+	}
+	b, err := canonicalJSON(&Explanation{
+		Action:     e.Action,
+		Name:       aws.StringValue(data.Name),
+		Namespace:  aws.StringValue(data.Namespace),
+		Config:     e.Inputs.Config,
+		Chart:      redactChart(e.Inputs.ChartDetails),
+		Values:     redactValuePaths(e.Inputs.ValueOpts, maskValuePaths(currentModel, e.Inputs.ResolvedValuePaths)),
+		ValuesHash: aws.StringValue(hash),
+	})
+	if err != nil {
+		return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error()))
+	}
+	log.Printf("Explain mode, resolved inputs of release %s: %s", aws.StringValue(data.Name), b)
+	currentModel.Name = data.Name
+	currentModel.Explanation = aws.String(string(b))
+	return makeEvent(currentModel, CompleteStage, nil)
+}
+
 func (c *Clients) lambdaDestroy(currentModel *Model) handler.ProgressEvent {
 	if IsZero(currentModel.VPCConfiguration) {
 		return makeEvent(nil, CompleteStage, nil)
@@ -309,7 +767,67 @@ func (c *Clients) helmDeleteWrapper(name *string, e *Event, functionName *string
 		_, err := invokeLambda(c.AWSClients.LambdaClient(nil, nil), functionName, e)
 		return err
 	default:
-		return c.HelmUninstall(*name)
+		var config *Config
+		if e.Inputs != nil {
+			config = e.Inputs.Config
+		}
+		return c.HelmUninstall(*name, config)
+	}
+}
+
+func (c *Clients) helmDeletePreviewWrapper(name *string, e *Event, functionName *string, vpc bool) ([]string, error) {
+	switch vpc {
+	case true:
+		e.Action = PreviewUninstallAction
+		r, err := invokeLambda(c.AWSClients.LambdaClient(nil, nil), functionName, e)
+		if err != nil {
+			return nil, err
+		}
+		return r.UninstallPreview, err
+	default:
+		return c.HelmUninstallPreview(*name)
+	}
+}
+
+func (c *Clients) helmDiffWrapper(e *Event, functionName *string, vpc bool) ([]string, error) {
+	switch vpc {
+	case true:
+		action := e.Action
+		e.Action = DiffReleaseAction
+		defer func() { e.Action = action }()
+		r, err := invokeLambda(c.AWSClients.LambdaClient(nil, nil), functionName, e)
+		if err != nil {
+			return nil, err
+		}
+		return r.Diff, err
+	default:
+		return c.HelmDiff(e.Inputs.Config, e.Inputs.ValueOpts, e.Inputs.ChartDetails)
+	}
+}
+
+func (c *Clients) helmSetDescriptionWrapper(e *Event, stage string, functionName *string, vpc bool) error {
+	switch vpc {
+	case true:
+		e.Action = SetDescriptionAction
+		e.ReleaseData.Description = stage
+		_, err := invokeLambda(c.AWSClients.LambdaClient(nil, nil), functionName, e)
+		return err
+	default:
+		return c.HelmSetDescription(e.ReleaseData.Name, stage)
+	}
+}
+
+// unlockReleaseWrapper releases the lock the operation holds on the release once the release is stable or failed.
+func (c *Clients) unlockReleaseWrapper(e *Event, functionName *string, vpc bool) {
+	e.ReleaseData.LockOwner = os.Getenv("OperationID")
+	switch vpc {
+	case true:
+		e.Action = UnlockReleaseAction
+		if _, err := invokeLambda(c.AWSClients.LambdaClient(nil, nil), functionName, e); err != nil {
+			log.Printf("Failed to release lock of release %s: %v", e.ReleaseData.Name, err)
+		}
+	default:
+		c.UnlockRelease(e.ReleaseData)
 	}
 }
 
@@ -321,6 +839,7 @@ func (c *Clients) kubePendingWrapper(e *Event, functionName *string, vpc bool) (
 			return true, err
 		}
 		LastKnownErrors = r.LastKnownErrors
+		ProgressDetail = r.ProgressDetail
 		return r.PendingResources, err
 	default:
 		return c.CheckPendingResources(e.ReleaseData)
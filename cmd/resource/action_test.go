@@ -1,17 +1,26 @@
 package resource
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws-cloudformation/cloudformation-cli-go-plugin/cfn/handler"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/stretchr/testify/assert"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/release"
 )
 
 func TestInitialize(t *testing.T) {
@@ -98,7 +107,7 @@ func TestInitialize(t *testing.T) {
 					m.VPCConfiguration = vpcPending
 				}
 			}
-			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration) (*Clients, error) {
+			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, authExec *KubeAuthExec, deadline *time.Time) (*Clients, error) {
 				return NewMockClient(t, m), nil
 			}
 			m.Name = aws.String(d.name)
@@ -139,6 +148,7 @@ func TestCheckReleaseStatus(t *testing.T) {
 		vpc       bool
 		name      *string
 		nextStage Stage
+		detail    string
 	}{
 		"WithVPC": {
 			name:      aws.String("one"),
@@ -159,6 +169,7 @@ func TestCheckReleaseStatus(t *testing.T) {
 			name:      aws.String("three"),
 			vpc:       false,
 			nextStage: ReleaseStabilize,
+			detail:    "0/1 pods ready",
 		},
 		"Unknown": {
 			name:      aws.String("four"),
@@ -173,10 +184,15 @@ func TestCheckReleaseStatus(t *testing.T) {
 	}
 
 	var eRes handler.ProgressEvent
+	defer func() { ResolvedChart = nil }()
+	// The mock releases have no values
+	hash, _ := valuesHash(map[string]interface{}{})
 	for name, d := range tests {
 		t.Run(name, func(t *testing.T) {
 			m.VPCConfiguration = nil
-			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration) (*Clients, error) {
+			// The mock releases are all of the hello chart, recorded for the next stage once the status is known
+			ResolvedChart = &HelmStatusData{ChartName: "hello", ChartVersion: "0.1.0", ValuesHash: aws.StringValue(hash)}
+			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, authExec *KubeAuthExec, deadline *time.Time) (*Clients, error) {
 				return NewMockClient(t, m), nil
 			}
 			if d.vpc {
@@ -186,6 +202,7 @@ func TestCheckReleaseStatus(t *testing.T) {
 				}
 			}
 			m.Name = d.name
+			ProgressDetail = d.detail
 			switch name {
 			case "Unknown":
 				eRes = makeEvent(m, d.nextStage, NewError(ErrCodeHelmActionException, "release failed"))
@@ -197,6 +214,498 @@ func TestCheckReleaseStatus(t *testing.T) {
 		})
 	}
 }
+func TestInitializeGenerateName(t *testing.T) {
+	m := &Model{
+		KubeConfig:         aws.String("arn:aws:secretsmanager:us-east-2:1234567890:secret:kubeconfig"),
+		Chart:              aws.String("stable/coscale"),
+		Namespace:          aws.String("default"),
+		GenerateNamePrefix: aws.String("web"),
+	}
+	NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, authExec *KubeAuthExec, deadline *time.Time) (*Clients, error) {
+		return NewMockClient(t, m), nil
+	}
+	res := initialize(MockSession, m, InstallReleaseAction)
+	assert.EqualValues(t, handler.InProgress, res.OperationStatus)
+	assert.Regexp(t, `^web-\d+$`, aws.StringValue(m.Name))
+	data, err := DecodeID(m.ID)
+	assert.Nil(t, err)
+	assert.EqualValues(t, aws.StringValue(m.Name), aws.StringValue(data.Name))
+
+	// An update without Name targets the generated release
+	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
+	defer testServer.Close()
+	u := &Model{
+		KubeConfig:         m.KubeConfig,
+		Chart:              aws.String(testServer.URL + "/test.tgz"),
+		Namespace:          aws.String("default"),
+		GenerateNamePrefix: aws.String("web"),
+	}
+	u.ID, _ = generateID(u, "web-1614556800", "us-east-1", "default")
+	initialize(MockSession, u, UpdateReleaseAction)
+	assert.EqualValues(t, "web-1614556800", aws.StringValue(u.Name))
+}
+
+// TestInitializeApproval to test the install waits for the approval parameter and fails when denied
+func TestInitializeApproval(t *testing.T) {
+	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
+	defer testServer.Close()
+	tests := map[string]struct {
+		parameter   string
+		nextStage   Stage
+		expectedErr string
+	}{
+		"Granted": {
+			parameter: "/app/approval/ok",
+			nextStage: ReleaseStabilize,
+		},
+		"Denied": {
+			parameter:   "/app/approval/no",
+			nextStage:   NoStage,
+			expectedErr: "release approval with chart test was denied by SSM parameter /app/approval/no, nothing was applied",
+		},
+		"Pending": {
+			parameter: "/app/approval/tbd",
+			nextStage: ApprovalStabilize,
+		},
+		"NotSet": {
+			parameter: "/app/approval/missing",
+			nextStage: ApprovalStabilize,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := &Model{
+				KubeConfig:        aws.String("arn:aws:secretsmanager:us-east-2:1234567890:secret:kubeconfig"),
+				Chart:             aws.String(testServer.URL + "/test.tgz"),
+				Name:              aws.String("approval"),
+				Namespace:         aws.String("default"),
+				ApprovalParameter: aws.String(d.parameter),
+			}
+			m.ID, _ = generateID(m, "approval", "eu-west-1", "default")
+			c := NewMockClient(t, m)
+			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, authExec *KubeAuthExec, deadline *time.Time) (*Clients, error) {
+				return c, nil
+			}
+			res := initialize(MockSession, m, InstallReleaseAction)
+			if d.expectedErr != "" {
+				assert.EqualValues(t, handler.Failed, res.OperationStatus)
+				assert.Equal(t, d.expectedErr, res.Message)
+				_, err := c.HelmClient.Releases.Last("approval")
+				assert.NotNil(t, err)
+				return
+			}
+			assert.EqualValues(t, handler.InProgress, res.OperationStatus)
+			assert.EqualValues(t, d.nextStage, res.CallbackContext["Stage"])
+			if d.nextStage == ApprovalStabilize {
+				// The pending approval shows the rendered changes without applying them
+				assert.Contains(t, res.Message, "set SSM parameter "+d.parameter+" to Approved or Denied, changes: + ConfigMap/approval-jenkins, ")
+				_, err := c.HelmClient.Releases.Last("approval")
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+// TestInitializeInstallRetry to test an install failing with a retryable error is retried by a later callback
+func TestInitializeInstallRetry(t *testing.T) {
+	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
+	defer testServer.Close()
+	backoff := installRetryBackoff
+	installRetryBackoff = 20 * time.Second
+	defer func() { installRetryBackoff, InstallRetries = backoff, 0 }()
+	tests := map[string]struct {
+		retries   int
+		nextStage Stage
+		eDelay    int64
+		eRetries  interface{}
+	}{
+		"FirstRetry": {
+			nextStage: InitStage,
+			eDelay:    20,
+			eRetries:  1,
+		},
+		"SecondRetry": {
+			retries:   1,
+			nextStage: InitStage,
+			eDelay:    40,
+			eRetries:  2,
+		},
+		"RetriesExhausted": {
+			retries:   retryCount,
+			nextStage: NoStage,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := &Model{
+				KubeConfig:      aws.String("arn:aws:secretsmanager:us-east-2:1234567890:secret:kubeconfig"),
+				Chart:           aws.String(testServer.URL + "/test.tgz"),
+				Name:            aws.String("retry"),
+				Namespace:       aws.String("default"),
+				RetryableErrors: []string{"failed calling webhook"},
+			}
+			m.ID, _ = generateID(m, "retry", "eu-west-1", "default")
+			c := NewMockClient(t, m)
+			kc := &flakyKubeClient{
+				FailingKubeClient: kubefake.FailingKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: ioutil.Discard}},
+				failures:          1,
+				err:               errors.New(`Internal error occurred: failed calling webhook "validate.nginx.ingress.kubernetes.io"`),
+			}
+			c.HelmClient.KubeClient = kc
+			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, authExec *KubeAuthExec, deadline *time.Time) (*Clients, error) {
+				return c, nil
+			}
+			InstallRetries = d.retries
+			res := initialize(MockSession, m, InstallReleaseAction)
+			if d.nextStage == NoStage {
+				assert.EqualValues(t, handler.Failed, res.OperationStatus)
+				assert.Contains(t, res.Message, "failed calling webhook")
+				return
+			}
+			assert.EqualValues(t, handler.InProgress, res.OperationStatus)
+			assert.EqualValues(t, d.nextStage, res.CallbackContext["Stage"])
+			assert.Equal(t, d.eRetries, res.CallbackContext["InstallRetries"])
+			assert.Equal(t, d.eDelay, res.CallbackDelaySeconds)
+
+			// The callback resumes with the retry count of the context and installs the release
+			InstallRetries = getInstallRetriesContext(res.CallbackContext)
+			res = initialize(MockSession, m, InstallReleaseAction)
+			assert.EqualValues(t, handler.InProgress, res.OperationStatus)
+			assert.EqualValues(t, ReleaseStabilize, res.CallbackContext["Stage"])
+			assert.Equal(t, 2, kc.creates)
+		})
+	}
+}
+
+// TestExplain to test the resolved inputs returned in explain mode
+func TestExplain(t *testing.T) {
+	m := &Model{
+		KubeConfig:        aws.String("arn:aws:secretsmanager:us-east-2:1234567890:secret:kubeconfig"),
+		Chart:             aws.String("stable/coscale"),
+		Name:              aws.String("web"),
+		Namespace:         aws.String("apps"),
+		Values:            map[string]string{"image.tag": "1.2.3"},
+		HelmFlags:         map[string]string{"atomic": "true"},
+		RepositoryOptions: &RepositoryOptions{Username: aws.String("user"), Password: aws.String("s3cr3t")},
+		ChartHTTPHeaders:  map[string]string{"Authorization": "Bearer t0ken"},
+		ChartUserAgent:    aws.String("cfn-helm"),
+		KubeConfigCACheck: aws.String(caCheckFail),
+		Explain:           aws.Bool(true),
+	}
+	c := NewMockClient(t, m)
+	// Explain mode neither connects to the cluster nor checks its CA
+	NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, authExec *KubeAuthExec, deadline *time.Time) (*Clients, error) {
+		return nil, errors.New("connected to the cluster")
+	}
+	awsClients := NewAWSClients
+	defer func() { NewAWSClients = awsClients }()
+	NewAWSClients = func(ses *session.Session) (*Clients, error) {
+		return &Clients{AWSClients: c.AWSClients}, nil
+	}
+	res := initialize(MockSession, m, InstallReleaseAction)
+	assert.EqualValues(t, handler.Success, res.OperationStatus)
+	assert.NotNil(t, m.ID)
+	assert.NotContains(t, aws.StringValue(m.Explanation), "s3cr3t")
+	assert.NotContains(t, aws.StringValue(m.Explanation), "t0ken")
+	e := &Explanation{}
+	assert.Nil(t, json.Unmarshal([]byte(aws.StringValue(m.Explanation)), e))
+	assert.EqualValues(t, InstallReleaseAction, e.Action)
+	assert.Equal(t, "web", e.Name)
+	assert.Equal(t, "apps", e.Namespace)
+	assert.Equal(t, "coscale", aws.StringValue(e.Chart.ChartName))
+	assert.Equal(t, "stable", aws.StringValue(e.Chart.ChartRepo))
+	assert.Equal(t, redactedValue, aws.StringValue(e.Chart.ChartUsername))
+	assert.Equal(t, redactedValue, aws.StringValue(e.Chart.ChartPassword))
+	assert.Equal(t, map[string]string{"Authorization": redactedValue, "User-Agent": "cfn-helm"}, e.Chart.ChartHeaders)
+	assert.Equal(t, map[string]string{"atomic": "true"}, e.Config.HelmFlags)
+	assert.Equal(t, map[string]interface{}{"image": map[string]interface{}{"tag": "1.2.3"}}, e.Values)
+	assert.Len(t, e.ValuesHash, 32)
+	_, err := c.HelmClient.Releases.Last("web")
+	assert.NotNil(t, err)
+
+	res = initialize(MockSession, m, UninstallReleaseAction)
+	assert.EqualValues(t, handler.Success, res.OperationStatus)
+}
+
+// TestPreviewDelete to test the delete fails with the resources it would delete and keeps the release
+func TestPreviewDelete(t *testing.T) {
+	m := &Model{
+		ClusterID:     aws.String("eks"),
+		Chart:         aws.String("stable/coscale"),
+		KubeConfig:    aws.String("arn:aws:secretsmanager:us-east-2:1234567890:secret:kubeconfig"),
+		ID:            aws.String("eyJDbHVzdGVySUQiOiJla3MiLCJSZWdpb24iOiJldS13ZXN0LTEiLCJOYW1lIjoib25lIiwiTmFtZXNwYWNlIjoiZGVmYXVsdCJ9"),
+		PreviewDelete: aws.Bool(true),
+	}
+	c := NewMockClient(t, m)
+	NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, authExec *KubeAuthExec, deadline *time.Time) (*Clients, error) {
+		return c, nil
+	}
+	res := initialize(MockSession, m, UninstallReleaseAction)
+	assert.EqualValues(t, handler.Failed, res.OperationStatus)
+	assert.EqualValues(t, ErrCodeInvalidException, res.HandlerErrorCode)
+	assert.Contains(t, res.Message, "uninstalling release one in namespace default would delete 6 resources: Ingress test-ingress, ")
+	_, err := c.HelmClient.Releases.Last("one")
+	assert.Nil(t, err)
+}
+
+type failingSTSClient struct {
+	STSAPI
+}
+
+func (m *failingSTSClient) GetCallerIdentity(*sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	return nil, awserr.New("ExpiredToken", "The security token included in the request is expired", nil)
+}
+
+type failingSTSClients struct {
+	mockAWSClients
+}
+
+func (m *failingSTSClients) STSClient(region *string, role *string) STSAPI {
+	return &failingSTSClient{}
+}
+
+// TestCaptureCallerIdentity to test the caller identity is returned when it is in ReturnAttributes
+func TestCaptureCallerIdentity(t *testing.T) {
+	tests := map[string]struct {
+		attributes []string
+		failing    bool
+		expected   *string
+	}{
+		"DefaultAttributes": {},
+		"Returned": {
+			attributes: []string{"Status", "CallerIdentity"},
+			expected:   aws.String("arn:aws:iam::1234567890:role/TestRole"),
+		},
+		"STSError": {
+			attributes: []string{"CallerIdentity"},
+			failing:    true,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewMockClient(t, nil)
+			if d.failing {
+				c.AWSClients = &failingSTSClients{}
+			}
+			m := &Model{ReturnAttributes: d.attributes, CallerIdentity: aws.String("stale")}
+			c.captureCallerIdentity(m, m.RoleArn)
+			assert.Equal(t, d.expected, m.CallerIdentity)
+			assert.Nil(t, c.setReleaseAttributes(m, &HelmStatusData{Status: release.StatusDeployed}))
+			assert.Equal(t, d.expected, m.CallerIdentity)
+		})
+	}
+}
+
+func TestCheckReleaseStatusGracePeriod(t *testing.T) {
+	defer os.Unsetenv("StartTime")
+	tests := map[string]struct {
+		startTime      time.Time
+		expectedStatus handler.Status
+	}{
+		"WithinGracePeriod": {
+			startTime:      time.Now(),
+			expectedStatus: handler.InProgress,
+		},
+		"AfterGracePeriod": {
+			startTime:      time.Now().Add(time.Minute * -10),
+			expectedStatus: handler.Failed,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := &Model{
+				Name:               aws.String("nomanifest"),
+				KubeConfig:         aws.String("arn:aws:secretsmanager:us-east-2:1234567890:secret:kubeconfig"),
+				StartupGracePeriod: aws.Int(300),
+			}
+			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, authExec *KubeAuthExec, deadline *time.Time) (*Clients, error) {
+				c := NewMockClient(t, m)
+				rel := namedRelease("nomanifest", release.StatusDeployed)
+				rel.Namespace = "default"
+				assert.Nil(t, c.HelmClient.Releases.Create(rel))
+				return c, nil
+			}
+			os.Setenv("StartTime", d.startTime.Format(time.RFC3339))
+			res := checkReleaseStatus(MockSession, m, CompleteStage)
+			assert.EqualValues(t, d.expectedStatus, res.OperationStatus)
+		})
+	}
+}
+
+func TestVerifyRelease(t *testing.T) {
+	defer os.Unsetenv("StartTime")
+	os.Setenv("StartTime", time.Now().Format(time.RFC3339))
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	m := &Model{Name: aws.String("one"), HealthCheckURL: aws.String(ts.URL)}
+	res := verifyRelease(m, CompleteStage)
+	assert.EqualValues(t, handler.InProgress, res.OperationStatus)
+	assert.EqualValues(t, VerifyStabilize, res.CallbackContext["Stage"])
+	res = verifyRelease(m, CompleteStage)
+	assert.EqualValues(t, handler.Success, res.OperationStatus)
+	m.HealthCheckExpectedStatus = aws.Int(http.StatusNoContent)
+	res = verifyRelease(m, CompleteStage)
+	assert.EqualValues(t, handler.InProgress, res.OperationStatus)
+	m.HealthCheckURL = aws.String("http://127.0.0.1:1")
+	res = verifyRelease(m, CompleteStage)
+	assert.EqualValues(t, handler.InProgress, res.OperationStatus)
+}
+
+func TestSetReleaseAttributes(t *testing.T) {
+	c := NewMockClient(t, nil)
+	values := map[string]interface{}{"replicaCount": 2, "image": map[string]interface{}{"repository": "nginx", "tag": "1.19"}, "tolerations": []interface{}{}}
+	s := &HelmStatusData{Status: release.StatusDeployed, Notes: "Visit https://example.com", Revision: 3, Namespace: "default", Manifest: TestManifest, Values: values}
+	hash, _ := valuesHash(values)
+	summary := aws.String("4 values under [image, replicaCount, tolerations], hash " + aws.StringValue(hash))
+	tests := map[string]struct {
+		attributes  []string
+		notes       *string
+		revision    *int
+		status      *string
+		summary     *string
+		resources   map[string]interface{}
+		expectedErr *string
+	}{
+		"Default": {
+			notes:    aws.String("Visit https://example.com"),
+			revision: aws.Int(3),
+			status:   aws.String("deployed"),
+			summary:  summary,
+		},
+		"ValuesSummary": {
+			attributes: []string{"ValuesSummary"},
+			summary:    summary,
+		},
+		"RevisionOnly": {
+			attributes: []string{"Revision"},
+			revision:   aws.Int(3),
+		},
+		"NotesAndStatus": {
+			attributes: []string{"Notes", "Status"},
+			notes:      aws.String("Visit https://example.com"),
+			status:     aws.String("deployed"),
+		},
+		"None": {
+			attributes: []string{},
+		},
+		"Resources": {
+			attributes: []string{"Resources"},
+			resources: map[string]interface{}{
+				"DaemonSet":   map[string]interface{}{"nginx-ds": map[string]interface{}{"Namespace": "default"}},
+				"Deployment":  map[string]interface{}{"nginx-deployment": map[string]interface{}{"Namespace": "default"}},
+				"Ingress":     map[string]interface{}{"test-ingress": map[string]interface{}{"Namespace": "default"}},
+				"Service":     map[string]interface{}{"my-service": map[string]interface{}{"Namespace": "default"}, "lb-service": map[string]interface{}{"Namespace": "default"}},
+				"StatefulSet": map[string]interface{}{"nginx-ss": map[string]interface{}{"Namespace": "default"}},
+			},
+		},
+		"Unsupported": {
+			attributes:  []string{"Manifest"},
+			expectedErr: aws.String("unsupported return attribute Manifest"),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := &Model{ReturnAttributes: d.attributes, Notes: aws.String("stale")}
+			err := c.setReleaseAttributes(m, s)
+			if d.expectedErr != nil {
+				assert.EqualError(t, err, aws.StringValue(d.expectedErr))
+				return
+			}
+			assert.Nil(t, err)
+			assert.EqualValues(t, d.notes, m.Notes)
+			assert.EqualValues(t, d.revision, m.Revision)
+			assert.EqualValues(t, d.status, m.Status)
+			assert.EqualValues(t, d.summary, m.ValuesSummary)
+			assert.EqualValues(t, d.resources, m.Resources)
+		})
+	}
+}
+
+type recordingS3Client struct {
+	mockS3Client
+	puts map[string][]byte
+}
+
+func (m *recordingS3Client) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	b, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.puts["s3://"+aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)] = b
+	return &s3.PutObjectOutput{}, nil
+}
+
+type recordingS3Clients struct {
+	mockAWSClients
+	s3 *recordingS3Client
+}
+
+func (m *recordingS3Clients) S3Client(region *string, role *string) S3API {
+	return m.s3
+}
+
+// TestComputedValues to test the computed values are truncated or offloaded to S3 past the size limit
+func TestComputedValues(t *testing.T) {
+	s := &HelmStatusData{
+		Namespace: "default",
+		Revision:  4,
+		Values: map[string]interface{}{
+			"auth":   map[string]interface{}{"password": "s3cr3t"},
+			"config": strings.Repeat("x", 200),
+			"image":  map[string]interface{}{"tag": "1.2.3"},
+		},
+	}
+	tests := map[string]struct {
+		maxSize  *int
+		s3URI    *string
+		expected string
+		eObject  string
+	}{
+		"UnderLimit": {
+			expected: `{"auth":{"password":"[REDACTED]"},"config":"` + strings.Repeat("x", 200) + `","image":{"tag":"1.2.3"}}`,
+		},
+		"Truncated": {
+			maxSize:  aws.Int(100),
+			expected: `{"auth":{"password":"[REDACTED]"},"config":"[TRUNCATED]","image":{"tag":"1.2.3"}}`,
+		},
+		"OffloadedToS3": {
+			maxSize:  aws.Int(100),
+			s3URI:    aws.String("s3://bucket/values/"),
+			expected: "s3://bucket/values/default/web/4.json",
+			eObject:  `{"auth":{"password":"[REDACTED]"},"config":"` + strings.Repeat("x", 200) + `","image":{"tag":"1.2.3"}}`,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewMockClient(t, nil)
+			rec := &recordingS3Client{puts: map[string][]byte{}}
+			c.AWSClients = &recordingS3Clients{s3: rec}
+			m := &Model{
+				Name:                  aws.String("web"),
+				ReturnAttributes:      []string{"ComputedValues"},
+				SecretValuePaths:      []string{"auth.password"},
+				ComputedValuesMaxSize: d.maxSize,
+				ComputedValuesS3URI:   d.s3URI,
+			}
+			assert.Nil(t, c.setReleaseAttributes(m, s))
+			assert.Equal(t, d.expected, aws.StringValue(m.ComputedValues))
+			if d.eObject == "" {
+				assert.Empty(t, rec.puts)
+				return
+			}
+			assert.Equal(t, d.eObject, string(rec.puts[d.expected]))
+		})
+	}
+}
+
 func TestLambdaDestroy(t *testing.T) {
 	m := &Model{
 		ClusterID: aws.String("eks"),
@@ -301,7 +810,6 @@ func TestHelmListWrapper(t *testing.T) {
 	}
 }
 func TestHelmInstallWrapper(t *testing.T) {
-	defer os.Remove(chartLocalPath)
 	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
 	defer func() { testServer.Close() }()
 	c := NewMockClient(t, nil)
@@ -386,6 +894,28 @@ func TestHelmDeleteWrapper(t *testing.T) {
 	}
 }
 
+func TestHelmSetDescriptionWrapper(t *testing.T) {
+	c := NewMockClient(t, nil)
+	event := &Event{
+		ReleaseData: &ReleaseData{
+			Name:      "one",
+			Namespace: "default",
+		},
+	}
+	tests := []bool{true, false}
+	functionName := aws.String("function1")
+	for _, d := range tests {
+		testName := "WithOutVPC"
+		if d {
+			testName = "WithVPC"
+		}
+		t.Run(testName, func(t *testing.T) {
+			err := c.helmSetDescriptionWrapper(event, DescriptionPending, functionName, d)
+			assert.Nil(t, err)
+		})
+	}
+}
+
 func TestKubePendingWrapper(t *testing.T) {
 	c := NewMockClient(t, nil)
 	event := &Event{
@@ -1,23 +1,41 @@
 package resource
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"math"
+	"net/http"
 	"os"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 
 	"github.com/ahmetb/go-linq/v3"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
 	"github.com/aws/aws-sdk-go/service/eks"
 	"github.com/aws/aws-sdk-go/service/eks/eksiface"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
 	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -25,11 +43,35 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
 )
 
+const (
+	partialFileSuffix = ".part"
+	// partialStateSuffix names the file recording the S3 object of a partial download
+	partialStateSuffix = ".part.json"
+)
+
+// s3RetryBackoff is the initial delay between retries of failed S3 object requests
+var s3RetryBackoff = time.Second
+
+// partialDownload is the S3 object version a partial file holds the first bytes of
+type partialDownload struct {
+	Bucket, Key, ETag string
+}
+
+// eksAccessDeniedCode is the error code EKS returns when the credentials lack the IAM permission
+const eksAccessDeniedCode = "AccessDeniedException"
+
+// errDescribeClusterDenied is returned when the credentials are not allowed to describe the EKS cluster
+var errDescribeClusterDenied = errors.New("not authorized to perform eks:DescribeCluster")
+
 type clusterData struct {
 	endpoint           string
 	CAData             []byte
@@ -42,6 +84,11 @@ type STSAPI stsiface.STSAPI
 type SecretsManagerAPI secretsmanageriface.SecretsManagerAPI
 type EKSAPI eksiface.EKSAPI
 type EC2API ec2iface.EC2API
+type SNSAPI snsiface.SNSAPI
+type SSMAPI ssmiface.SSMAPI
+type KMSAPI kmsiface.KMSAPI
+type DynamoDBAPI dynamodbiface.DynamoDBAPI
+type ECRAPI ecriface.ECRAPI
 
 type AWSClients struct {
 	AWSSession *session.Session
@@ -55,6 +102,11 @@ type AWSClientsIface interface {
 	SecretsManagerClient(region *string, role *string) SecretsManagerAPI
 	EKSClient(region *string, role *string) EKSAPI
 	EC2Client(region *string, role *string) EC2API
+	SNSClient(region *string, role *string) SNSAPI
+	SSMClient(region *string, role *string) SSMAPI
+	KMSClient(region *string, role *string) KMSAPI
+	DynamoDBClient(region *string, role *string) DynamoDBAPI
+	ECRClient(region *string, role *string) ECRAPI
 	Session(region *string, role *string) *session.Session
 }
 
@@ -82,6 +134,26 @@ func (c *AWSClients) EC2Client(region *string, role *string) EC2API {
 	return ec2.New(c.Session(region, role))
 }
 
+func (c *AWSClients) SNSClient(region *string, role *string) SNSAPI {
+	return sns.New(c.Session(region, role))
+}
+
+func (c *AWSClients) SSMClient(region *string, role *string) SSMAPI {
+	return ssm.New(c.Session(region, role))
+}
+
+func (c *AWSClients) KMSClient(region *string, role *string) KMSAPI {
+	return kms.New(c.Session(region, role))
+}
+
+func (c *AWSClients) DynamoDBClient(region *string, role *string) DynamoDBAPI {
+	return dynamodb.New(c.Session(region, role))
+}
+
+func (c *AWSClients) ECRClient(region *string, role *string) ECRAPI {
+	return ecr.New(c.Session(region, role))
+}
+
 func (c *AWSClients) Session(region *string, role *string) *session.Session {
 	if region != nil || role != nil {
 		return c.AWSSession.Copy(c.Config(region, role))
@@ -102,6 +174,24 @@ func (c *AWSClients) Config(region *string, role *string) *aws.Config {
 	return config
 }
 
+// regionPartition returns the partition (aws, aws-cn, aws-us-gov) the region belongs to.
+func regionPartition(region string) (string, error) {
+	p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region)
+	if !ok {
+		return "", fmt.Errorf("could not determine the AWS partition of region %s", region)
+	}
+	return p.ID(), nil
+}
+
+// metadataRegionTimeout limits the time the EC2 instance metadata may take to return the region
+const metadataRegionTimeout = 2 * time.Second
+
+// metadataRegion returns the region of the EC2 instance metadata, the last place the region is looked up.
+var metadataRegion = func(ses *session.Session) (string, error) {
+	c := ec2metadata.New(ses, aws.NewConfig().WithHTTPClient(&http.Client{Timeout: metadataRegionTimeout}).WithMaxRetries(0))
+	return c.Region()
+}
+
 // getClusterDetails use describe_cluster API
 func getClusterDetails(svc eksiface.EKSAPI, clusterName string) (*clusterData, error) {
 	log.Printf("Getting cluster data...")
@@ -111,6 +201,9 @@ func getClusterDetails(svc eksiface.EKSAPI, clusterName string) (*clusterData, e
 	}
 	result, err := svc.DescribeCluster(input)
 	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == eksAccessDeniedCode {
+			return nil, errDescribeClusterDenied
+		}
 		return nil, AWSError(err)
 	}
 	switch *result.Cluster.Status {
@@ -127,13 +220,22 @@ func getClusterDetails(svc eksiface.EKSAPI, clusterName string) (*clusterData, e
 	return c, nil
 }
 
+// describeClusterDeniedError names the missing permission and the role used to describe the cluster
+func describeClusterDeniedError(svc STSAPI, clusterName string) error {
+	role := "unknown"
+	if arn, err := getCurrentRoleARN(svc); err == nil {
+		role = *arn
+	}
+	return fmt.Errorf("role %s is not authorized to perform eks:DescribeCluster on cluster %s, add the eks:DescribeCluster permission to the role", role, clusterName)
+}
+
 // generateKubeToken using the aws-iam-auth pkg
 func generateKubeToken(svc STSAPI, clusterID *string) (*string, error) {
 	roleArn, err := getCurrentRoleARN(svc)
 	if err != nil {
 		return nil, genericError("Could not get token: ", err)
 	}
-	log.Printf("Generating token for cluster: %s, role: %s", *clusterID, *roleArn)
+	log.Printf("Generating token for cluster: %s, role: %s", logID(*clusterID, logPhysicalID), logID(*roleArn, logPhysicalID))
 	gen, err := token.NewGenerator(false, false)
 	if err != nil {
 		return nil, genericError("Could not get token: ", err)
@@ -145,29 +247,211 @@ func generateKubeToken(svc STSAPI, clusterID *string) (*string, error) {
 	return &tok.Token, nil
 }
 
+// uploadS3 writes the JSON data to the S3 object with server-side encryption, used to offload the computed values
+// exceeding ComputedValuesMaxSize.
+func uploadS3(svc S3API, bucket string, key string, data []byte) error {
+	_, err := svc.PutObject(&s3.PutObjectInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(data),
+		ContentType:          aws.String("application/json"),
+		ServerSideEncryption: aws.String(s3.ServerSideEncryptionAes256),
+	})
+	if err != nil {
+		return AWSError(err)
+	}
+	return nil
+}
+
 // downloadS3 download file from S3 to specified path.
+// Interrupted and failed downloads are resumed from a partial file, requesting only the missing byte range, in the
+// same or a later invocation. Retryable errors of the requests are retried.
 func downloadS3(svc S3API, bucket string, key string, filename string) error {
 	log.Printf("Getting file from S3...")
 
-	// Create a downloader with the session and default options
-	downloader := s3manager.NewDownloaderWithClient(svc)
-
-	// Create a file to write the S3 Object contents to.
-	f, err := os.Create(filename)
+	// Create a partial file to write the S3 Object contents to, or resume the one left by a failed download of the
+	// same object.
+	partial, state := filename+partialFileSuffix, filename+partialStateSuffix
+	var offset int64
+	var etag *string
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if p, size := readPartialDownload(partial, state); p != nil && p.Bucket == bucket && p.Key == key && size > 0 {
+		offset, etag, flags = size, aws.String(p.ETag), os.O_WRONLY|os.O_APPEND
+		log.Printf("Resuming download of s3://%s/%s from %v bytes", bucket, key, offset)
+	}
+	f, err := os.OpenFile(partial, flags, 0644)
 	if err != nil {
 		return genericError("downloadS3", err)
 	}
+	defer f.Close()
+
+	delay := s3RetryBackoff
+	for count := 0; ; count++ {
+		input := &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		}
+		if offset > 0 {
+			// Only request the missing bytes of the same object version.
+			input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+			input.IfMatch = etag
+		}
+		result, err := svc.GetObjectWithContext(aws.BackgroundContext(), input)
+		if err != nil {
+			switch {
+			case offset > 0 && staleRange(err):
+				log.Printf("s3://%s/%s changed since the partial download. Restarting...", bucket, key)
+				if err := f.Truncate(0); err != nil {
+					return genericError("downloadS3", err)
+				}
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					return genericError("downloadS3", err)
+				}
+				offset, etag = 0, nil
+			case count >= retryCount || !retryableS3Error(err):
+				return genericError("downloadS3", err)
+			default:
+				log.Printf("Getting s3://%s/%s failed: %s. Retrying in %s...", bucket, key, err, delay)
+				time.Sleep(delay)
+				delay *= 2
+			}
+			continue
+		}
+		if etag == nil {
+			etag = result.ETag
+			if err := writePartialDownload(state, &partialDownload{Bucket: bucket, Key: key, ETag: aws.StringValue(etag)}); err != nil {
+				result.Body.Close()
+				return genericError("downloadS3", err)
+			}
+		}
+		n, err := io.Copy(f, result.Body)
+		result.Body.Close()
+		offset += n
+		if err == nil {
+			break
+		}
+		if count >= retryCount {
+			return genericError("downloadS3", err)
+		}
+		log.Printf("Download of s3://%s/%s interrupted after %v bytes: %s. Resuming...", bucket, key, offset, err)
+	}
+	if err := f.Close(); err != nil {
+		return genericError("downloadS3", err)
+	}
+	if err := os.Rename(partial, filename); err != nil {
+		return genericError("downloadS3", err)
+	}
+	os.Remove(state)
+
+	log.Printf("Downloaded %s - %v bytes ", filename, offset)
+	return nil
+}
+
+// readPartialDownload returns the S3 object of the partial file and its size, nil when there is none to resume.
+func readPartialDownload(partial string, state string) (*partialDownload, int64) {
+	fi, err := os.Stat(partial)
+	if err != nil {
+		return nil, 0
+	}
+	b, err := ioutil.ReadFile(state)
+	if err != nil {
+		return nil, 0
+	}
+	p := &partialDownload{}
+	if err := json.Unmarshal(b, p); err != nil || p.ETag == "" {
+		return nil, 0
+	}
+	return p, fi.Size()
+}
+
+func writePartialDownload(state string, p *partialDownload) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(state, b, 0644)
+}
 
-	// Write the contents of S3 Object to the file
-	numBytes, err := downloader.Download(f, &s3.GetObjectInput{
+// retryableS3Error checks whether the failed S3 request may succeed when retried
+func retryableS3Error(err error) bool {
+	if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() >= http.StatusInternalServerError {
+		return true
+	}
+	if _, ok := err.(awserr.Error); !ok {
+		return false
+	}
+	return request.IsErrorRetryable(err) || request.IsErrorThrottle(err)
+}
+
+// staleRange checks whether a ranged request failed as the object changed or is shorter than the partial file
+func staleRange(err error) bool {
+	if e, ok := err.(awserr.RequestFailure); ok {
+		return e.StatusCode() == http.StatusPreconditionFailed || e.StatusCode() == http.StatusRequestedRangeNotSatisfiable
+	}
+	return false
+}
+
+// listS3Objects returns the object keys under the prefix in lexical order.
+func listS3Objects(svc S3API, bucket string, prefix string) ([]string, error) {
+	log.Printf("Listing S3 objects under prefix %s...", prefix)
+	var keys []string
+	input := &s3.ListObjectsV2Input{
 		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
+		Prefix: aws.String(prefix),
+	}
+	err := svc.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.StringValue(obj.Key))
+		}
+		return true
 	})
 	if err != nil {
-		return genericError("downloadS3", err)
+		return nil, AWSError(err)
 	}
+	sort.Strings(keys)
+	return keys, nil
+}
 
-	log.Printf("Downloaded %s - %v bytes ", f.Name(), numBytes)
+// putDynamoDBItem writes the item of string attributes to the DynamoDB table, leaving out the empty attributes.
+func putDynamoDBItem(svc DynamoDBAPI, table string, attributes map[string]string) error {
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(table),
+		Item:      map[string]*dynamodb.AttributeValue{},
+	}
+	for k, v := range attributes {
+		if v == "" {
+			continue
+		}
+		input.Item[k] = &dynamodb.AttributeValue{S: aws.String(v)}
+	}
+	_, err := svc.PutItem(input)
+	if err != nil {
+		return AWSError(err)
+	}
+	return nil
+}
+
+// publishSNS publishes the message with string attributes to the SNS topic.
+func publishSNS(svc SNSAPI, topic string, subject string, message string, attributes map[string]string) error {
+	input := &sns.PublishInput{
+		TopicArn:          aws.String(topic),
+		Subject:           aws.String(subject),
+		Message:           aws.String(message),
+		MessageAttributes: map[string]*sns.MessageAttributeValue{},
+	}
+	for k, v := range attributes {
+		if v == "" {
+			continue
+		}
+		input.MessageAttributes[k] = &sns.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(v),
+		}
+	}
+	_, err := svc.Publish(input)
+	if err != nil {
+		return AWSError(err)
+	}
 	return nil
 }
 
@@ -200,6 +484,58 @@ func getSecretsManager(svc SecretsManagerAPI, arn *string) ([]byte, error) {
 	return secretString, nil
 }
 
+// getSSMParameter returns the decrypted value of the SSM parameter.
+func getSSMParameter(svc SSMAPI, name string) (string, error) {
+	log.Printf("Getting data from SSM Parameter Store...")
+	result, err := svc.GetParameter(&ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", AWSError(err)
+	}
+	return aws.StringValue(result.Parameter.Value), nil
+}
+
+// getApproval returns the approval of the operation started at since from the SSM parameter, Approved or Denied once
+// the parameter is set to it. It is Pending while the parameter is missing, holds another value or was last set before
+// the operation started, so an approval given for an earlier operation is not reused.
+func getApproval(svc SSMAPI, name string, since time.Time) (string, error) {
+	result, err := svc.GetParameter(&ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeParameterNotFound {
+			return approvalPending, nil
+		}
+		return "", AWSError(err)
+	}
+	if t := result.Parameter.LastModifiedDate; t != nil && t.Before(since) {
+		return approvalPending, nil
+	}
+	switch v := strings.TrimSpace(aws.StringValue(result.Parameter.Value)); {
+	case strings.EqualFold(v, approvalGranted):
+		return approvalGranted, nil
+	case strings.EqualFold(v, approvalDenied):
+		return approvalDenied, nil
+	}
+	return approvalPending, nil
+}
+
+// decryptKMS returns the plaintext of the KMS ciphertext blob encrypted with the encryption context.
+func decryptKMS(svc KMSAPI, blob []byte, encryptionContext map[string]*string) ([]byte, error) {
+	log.Printf("Decrypting data with KMS...")
+	result, err := svc.Decrypt(&kms.DecryptInput{
+		CiphertextBlob:    blob,
+		EncryptionContext: encryptionContext,
+	})
+	if err != nil {
+		return nil, AWSError(err)
+	}
+	return result.Plaintext, nil
+}
+
 func getBucketRegion(svc S3API, bucket string) (*string, error) {
 	log.Printf("Checking S3 bucket region...")
 	ctx := context.Background()
@@ -220,6 +556,15 @@ func getCurrentRoleARN(svc STSAPI) (*string, error) {
 	return toRoleArn(response.Arn), nil
 }
 
+// getCallerIdentity returns the ARN, without the role session name, and the account of the identity making the requests.
+func getCallerIdentity(svc STSAPI) (*string, *string, error) {
+	response, err := svc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, nil, AWSError(err)
+	}
+	return toRoleArn(response.Arn), response.Account, nil
+}
+
 func toRoleArn(arn *string) *string {
 	arnParts := strings.Split(*arn, ":")
 	if arnParts[2] != "sts" || !strings.HasPrefix(arnParts[5], "assumed-role") {
@@ -232,11 +577,14 @@ func toRoleArn(arn *string) *string {
 	return arn
 }
 
-func getVpcConfig(ekssvc EKSAPI, ec2svc EC2API, model *Model) (*VPCConfiguration, error) {
+func getVpcConfig(ekssvc EKSAPI, ec2svc EC2API, stssvc STSAPI, model *Model) (*VPCConfiguration, error) {
 	if model.ClusterID == nil || !IsZero(model.VPCConfiguration) {
 		return nil, nil
 	}
 	resp, err := getClusterDetails(ekssvc, *model.ClusterID)
+	if err == errDescribeClusterDenied {
+		return nil, describeClusterDeniedError(stssvc, *model.ClusterID)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -2,22 +2,34 @@ package resource
 
 import (
 	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/eks"
+	"github.com/aws/aws-sdk-go/service/kms"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/stretchr/testify/assert"
 )
@@ -43,6 +55,36 @@ type mockS3Client struct {
 	S3API
 }
 
+type mockSNSClient struct {
+	SNSAPI
+}
+
+type mockSSMClient struct {
+	SSMAPI
+}
+
+type mockKMSClient struct {
+	KMSAPI
+}
+
+type mockDynamoDBClient struct {
+	DynamoDBAPI
+}
+
+type mockECRClient struct {
+	ECRAPI
+	region *string
+}
+
+// ecrTokenRequests records the region and registry of the authorization tokens requested from the mock ECR client.
+var ecrTokenRequests []string
+
+// snsPublished records the messages published to the mock SNS client.
+var snsPublished []*sns.PublishInput
+
+// dynamoDBItems records the items written to the mock DynamoDB client.
+var dynamoDBItems []*dynamodb.PutItemInput
+
 func (m *mockAWSClients) EKSClient(region *string, role *string) EKSAPI {
 	return &mockEKSClient{}
 }
@@ -61,6 +103,21 @@ func (m *mockAWSClients) LambdaClient(region *string, role *string) LambdaAPI {
 func (m *mockAWSClients) SecretsManagerClient(region *string, role *string) SecretsManagerAPI {
 	return &mockSecretsManagerClient{}
 }
+func (m *mockAWSClients) SNSClient(region *string, role *string) SNSAPI {
+	return &mockSNSClient{}
+}
+func (m *mockAWSClients) SSMClient(region *string, role *string) SSMAPI {
+	return &mockSSMClient{}
+}
+func (m *mockAWSClients) KMSClient(region *string, role *string) KMSAPI {
+	return &mockKMSClient{}
+}
+func (m *mockAWSClients) DynamoDBClient(region *string, role *string) DynamoDBAPI {
+	return &mockDynamoDBClient{}
+}
+func (m *mockAWSClients) ECRClient(region *string, role *string) ECRAPI {
+	return &mockECRClient{region: region}
+}
 func (m *mockAWSClients) Session(region *string, role *string) *session.Session {
 	return MockSession
 }
@@ -139,6 +196,9 @@ func (m *mockEKSClient) DescribeCluster(c *eks.DescribeClusterInput) (*eks.Descr
 			},
 		},
 	}
+	if aws.StringValue(c.Name) == "denied" {
+		return nil, awserr.New(eksAccessDeniedCode, "User is not authorized to perform: eks:DescribeCluster", nil)
+	}
 	for name, d := range clusters {
 		if aws.StringValue(c.Name) == name {
 			return &eks.DescribeClusterOutput{
@@ -231,6 +291,27 @@ func (m *mockSecretsManagerClient) GetSecretValue(s *secretsmanager.GetSecretVal
 				SecretBinary: []byte("Test"),
 			},
 		},
+		"sftp": {
+			GetSecretValueOutput: &secretsmanager.GetSecretValueOutput{
+				ARN:          aws.String("arn:aws:secretsmanager:us-east-2:1234567890:secret:sftp"),
+				Name:         aws.String("sftp"),
+				SecretString: aws.String(`{"Username":"test","Password":"test"}`),
+			},
+		},
+		"repo": {
+			GetSecretValueOutput: &secretsmanager.GetSecretValueOutput{
+				ARN:          aws.String("arn:aws:secretsmanager:us-east-2:1234567890:secret:repo"),
+				Name:         aws.String("repo"),
+				SecretString: aws.String(`{"Username":"admin","Password":"s3cr3t"}`),
+			},
+		},
+		"repo-invalid": {
+			GetSecretValueOutput: &secretsmanager.GetSecretValueOutput{
+				ARN:          aws.String("arn:aws:secretsmanager:us-east-2:1234567890:secret:repo-invalid"),
+				Name:         aws.String("repo-invalid"),
+				SecretString: aws.String(`{"Username":"admin"}`),
+			},
+		},
 	}
 	for _, d := range secrets {
 		if aws.StringValue(s.SecretId) == aws.StringValue(d.GetSecretValueOutput.ARN) {
@@ -282,14 +363,136 @@ func (m *mockS3Client) HeadBucketRequest(input *s3.HeadBucketInput) (req *reques
 	return
 }
 
+func (m *mockS3Client) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	var contents []*s3.Object
+	if aws.StringValue(input.Prefix) == "values/" {
+		for _, key := range []string{"values/b.yaml", "values/notes.txt", "values/a.yaml"} {
+			contents = append(contents, &s3.Object{Key: aws.String(key)})
+		}
+	}
+	fn(&s3.ListObjectsV2Output{Contents: contents}, true)
+	return nil
+}
+
 func (m *mockS3Client) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
-	data, _ := ioutil.ReadFile(TestFolder + "/test.yaml")
+	file := TestFolder + "/test.yaml"
+	if strings.HasPrefix(aws.StringValue(input.Key), "values/") {
+		file = TestFolder + "/" + aws.StringValue(input.Key)
+	}
+	data, _ := ioutil.ReadFile(file)
 	return &s3.GetObjectOutput{
 		Body:          ioutil.NopCloser(bytes.NewReader(data[:])),
 		ContentLength: aws.Int64(int64(len(data))),
 	}, nil
 }
 
+func (m *mockSNSClient) Publish(input *sns.PublishInput) (*sns.PublishOutput, error) {
+	snsPublished = append(snsPublished, input)
+	return &sns.PublishOutput{MessageId: aws.String("1")}, nil
+}
+
+func (m *mockDynamoDBClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	dynamoDBItems = append(dynamoDBItems, input)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (m *mockECRClient) GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+	ecrTokenRequests = append(ecrTokenRequests, aws.StringValue(m.region)+"/"+strings.Join(aws.StringValueSlice(input.RegistryIds), ","))
+	return &ecr.GetAuthorizationTokenOutput{AuthorizationData: []*ecr.AuthorizationData{{
+		AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("AWS:ecr-t0ken"))),
+		ExpiresAt:          aws.Time(time.Now().Add(12 * time.Hour)),
+	}}}, nil
+}
+
+func (m *mockSSMClient) GetParameter(input *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	params := map[string]string{
+		"/app/db/password":  "s3cr3t",
+		"/app/db/port":      "5432",
+		"/app/approval/ok":  "Approved",
+		"/app/approval/no":  "denied",
+		"/app/approval/tbd": "Review",
+	}
+	v, ok := params[aws.StringValue(input.Name)]
+	if !ok {
+		return nil, awserr.New(ssm.ErrCodeParameterNotFound, "parameter not found", nil)
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Name: input.Name, Value: aws.String(v), LastModifiedDate: aws.Time(time.Now())}}, nil
+}
+
+// mockSOPSDataKey is the data key the mock KMS client decrypts the mockSOPSEncryptedKey ciphertext to
+var mockSOPSDataKey = bytes.Repeat([]byte{7}, 32)
+
+const mockSOPSEncryptedKey = "encrypted-data-key"
+
+func (m *mockKMSClient) Decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	if string(input.CiphertextBlob) != mockSOPSEncryptedKey || aws.StringValue(input.EncryptionContext["app"]) != "web" {
+		return nil, awserr.New(kms.ErrCodeInvalidCiphertextException, "invalid ciphertext", nil)
+	}
+	return &kms.DecryptOutput{Plaintext: mockSOPSDataKey}, nil
+}
+
+// flakyS3Client fails the first download mid-stream and serves ranged requests afterwards.
+type flakyS3Client struct {
+	S3API
+	data   []byte
+	failAt int
+	ranges []string
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func (m *flakyS3Client) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	r := aws.StringValue(input.Range)
+	m.ranges = append(m.ranges, r)
+	if r == "" {
+		return &s3.GetObjectOutput{
+			Body: ioutil.NopCloser(io.MultiReader(bytes.NewReader(m.data[:m.failAt]), failingReader{})),
+			ETag: aws.String("etag"),
+		}, nil
+	}
+	if aws.StringValue(input.IfMatch) != "etag" {
+		return nil, errors.New("PreconditionFailed")
+	}
+	var offset int
+	_, _ = fmt.Sscanf(r, "bytes=%d-", &offset)
+	return &s3.GetObjectOutput{
+		Body: ioutil.NopCloser(bytes.NewReader(m.data[offset:])),
+		ETag: aws.String("etag"),
+	}, nil
+}
+
+// scriptedS3Client fails the requests with the scripted errors first and serves the object version afterwards
+type scriptedS3Client struct {
+	S3API
+	data   []byte
+	etag   string
+	errs   []error
+	ranges []string
+}
+
+func (m *scriptedS3Client) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	r := aws.StringValue(input.Range)
+	m.ranges = append(m.ranges, r)
+	if len(m.errs) > 0 {
+		err := m.errs[0]
+		m.errs = m.errs[1:]
+		return nil, err
+	}
+	if r != "" && aws.StringValue(input.IfMatch) != m.etag {
+		return nil, awserr.NewRequestFailure(awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil), http.StatusPreconditionFailed, "id")
+	}
+	var offset int
+	_, _ = fmt.Sscanf(r, "bytes=%d-", &offset)
+	return &s3.GetObjectOutput{
+		Body: ioutil.NopCloser(bytes.NewReader(m.data[offset:])),
+		ETag: aws.String(m.etag),
+	}, nil
+}
+
 func testSetupGetBucketRegionServer(region string, statusCode int, incHeader bool) *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if incHeader {
@@ -337,11 +540,27 @@ func TestGetClusterDetails(t *testing.T) {
 	}
 }
 
+func TestDescribeClusterDenied(t *testing.T) {
+	_, err := getClusterDetails(&mockEKSClient{}, "denied")
+	assert.Equal(t, errDescribeClusterDenied, err)
+	err = describeClusterDeniedError(&mockSTSClient{}, "denied")
+	assert.EqualError(t, err, "role arn:aws:iam::1234567890:role/TestRole is not authorized to perform eks:DescribeCluster on cluster denied, add the eks:DescribeCluster permission to the role")
+}
+
 func TestGenerateKubeToken(t *testing.T) {
 	mockSvc := &mockSTSClient{}
-	cluster := aws.String("eks")
-	_, err := generateKubeToken(mockSvc, cluster)
-	assert.Nil(t, err)
+	cluster := aws.String("eks-cluster")
+	defer log.SetOutput(log.Writer())
+	defer func() { logPhysicalID = nil }()
+	for _, debug := range []bool{false, true} {
+		out := &bytes.Buffer{}
+		log.SetOutput(out)
+		logPhysicalID = aws.Bool(debug)
+		_, err := generateKubeToken(mockSvc, cluster)
+		assert.Nil(t, err)
+		assert.Equal(t, debug, strings.Contains(out.String(), "eks-cluster"))
+		assert.Equal(t, debug, strings.Contains(out.String(), "arn:aws:iam::1234567890:role/TestRole"))
+	}
 }
 
 func TestGetSecretsManager(t *testing.T) {
@@ -361,6 +580,28 @@ func TestGetSecretsManager(t *testing.T) {
 	}
 }
 
+// TestGetApproval to test the approval read from the SSM parameter, ignoring an approval set before the operation
+func TestGetApproval(t *testing.T) {
+	tests := map[string]struct {
+		name     string
+		since    time.Time
+		expected string
+	}{
+		"Approved":  {name: "/app/approval/ok", expected: approvalGranted},
+		"Denied":    {name: "/app/approval/no", expected: approvalDenied},
+		"Review":    {name: "/app/approval/tbd", expected: approvalPending},
+		"NotFound":  {name: "/app/approval/missing", expected: approvalPending},
+		"SetBefore": {name: "/app/approval/ok", since: time.Now().Add(time.Hour), expected: approvalPending},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			approval, err := getApproval(&mockSSMClient{}, d.name, d.since)
+			assert.Nil(t, err)
+			assert.Equal(t, d.expected, approval)
+		})
+	}
+}
+
 func TestDownloadS3(t *testing.T) {
 	testFile := "/tmp/test"
 	defer os.Remove(testFile)
@@ -383,6 +624,92 @@ func TestDownloadS3(t *testing.T) {
 	}
 }
 
+func TestDownloadS3Resume(t *testing.T) {
+	testFile := "/tmp/test"
+	defer os.Remove(testFile)
+	data, _ := ioutil.ReadFile(TestZipFile)
+	svc := &flakyS3Client{data: data, failAt: len(data) / 3}
+	err := downloadS3(svc, "bucket", "key", testFile)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"", fmt.Sprintf("bytes=%d-", len(data)/3)}, svc.ranges)
+	result, _ := ioutil.ReadFile(testFile)
+	assert.Equal(t, data, result)
+	_, err = os.Stat(testFile + partialFileSuffix)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// TestDownloadS3Partial to test resuming the partial file of an earlier download and retrying failed requests
+func TestDownloadS3Partial(t *testing.T) {
+	backoff := s3RetryBackoff
+	s3RetryBackoff = time.Millisecond
+	defer func() { s3RetryBackoff = backoff }()
+	testFile := "/tmp/test"
+	defer os.Remove(testFile)
+	data, _ := ioutil.ReadFile(TestFolder + "/test.tgz")
+	serverErr := awserr.NewRequestFailure(awserr.New("InternalError", "We encountered an internal error", nil), http.StatusInternalServerError, "id")
+	deniedErr := awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), http.StatusForbidden, "id")
+	tests := map[string]struct {
+		partial     *partialDownload
+		etag        string
+		errs        []error
+		eRanges     []string
+		expectedErr string
+	}{
+		"ResumePartial": {
+			partial: &partialDownload{Bucket: "bucket", Key: "key", ETag: "etag"},
+			etag:    "etag",
+			eRanges: []string{"bytes=100-"},
+		},
+		"ObjectChanged": {
+			partial: &partialDownload{Bucket: "bucket", Key: "key", ETag: "old"},
+			etag:    "new",
+			eRanges: []string{"bytes=100-", ""},
+		},
+		"OtherObject": {
+			partial: &partialDownload{Bucket: "bucket", Key: "other", ETag: "etag"},
+			etag:    "etag",
+			eRanges: []string{""},
+		},
+		"RetryServerError": {
+			etag:    "etag",
+			errs:    []error{serverErr, serverErr},
+			eRanges: []string{"", "", ""},
+		},
+		"KeepPartialOnFailure": {
+			partial:     &partialDownload{Bucket: "bucket", Key: "key", ETag: "etag"},
+			etag:        "etag",
+			errs:        []error{deniedErr},
+			eRanges:     []string{"bytes=100-"},
+			expectedErr: "AccessDenied",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			defer os.Remove(testFile + partialFileSuffix)
+			defer os.Remove(testFile + partialStateSuffix)
+			if d.partial != nil {
+				assert.Nil(t, ioutil.WriteFile(testFile+partialFileSuffix, data[:100], 0644))
+				assert.Nil(t, writePartialDownload(testFile+partialStateSuffix, d.partial))
+			}
+			svc := &scriptedS3Client{data: data, etag: d.etag, errs: d.errs}
+			err := downloadS3(svc, "bucket", "key", testFile)
+			assert.Equal(t, d.eRanges, svc.ranges)
+			if d.expectedErr != "" {
+				assert.Contains(t, err.Error(), d.expectedErr)
+				p, size := readPartialDownload(testFile+partialFileSuffix, testFile+partialStateSuffix)
+				assert.Equal(t, d.partial, p)
+				assert.EqualValues(t, 100, size)
+				return
+			}
+			assert.Nil(t, err)
+			result, _ := ioutil.ReadFile(testFile)
+			assert.Equal(t, data, result)
+			_, err = os.Stat(testFile + partialStateSuffix)
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
 func TestGetBucketRegion(t *testing.T) {
 	sess := MockSession
 	expectedErr := "NotFound"
@@ -436,20 +763,82 @@ func TestGetCurrentRoleARN(t *testing.T) {
 	assert.EqualValues(t, aws.StringValue(expectedARN), aws.StringValue(res))
 }
 
+// TestGetCallerIdentity to test the caller identity is returned without the role session name
+func TestGetCallerIdentity(t *testing.T) {
+	arn, account, err := getCallerIdentity(&mockSTSClient{})
+	assert.Nil(t, err)
+	assert.Equal(t, "arn:aws:iam::1234567890:role/TestRole", aws.StringValue(arn))
+	assert.Equal(t, "1234567890", aws.StringValue(account))
+}
+
 func TestToRoleArn(t *testing.T) {
-	arns := []string{"arn:aws:sts::1234567890:assumed-role/TestRole/session-1587810408", "arn:aws:iam::1234567890:role/TestRole"}
-	expectedARN := aws.String("arn:aws:iam::1234567890:role/TestRole")
-	for _, arn := range arns {
+	arns := map[string]string{
+		"arn:aws:sts::1234567890:assumed-role/TestRole/session-1587810408":        "arn:aws:iam::1234567890:role/TestRole",
+		"arn:aws:iam::1234567890:role/TestRole":                                   "arn:aws:iam::1234567890:role/TestRole",
+		"arn:aws-cn:sts::1234567890:assumed-role/TestRole/session-1587810408":     "arn:aws-cn:iam::1234567890:role/TestRole",
+		"arn:aws-us-gov:sts::1234567890:assumed-role/TestRole/session-1587810408": "arn:aws-us-gov:iam::1234567890:role/TestRole",
+	}
+	for arn, expectedARN := range arns {
 		t.Run(arn, func(t *testing.T) {
 			res := toRoleArn(aws.String(arn))
-			assert.EqualValues(t, aws.StringValue(expectedARN), aws.StringValue(res))
+			assert.EqualValues(t, expectedARN, aws.StringValue(res))
+		})
+	}
+}
+
+// TestRegionPartition is to test regionPartition and the endpoints of clients built for each partition
+func TestRegionPartition(t *testing.T) {
+	tests := map[string]struct {
+		region      string
+		ePartition  string
+		eEKS        string
+		eSTS        string
+		expectedErr *string
+	}{
+		"Commercial": {
+			region:     "us-east-1",
+			ePartition: "aws",
+			eEKS:       "https://eks.us-east-1.amazonaws.com",
+			eSTS:       ".amazonaws.com",
+		},
+		"China": {
+			region:     "cn-north-1",
+			ePartition: "aws-cn",
+			eEKS:       "https://eks.cn-north-1.amazonaws.com.cn",
+			eSTS:       ".cn-north-1.amazonaws.com.cn",
+		},
+		"GovCloud": {
+			region:     "us-gov-west-1",
+			ePartition: "aws-us-gov",
+			eEKS:       "https://eks.us-gov-west-1.amazonaws.com",
+			eSTS:       ".us-gov-west-1.amazonaws.com",
+		},
+		"Unknown": {
+			region:      "mars-east-1",
+			expectedErr: aws.String("could not determine the AWS partition of region mars-east-1"),
+		},
+	}
+	clients := &AWSClients{AWSSession: session.Must(session.NewSession())}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := regionPartition(d.region)
+			if d.expectedErr != nil {
+				assert.EqualError(t, err, aws.StringValue(d.expectedErr))
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, d.ePartition, p)
+			assert.Equal(t, d.eEKS, clients.EKSClient(aws.String(d.region), nil).(*eks.EKS).Endpoint)
+			// The commercial STS endpoint is global or regional depending on AWS_STS_REGIONAL_ENDPOINTS.
+			assert.True(t, strings.HasSuffix(clients.STSClient(aws.String(d.region), nil).(*sts.STS).Endpoint, d.eSTS))
 		})
 	}
 }
 
 func TestGetVpcConfig(t *testing.T) {
 	tests := map[string]struct {
-		m *Model
+		m           *Model
+		expectedErr string
 	}{
 		"Public": {
 			m: &Model{
@@ -460,20 +849,27 @@ func TestGetVpcConfig(t *testing.T) {
 			m: &Model{
 				ClusterID: aws.String("private"),
 			},
+			expectedErr: "no subnets with NAT/Transit Gateway found",
 		},
 		"PrivateWithoutNatGW": {
 			m: &Model{
 				ClusterID: aws.String("private-nonat"),
 			},
+			expectedErr: "no subnets with NAT/Transit Gateway found",
+		},
+		"DescribeClusterDenied": {
+			m: &Model{
+				ClusterID: aws.String("denied"),
+			},
+			expectedErr: "role arn:aws:iam::1234567890:role/TestRole is not authorized to perform eks:DescribeCluster",
 		},
 	}
-	eErr := "no subnets with NAT/Transit Gateway found"
 	for name, d := range tests {
 		t.Run(name, func(t *testing.T) {
 			//d.m.VPCConfiguration = nil
-			_, err := getVpcConfig(&mockEKSClient{}, &mockEC2Client{}, d.m)
+			_, err := getVpcConfig(&mockEKSClient{}, &mockEC2Client{}, &mockSTSClient{}, d.m)
 			if err != nil {
-				assert.Contains(t, err.Error(), eErr)
+				assert.Contains(t, err.Error(), d.expectedErr)
 			}
 
 		})
@@ -1,5 +1,7 @@
 package resource
 
+import "fmt"
+
 const (
 	// ErrCodeHelmActionException The specified helm action errors
 	ErrCodeHelmActionException = "HelmActionException"
@@ -17,12 +19,42 @@ const (
 	ErrCodeTimeOut = "TimeOut"
 )
 
+// Reasons of a timeout, the phase of the operation in progress when it timed out
+const (
+	// TimeOutChartDownload Downloading the chart and the values
+	TimeOutChartDownload = "ChartDownloadTimeOut"
+
+	// TimeOutHooks Running the helm install or upgrade, which waits for the hooks of the chart
+	TimeOutHooks = "HooksTimeOut"
+
+	// TimeOutVPCConnector Waiting for the VPC connector function to become active
+	TimeOutVPCConnector = "VPCConnectorTimeOut"
+
+	// TimeOutResources Waiting for the pods and other resources of the release to become ready
+	TimeOutResources = "ResourcesTimeOut"
+
+	// TimeOutHealthCheck Waiting for the health check of the release to pass
+	TimeOutHealthCheck = "HealthCheckTimeOut"
+
+	// TimeOutUninstall Uninstalling the release
+	TimeOutUninstall = "UninstallTimeOut"
+
+	// TimeOutApproval Waiting for the approval of the install or upgrade
+	TimeOutApproval = "ApprovalTimeOut"
+
+	// TimeOutOperation The phase is unknown
+	TimeOutOperation = "OperationTimeOut"
+)
+
 type Error struct {
 	// Classification of error
 	code string
 
 	// Detailed information about error
 	message string
+
+	// Phase that timed out, for timeout errors
+	reason string
 }
 
 func NewError(code, message string) *Error {
@@ -33,6 +65,15 @@ func NewError(code, message string) *Error {
 	return b
 }
 
+// NewTimeOutError returns a timeout error, the message starting with the reason so automation can tell the phases apart.
+func NewTimeOutError(reason, message string) *Error {
+	return &Error{
+		code:    ErrCodeTimeOut,
+		message: fmt.Sprintf("%s: %s", reason, message),
+		reason:  reason,
+	}
+}
+
 func (b Error) Code() string {
 	return b.code
 }
@@ -41,3 +82,8 @@ func (b Error) Code() string {
 func (b Error) Message() string {
 	return b.message
 }
+
+// Reason returns the phase that timed out, empty for other errors.
+func (b Error) Reason() string {
+	return b.reason
+}
@@ -1,19 +1,71 @@
 package resource
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/aws-cloudformation/cloudformation-cli-go-plugin/cfn/handler"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
 )
 
 const callbackDelaySeconds = 30
 
 var LastKnownErrors []string
 
+// ProgressDetail is added to the status message of the next in progress event, e.g. the ready pods of the release
+var ProgressDetail string
+
+// Phase is the part of the operation in progress, reported as the reason of the error when the operation times out
+var Phase string
+
+// stageTimeOutReasons are the timeout reasons of the stages, used when no phase was set
+var stageTimeOutReasons = map[Stage]string{
+	InitStage:         TimeOutChartDownload,
+	LambdaStabilize:   TimeOutVPCConnector,
+	ReleaseStabilize:  TimeOutResources,
+	VerifyStabilize:   TimeOutHealthCheck,
+	UninstallRelease:  TimeOutUninstall,
+	ApprovalStabilize: TimeOutApproval,
+}
+
+// ResolvedChart is the chart deployed by an earlier stage of the operation. It is carried in the callback context so
+// a stage resumed in a fresh container deploys the same chart version instead of resolving the latest one again.
+var ResolvedChart *HelmStatusData
+
+// InstallRetries is the number of installs of the operation retried after a retryable error. It is carried in the
+// callback context, as each retry is a callback of the install stage.
+var InstallRetries int
+
+// stageMessages are the status messages shown in the CloudFormation console while waiting for the stage
+var stageMessages = map[Stage]string{
+	InitStage:         "Downloading the chart and deploying release %s",
+	LambdaStabilize:   "Waiting for the VPC connector function of release %s to become active",
+	ReleaseStabilize:  "Waiting for the resources of release %s to become ready",
+	VerifyStabilize:   "Checking the health of release %s",
+	UninstallRelease:  "Uninstalling release %s",
+	ApprovalStabilize: "Waiting for the approval of release %s",
+}
+
+// urlUserInfo matches the credentials part of an URL.
+var urlUserInfo = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/@\s]+@`)
+
+// DeploymentSummary is the notification published on completion or failure.
+type DeploymentSummary struct {
+	Action       Action
+	Release      string
+	Namespace    string
+	Status       handler.Status
+	Duration     string
+	ChartVersion string `json:",omitempty"`
+	Message      string `json:",omitempty"`
+}
+
 func errorEvent(model *Model, err *Error) handler.ProgressEvent {
 	log.Printf("Returning ERROR...")
 	log.Printf("HandlerErrorCode: %s, Message: %s", err.Code(), err.Message())
@@ -35,25 +87,53 @@ func successEvent(model *Model) handler.ProgressEvent {
 
 func inProgressEvent(model *Model, stage Stage) handler.ProgressEvent {
 	log.Printf("Returning IN_PROGRESS next stage %v...\n", stage)
+	context := map[string]interface{}{
+		"Stage":     stage,
+		"StartTime": os.Getenv("StartTime"),
+		"Name":      aws.StringValue(model.Name),
+	}
+	if id := os.Getenv("OperationID"); id != "" {
+		context["OperationID"] = id
+	}
+	if ResolvedChart != nil {
+		context["ChartName"] = ResolvedChart.ChartName
+		context["ChartVersion"] = ResolvedChart.ChartVersion
+		context["ChartDigest"] = ResolvedChart.ChartDigest
+		context["ValuesHash"] = ResolvedChart.ValuesHash
+	}
+	if InstallRetries > 0 {
+		context["InstallRetries"] = InstallRetries
+	}
 	return handler.ProgressEvent{
-		OperationStatus: handler.InProgress,
-		Message:         fmt.Sprintf("%v in progress\n", stage),
-		ResourceModel:   model,
-		CallbackContext: map[string]interface{}{
-			"Stage":     stage,
-			"StartTime": os.Getenv("StartTime"),
-			"Name":      aws.StringValue(model.Name),
-		},
+		OperationStatus:      handler.InProgress,
+		Message:              progressMessage(model, stage),
+		ResourceModel:        model,
+		CallbackContext:      context,
 		CallbackDelaySeconds: callbackDelaySeconds,
 	}
 }
 
+// progressMessage returns the human-readable status message for the stage, with the progress detail if any.
+func progressMessage(model *Model, stage Stage) string {
+	format, ok := stageMessages[stage]
+	if !ok {
+		return fmt.Sprintf("%v in progress", stage)
+	}
+	msg := fmt.Sprintf(format, aws.StringValue(model.Name))
+	if ProgressDetail != "" {
+		msg = fmt.Sprintf("%s, %s", msg, ProgressDetail)
+	}
+	return msg
+}
+
 func makeEvent(model *Model, nextStage Stage, err *Error) handler.ProgressEvent {
+	// The progress detail and phase only apply to this event
+	defer func() { ProgressDetail, Phase = "", "" }()
 	if model != nil {
-		timeout := checkTimeOut(os.Getenv("StartTime"), model.TimeOut)
+		timeout := checkTimeOut(os.Getenv("StartTime"), model.TimeOut, model.TimeOutUnit)
 		if timeout && nextStage != CompleteStage {
 			errorString := fmt.Sprintf("resource creation timed out\n, LastKnownErrors: %s", strings.Join(LastKnownErrors, "\n "))
-			return errorEvent(nil, NewError(ErrCodeTimeOut, errorString))
+			return errorEvent(nil, NewTimeOutError(timeOutReason(nextStage), errorString))
 		}
 	}
 	if err != nil {
@@ -64,3 +144,149 @@ func makeEvent(model *Model, nextStage Stage, err *Error) handler.ProgressEvent
 	}
 	return inProgressEvent(model, nextStage)
 }
+
+// timeOutReason returns the reason of a timeout, the phase in progress or else the phase of the next stage.
+func timeOutReason(nextStage Stage) string {
+	if Phase != "" {
+		return Phase
+	}
+	if r, ok := stageTimeOutReasons[nextStage]; ok {
+		return r
+	}
+	return TimeOutOperation
+}
+
+// notifyDeployment publishes the deployment summary to the notification topic once the event is final.
+// Failures are only logged so the notification never changes the outcome.
+func notifyDeployment(clients AWSClientsIface, model *Model, action Action, event handler.ProgressEvent) {
+	if model == nil || model.NotificationTopicArn == nil {
+		return
+	}
+	if event.OperationStatus != handler.Success && event.OperationStatus != handler.Failed {
+		return
+	}
+	a, err := arn.Parse(*model.NotificationTopicArn)
+	if err != nil {
+		log.Printf("Invalid notification topic %s: %v", *model.NotificationTopicArn, err)
+		return
+	}
+	summary := deploymentSummary(model, repositoryChart(clients, model), action, event)
+	b, err := json.Marshal(summary)
+	if err != nil {
+		log.Printf("Failed to marshal deployment summary: %v", err)
+		return
+	}
+	attributes := map[string]string{
+		"Action":    string(summary.Action),
+		"Release":   summary.Release,
+		"Namespace": summary.Namespace,
+		"Status":    string(summary.Status),
+	}
+	subject := fmt.Sprintf("Helm release %s %s", summary.Release, summary.Status)
+	if err := publishSNS(clients.SNSClient(aws.String(a.Region), nil), *model.NotificationTopicArn, subject, string(b), attributes); err != nil {
+		log.Printf("Failed to publish deployment summary: %v", err)
+	}
+}
+
+// auditDeployment writes an audit item of the operation to the audit table once the event is final.
+// Failures are only logged so the audit never changes the outcome.
+func auditDeployment(clients AWSClientsIface, model *Model, action Action, event handler.ProgressEvent) {
+	if model == nil || model.AuditTableArn == nil {
+		return
+	}
+	if event.OperationStatus != handler.Success && event.OperationStatus != handler.Failed {
+		return
+	}
+	a, err := arn.Parse(*model.AuditTableArn)
+	if err != nil || !strings.HasPrefix(a.Resource, "table/") {
+		log.Printf("Invalid audit table %s", *model.AuditTableArn)
+		return
+	}
+	if err := putDynamoDBItem(clients.DynamoDBClient(aws.String(a.Region), nil), strings.TrimPrefix(a.Resource, "table/"), auditItem(clients, model, action, event)); err != nil {
+		log.Printf("Failed to write audit item: %v", err)
+	}
+}
+
+// auditItem builds the audit item of the event, keyed by the operation ID, with sensitive data redacted.
+func auditItem(clients AWSClientsIface, model *Model, action Action, event handler.ProgressEvent) map[string]string {
+	item := map[string]string{
+		"Id":             os.Getenv("OperationID"),
+		"StackId":        os.Getenv("StackID"),
+		"Action":         string(action),
+		"Release":        aws.StringValue(model.Name),
+		"Namespace":      aws.StringValue(model.Namespace),
+		"Chart":          aws.StringValue(model.Chart),
+		"ChartVersion":   aws.StringValue(model.Version),
+		"Outcome":        string(event.OperationStatus),
+		"Message":        redactSecrets(event.Message, model, repositoryChart(clients, model)),
+		"Timestamp":      time.Now().UTC().Format(time.RFC3339),
+		"CallerIdentity": aws.StringValue(model.CallerIdentity),
+	}
+	if ResolvedChart != nil {
+		if ResolvedChart.ChartVersion != "" {
+			item["ChartVersion"] = ResolvedChart.ChartVersion
+		}
+		item["ValuesHash"] = ResolvedChart.ValuesHash
+	}
+	if item["CallerIdentity"] == "" {
+		if id, _, err := getCallerIdentity(clients.STSClient(nil, operationRole(model, false))); err == nil {
+			item["CallerIdentity"] = aws.StringValue(id)
+		}
+	}
+	return item
+}
+
+// deploymentSummary builds the summary of the event with sensitive data redacted.
+func deploymentSummary(model *Model, chart *Chart, action Action, event handler.ProgressEvent) *DeploymentSummary {
+	summary := &DeploymentSummary{
+		Action:       action,
+		Release:      aws.StringValue(model.Name),
+		Namespace:    aws.StringValue(model.Namespace),
+		Status:       event.OperationStatus,
+		ChartVersion: aws.StringValue(model.Version),
+		Message:      redactSecrets(event.Message, model, chart),
+	}
+	if ResolvedChart != nil && ResolvedChart.ChartVersion != "" {
+		summary.ChartVersion = ResolvedChart.ChartVersion
+	}
+	if t, err := time.Parse(time.RFC3339, os.Getenv("StartTime")); err == nil {
+		summary.Duration = time.Since(t).Round(time.Second).String()
+	}
+	return summary
+}
+
+// repositoryChart returns the chart with the repository credentials of the model, the password being fetched from the
+// CredentialsSecretArn secret when set, so it is masked in the messages of any stage.
+func repositoryChart(clients AWSClientsIface, model *Model) *Chart {
+	username, password, err := (&Clients{AWSClients: clients}).getRepositoryCredentials(model.RepositoryOptions)
+	if err != nil {
+		log.Printf("Failed to get repository credentials: %v", err)
+		return nil
+	}
+	return &Chart{ChartUsername: username, ChartPassword: password}
+}
+
+// redactSecrets masks URL credentials, the model secrets, the chart password and the values set at the MaskValuePaths
+// in the message.
+func redactSecrets(msg string, model *Model, chart *Chart) string {
+	msg = urlUserInfo.ReplaceAllString(msg, "${1}***@")
+	var secrets []*string
+	if model.RepositoryOptions != nil {
+		secrets = append(secrets, model.RepositoryOptions.Password)
+	}
+	if chart != nil {
+		secrets = append(secrets, chart.ChartPassword)
+	}
+	if model.SFTPOptions != nil {
+		secrets = append(secrets, model.SFTPOptions.Credentials)
+	}
+	for _, v := range maskedValueStrings(model) {
+		secrets = append(secrets, aws.String(v))
+	}
+	for _, v := range secrets {
+		if aws.StringValue(v) != "" {
+			msg = strings.ReplaceAll(msg, *v, "***")
+		}
+	}
+	return msg
+}
@@ -0,0 +1,128 @@
+package resource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+const (
+	// gitTimeout limits the time fetching a values file from Git may take
+	gitTimeout = 2 * time.Minute
+	// gitFetchedRef is the local reference the fetched ref is stored under
+	gitFetchedRef = "refs/fetched"
+)
+
+// loadGitValues fetches the ref of the Git repository with a shallow fetch and returns the content of the values file.
+// The repository is fetched in memory with go-git, as the Lambda runtime has no git binary.
+func (c *Clients) loadGitValues(g *ValuesFromGit) ([]byte, error) {
+	if IsZero(g.Repository) || IsZero(g.Path) {
+		return nil, genericError("Fetching values from Git", errors.New("ValuesFromGit Repository and Path are required"))
+	}
+	var auth transport.AuthMethod
+	if !IsZero(g.TokenSecretArn) {
+		token, err := getSecretsManager(c.AWSClients.SecretsManagerClient(nil, nil), g.TokenSecretArn)
+		if err != nil {
+			return nil, err
+		}
+		auth = gitTokenAuth(strings.TrimSpace(string(token)))
+	}
+	ref := "HEAD"
+	if !IsZero(g.Ref) {
+		ref = *g.Ref
+	}
+	log.Printf("Fetching values file %s from Git ref %s...", *g.Path, ref)
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	repo, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		return nil, genericError("Fetching values from Git", err)
+	}
+	remote, err := repo.CreateRemote(&gitconfig.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{*g.Repository}})
+	if err != nil {
+		return nil, genericError("Fetching values from Git", err)
+	}
+	refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth})
+	if err != nil {
+		return nil, genericError("Fetching values from Git", fmt.Errorf("git fetch: %s", err))
+	}
+	opts := &git.FetchOptions{Auth: auth, Depth: 1, Tags: git.NoTags}
+	name, hash := gitRemoteRef(refs, ref)
+	switch {
+	case name != "":
+		opts.RefSpecs = []gitconfig.RefSpec{gitconfig.RefSpec(fmt.Sprintf("+%s:%s", name, gitFetchedRef))}
+	case plumbing.IsHash(ref):
+		// A commit that is not the tip of a branch or tag is looked up in their full history
+		opts.Depth = 0
+		opts.RefSpecs = []gitconfig.RefSpec{"+refs/heads/*:refs/remotes/origin/*", "+refs/tags/*:refs/tags/*"}
+		hash = plumbing.NewHash(ref)
+	default:
+		return nil, genericError("Fetching values from Git", fmt.Errorf("git fetch: ref %s not found in %s", ref, *g.Repository))
+	}
+	if err := remote.FetchContext(ctx, opts); err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, genericError("Fetching values from Git", fmt.Errorf("git fetch: %s", err))
+	}
+	commit, err := gitCommit(repo, hash)
+	if err != nil {
+		return nil, genericError("Fetching values from Git", fmt.Errorf("git fetch: ref %s: %s", ref, err))
+	}
+	f, err := commit.File(strings.TrimLeft(*g.Path, "/"))
+	if err != nil {
+		return nil, genericError("Fetching values from Git", fmt.Errorf("git show: %s: %s", *g.Path, err))
+	}
+	data, err := f.Contents()
+	if err != nil {
+		return nil, genericError("Fetching values from Git", fmt.Errorf("git show: %s: %s", *g.Path, err))
+	}
+	return []byte(data), nil
+}
+
+// gitRemoteRef returns the name and the hash of the remote reference matching the ref, a reference name, a branch,
+// a tag or the hash of a branch or tag tip, following the symbolic HEAD. The name is empty when no reference matches.
+func gitRemoteRef(refs []*plumbing.Reference, ref string) (plumbing.ReferenceName, plumbing.Hash) {
+	byName := map[plumbing.ReferenceName]*plumbing.Reference{}
+	for _, r := range refs {
+		byName[r.Name()] = r
+	}
+	for _, n := range []plumbing.ReferenceName{plumbing.ReferenceName(ref), plumbing.NewBranchReferenceName(ref), plumbing.NewTagReferenceName(ref)} {
+		r, ok := byName[n]
+		if ok && r.Type() == plumbing.SymbolicReference {
+			r, ok = byName[r.Target()]
+		}
+		if ok {
+			return r.Name(), r.Hash()
+		}
+	}
+	if plumbing.IsHash(ref) {
+		for _, r := range refs {
+			if r.Type() == plumbing.HashReference && r.Hash().String() == ref {
+				return r.Name(), r.Hash()
+			}
+		}
+	}
+	return "", plumbing.ZeroHash
+}
+
+// gitCommit returns the commit of the hash, peeling annotated tags.
+func gitCommit(repo *git.Repository, hash plumbing.Hash) (*object.Commit, error) {
+	if tag, err := repo.TagObject(hash); err == nil {
+		return tag.Commit()
+	}
+	return repo.CommitObject(hash)
+}
+
+// gitTokenAuth returns the HTTP basic authentication sending the token with the requests to the repository.
+func gitTokenAuth(token string) transport.AuthMethod {
+	return &githttp.BasicAuth{Username: "x-access-token", Password: token}
+}
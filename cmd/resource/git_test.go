@@ -0,0 +1,143 @@
+package resource
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/stretchr/testify/assert"
+)
+
+// gitFixture creates a bare repository with a first values file commit with the annotated tag v1, a second commit and
+// a third commit on main. It returns the fixture directory, the repository URL and the commits.
+func gitFixture(t *testing.T) (string, string, []string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "git-fixture")
+	assert.Nil(t, err)
+	bare, work := filepath.Join(dir, "values.git"), filepath.Join(dir, "work")
+	run := func(dir string, args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "commit.gpgsign=false", "-c", "tag.gpgsign=false"}, args...)...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com", "GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		assert.Nil(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+	run(dir, "init", "-q", "--bare", bare)
+	run(bare, "symbolic-ref", "HEAD", "refs/heads/main")
+	run(dir, "init", "-q", work)
+	assert.Nil(t, os.MkdirAll(filepath.Join(work, "env"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(work, "env", "values.yaml"), []byte("image:\n  tag: 1.0.0\nreplicas: 1\n"), 0644))
+	run(work, "add", ".")
+	run(work, "commit", "-q", "-m", "v1")
+	run(work, "tag", "-a", "v1", "-m", "v1")
+	commits := []string{run(work, "rev-parse", "HEAD")}
+	for _, tag := range []string{"1.5.0", "2.0.0"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(work, "env", "values.yaml"), []byte("image:\n  tag: "+tag+"\nreplicas: 2\n"), 0644))
+		run(work, "commit", "-q", "-am", tag)
+		commits = append(commits, run(work, "rev-parse", "HEAD"))
+	}
+	run(work, "push", "-q", bare, "HEAD:refs/heads/main", "refs/tags/v1")
+	return dir, "file://" + bare, commits
+}
+
+// TestLoadGitValues to test reading a values file from a repository at a ref
+func TestLoadGitValues(t *testing.T) {
+	dir, repo, commits := gitFixture(t)
+	defer os.RemoveAll(dir)
+	c := NewMockClient(t, nil)
+	tests := map[string]struct {
+		ref         *string
+		path        string
+		expected    string
+		expectedErr string
+	}{
+		"DefaultRef": {
+			path:     "env/values.yaml",
+			expected: "image:\n  tag: 2.0.0\nreplicas: 2\n",
+		},
+		"Branch": {
+			ref:      aws.String("main"),
+			path:     "/env/values.yaml",
+			expected: "image:\n  tag: 2.0.0\nreplicas: 2\n",
+		},
+		"Tag": {
+			ref:      aws.String("v1"),
+			path:     "env/values.yaml",
+			expected: "image:\n  tag: 1.0.0\nreplicas: 1\n",
+		},
+		"TagCommit": {
+			ref:      aws.String(commits[0]),
+			path:     "env/values.yaml",
+			expected: "image:\n  tag: 1.0.0\nreplicas: 1\n",
+		},
+		"Commit": {
+			ref:      aws.String(commits[1]),
+			path:     "env/values.yaml",
+			expected: "image:\n  tag: 1.5.0\nreplicas: 2\n",
+		},
+		"TipCommit": {
+			ref:      aws.String(commits[2]),
+			path:     "env/values.yaml",
+			expected: "image:\n  tag: 2.0.0\nreplicas: 2\n",
+		},
+		"MissingRef": {
+			ref:         aws.String("v9"),
+			path:        "env/values.yaml",
+			expectedErr: "git fetch: ref v9 not found",
+		},
+		"MissingCommit": {
+			ref:         aws.String(strings.Repeat("0", 40)),
+			path:        "env/values.yaml",
+			expectedErr: "git fetch",
+		},
+		"MissingPath": {
+			ref:         aws.String("v1"),
+			path:        "values.yaml",
+			expectedErr: "git show",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			data, err := c.loadGitValues(&ValuesFromGit{Repository: aws.String(repo), Ref: d.ref, Path: aws.String(d.path)})
+			if d.expectedErr != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), d.expectedErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, d.expected, string(data))
+		})
+	}
+}
+
+// TestProcessGitValues to test merging the values file of the repository with the standard precedence
+func TestProcessGitValues(t *testing.T) {
+	dir, repo, _ := gitFixture(t)
+	defer os.RemoveAll(dir)
+	c := NewMockClient(t, nil)
+	m := &Model{
+		ValueYaml:     aws.String("image:\n  repository: nginx\n  tag: 0.1.0\n"),
+		ValuesFromGit: &ValuesFromGit{Repository: aws.String(repo), Ref: aws.String("v1"), Path: aws.String("env/values.yaml")},
+		Values:        map[string]string{"replicas": "3"},
+	}
+	values, _, err := c.processValues(m)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"image":    map[string]interface{}{"repository": "nginx", "tag": "1.0.0"},
+		"replicas": int64(3),
+	}, values)
+}
+
+// TestGitTokenAuth to test the token is sent with the HTTP basic authentication
+func TestGitTokenAuth(t *testing.T) {
+	assert.Equal(t, &githttp.BasicAuth{Username: "x-access-token", Password: "s3cr3t"}, gitTokenAuth("s3cr3t"))
+}
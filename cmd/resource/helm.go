@@ -1,39 +1,76 @@
 package resource
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/gofrs/flock"
 	"github.com/pkg/errors"
 	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/cli"
 	"helm.sh/helm/v3/pkg/downloader"
+	"helm.sh/helm/v3/pkg/engine"
 	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/helmpath/xdg"
+	"helm.sh/helm/v3/pkg/kube"
+	"helm.sh/helm/v3/pkg/postrender"
+	"helm.sh/helm/v3/pkg/provenance"
 	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
 	"helm.sh/helm/v3/pkg/repo"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	"helm.sh/helm/v3/pkg/strvals"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/version"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/discovery"
 	"sigs.k8s.io/yaml"
 )
 
+var (
+	HelmCacheHomeEnvVar  = filepath.Join(tempDir, "cache")
+	HelmConfigHomeEnvVar = filepath.Join(tempDir, "config")
+	HelmDataHomeEnvVar   = filepath.Join(tempDir, "data")
+	caLocalPath          = filepath.Join(tempDir, "ca.pem")
+	// installRetryBackoff is the initial delay before the callback retrying an install that failed with a retryable error
+	installRetryBackoff = 10 * time.Second
+)
+
 const (
-	HelmCacheHomeEnvVar  = "/tmp/cache"
-	HelmConfigHomeEnvVar = "/tmp/config"
-	HelmDataHomeEnvVar   = "/tmp/data"
-	HelmDriver           = "secret"
-	stableRepoURL        = "https://charts.helm.sh/stable"
-	chartLocalPath       = "/tmp/chart.tgz"
-	caLocalPath          = "/tmp/ca.pem"
+	HelmDriver            = "secret"
+	stableRepoURL         = "https://charts.helm.sh/stable"
+	helmIgnoreFile        = ".helmignore"
+	OperationIDAnnotation = "awsqs.kubernetes.helm/operation-id"
+	StackIDAnnotation     = "awsqs.kubernetes.helm/stack-id"
+	// ChartDigestAnnotation records the digest of the deployed chart archive in the release chart metadata
+	ChartDigestAnnotation = "awsqs.kubernetes.helm/chart-digest"
+	// ExternallyManagedAnnotation is the default annotation marking a release managed outside CloudFormation, e.g. by GitOps
+	ExternallyManagedAnnotation = "awsqs.kubernetes.helm/externally-managed"
+	// overlapFail, overlapKeepFirst and overlapKeepLast are the ways to handle OverlappingResources
+	overlapFail      = "Fail"
+	overlapKeepFirst = "KeepFirst"
+	overlapKeepLast  = "KeepLast"
+	// valuesReuse, valuesReset and valuesResetThenReuse are the ValuesStrategy of upgrades
+	valuesReuse          = "ReuseValues"
+	valuesReset          = "ResetValues"
+	valuesResetThenReuse = "ResetThenReuseValues"
 )
 
 type HelmStatusData struct {
@@ -44,6 +81,13 @@ type HelmStatusData struct {
 	Chart        string         `json:",omitempty"`
 	Manifest     string         `json:",omitempty"`
 	Description  string         `json:",omitempty"`
+	Notes        string         `json:",omitempty"`
+	Revision     int            `json:",omitempty"`
+	ChartDigest  string         `json:",omitempty"`
+	// Values are the computed values of the release, the chart values coalesced with the supplied values
+	Values map[string]interface{} `json:",omitempty"`
+	// ValuesHash is the hash of the computed values, recorded in the audit item
+	ValuesHash string `json:",omitempty"`
 }
 type HelmListData struct {
 	ReleaseName  string `json:",omitempty"`
@@ -53,6 +97,28 @@ type HelmListData struct {
 	Namespace    string `json:",omitempty"`
 }
 
+// annotationPostRenderer adds annotations and labels to the top level resources of the rendered manifests
+type annotationPostRenderer struct {
+	annotations map[string]string
+	labels      map[string]string
+}
+
+// overlapPostRenderer handles the resources defined by more than one template of the rendered manifests, usually in
+// several subcharts of an umbrella chart, before the next post renderer runs
+type overlapPostRenderer struct {
+	namespace string
+	mode      string
+	next      postrender.PostRenderer
+}
+
+// permissionPostRenderer checks the identity may deploy the rendered manifests before helm applies them
+type permissionPostRenderer struct {
+	clients   *Clients
+	namespace string
+	verbs     []string
+	next      postrender.PostRenderer
+}
+
 type ReleaseState string
 
 const (
@@ -62,24 +128,70 @@ const (
 	ReleaseError    ReleaseState = "ReleaseError"
 )
 
+// Stage descriptions recorded in the helm release metadata after the resource ID
+const (
+	DescriptionInstall  = "CFN install in progress"
+	DescriptionUpgrade  = "CFN upgrade in progress"
+	DescriptionPending  = "CFN awaiting readiness"
+	DescriptionComplete = "CFN deployment complete"
+)
+
+// ChartSymlinks handling modes for chart directories
+const (
+	chartSymlinksResolve = "Resolve"
+	chartSymlinksReject  = "Reject"
+)
+
 // HelmClientInvoke generates the namespaced helm client
 func helmClientInvoke(namespace *string, getter genericclioptions.RESTClientGetter) (*action.Configuration, error) {
 	if namespace == nil {
 		namespace = aws.String("default")
 	}
 	actionConfig := new(action.Configuration)
-	if err := actionConfig.Init(getter, *namespace, os.Getenv("HELM_DRIVER"), func(format string, v ...interface{}) {
-		fmt.Sprintf(format, v)
-	}); err != nil {
+	if err := actionConfig.Init(getter, *namespace, os.Getenv("HELM_DRIVER"), func(format string, v ...interface{}) {}); err != nil {
 		return nil, genericError("Helm client", err)
 	}
 	return actionConfig, nil
 }
 
+// checkHelmDirs verifies the helm repository config and cache directories are writable.
+// Directories that are not writable fall back to a temp directory.
+func checkHelmDirs(settings *cli.EnvSettings) error {
+	if err := checkWritableDir(filepath.Dir(settings.RepositoryConfig)); err != nil {
+		fallback := filepath.Join(os.TempDir(), "helm", "config", filepath.Base(settings.RepositoryConfig))
+		if ferr := checkWritableDir(filepath.Dir(fallback)); ferr != nil {
+			return genericError("Helm directories", fmt.Errorf("repository config directory is not writable: %s. Please set %s to a writable directory", err, xdg.ConfigHomeEnvVar))
+		}
+		log.Printf("Repository config directory is not writable: %s. Using %s", err, fallback)
+		settings.RepositoryConfig = fallback
+	}
+	if err := checkWritableDir(settings.RepositoryCache); err != nil {
+		fallback := filepath.Join(os.TempDir(), "helm", "cache")
+		if ferr := checkWritableDir(fallback); ferr != nil {
+			return genericError("Helm directories", fmt.Errorf("repository cache directory is not writable: %s. Please set %s to a writable directory", err, xdg.CacheHomeEnvVar))
+		}
+		log.Printf("Repository cache directory is not writable: %s. Using %s", err, fallback)
+		settings.RepositoryCache = fallback
+	}
+	return nil
+}
+
+// checkWritableDir creates the directory if required and verifies a file can be written to it
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".write-check")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
 // addHelmRepoUpdate Add the repo and fire repo update
 func addHelmRepoUpdate(name string, url string, username string, password string, tlsverify bool, localCA bool, settings *cli.EnvSettings) error {
 	file := settings.RepositoryConfig
-	os.Remove(file)
 	//Ensure the file directory exists as it is required for file locking
 	err := os.MkdirAll(filepath.Dir(file), os.ModePerm)
 	if err != nil && !os.IsExist(err) {
@@ -123,55 +235,108 @@ func addHelmRepoUpdate(name string, url string, username string, password string
 		c.CAFile = caLocalPath
 	}
 
+	// An entry with the same name left by an earlier invocation is updated to the new URL,
+	// dropping its cached index so charts are never resolved from the previous repository.
+	if e := f.Get(name); e != nil && e.URL != url {
+		log.Printf("Repository %q is configured with URL %s, updating it to %s", name, e.URL, url)
+		for _, cached := range []string{helmpath.CacheIndexFile(name), helmpath.CacheChartsFile(name)} {
+			if err := os.Remove(filepath.Join(settings.RepositoryCache, cached)); err != nil && !os.IsNotExist(err) {
+				return genericError("Adding helm repository", err)
+			}
+		}
+	}
+
 	r, err := repo.NewChartRepository(&c, getter.All(settings))
 	if err != nil {
 		return genericError("Adding helm repository", err)
 	}
+	r.CachePath = settings.RepositoryCache
 
 	if _, err := r.DownloadIndexFile(); err != nil {
 		return genericError("Adding helm repository", errors.Wrapf(err, "looks like %q is not a valid chart repository or cannot be reached", url))
 	}
 
-	f.Update(&c)
-
-	if err := f.WriteFile(file, 0644); err != nil {
+	// Only the requested entry is written, so the entries and credentials of earlier invocations do not accumulate
+	// and are not refreshed with it
+	out := repo.NewFile()
+	out.Update(&c)
+	if err := out.WriteFile(file, 0644); err != nil {
 		return genericError("Adding helm repository", err)
 	}
 	log.Printf("%q has been added to your repositories\n", name)
-	var repos []*repo.ChartRepository
-	for _, cfg := range f.Repositories {
-		r, err := repo.NewChartRepository(cfg, getter.All(settings))
-		if err != nil {
-			genericError("Adding helm repository", err)
-		}
-		repos = append(repos, r)
-	}
-	log.Printf("Hang tight while we grab the latest from your chart repositories...")
-	var wg sync.WaitGroup
-	for _, re := range repos {
-		wg.Add(1)
-		go func(re *repo.ChartRepository) {
-			defer wg.Done()
-			if _, err := re.DownloadIndexFile(); err != nil {
-				log.Printf("...Unable to get an update from the %q chart repository (%s):\n\t%s\n", re.Config.Name, re.Config.URL, err)
-			} else {
-				log.Printf("...Successfully got an update from the %q chart repository\n", re.Config.Name)
-			}
-		}(re)
-	}
-	wg.Wait()
 	log.Printf("Update Complete. ⎈ Happy Helming!⎈ ")
 	return nil
 }
 
+// locateChart adds the chart repository under the repo name of the repo/name chart, updating an existing entry,
+// before resolving the chart from it, so the chart never depends on repositories added outside the provider.
+// When the repository index or the chart cannot be downloaded, the mirrors of the repository are tried in order.
+func (c *Clients) locateChart(opts *action.ChartPathOptions, chart *Chart) (string, error) {
+	opts.InsecureSkipTLSverify = aws.BoolValue(chart.ChartSkipTLSVerify)
+	if !IsZero(chart.ChartUsername) && !IsZero(chart.ChartPassword) {
+		opts.Username = *chart.ChartUsername
+		opts.Password = *chart.ChartPassword
+	}
+	if aws.BoolValue(chart.ChartLocalCA) {
+		opts.CaFile = caLocalPath
+	}
+	urls := append([]string{aws.StringValue(chart.ChartRepoURL)}, chart.ChartRepoMirrors...)
+	var err error
+	for i, u := range urls {
+		var cp string
+		if err = addHelmRepoUpdate(aws.StringValue(chart.ChartRepo), u, aws.StringValue(chart.ChartUsername), aws.StringValue(chart.ChartPassword), aws.BoolValue(chart.ChartSkipTLSVerify), aws.BoolValue(chart.ChartLocalCA), c.Settings); err == nil {
+			if opts.Version, err = c.fallbackChartVersion(chart); err == nil {
+				if cp, err = opts.LocateChart(*chart.Chart, c.Settings); err == nil {
+					log.Printf("Chart %s served by %s", *chart.Chart, u)
+					return cp, nil
+				}
+			}
+		}
+		if i < len(urls)-1 {
+			log.Printf("Unable to get chart %s from %s, failing over to mirror %s: %s", *chart.Chart, u, urls[i+1], err)
+		}
+	}
+	return "", err
+}
+
+// fallbackChartVersion returns the chart version to locate in the repository index. When the requested version is
+// missing from the index, e.g. yanked, it falls back to the highest lower version matching the ChartFallbackVersion constraint.
+func (c *Clients) fallbackChartVersion(chart *Chart) (string, error) {
+	version := aws.StringValue(chart.ChartVersion)
+	if version == "" || IsZero(chart.ChartFallbackVersion) {
+		return version, nil
+	}
+	repoName := aws.StringValue(chart.ChartRepo)
+	idx, err := repo.LoadIndexFile(filepath.Join(c.Settings.RepositoryCache, helmpath.CacheIndexFile(repoName)))
+	if err != nil {
+		return "", err
+	}
+	if idx.Has(aws.StringValue(chart.ChartName), version) {
+		return version, nil
+	}
+	cv, err := idx.Get(aws.StringValue(chart.ChartName), fmt.Sprintf("%s, <%s", *chart.ChartFallbackVersion, version))
+	if err != nil {
+		return "", fmt.Errorf("chart %s version %s not found in repository %s and no lower version matches FallbackVersion %s", *chart.Chart, version, repoName, *chart.ChartFallbackVersion)
+	}
+	log.Printf("Chart %s version %s not found in repository %s, falling back to version %s", *chart.Chart, version, repoName, cv.Version)
+	return cv.Version, nil
+}
+
 // HelmInstall invokes the helm install client
 func (c *Clients) HelmInstall(config *Config, values map[string]interface{}, chart *Chart, id string) error {
 	var cp string
 	var err error
 	var state ReleaseState
 	client := action.NewInstall(c.HelmClient)
-	client.Description = id
+	client.Description = releaseDescription(id, DescriptionInstall)
 	client.ReleaseName = *config.Name
+	if err := applyHelmFlags(client, config.HelmFlags); err != nil {
+		return genericError("Helm install", err)
+	}
+	if aws.StringValue(config.SkipHooks) == "Install" {
+		log.Printf("Skipping install hooks")
+		client.DisableHooks = true
+	}
 
 	state, err = c.HelmVerifyRelease(*config.Name, id)
 	if err != nil {
@@ -179,89 +344,352 @@ func (c *Clients) HelmInstall(config *Config, values map[string]interface{}, cha
 	}
 	switch state {
 	case ReleasePending:
-		log.Printf("Release with name: %s and ID: %s is pending state.", *config.Name, id)
+		log.Printf("Release with name: %s and ID: %s is pending state.", *config.Name, logID(id, config.LogPhysicalID))
 		return nil
 	case ReleaseError:
 		return err
 	case ReleaseFound:
-		log.Printf("Found release with name: %s and ID: %s. Please check..", *config.Name, id)
+		log.Printf("Found release with name: %s and ID: %s. Please check..", *config.Name, logID(id, config.LogPhysicalID))
+		// The ownership override only applies to upgrades, an install never takes over an existing release
+		owner := *config
+		owner.OverrideOwnership = nil
+		if err := c.checkReleaseOwner(*config.Name, &owner); err != nil {
+			return genericError("Helm install", err)
+		}
 		return genericError("Helm install", errors.New("release already exists"))
 	}
 
+	if err := c.checkRequiredResources(*config.Namespace, config.RequireExisting); err != nil {
+		return genericError("Helm install", err)
+	}
+
 	log.Printf("Installing release %s", *config.Name)
 
 	switch *chart.ChartType {
 	case "Remote":
-		if chart.ChartVersion != nil {
-			client.Version = *chart.ChartVersion
-		}
-		err = addHelmRepoUpdate(aws.StringValue(chart.ChartRepo), aws.StringValue(chart.ChartRepoURL), aws.StringValue(chart.ChartUsername), aws.StringValue(chart.ChartPassword), aws.BoolValue(chart.ChartSkipTLSVerify), aws.BoolValue(chart.ChartLocalCA), c.Settings)
+		cp, err = c.locateChart(&client.ChartPathOptions, chart)
 		if err != nil {
 			return genericError("Helm Install", err)
 		}
-		client.ChartPathOptions.InsecureSkipTLSverify = *chart.ChartSkipTLSVerify
-		if !IsZero(chart.ChartUsername) && !IsZero(chart.ChartPassword) {
-			client.ChartPathOptions.Username = *chart.ChartUsername
-			client.ChartPathOptions.Password = *chart.ChartPassword
-		}
-		if *chart.ChartLocalCA {
-			client.ChartPathOptions.CaFile = caLocalPath
-		}
-		cp, err = client.ChartPathOptions.LocateChart(*chart.Chart, c.Settings)
+	case "OCI":
+		cp, err = c.pullOCIChart(chart)
 		if err != nil {
-			return genericError("Helm Install", err)
+			return err
 		}
+		defer os.Remove(cp)
 	default:
-		err = c.downloadChart(*chart.ChartPath, chartLocalPath)
+		cp, err = c.downloadChart(*chart.ChartPath, chartRequestHeaders(chart))
 		if err != nil {
 			return err
 		}
-		cp = *chart.Chart
+		defer os.Remove(cp)
 	}
-	p := getter.All(c.Settings)
-	chartRequested, err := loader.Load(cp)
+	chartRequested, err := loadChart(cp, chart.ChartDefaultVersion, chart.ignoreRules())
 	if err != nil {
 		return genericError("Helm install", err)
 	}
+	if !IsZero(chart.ChartDigest) {
+		err = verifyChartDigest(cp, c.chartIndexFile(chart), chartRequested, *chart.ChartDigest)
+		if err != nil {
+			return genericError("Helm install", err)
+		}
+	}
 
-	if req := chartRequested.Metadata.Dependencies; req != nil {
-		if err := action.CheckDependencies(chartRequested, req); err != nil {
-			if client.DependencyUpdate {
-				man := &downloader.Manager{
-					ChartPath:        cp,
-					Keyring:          client.ChartPathOptions.Keyring,
-					SkipUpdate:       false,
-					Getters:          p,
-					RepositoryConfig: c.Settings.RepositoryConfig,
-					RepositoryCache:  c.Settings.RepositoryCache,
-					Debug:            true,
-				}
-				if err := man.Update(); err != nil {
-					return genericError("Helm install", err)
-				}
-			} else {
-				return genericError("Helm install", err)
-			}
+	client.DependencyUpdate = aws.BoolValue(chart.ChartDependencyUpdate)
+	chartRequested, _, err = c.checkChartDependencies(cp, chartRequested, client.DependencyUpdate, client.ChartPathOptions.Keyring, chart.ignoreRules())
+	if err != nil {
+		return genericError("Helm install", err)
+	}
+	err = checkAppVersion(chartRequested, chart.ChartExpectedAppVersion)
+	if err != nil {
+		return genericError("Helm install", err)
+	}
+	err = checkChartAPIVersion(chartRequested, chart.ChartAPIVersion)
+	if err != nil {
+		return genericError("Helm install", err)
+	}
+	kubeVersion, err := parseKubeVersion(config.KubeVersionOverride)
+	if err != nil {
+		return genericError("Helm install", err)
+	}
+	err = checkHelmCapabilities(chartRequested, c.helmCapabilities(config.APIVersions, kubeVersion))
+	if err != nil {
+		return genericError("Helm install", err)
+	}
+	err = recordChartDigest(cp, chartRequested)
+	if err != nil {
+		return genericError("Helm install", err)
+	}
+	recordStackID(chartRequested, config.StackID)
+	values, err = applyValuesProfile(chartRequested, chart.ChartValuesProfile, values)
+	if err != nil {
+		return genericError("Helm install", err)
+	}
+	values, err = applyChartFileValues(chartRequested, chart.ChartFileValues, values)
+	if err != nil {
+		return genericError("Helm install", err)
+	}
+	if aws.BoolValue(chart.ChartConditionsChecked) {
+		if err := checkDependencyConditions(chartRequested, values); err != nil {
+			return genericError("Helm install", err)
+		}
+	}
+	if aws.BoolValue(chart.ChartValueTypesChecked) {
+		if err := checkValueTypes(chartRequested, values); err != nil {
+			return genericError("Helm install", err)
 		}
 	}
 
-	err = c.createNamespace(*config.Namespace)
+	err = c.createNamespace(*config.Namespace, *config.Name)
 	// Here is fine still
 	if err != nil {
 		return err
 	}
+	// The lock is taken once the namespace exists and held until the release stabilizes, unless the install fails
+	if err := c.lockRelease(config, *config.Name); err != nil {
+		return genericError("Helm install", err)
+	}
+	installed := false
+	defer func() {
+		if !installed {
+			c.UnlockRelease(&ReleaseData{Name: *config.Name, Namespace: *config.Namespace, LockOwner: aws.StringValue(config.OperationID)})
+		}
+	}()
 	client.Namespace = *config.Namespace
+	if a, l := releaseAnnotations(config), config.CommonLabels; len(a) > 0 || len(l) > 0 {
+		client.PostRenderer = &annotationPostRenderer{annotations: a, labels: l}
+	}
+	if !IsZero(config.Kustomization) {
+		if client.PostRenderer, err = newKustomizePostRenderer(*config.Kustomization, client.PostRenderer); err != nil {
+			return genericError("Helm install", err)
+		}
+	}
+	if mode := aws.StringValue(config.OverlappingResources); mode != "" {
+		client.PostRenderer = &overlapPostRenderer{namespace: *config.Namespace, mode: mode, next: client.PostRenderer}
+	}
+	if aws.BoolValue(config.CheckPermissions) {
+		client.PostRenderer = &permissionPostRenderer{clients: c, namespace: *config.Namespace, verbs: []string{"create"}, next: client.PostRenderer}
+	}
+	warnings := captureChartWarnings(chartRequested, aws.StringValue(config.ChartWarnings))
+	if aws.StringValue(config.ChartWarnings) == chartWarningsFail {
+		client.PostRenderer = &warningPostRenderer{warnings: warnings, next: client.PostRenderer}
+	}
 	_, err = client.Run(chartRequested, values)
+	warnings.stop()
 	if err != nil {
+		if retryableError(err, config.RetryableErrors) {
+			// The install is retried by a later callback, which keeps the release lock
+			if err := c.removeFailedInstall(*config.Name); err != nil {
+				return genericError("Helm install", err)
+			}
+			installed = true
+		}
 		return genericError("Helm install", err)
 	}
+	err = c.applyNetworkPolicy(*config.Namespace, *config.Name, config.NetworkPolicy)
+	if err != nil {
+		return err
+	}
+	installed = true
 	log.Printf("Release installation completed. Waiting for resources to stablize.")
 	return nil
 }
 
+// retryableError returns whether the error contains one of the retryable error substrings
+func retryableError(err error, retryable []string) bool {
+	for _, s := range retryable {
+		if s != "" && strings.Contains(err.Error(), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// beforeDeadline returns whether a retry after the delay still starts before the deadline, if any
+func beforeDeadline(deadline *time.Time, delay time.Duration) bool {
+	return deadline == nil || time.Now().Add(delay).Before(*deadline)
+}
+
+// removeFailedInstall uninstalls the release left by a failed install, if any, so the install can be retried
+func (c *Clients) removeFailedInstall(name string) error {
+	if _, err := c.HelmClient.Releases.Last(name); err != nil {
+		if errors.Cause(err) == driver.ErrReleaseNotFound {
+			return nil
+		}
+		return err
+	}
+	client := action.NewUninstall(c.HelmClient)
+	client.DisableHooks = true
+	_, err := client.Run(name)
+	return err
+}
+
+// HelmUninstallPreview runs the uninstall of the release as a dry run and lists the resources it would delete,
+// leaving out the resources kept by the helm.sh/resource-policy annotation.
+func (c *Clients) HelmUninstallPreview(name string) ([]string, error) {
+	client := action.NewUninstall(c.HelmClient)
+	client.DryRun = true
+	res, err := client.Run(name)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			log.Printf("Release not found..")
+			return nil, fmt.Errorf(ErrCodeNotFound)
+		}
+		return nil, genericError("Helm Uninstall preview", err)
+	}
+	_, manifests, err := releaseutil.SortManifests(releaseutil.SplitManifests(res.Release.Manifest), nil, releaseutil.UninstallOrder)
+	if err != nil {
+		return nil, genericError("Helm Uninstall preview", err)
+	}
+	var resources []string
+	for _, m := range manifests {
+		if m.Head == nil || m.Head.Metadata == nil || m.Head.Kind == "" {
+			continue
+		}
+		resource := fmt.Sprintf("%s %s", m.Head.Kind, m.Head.Metadata.Name)
+		if m.Head.Metadata.Annotations != nil && strings.ToLower(strings.TrimSpace(m.Head.Metadata.Annotations[kube.ResourcePolicyAnno])) == kube.KeepPolicy {
+			log.Printf("%s would be kept by its resource policy", resource)
+			continue
+		}
+		resources = append(resources, resource)
+	}
+	return resources, nil
+}
+
+// HelmDiff renders the release of the chart and values as a dry run, applying nothing, and lists the resources the
+// install or upgrade would add (+), change (~) or remove (-) compared to the deployed release.
+func (c *Clients) HelmDiff(config *Config, values map[string]interface{}, chart *Chart) ([]string, error) {
+	var cp string
+	var err error
+	client := action.NewInstall(c.HelmClient)
+	client.DryRun = true
+	client.ReleaseName = *config.Name
+	client.Namespace = *config.Namespace
+	deployed := ""
+	rel, err := c.HelmClient.Releases.Last(*config.Name)
+	switch {
+	case err == nil:
+		// Renders the upgrade, which skips the conflict check of the resources the release already owns
+		client.IsUpgrade = true
+		deployed = rel.Manifest
+	case errors.Cause(err) != driver.ErrReleaseNotFound:
+		return nil, genericError("Helm diff", err)
+	}
+	switch *chart.ChartType {
+	case "Remote":
+		cp, err = c.locateChart(&client.ChartPathOptions, chart)
+		if err != nil {
+			return nil, genericError("Helm diff", err)
+		}
+	case "OCI":
+		cp, err = c.pullOCIChart(chart)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(cp)
+	default:
+		cp, err = c.downloadChart(*chart.ChartPath, chartRequestHeaders(chart))
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(cp)
+	}
+	ch, err := loadChart(cp, chart.ChartDefaultVersion, chart.ignoreRules())
+	if err != nil {
+		return nil, genericError("Helm diff", err)
+	}
+	ch, _, err = c.checkChartDependencies(cp, ch, aws.BoolValue(chart.ChartDependencyUpdate), client.ChartPathOptions.Keyring, chart.ignoreRules())
+	if err != nil {
+		return nil, genericError("Helm diff", err)
+	}
+	values, err = applyValuesProfile(ch, chart.ChartValuesProfile, values)
+	if err != nil {
+		return nil, genericError("Helm diff", err)
+	}
+	values, err = applyChartFileValues(ch, chart.ChartFileValues, values)
+	if err != nil {
+		return nil, genericError("Helm diff", err)
+	}
+	if a, l := releaseAnnotations(config), config.CommonLabels; len(a) > 0 || len(l) > 0 {
+		client.PostRenderer = &annotationPostRenderer{annotations: a, labels: l}
+	}
+	if !IsZero(config.Kustomization) {
+		if client.PostRenderer, err = newKustomizePostRenderer(*config.Kustomization, client.PostRenderer); err != nil {
+			return nil, genericError("Helm diff", err)
+		}
+	}
+	rendered, err := client.Run(ch, values)
+	if err != nil {
+		return nil, genericError("Helm diff", err)
+	}
+	return diffManifests(deployed, rendered.Manifest), nil
+}
+
+// diffManifests lists the resources of the rendered manifest added (+) or changed (~) compared to the deployed
+// manifest and the resources of the deployed manifest removed (-), ignoring the operation ID annotation.
+func diffManifests(deployed string, rendered string) []string {
+	before, after := manifestObjects(deployed), manifestObjects(rendered)
+	var diff []string
+	for k, obj := range after {
+		prev, ok := before[k]
+		switch {
+		case !ok:
+			diff = append(diff, "+ "+k)
+		case !reflect.DeepEqual(prev, obj):
+			diff = append(diff, "~ "+k)
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			diff = append(diff, "- "+k)
+		}
+	}
+	sort.Slice(diff, func(i, j int) bool { return diff[i][2:] < diff[j][2:] })
+	return diff
+}
+
+// manifestObjects returns the objects of the manifest by kind and name, without the operation ID annotation
+func manifestObjects(manifest string) map[string]map[string]interface{} {
+	objects := map[string]map[string]interface{}{}
+	for _, m := range releaseutil.SplitManifests(manifest) {
+		obj := map[string]interface{}{}
+		if err := yaml.Unmarshal([]byte(m), &obj); err != nil || len(obj) == 0 {
+			continue
+		}
+		metadata, _ := obj["metadata"].(map[string]interface{})
+		if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+			delete(annotations, OperationIDAnnotation)
+			if len(annotations) == 0 {
+				delete(metadata, "annotations")
+			}
+		}
+		objects[fmt.Sprintf("%v/%v", obj["kind"], metadata["name"])] = obj
+	}
+	return objects
+}
+
 // HelmUninstall invokes the helm uninstaller client
-func (c *Clients) HelmUninstall(name string) error {
+func (c *Clients) HelmUninstall(name string, config *Config) error {
 	log.Printf("Uninstalling release %s", name)
+	// The lock cannot be taken in a deleted namespace, checked first
+	gone, err := c.namespaceGone(c.Settings.Namespace())
+	if err != nil {
+		return genericError("Helm Uninstall", err)
+	}
+	if gone {
+		log.Printf("Namespace %s was deleted. Nothing to uninstall for release %s", c.Settings.Namespace(), name)
+		return nil
+	}
+	if err := c.lockRelease(config, name); err != nil {
+		return genericError("Helm Uninstall", err)
+	}
+	// Deleting the release completes the operation
+	if config != nil {
+		defer c.UnlockRelease(&ReleaseData{Name: name, Namespace: aws.StringValue(config.Namespace), LockOwner: aws.StringValue(config.OperationID)})
+	}
+	if err := c.checkExternallyManaged(name, config); err != nil {
+		return genericError("Helm Uninstall", err)
+	}
 	client := action.NewUninstall(c.HelmClient)
 	res, err := client.Run(name)
 	re := regexp.MustCompile(`not found`)
@@ -275,6 +703,23 @@ func (c *Clients) HelmUninstall(name string) error {
 	if res != nil && res.Info != "" {
 		log.Printf(res.Info)
 	}
+	if res != nil && res.Release != nil {
+		cleanup := []string{CleanupNetworkPolicy}
+		if config != nil && config.CleanupOnDelete != nil {
+			cleanup = config.CleanupOnDelete
+		}
+		for _, kind := range cleanup {
+			switch kind {
+			case CleanupNetworkPolicy:
+				err = c.deleteNetworkPolicies(res.Release.Namespace, name)
+			case CleanupNamespace:
+				err = c.deleteReleaseNamespace(res.Release.Namespace, name)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
 	log.Printf("Release \"%s\" uninstalled\n", name)
 	return nil
 }
@@ -283,10 +728,21 @@ func (c *Clients) HelmUninstall(name string) error {
 func (c *Clients) HelmStatus(name string) (*HelmStatusData, error) {
 	log.Printf("Checking release status %s", name)
 	h := &HelmStatusData{}
+	gone, err := c.namespaceGone(c.Settings.Namespace())
+	if err != nil {
+		return nil, err
+	}
+	if gone {
+		log.Printf("Namespace %s was deleted. Release not found..", c.Settings.Namespace())
+		return nil, fmt.Errorf(ErrCodeNotFound)
+	}
 	client := action.NewStatus(c.HelmClient)
 	res, err := client.Run(name)
 	re := regexp.MustCompile(`not found`)
 	if err != nil {
+		if lerr := c.checkLegacyRelease(c.Settings.Namespace(), name); lerr != nil {
+			return nil, lerr
+		}
 		if re.MatchString(err.Error()) {
 			log.Printf("Release not found..")
 			return nil, fmt.Errorf(ErrCodeNotFound)
@@ -296,20 +752,48 @@ func (c *Clients) HelmStatus(name string) (*HelmStatusData, error) {
 	if res != nil {
 		h.Namespace = res.Namespace
 		h.Manifest = res.Manifest
+		h.Revision = res.Version
 		if res.Info != nil {
 			h.Status = res.Info.Status
 			h.Description = res.Info.Description
+			h.Notes = res.Info.Notes
 		}
 		if res.Chart != nil {
 			h.ChartName = res.Chart.Metadata.Name
 			h.ChartVersion = res.Chart.Metadata.Version
 			h.Chart = res.Chart.Metadata.Name + "-" + res.Chart.Metadata.Version
+			h.ChartDigest = res.Chart.Metadata.Annotations[ChartDigestAnnotation]
+			h.Values, err = chartutil.CoalesceValues(res.Chart, res.Config)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 	log.Printf("Found release in %s status", h.Status)
 	return h, nil
 }
 
+// releaseNotes returns the rendered release notes with the lines matching the redact pattern masked.
+func releaseNotes(notes string, redactPattern *string) (*string, error) {
+	if notes == "" {
+		return nil, nil
+	}
+	if IsZero(redactPattern) {
+		return aws.String(notes), nil
+	}
+	re, err := regexp.Compile(*redactPattern)
+	if err != nil {
+		return nil, genericError("Redact notes", err)
+	}
+	lines := strings.Split(notes, "\n")
+	for i, l := range lines {
+		if re.MatchString(l) {
+			lines[i] = redactedValue
+		}
+	}
+	return aws.String(strings.Join(lines, "\n")), nil
+}
+
 // HelmList list the release with specific chart and version in a namespace.
 func (c *Clients) HelmList(config *Config, chart *Chart) ([]HelmListData, error) {
 	a := []HelmListData{}
@@ -353,9 +837,32 @@ func (c *Clients) HelmUpgrade(name string, config *Config, values map[string]int
 	log.Printf("Upgrading release %s", name)
 	client := action.NewUpgrade(c.HelmClient)
 	var cp string
-	var err error
 	var state ReleaseState
-	client.Description = id
+	client.Description = releaseDescription(id, DescriptionUpgrade)
+	if err := applyHelmFlags(client, config.HelmFlags); err != nil {
+		return genericError("Helm Upgrade", err)
+	}
+	if aws.StringValue(config.SkipHooks) == "Upgrade" {
+		log.Printf("Skipping upgrade hooks")
+		client.DisableHooks = true
+	}
+	gone, err := c.namespaceGone(c.Settings.Namespace())
+	if err != nil {
+		return genericError("Helm Upgrade", err)
+	}
+	if gone {
+		return genericError("Helm Upgrade", fmt.Errorf("namespace %s of release %s was deleted, please delete and re-create the resource", c.Settings.Namespace(), name))
+	}
+	// The lock is held until the release stabilizes, unless the upgrade fails
+	if err := c.lockRelease(config, name); err != nil {
+		return genericError("Helm Upgrade", err)
+	}
+	upgraded := false
+	defer func() {
+		if !upgraded {
+			c.UnlockRelease(&ReleaseData{Name: name, Namespace: aws.StringValue(config.Namespace), LockOwner: aws.StringValue(config.OperationID)})
+		}
+	}()
 
 	state, err = c.HelmVerifyRelease(*config.Name, id)
 	if err != nil {
@@ -363,72 +870,168 @@ func (c *Clients) HelmUpgrade(name string, config *Config, values map[string]int
 	}
 	switch state {
 	case ReleasePending:
-		log.Printf("Release with name: %s and ID: %s is pending state.", *config.Name, id)
+		log.Printf("Release with name: %s and ID: %s is pending state.", *config.Name, logID(id, config.LogPhysicalID))
+		upgraded = true
 		return nil
 	case ReleaseError:
 		return err
 	case ReleaseFound:
-		log.Printf("Found release with name: %s and ID: %s. Proceeding with upgrade..", *config.Name, id)
+		log.Printf("Found release with name: %s and ID: %s. Proceeding with upgrade..", *config.Name, logID(id, config.LogPhysicalID))
+		if err := c.checkReleaseOwner(*config.Name, config); err != nil {
+			return genericError("Helm Upgrade", err)
+		}
+		if err := c.checkExternallyManaged(*config.Name, config); err != nil {
+			return genericError("Helm Upgrade", err)
+		}
 		switch *chart.ChartType {
 		case "Remote":
-			if chart.ChartVersion != nil {
-				client.Version = *chart.ChartVersion
-			}
-			err = addHelmRepoUpdate(aws.StringValue(chart.ChartRepo), aws.StringValue(chart.ChartRepoURL), aws.StringValue(chart.ChartUsername), aws.StringValue(chart.ChartPassword), aws.BoolValue(chart.ChartSkipTLSVerify), aws.BoolValue(chart.ChartLocalCA), c.Settings)
+			cp, err = c.locateChart(&client.ChartPathOptions, chart)
 			if err != nil {
 				return genericError("Helm Upgrade", err)
 			}
-			client.ChartPathOptions.InsecureSkipTLSverify = *chart.ChartSkipTLSVerify
-			if !IsZero(chart.ChartUsername) && !IsZero(chart.ChartPassword) {
-				client.ChartPathOptions.Username = *chart.ChartUsername
-				client.ChartPathOptions.Password = *chart.ChartPassword
-			}
-			if *chart.ChartLocalCA {
-				client.ChartPathOptions.CaFile = caLocalPath
-			}
-			cp, err = client.ChartPathOptions.LocateChart(*chart.Chart, c.Settings)
+		case "OCI":
+			cp, err = c.pullOCIChart(chart)
 			if err != nil {
-				return genericError("Helm Upgrade", err)
+				return err
 			}
+			defer os.Remove(cp)
 		default:
-			err = c.downloadChart(*chart.ChartPath, chartLocalPath)
+			cp, err = c.downloadChart(*chart.ChartPath, chartRequestHeaders(chart))
 			if err != nil {
 				return err
 			}
-			cp = *chart.Chart
+			defer os.Remove(cp)
 		}
 		// Check chart dependencies to make sure all are present in /charts
-		ch, err := loader.Load(cp)
+		ch, err := loadChart(cp, chart.ChartDefaultVersion, chart.ignoreRules())
 		if err != nil {
 			return genericError("Helm Upgrade", err)
 		}
-		if req := ch.Metadata.Dependencies; req != nil {
-			if err := action.CheckDependencies(ch, req); err != nil {
+		if !IsZero(chart.ChartDigest) {
+			err = verifyChartDigest(cp, c.chartIndexFile(chart), ch, *chart.ChartDigest)
+			if err != nil {
 				return genericError("Helm Upgrade", err)
 			}
 		}
-
-		rel, err := client.Run(name, ch, values)
+		ch, _, err = c.checkChartDependencies(cp, ch, aws.BoolValue(chart.ChartDependencyUpdate), client.ChartPathOptions.Keyring, chart.ignoreRules())
 		if err != nil {
 			return genericError("Helm Upgrade", err)
 		}
-		log.Printf("Release %q has been upgraded. Happy Helming!\n", rel.Name)
-		return nil
-	}
-
-	return errors.New("unknown error")
-}
-
-// HelmVerifyDescription verifies the if the description matches ID
-func (c *Clients) HelmVerifyRelease(name string, id string) (ReleaseState, error) {
-	status, staterr := c.HelmStatus(name)
-	if staterr != nil {
-		log.Print(staterr)
-		if staterr.Error() == ErrCodeNotFound {
-			log.Printf("Release not found..")
-			return ReleaseNotFound, nil
+		err = checkAppVersion(ch, chart.ChartExpectedAppVersion)
+		if err != nil {
+			return genericError("Helm Upgrade", err)
 		}
-		return ReleaseError, staterr
+		err = checkChartAPIVersion(ch, chart.ChartAPIVersion)
+		if err != nil {
+			return genericError("Helm Upgrade", err)
+		}
+		kubeVersion, err := parseKubeVersion(config.KubeVersionOverride)
+		if err != nil {
+			return genericError("Helm Upgrade", err)
+		}
+		err = checkHelmCapabilities(ch, c.helmCapabilities(config.APIVersions, kubeVersion))
+		if err != nil {
+			return genericError("Helm Upgrade", err)
+		}
+		err = recordChartDigest(cp, ch)
+		if err != nil {
+			return genericError("Helm Upgrade", err)
+		}
+		recordStackID(ch, config.StackID)
+		values, err = applyValuesProfile(ch, chart.ChartValuesProfile, values)
+		if err != nil {
+			return genericError("Helm Upgrade", err)
+		}
+		values, err = applyChartFileValues(ch, chart.ChartFileValues, values)
+		if err != nil {
+			return genericError("Helm Upgrade", err)
+		}
+		values, err = c.applyValuesStrategy(client, name, config.ValuesStrategy, values)
+		if err != nil {
+			return genericError("Helm Upgrade", err)
+		}
+		values, err = c.preserveSecretValues(*config.Namespace, config.PreservedSecretValues, values)
+		if err != nil {
+			return genericError("Helm Upgrade", err)
+		}
+		if aws.BoolValue(chart.ChartConditionsChecked) {
+			if err := checkDependencyConditions(ch, values); err != nil {
+				return genericError("Helm Upgrade", err)
+			}
+		}
+		if aws.BoolValue(chart.ChartValueTypesChecked) {
+			if err := checkValueTypes(ch, values); err != nil {
+				return genericError("Helm Upgrade", err)
+			}
+		}
+
+		if a, l := releaseAnnotations(config), config.CommonLabels; len(a) > 0 || len(l) > 0 {
+			client.PostRenderer = &annotationPostRenderer{annotations: a, labels: l}
+		}
+		if !IsZero(config.Kustomization) {
+			if client.PostRenderer, err = newKustomizePostRenderer(*config.Kustomization, client.PostRenderer); err != nil {
+				return genericError("Helm Upgrade", err)
+			}
+		}
+		if mode := aws.StringValue(config.OverlappingResources); mode != "" {
+			client.PostRenderer = &overlapPostRenderer{namespace: *config.Namespace, mode: mode, next: client.PostRenderer}
+		}
+		if aws.BoolValue(config.CheckPermissions) {
+			client.PostRenderer = &permissionPostRenderer{clients: c, namespace: *config.Namespace, verbs: []string{"create", "patch"}, next: client.PostRenderer}
+		}
+		warnings := captureChartWarnings(ch, aws.StringValue(config.ChartWarnings))
+		if aws.StringValue(config.ChartWarnings) == chartWarningsFail {
+			client.PostRenderer = &warningPostRenderer{warnings: warnings, next: client.PostRenderer}
+		}
+		rel, err := client.Run(name, ch, values)
+		warnings.stop()
+		if err != nil {
+			return genericError("Helm Upgrade", upgradeConflictError(err, name, *config.Namespace))
+		}
+		if err := c.scaleWorkloads(rel.Manifest, *config.Namespace, aws.BoolValue(config.Suspend)); err != nil {
+			return err
+		}
+		upgraded = true
+		log.Printf("Release %q has been upgraded. Happy Helming!\n", rel.Name)
+		return nil
+	}
+
+	return errors.New("unknown error")
+}
+
+// applyValuesStrategy sets how the upgrade combines the values with those of the previous release. ResetThenReuseValues,
+// not available in the bundled helm, resets to the defaults of the new chart and merges the values over the values
+// supplied to the previous release, so changed chart defaults apply while earlier overrides are kept.
+func (c *Clients) applyValuesStrategy(client *action.Upgrade, name string, strategy *string, values map[string]interface{}) (map[string]interface{}, error) {
+	switch aws.StringValue(strategy) {
+	case "":
+	case valuesReuse:
+		client.ReuseValues = true
+	case valuesReset:
+		client.ResetValues = true
+	case valuesResetThenReuse:
+		rel, err := c.HelmClient.Releases.Last(name)
+		if err != nil {
+			return nil, err
+		}
+		client.ResetValues = true
+		return mergeMaps(rel.Config, values), nil
+	default:
+		return nil, fmt.Errorf("invalid ValuesStrategy %q, expected %s, %s or %s", *strategy, valuesReuse, valuesReset, valuesResetThenReuse)
+	}
+	return values, nil
+}
+
+// HelmVerifyDescription verifies the if the description matches ID
+func (c *Clients) HelmVerifyRelease(name string, id string) (ReleaseState, error) {
+	status, staterr := c.HelmStatus(name)
+	if staterr != nil {
+		log.Print(staterr)
+		if staterr.Error() == ErrCodeNotFound {
+			log.Printf("Release not found..")
+			return ReleaseNotFound, nil
+		}
+		return ReleaseError, staterr
 	}
 
 	switch status.Status {
@@ -436,14 +1039,979 @@ func (c *Clients) HelmVerifyRelease(name string, id string) (ReleaseState, error
 		log.Printf("Release: %s in status: %s", name, status.Status)
 		return ReleasePending, nil
 	case release.StatusDeployed:
-		if status.Description == id {
+		if releaseID(status.Description) == id {
 			return ReleaseFound, nil
 		}
-		return ReleaseError, fmt.Errorf("another release exists with the same name but different ID %s instead of %s", status.Description, id)
+		return ReleaseError, fmt.Errorf("another release exists with the same name but different ID %s instead of %s", releaseID(status.Description), id)
 	case release.StatusFailed:
 		return ReleaseError, errors.New("release in failed status")
 	default:
 		return ReleaseError, errors.New("unknown error")
 	}
-	return ReleaseFound, nil
+}
+
+// HelmSetDescription records the stage description on the latest release revision
+func (c *Clients) HelmSetDescription(name string, stage string) error {
+	rel, err := c.HelmClient.Releases.Last(name)
+	if err != nil {
+		return genericError("Helm set description", err)
+	}
+	description := releaseDescription(releaseID(rel.Info.Description), stage)
+	if rel.Info.Description == description {
+		return nil
+	}
+	log.Printf("Setting release %s description to %q", name, stage)
+	rel.Info.Description = description
+	if err := c.HelmClient.Releases.Update(rel); err != nil {
+		return genericError("Helm set description", err)
+	}
+	return nil
+}
+
+// releaseDescription returns the release description for the resource ID and stage
+func releaseDescription(id string, stage string) string {
+	return fmt.Sprintf("%s: %s", id, stage)
+}
+
+// releaseID returns the resource ID from the release description
+func releaseID(description string) string {
+	return strings.SplitN(description, ": ", 2)[0]
+}
+
+// checkChartDependencies verifies the chart dependencies are present in /charts and runs
+// a dependency update when requested. Charts without dependencies and packaged charts are never updated.
+func (c *Clients) checkChartDependencies(cp string, ch *chart.Chart, update bool, keyring string, ignore chartIgnore) (*chart.Chart, bool, error) {
+	req := ch.Metadata.Dependencies
+	if len(req) == 0 {
+		log.Printf("Chart %s has no dependencies. Skipping dependency check.", ch.Name())
+		return ch, false, nil
+	}
+	err := action.CheckDependencies(ch, req)
+	if err == nil {
+		return ch, false, nil
+	}
+	if !update {
+		return nil, false, err
+	}
+	fi, serr := os.Stat(cp)
+	if serr != nil || !fi.IsDir() {
+		log.Printf("Chart %s is packaged without the required dependencies. Skipping dependency update.", ch.Name())
+		return nil, false, err
+	}
+	log.Printf("Updating dependencies for chart %s", ch.Name())
+	man := &downloader.Manager{
+		Out:              log.Writer(),
+		ChartPath:        cp,
+		Keyring:          keyring,
+		SkipUpdate:       false,
+		Getters:          getter.All(c.Settings),
+		RepositoryConfig: c.Settings.RepositoryConfig,
+		RepositoryCache:  c.Settings.RepositoryCache,
+		Debug:            true,
+	}
+	if err := man.Update(); err != nil {
+		return nil, false, err
+	}
+	// Reload the chart with the updated dependencies
+	ch, err = loadChartDir(cp, ignore)
+	if err != nil {
+		return nil, false, err
+	}
+	return ch, true, nil
+}
+
+// chartIndexFile returns the cached repository index file for remote charts
+func (c *Clients) chartIndexFile(chart *Chart) string {
+	if aws.StringValue(chart.ChartType) != "Remote" {
+		return ""
+	}
+	return filepath.Join(c.Settings.RepositoryCache, helmpath.CacheIndexFile(aws.StringValue(chart.ChartRepo)))
+}
+
+// verifyChartDigest verifies the chart archive digest. For repository charts the digest declared in the
+// repository index must match both the pinned digest and the downloaded archive.
+func verifyChartDigest(cp string, indexFile string, ch *chart.Chart, digest string) error {
+	digest = strings.TrimPrefix(digest, "sha256:")
+	expected := digest
+	if indexFile != "" {
+		idx, err := repo.LoadIndexFile(indexFile)
+		if err != nil {
+			return err
+		}
+		cv, err := idx.Get(ch.Name(), ch.Metadata.Version)
+		if err != nil {
+			return fmt.Errorf("chart %s-%s not found in repository index: %s", ch.Name(), ch.Metadata.Version, err)
+		}
+		if cv.Digest != digest {
+			return fmt.Errorf("repository index digest %s for chart %s-%s does not match ChartDigest %s", cv.Digest, ch.Name(), ch.Metadata.Version, digest)
+		}
+		expected = cv.Digest
+	}
+	sum, err := provenance.DigestFile(cp)
+	if err != nil {
+		return err
+	}
+	if sum != expected {
+		return fmt.Errorf("chart archive digest %s does not match expected digest %s", sum, expected)
+	}
+	log.Printf("Verified chart %s-%s digest %s", ch.Name(), ch.Metadata.Version, sum)
+	return nil
+}
+
+// recordChartDigest annotates the chart metadata with the digest of the chart archive, so the deployed
+// release records the artifact resolved from a moving chart version.
+func recordChartDigest(cp string, ch *chart.Chart) error {
+	fi, err := os.Stat(cp)
+	if err != nil || fi.IsDir() {
+		return nil
+	}
+	sum, err := provenance.DigestFile(cp)
+	if err != nil {
+		return err
+	}
+	if ch.Metadata.Annotations == nil {
+		ch.Metadata.Annotations = map[string]string{}
+	}
+	ch.Metadata.Annotations[ChartDigestAnnotation] = sum
+	return nil
+}
+
+// recordStackID records the stack ID of the operation in the release chart metadata, the owner of the release
+// compared by checkReleaseOwner
+func recordStackID(ch *chart.Chart, stackID *string) {
+	if IsZero(stackID) {
+		return
+	}
+	if ch.Metadata.Annotations == nil {
+		ch.Metadata.Annotations = map[string]string{}
+	}
+	ch.Metadata.Annotations[StackIDAnnotation] = *stackID
+}
+
+// pinChartVersion pins a repository chart without a version to the version and digest of the deployed release,
+// instead of resolving the latest version again.
+func pinChartVersion(chart *Chart, s *HelmStatusData) {
+	if aws.StringValue(chart.ChartType) != "Remote" || chart.ChartVersion != nil || s.ChartName != aws.StringValue(chart.ChartName) || s.ChartVersion == "" {
+		return
+	}
+	log.Printf("Pinning chart %s to the deployed version %s", s.ChartName, s.ChartVersion)
+	chart.ChartVersion = aws.String(s.ChartVersion)
+	if chart.ChartDigest == nil && s.ChartDigest != "" {
+		chart.ChartDigest = aws.String(s.ChartDigest)
+	}
+}
+
+// undefinedTemplateFunction matches the template parse error for functions the helm engine does not provide.
+var undefinedTemplateFunction = regexp.MustCompile(`function "([^"]+)" not defined`)
+
+// helmCapabilities discovers the version and API versions of the cluster and sets them as the capabilities
+// of the helm actions, so templates gated on .Capabilities render as they will on the cluster. The extra API
+// versions are added to the discovered ones. Without a reachable cluster the helm defaults are used instead, with
+// the kube version override if set so templates gated on the kube version render deterministically offline.
+func (c *Clients) helmCapabilities(extra []string, kubeVersion *chartutil.KubeVersion) *chartutil.Capabilities {
+	offlineKubeVersion := chartutil.DefaultCapabilities.KubeVersion
+	if kubeVersion != nil {
+		offlineKubeVersion = *kubeVersion
+	}
+	caps := &chartutil.Capabilities{
+		APIVersions: chartutil.DefaultVersionSet,
+		KubeVersion: offlineKubeVersion,
+		HelmVersion: chartutil.DefaultCapabilities.HelmVersion,
+	}
+	discovered := false
+	if c.ClientSet != nil {
+		dc := c.ClientSet.Discovery()
+		kubeVersion, err := dc.ServerVersion()
+		if err == nil {
+			caps.KubeVersion = chartutil.KubeVersion{Version: kubeVersion.GitVersion, Major: kubeVersion.Major, Minor: kubeVersion.Minor}
+			caps.APIVersions, err = action.GetVersionSet(dc)
+		}
+		if err != nil && !discovery.IsGroupDiscoveryFailedError(err) {
+			log.Printf("Could not discover the cluster capabilities, using the defaults: %v", err)
+			caps.KubeVersion = offlineKubeVersion
+			caps.APIVersions = chartutil.DefaultVersionSet
+		} else {
+			discovered = true
+		}
+	}
+	caps.APIVersions = append(append(chartutil.VersionSet{}, caps.APIVersions...), extra...)
+	if discovered && c.HelmClient != nil {
+		c.HelmClient.Capabilities = caps
+	}
+	return caps
+}
+
+// parseKubeVersion parses the KubeVersionOverride semantic version, e.g. 1.20.4 or v1.20.4
+func parseKubeVersion(override *string) (*chartutil.KubeVersion, error) {
+	if IsZero(override) {
+		return nil, nil
+	}
+	v, err := version.ParseSemantic(*override)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KubeVersionOverride %q, expected a semantic version such as 1.20.4: %v", *override, err)
+	}
+	return &chartutil.KubeVersion{Version: "v" + v.String(), Major: strconv.Itoa(int(v.Major())), Minor: strconv.Itoa(int(v.Minor()))}, nil
+}
+
+// checkHelmCapabilities renders the chart with the bundled helm engine to catch templates using features
+// only available in newer helm versions. Other render errors are left to the install or upgrade.
+func checkHelmCapabilities(ch *chart.Chart, caps *chartutil.Capabilities) error {
+	vals, err := chartutil.ToRenderValues(ch, map[string]interface{}{}, chartutil.ReleaseOptions{Name: ch.Name(), Namespace: "default"}, caps)
+	if err != nil {
+		return nil
+	}
+	_, err = engine.Render(ch, vals)
+	if err == nil {
+		return nil
+	}
+	if m := undefinedTemplateFunction.FindStringSubmatch(err.Error()); m != nil {
+		return fmt.Errorf("chart %s uses template function %q which is not supported by the bundled helm %s, a newer helm version is required", ch.Name(), m[1], chartutil.DefaultCapabilities.HelmVersion.Version)
+	}
+	return nil
+}
+
+// manifestSource matches the comment helm adds to each rendered manifest with the template it was rendered from
+var manifestSource = regexp.MustCompile(`(?m)^# Source: (.+)$`)
+
+// overlappingResources finds the resources with the same kind, namespace and name defined more than once in the
+// manifests. With the Fail mode it errors listing the templates defining each of them, KeepFirst and KeepLast keep
+// only the first or last definition in the order helm renders the manifests.
+func overlappingResources(manifests string, namespace string, mode string) (*bytes.Buffer, error) {
+	if mode != overlapFail && mode != overlapKeepFirst && mode != overlapKeepLast {
+		return nil, fmt.Errorf("invalid OverlappingResources %q, expected %s, %s or %s", mode, overlapFail, overlapKeepFirst, overlapKeepLast)
+	}
+	split := releaseutil.SplitManifests(manifests)
+	keys := make([]string, 0, len(split))
+	for k := range split {
+		keys = append(keys, k)
+	}
+	sort.Sort(releaseutil.BySplitManifestsOrder(keys))
+	type definition struct {
+		resource string
+		sources  []string
+		indexes  []int
+	}
+	var order []string
+	definitions := map[string]*definition{}
+	for i, k := range keys {
+		obj := &metav1.PartialObjectMetadata{}
+		if err := yaml.Unmarshal([]byte(split[k]), obj); err != nil {
+			return nil, err
+		}
+		if obj.Kind == "" {
+			continue
+		}
+		ns := obj.Namespace
+		if ns == "" {
+			ns = namespace
+		}
+		gvk := obj.GroupVersionKind()
+		id := strings.Join([]string{gvk.Group, gvk.Kind, ns, obj.Name}, "/")
+		d, ok := definitions[id]
+		if !ok {
+			d = &definition{resource: fmt.Sprintf("%s %s", gvk.Kind, obj.Name)}
+			definitions[id] = d
+			order = append(order, id)
+		}
+		source := "unknown template"
+		if m := manifestSource.FindStringSubmatch(split[k]); m != nil {
+			source = strings.TrimSpace(m[1])
+		}
+		d.sources = append(d.sources, source)
+		d.indexes = append(d.indexes, i)
+	}
+	var overlaps []string
+	dropped := map[int]bool{}
+	for _, id := range order {
+		d := definitions[id]
+		if len(d.indexes) < 2 {
+			continue
+		}
+		overlaps = append(overlaps, fmt.Sprintf("%s is defined by %s", d.resource, strings.Join(d.sources, " and ")))
+		kept := 0
+		if mode == overlapKeepLast {
+			kept = len(d.indexes) - 1
+		}
+		for i, index := range d.indexes {
+			if i != kept {
+				dropped[index] = true
+			}
+		}
+		log.Printf("%s is defined by %s, keeping the definition of %s", d.resource, strings.Join(d.sources, " and "), d.sources[kept])
+	}
+	if len(overlaps) > 0 && mode == overlapFail {
+		return nil, fmt.Errorf("overlapping resources: %s", strings.Join(overlaps, "; "))
+	}
+	out := new(bytes.Buffer)
+	for i, k := range keys {
+		if dropped[i] {
+			continue
+		}
+		out.WriteString("---\n")
+		out.WriteString(split[k])
+		out.WriteString("\n")
+	}
+	return out, nil
+}
+
+// patchConflict matches the kube client error for a resource the upgrade could not patch, with the field the
+// API server rejected when it names one, e.g. an immutable field changed since the last release.
+var patchConflict = regexp.MustCompile(`cannot patch "([^"]+)" with kind (\w+): (?:[^:&]*? is invalid: ([^:&]+): )?`)
+
+// importConflict matches the upgrade error for a new release resource that already exists outside the release.
+var importConflict = regexp.MustCompile(`(\w+) "([^"]+)"(?: in namespace "([^"]+)")? exists and cannot be imported into the current release`)
+
+// upgradeConflictError names the resources, and fields where known, of a failed upgrade that conflict with their
+// live state in the cluster, with how to resolve the conflict. Other errors are returned unchanged.
+func upgradeConflictError(err error, name string, namespace string) error {
+	var hints []string
+	for _, m := range patchConflict.FindAllStringSubmatch(err.Error(), -1) {
+		resource := fmt.Sprintf("%s %q", m[2], m[1])
+		if m[3] != "" {
+			resource = fmt.Sprintf("%s field %s", resource, m[3])
+		}
+		hints = append(hints, fmt.Sprintf("%s conflicts with its live state, set the force helm flag to replace it", resource))
+	}
+	for _, m := range importConflict.FindAllStringSubmatch(err.Error(), -1) {
+		resource := fmt.Sprintf("%s %q", m[1], m[2])
+		if m[3] != "" {
+			resource = fmt.Sprintf("%s in namespace %q", resource, m[3])
+		}
+		hints = append(hints, fmt.Sprintf("%s is not part of release %s, to take ownership of it label it %s=Helm and annotate it %s=%s and %s=%s",
+			resource, name, "app.kubernetes.io/managed-by", "meta.helm.sh/release-name", name, "meta.helm.sh/release-namespace", namespace))
+	}
+	if len(hints) == 0 {
+		return err
+	}
+	return fmt.Errorf("%s: %s", strings.Join(hints, "; "), err)
+}
+
+// loadChart loads the chart, naming it in validation errors. A chart archive whose Chart.yaml
+// has no version gets the default version, and appVersion if that is missing too.
+func loadChart(cp string, defaultVersion *string, ignore chartIgnore) (*chart.Chart, error) {
+	fi, err := os.Stat(cp)
+	if err != nil {
+		return loader.Load(cp)
+	}
+	if fi.IsDir() {
+		return loadChartDir(cp, ignore)
+	}
+	f, err := os.Open(cp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	files, err := loader.LoadArchiveFiles(f)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(cp)
+	for _, file := range files {
+		if file.Name != "Chart.yaml" {
+			continue
+		}
+		md := &chart.Metadata{}
+		if err := yaml.Unmarshal(file.Data, md); err != nil {
+			return nil, fmt.Errorf("chart %s: %v", name, err)
+		}
+		if md.Name != "" {
+			name = md.Name
+		}
+		if md.Version != "" {
+			break
+		}
+		if IsZero(defaultVersion) {
+			return nil, fmt.Errorf("chart %s has no version in Chart.yaml, please set one or set DefaultChartVersion", name)
+		}
+		log.Printf("Chart %s has no version, using %s", name, *defaultVersion)
+		md.Version = *defaultVersion
+		if md.AppVersion == "" {
+			md.AppVersion = *defaultVersion
+		}
+		if file.Data, err = yaml.Marshal(md); err != nil {
+			return nil, fmt.Errorf("chart %s: %v", name, err)
+		}
+	}
+	ch, err := loader.LoadFiles(files)
+	if err != nil {
+		return nil, fmt.Errorf("chart %s: %v", name, err)
+	}
+	return ch, nil
+}
+
+// loadChartDir loads the chart directory without the files matched by its .helmignore. The ignore patterns
+// are added to the .helmignore rules, or replace them when the .helmignore is disabled. As helm only reads the
+// rules from the chart directory, the chart is loaded from a copy with the combined .helmignore in that case.
+func loadChartDir(dir string, ignore chartIgnore) (*chart.Chart, error) {
+	if err := checkChartSymlinks(dir, ignore.symlinks); err != nil {
+		return nil, err
+	}
+	if len(ignore.patterns) == 0 && !ignore.disabled {
+		return loader.LoadDir(dir)
+	}
+	var rules []byte
+	if !ignore.disabled {
+		data, err := ioutil.ReadFile(filepath.Join(dir, helmIgnoreFile))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		rules = append(data, '\n')
+	}
+	rules = append(rules, strings.Join(ignore.patterns, "\n")...)
+	tmp, err := ioutil.TempDir("", "chart")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(tmp, rel)
+		if fi.Mode()&os.ModeSymlink != 0 {
+			// Checked to resolve within the chart, the loader follows it into the chart directory
+			resolved, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				return err
+			}
+			resolved, err = filepath.Abs(resolved)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(resolved, target)
+		}
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, data, 0644)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, helmIgnoreFile), rules, 0644); err != nil {
+		return nil, err
+	}
+	return loader.LoadDir(tmp)
+}
+
+// checkChartSymlinks resolves the symlinks of the chart directory and rejects those pointing outside of it or to a
+// directory containing them, which the loader would follow. With the Reject mode any symlink is rejected.
+func checkChartSymlinks(dir string, mode string) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if root, err = filepath.Abs(root); err != nil {
+		return err
+	}
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if mode == chartSymlinksReject {
+			return fmt.Errorf("chart symlink %s is not allowed, set ChartSymlinks to %s to follow symlinks within the chart", rel, chartSymlinksResolve)
+		}
+		target, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return fmt.Errorf("chart symlink %s cannot be resolved: %v", rel, err)
+		}
+		if target, err = filepath.Abs(target); err != nil {
+			return err
+		}
+		if !pathWithin(root, target) {
+			return fmt.Errorf("chart symlink %s points outside the chart", rel)
+		}
+		parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if parent, err = filepath.Abs(parent); err != nil {
+			return err
+		}
+		if pathWithin(target, parent) {
+			return fmt.Errorf("chart symlink %s points to a directory containing it", rel)
+		}
+		return nil
+	})
+}
+
+// pathWithin returns whether the path is the directory or below it
+func pathWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// generateReleaseName lets helm generate the release name from the prefix, which may be a name template.
+func generateReleaseName(prefix string) (*string, error) {
+	client := action.NewInstall(&action.Configuration{})
+	client.GenerateName = true
+	client.NameTemplate = prefix + "-{{ now | unixEpoch }}"
+	name, _, err := client.NameAndChart([]string{prefix})
+	if err != nil {
+		return nil, genericError("Generate release name", err)
+	}
+	if err := chartutil.ValidateReleaseName(name); err != nil {
+		return nil, genericError("Generate release name", err)
+	}
+	return aws.String(name), nil
+}
+
+// checkAppVersion verifies the chart appVersion matches the expected value if one is set
+func checkAppVersion(ch *chart.Chart, expected *string) error {
+	if IsZero(expected) {
+		return nil
+	}
+	if ch.AppVersion() != *expected {
+		return fmt.Errorf("chart %s appVersion %q does not match expected appVersion %q", ch.Name(), ch.AppVersion(), *expected)
+	}
+	return nil
+}
+
+// checkChartAPIVersion verifies the chart and its subcharts declare the required apiVersion if one is set
+func checkChartAPIVersion(ch *chart.Chart, required *string) error {
+	if IsZero(required) {
+		return nil
+	}
+	if ch.Metadata.APIVersion != *required {
+		return fmt.Errorf("chart %s has apiVersion %q but apiVersion %q is required", ch.ChartFullPath(), ch.Metadata.APIVersion, *required)
+	}
+	for _, dep := range ch.Dependencies() {
+		if err := checkChartAPIVersion(dep, required); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyValuesProfile merges the user values over the named profile values file (values-<profile>.yaml) shipped in the chart
+func applyValuesProfile(ch *chart.Chart, profile *string, values map[string]interface{}) (map[string]interface{}, error) {
+	if IsZero(profile) {
+		return values, nil
+	}
+	name := fmt.Sprintf("values-%s.yaml", *profile)
+	for _, f := range ch.Files {
+		if f.Name != name {
+			continue
+		}
+		log.Printf("Using values profile %s from chart %s", name, ch.Name())
+		base, err := unmarshalValues(f.Data, "values profile "+name)
+		if err != nil {
+			return nil, err
+		}
+		return mergeMaps(base, values), nil
+	}
+	return nil, fmt.Errorf("values profile %s not found in chart %s", name, ch.Name())
+}
+
+// applyChartFileValues sets the value paths to the contents of the chart files, like helm --set-file
+// with the file paths resolved against the chart root instead of the working directory.
+func applyChartFileValues(ch *chart.Chart, files map[string]string, values map[string]interface{}) (map[string]interface{}, error) {
+	keys := make([]string, 0, len(files))
+	for key := range files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := path.Clean(filepath.ToSlash(files[key]))
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("chart file %s of value %s must be relative to the chart root", files[key], key)
+		}
+		data, ok := chartFile(ch, name)
+		if !ok {
+			return nil, fmt.Errorf("chart file %s of value %s not found in chart %s", files[key], key, ch.Name())
+		}
+		reader := func(rs []rune) (interface{}, error) {
+			return string(data), nil
+		}
+		if err := strvals.ParseIntoFile(key+"="+name, values, reader); err != nil {
+			return nil, fmt.Errorf("setting value %s from chart file %s: %s", key, files[key], err)
+		}
+	}
+	return values, nil
+}
+
+// checkDependencyConditions verifies that the condition of each chart dependency matches a value of the chart or
+// its subcharts, as helm keeps a dependency enabled when none of its condition paths is set, e.g. on a typo.
+func checkDependencyConditions(ch *chart.Chart, values map[string]interface{}) error {
+	cvals, err := chartutil.CoalesceValues(ch, values)
+	if err != nil {
+		return err
+	}
+	for _, dep := range ch.Metadata.Dependencies {
+		if strings.TrimSpace(dep.Condition) == "" {
+			continue
+		}
+		found := false
+		for _, p := range strings.Split(dep.Condition, ",") {
+			if _, err := cvals.PathValue(strings.TrimSpace(p)); err == nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("condition %s of dependency %s in chart %s does not match any value", dep.Condition, dep.Name, ch.Name())
+		}
+	}
+	return nil
+}
+
+// checkValueTypes verifies that the values set the same kind of value, a map, a list, a string, a boolean or a number,
+// as the defaults of the chart and its subcharts, listing the conflicting paths. Helm skips or replaces the defaults on
+// such conflicts, e.g. a string set over a map of image settings, which templates then fail on or silently ignore.
+func checkValueTypes(ch *chart.Chart, values map[string]interface{}) error {
+	var conflicts []string
+	collectValueTypeConflicts(ch, values, "", &conflicts)
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return fmt.Errorf("values conflict with the types of the chart defaults: %s", strings.Join(conflicts, ", "))
+	}
+	return nil
+}
+
+// collectValueTypeConflicts adds the paths of the values whose kind differs from the default of the chart, then
+// checks the values of each subchart against its own defaults.
+func collectValueTypeConflicts(ch *chart.Chart, values map[string]interface{}, prefix string, conflicts *[]string) {
+	compareValueTypes(values, ch.Values, prefix, conflicts)
+	for _, sub := range ch.Dependencies() {
+		if v, ok := values[sub.Name()].(map[string]interface{}); ok {
+			collectValueTypeConflicts(sub, v, prefix+sub.Name()+".", conflicts)
+		}
+	}
+}
+
+// compareValueTypes adds the paths of the values whose kind differs from the default at the same path, descending
+// into the maps set on both sides. Null values and values without a default are not conflicts.
+func compareValueTypes(values, defaults map[string]interface{}, prefix string, conflicts *[]string) {
+	for k, v := range values {
+		d, ok := defaults[k]
+		if !ok || v == nil || d == nil {
+			continue
+		}
+		vk, dk := valueKind(v), valueKind(d)
+		if vk != dk {
+			*conflicts = append(*conflicts, fmt.Sprintf("%s%s is a %s, the chart default is a %s", prefix, k, vk, dk))
+			continue
+		}
+		if vk == "map" {
+			compareValueTypes(v.(map[string]interface{}), d.(map[string]interface{}), prefix+k+".", conflicts)
+		}
+	}
+}
+
+// valueKind returns the kind of the value as named in the type conflicts
+func valueKind(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "map"
+	case []interface{}:
+		return "list"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// chartFile returns the data of the chart file at the path relative to the chart root
+func chartFile(ch *chart.Chart, name string) ([]byte, bool) {
+	for _, files := range [][]*chart.File{ch.Raw, ch.Files, ch.Templates} {
+		for _, f := range files {
+			if f.Name == name {
+				return f.Data, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// applyHelmFlags applies the supported helm flags to the install or upgrade action
+func applyHelmFlags(client interface{}, flags map[string]string) error {
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var err error
+		switch c := client.(type) {
+		case *action.Install:
+			err = setInstallFlag(c, name, flags[name])
+		case *action.Upgrade:
+			err = setUpgradeFlag(c, name, flags[name])
+		default:
+			err = fmt.Errorf("helm flags are not supported for %T", client)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setInstallFlag(client *action.Install, name string, value string) error {
+	switch name {
+	case "atomic":
+		return parseBoolFlag(name, value, &client.Atomic)
+	case "disable-openapi-validation":
+		return parseBoolFlag(name, value, &client.DisableOpenAPIValidation)
+	case "no-hooks":
+		return parseBoolFlag(name, value, &client.DisableHooks)
+	case "skip-crds":
+		return parseBoolFlag(name, value, &client.SkipCRDs)
+	case "timeout":
+		return parseDurationFlag(name, value, &client.Timeout)
+	case "wait":
+		return parseBoolFlag(name, value, &client.Wait)
+	}
+	return fmt.Errorf("unsupported helm flag %q for install", name)
+}
+
+func setUpgradeFlag(client *action.Upgrade, name string, value string) error {
+	switch name {
+	case "atomic":
+		return parseBoolFlag(name, value, &client.Atomic)
+	case "cleanup-on-fail":
+		return parseBoolFlag(name, value, &client.CleanupOnFail)
+	case "disable-openapi-validation":
+		return parseBoolFlag(name, value, &client.DisableOpenAPIValidation)
+	case "force":
+		return parseBoolFlag(name, value, &client.Force)
+	case "max-history":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q for helm flag %q", value, name)
+		}
+		client.MaxHistory = v
+		return nil
+	case "no-hooks":
+		return parseBoolFlag(name, value, &client.DisableHooks)
+	case "skip-crds":
+		return parseBoolFlag(name, value, &client.SkipCRDs)
+	case "timeout":
+		return parseDurationFlag(name, value, &client.Timeout)
+	case "wait":
+		return parseBoolFlag(name, value, &client.Wait)
+	}
+	return fmt.Errorf("unsupported helm flag %q for upgrade", name)
+}
+
+func parseBoolFlag(name string, value string, field *bool) error {
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid value %q for helm flag %q", value, name)
+	}
+	*field = v
+	return nil
+}
+
+func parseDurationFlag(name string, value string, field *time.Duration) error {
+	v, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid value %q for helm flag %q", value, name)
+	}
+	*field = v
+	return nil
+}
+
+// releaseAnnotations returns the annotations to apply to the release resources. The request and stack ID
+// annotations take precedence over the common annotations.
+func releaseAnnotations(config *Config) map[string]string {
+	a := map[string]string{}
+	for k, v := range config.CommonAnnotations {
+		a[k] = v
+	}
+	if !IsZero(config.OperationID) {
+		a[OperationIDAnnotation] = *config.OperationID
+	}
+	if !IsZero(config.StackID) {
+		a[StackIDAnnotation] = *config.StackID
+	}
+	return a
+}
+
+// checkReleaseOwner verifies the existing release is owned by the incoming stack, unless the ownership override is set.
+// Releases without a stack ID recorded in their chart metadata have no owner.
+func (c *Clients) checkReleaseOwner(name string, config *Config) error {
+	if IsZero(config.StackID) {
+		return nil
+	}
+	rel, err := c.HelmClient.Releases.Last(name)
+	if err != nil {
+		return err
+	}
+	owner := releaseStackID(rel)
+	if owner == "" || owner == *config.StackID {
+		return nil
+	}
+	if aws.BoolValue(config.OverrideOwnership) {
+		log.Printf("Release %s is owned by stack %s. Overriding ownership for stack %s", name, owner, *config.StackID)
+		return nil
+	}
+	return fmt.Errorf("release %s owned by another stack %s", name, owner)
+}
+
+// checkExternallyManaged refuses to mutate a release whose resources carry the externally managed annotation,
+// unless the override is set. The annotation is disabled by setting its value to false.
+func (c *Clients) checkExternallyManaged(name string, config *Config) error {
+	key := ExternallyManagedAnnotation
+	if config != nil && !IsZero(config.ExternallyManagedAnnotation) {
+		key = *config.ExternallyManagedAnnotation
+	}
+	rel, err := c.HelmClient.Releases.Last(name)
+	if err != nil {
+		if errors.Cause(err) == driver.ErrReleaseNotFound {
+			return nil
+		}
+		return err
+	}
+	for _, m := range releaseutil.SplitManifests(rel.Manifest) {
+		obj := map[string]interface{}{}
+		if err := yaml.Unmarshal([]byte(m), &obj); err != nil {
+			continue
+		}
+		metadata, _ := obj["metadata"].(map[string]interface{})
+		annotations, _ := metadata["annotations"].(map[string]interface{})
+		v, ok := annotations[key]
+		if !ok || strings.EqualFold(strings.TrimSpace(fmt.Sprint(v)), "false") {
+			continue
+		}
+		if config != nil && aws.BoolValue(config.OverrideExternallyManaged) {
+			log.Printf("Release %s is annotated %s. Overriding the externally managed guard", name, key)
+			return nil
+		}
+		return fmt.Errorf("release %s is externally managed, its resources are annotated %s. Set OverrideExternallyManaged to update or delete it", name, key)
+	}
+	return nil
+}
+
+// releaseStackID returns the stack ID recorded in the release chart metadata
+func releaseStackID(rel *release.Release) string {
+	if rel.Chart == nil || rel.Chart.Metadata == nil {
+		return ""
+	}
+	return rel.Chart.Metadata.Annotations[StackIDAnnotation]
+}
+
+// manifestResources lists the kind, name and namespace of the objects in the release manifest without their data
+func manifestResources(manifest string, namespace string) map[string]interface{} {
+	manifests := releaseutil.SplitManifests(manifest)
+	keys := make([]string, 0, len(manifests))
+	for k := range manifests {
+		keys = append(keys, k)
+	}
+	sort.Sort(releaseutil.BySplitManifestsOrder(keys))
+	resources := map[string]interface{}{}
+	for _, k := range keys {
+		if checkSize(resources, ResourcesOutputSize) {
+			break
+		}
+		obj := map[string]interface{}{}
+		if err := yaml.Unmarshal([]byte(manifests[k]), &obj); err != nil {
+			continue
+		}
+		kind, _ := obj["kind"].(string)
+		metadata, _ := obj["metadata"].(map[string]interface{})
+		name, _ := metadata["name"].(string)
+		if kind == "" || name == "" {
+			continue
+		}
+		ns, ok := metadata["namespace"].(string)
+		if !ok {
+			ns = namespace
+		}
+		if resources[kind] == nil {
+			resources[kind] = map[string]interface{}{}
+		}
+		resources[kind].(map[string]interface{})[name] = map[string]interface{}{"Namespace": ns}
+	}
+	return resources
+}
+
+// Run adds the annotations and labels to each of the rendered manifests
+func (p *annotationPostRenderer) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	manifests := releaseutil.SplitManifests(renderedManifests.String())
+	keys := make([]string, 0, len(manifests))
+	for k := range manifests {
+		keys = append(keys, k)
+	}
+	sort.Sort(releaseutil.BySplitManifestsOrder(keys))
+	out := new(bytes.Buffer)
+	for _, k := range keys {
+		obj := map[string]interface{}{}
+		if err := yaml.Unmarshal([]byte(manifests[k]), &obj); err != nil {
+			return nil, genericError("Annotating manifest", err)
+		}
+		if len(obj) == 0 {
+			continue
+		}
+		metadata, ok := obj["metadata"].(map[string]interface{})
+		if !ok {
+			metadata = map[string]interface{}{}
+		}
+		for field, entries := range map[string]map[string]string{"annotations": p.annotations, "labels": p.labels} {
+			if len(entries) == 0 {
+				continue
+			}
+			m, ok := metadata[field].(map[string]interface{})
+			if !ok {
+				m = map[string]interface{}{}
+			}
+			for k, v := range entries {
+				m[k] = v
+			}
+			metadata[field] = m
+		}
+		obj["metadata"] = metadata
+		b, err := yaml.Marshal(obj)
+		if err != nil {
+			return nil, genericError("Annotating manifest", err)
+		}
+		out.WriteString("---\n")
+		out.Write(b)
+	}
+	return out, nil
+}
+
+// Run handles the overlapping resources of the rendered manifests, then runs the next post renderer if any
+func (p *overlapPostRenderer) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	out, err := overlappingResources(renderedManifests.String(), p.namespace, p.mode)
+	if err != nil {
+		return nil, genericError("Checking overlapping resources", err)
+	}
+	if p.next != nil {
+		return p.next.Run(out)
+	}
+	return out, nil
+}
+
+// Run checks the permissions for the manifests rendered by the next post renderer, if any
+func (p *permissionPostRenderer) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	if p.next != nil {
+		var err error
+		if renderedManifests, err = p.next.Run(renderedManifests); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.clients.checkPermissions(renderedManifests.String(), p.namespace, p.verbs); err != nil {
+		return nil, genericError("Checking permissions", err)
+	}
+	return renderedManifests, nil
 }
@@ -1,15 +1,50 @@
 package resource
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"helm.sh/helm/v3/pkg/cli"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/kube"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/provenance"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
 	"helm.sh/helm/v3/pkg/repo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8sversion "k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	restfake "k8s.io/client-go/rest/fake"
+	"k8s.io/kubectl/pkg/scheme"
+	"sigs.k8s.io/yaml"
 )
 
 func TestHelmClientInvoke(t *testing.T) {
@@ -64,63 +99,1904 @@ func TestAddHelmRepoUpdate(t *testing.T) {
 	}
 }
 
+// TestAddHelmRepoConflict to test a repository entry with the same name and another URL is updated, and the entries
+// of earlier invocations are neither kept nor refreshed
+func TestAddHelmRepoConflict(t *testing.T) {
+	idx := repo.NewIndexFile()
+	idx.Add(&chart.Metadata{APIVersion: chart.APIVersionV2, Name: "hello", Version: "0.1.0"}, "hello-0.1.0.tgz", "", "")
+	b, err := yaml.Marshal(idx)
+	assert.Nil(t, err)
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		_, _ = w.Write(b)
+	}))
+	defer ts.Close()
+	tests := map[string]struct {
+		existing string
+		stale    bool
+	}{
+		"NoEntry":  {},
+		"SameURL":  {existing: ts.URL},
+		"Conflict": {existing: "https://old.example.com/charts", stale: true},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			requests = nil
+			c := NewMockClient(t, nil)
+			dir, err := ioutil.TempDir("", "repo")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+			c.Settings.RepositoryConfig = filepath.Join(dir, "repositories.yaml")
+			c.Settings.RepositoryCache = filepath.Join(dir, "cache")
+			assert.Nil(t, os.MkdirAll(c.Settings.RepositoryCache, 0755))
+			f := repo.NewFile()
+			f.Update(&repo.Entry{Name: "other", URL: ts.URL + "/other"})
+			if d.existing != "" {
+				f.Update(&repo.Entry{Name: "myrepo", URL: d.existing})
+			}
+			assert.Nil(t, f.WriteFile(c.Settings.RepositoryConfig, 0644))
+			stale := filepath.Join(c.Settings.RepositoryCache, helmpath.CacheChartsFile("myrepo"))
+			if d.stale {
+				assert.Nil(t, ioutil.WriteFile(stale, []byte("stale\n"), 0644))
+			}
+			err = addHelmRepoUpdate("myrepo", ts.URL, "", "", false, false, c.Settings)
+			assert.Nil(t, err)
+			r, err := repo.LoadFile(c.Settings.RepositoryConfig)
+			assert.Nil(t, err)
+			assert.Len(t, r.Repositories, 1)
+			assert.Equal(t, ts.URL, r.Get("myrepo").URL)
+			assert.Equal(t, []string{"/index.yaml"}, requests)
+			charts, err := ioutil.ReadFile(stale)
+			assert.Nil(t, err)
+			assert.Equal(t, "hello\n", string(charts))
+			_, err = repo.LoadIndexFile(filepath.Join(c.Settings.RepositoryCache, helmpath.CacheIndexFile("myrepo")))
+			assert.Nil(t, err)
+		})
+	}
+}
+
+// TestLocateChart to test locateChart against a fresh helm home
+func TestLocateChart(t *testing.T) {
+	ch, err := loader.Load(TestFolder + "/test.tgz")
+	assert.Nil(t, err)
+	tgz, err := ioutil.ReadFile(TestFolder + "/test.tgz")
+	assert.Nil(t, err)
+	var b []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.yaml":
+			_, _ = w.Write(b)
+		case "/test.tgz":
+			_, _ = w.Write(tgz)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	idx := repo.NewIndexFile()
+	idx.Add(ch.Metadata, "test.tgz", ts.URL, "")
+	b, err = yaml.Marshal(idx)
+	assert.Nil(t, err)
+	c := NewMockClient(t, nil)
+	dir, err := ioutil.TempDir("", "helmhome")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	c.Settings.RepositoryConfig = filepath.Join(dir, "config", "repositories.yaml")
+	c.Settings.RepositoryCache = filepath.Join(dir, "cache")
+	chartName := "fresh/" + ch.Metadata.Name
+	chartDetails := &Chart{
+		Chart:              aws.String(chartName),
+		ChartRepo:          aws.String("fresh"),
+		ChartRepoURL:       aws.String(ts.URL),
+		ChartVersion:       aws.String(ch.Metadata.Version),
+		ChartSkipTLSVerify: aws.Bool(false),
+		ChartLocalCA:       aws.Bool(false),
+	}
+	for i := 0; i < 2; i++ {
+		opts := &action.ChartPathOptions{}
+		cp, err := c.locateChart(opts, chartDetails)
+		assert.Nil(t, err)
+		assert.Equal(t, ch.Metadata.Version, opts.Version)
+		located, err := loader.Load(cp)
+		assert.Nil(t, err)
+		assert.Equal(t, ch.Metadata.Name, located.Metadata.Name)
+		r, err := repo.LoadFile(c.Settings.RepositoryConfig)
+		assert.Nil(t, err)
+		assert.Len(t, r.Repositories, 1)
+		assert.Equal(t, ts.URL, r.Get("fresh").URL)
+	}
+	chartDetails.Chart = aws.String("fresh/missing")
+	_, err = c.locateChart(&action.ChartPathOptions{}, chartDetails)
+	assert.NotNil(t, err)
+}
+
+// TestLocateChartMirrors to test the chart is located from the next mirror when the repository is down
+func TestLocateChartMirrors(t *testing.T) {
+	ch, err := loader.Load(TestFolder + "/test.tgz")
+	assert.Nil(t, err)
+	tgz, err := ioutil.ReadFile(TestFolder + "/test.tgz")
+	assert.Nil(t, err)
+	var b []byte
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.yaml":
+			_, _ = w.Write(b)
+		case "/test.tgz":
+			_, _ = w.Write(tgz)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mirror.Close()
+	idx := repo.NewIndexFile()
+	idx.Add(ch.Metadata, "test.tgz", mirror.URL, "")
+	b, err = yaml.Marshal(idx)
+	assert.Nil(t, err)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	tests := map[string]struct {
+		url         string
+		mirrors     []string
+		expectedURL string
+		expectedErr string
+	}{
+		"PrimaryUp": {
+			url:         mirror.URL,
+			mirrors:     []string{down.URL},
+			expectedURL: mirror.URL,
+		},
+		"PrimaryDown": {
+			url:         down.URL,
+			mirrors:     []string{mirror.URL},
+			expectedURL: mirror.URL,
+		},
+		"FirstMirrorDown": {
+			url:         down.URL,
+			mirrors:     []string{down.URL + "/mirror", mirror.URL},
+			expectedURL: mirror.URL,
+		},
+		"AllDown": {
+			url:         down.URL,
+			mirrors:     []string{down.URL + "/mirror"},
+			expectedErr: "is not a valid chart repository or cannot be reached",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewMockClient(t, nil)
+			dir, err := ioutil.TempDir("", "helmhome")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+			c.Settings.RepositoryConfig = filepath.Join(dir, "config", "repositories.yaml")
+			c.Settings.RepositoryCache = filepath.Join(dir, "cache")
+			cp, err := c.locateChart(&action.ChartPathOptions{}, &Chart{
+				Chart:              aws.String("mirrored/" + ch.Metadata.Name),
+				ChartRepo:          aws.String("mirrored"),
+				ChartRepoURL:       aws.String(d.url),
+				ChartRepoMirrors:   d.mirrors,
+				ChartSkipTLSVerify: aws.Bool(false),
+				ChartLocalCA:       aws.Bool(false),
+			})
+			if d.expectedErr != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), d.expectedErr)
+				return
+			}
+			assert.Nil(t, err)
+			located, err := loader.Load(cp)
+			assert.Nil(t, err)
+			assert.Equal(t, ch.Metadata.Name, located.Metadata.Name)
+			r, err := repo.LoadFile(c.Settings.RepositoryConfig)
+			assert.Nil(t, err)
+			assert.Equal(t, d.expectedURL, r.Get("mirrored").URL)
+		})
+	}
+}
+
+// TestLocateChartFallbackVersion to test a lower version is located when the requested version is missing
+func TestLocateChartFallbackVersion(t *testing.T) {
+	tgz, err := ioutil.ReadFile(TestFolder + "/test.tgz")
+	assert.Nil(t, err)
+	var b []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.yaml":
+			_, _ = w.Write(b)
+		case "/test.tgz":
+			_, _ = w.Write(tgz)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	idx := repo.NewIndexFile()
+	for _, v := range []string{"1.0.0", "1.1.0", "2.0.0"} {
+		idx.Add(&chart.Metadata{APIVersion: chart.APIVersionV2, Name: "web", Version: v}, "test.tgz", ts.URL, "")
+	}
+	b, err = yaml.Marshal(idx)
+	assert.Nil(t, err)
+	tests := map[string]struct {
+		version     string
+		fallback    *string
+		expected    string
+		expectedErr string
+	}{
+		"Present": {
+			version:  "1.1.0",
+			fallback: aws.String("*"),
+			expected: "1.1.0",
+		},
+		"NearestLower": {
+			version:  "1.2.0",
+			fallback: aws.String("*"),
+			expected: "1.1.0",
+		},
+		"Constraint": {
+			version:  "1.2.0",
+			fallback: aws.String("~1.0.0"),
+			expected: "1.0.0",
+		},
+		"NoMatch": {
+			version:     "1.2.0",
+			fallback:    aws.String(">=2.0.0"),
+			expectedErr: "chart fallback/web version 1.2.0 not found in repository fallback and no lower version matches FallbackVersion >=2.0.0",
+		},
+		"NoFallback": {
+			version:     "1.2.0",
+			expectedErr: `failed to download "fallback/web" at version "1.2.0"`,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewMockClient(t, nil)
+			dir, err := ioutil.TempDir("", "helmhome")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+			c.Settings.RepositoryConfig = filepath.Join(dir, "config", "repositories.yaml")
+			c.Settings.RepositoryCache = filepath.Join(dir, "cache")
+			opts := &action.ChartPathOptions{}
+			_, err = c.locateChart(opts, &Chart{
+				Chart:                aws.String("fallback/web"),
+				ChartName:            aws.String("web"),
+				ChartRepo:            aws.String("fallback"),
+				ChartRepoURL:         aws.String(ts.URL),
+				ChartVersion:         aws.String(d.version),
+				ChartFallbackVersion: d.fallback,
+				ChartSkipTLSVerify:   aws.Bool(false),
+				ChartLocalCA:         aws.Bool(false),
+			})
+			if d.expectedErr != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), d.expectedErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, d.expected, opts.Version)
+		})
+	}
+}
+
+// TestCheckHelmDirs to test checkHelmDirs
+func TestCheckHelmDirs(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "helmdirs")
+	defer os.RemoveAll(dir)
+	// A regular file in the path makes the directories below it non writable, even for root.
+	blocked := filepath.Join(dir, "blocked")
+	_ = ioutil.WriteFile(blocked, []byte{}, 0400)
+	tmpDir := os.Getenv("TMPDIR")
+	defer os.Setenv("TMPDIR", tmpDir)
+	tests := map[string]struct {
+		config      string
+		cache       string
+		tmpDir      string
+		eConfig     string
+		eCache      string
+		expectedErr *string
+	}{
+		"Writable": {
+			config:  filepath.Join(dir, "config", "repositories.yaml"),
+			cache:   filepath.Join(dir, "cache"),
+			tmpDir:  dir,
+			eConfig: filepath.Join(dir, "config", "repositories.yaml"),
+			eCache:  filepath.Join(dir, "cache"),
+		},
+		"Fallback": {
+			config:  filepath.Join(blocked, "config", "repositories.yaml"),
+			cache:   filepath.Join(blocked, "cache"),
+			tmpDir:  dir,
+			eConfig: filepath.Join(dir, "helm", "config", "repositories.yaml"),
+			eCache:  filepath.Join(dir, "helm", "cache"),
+		},
+		"NotWritable": {
+			config:      filepath.Join(blocked, "config", "repositories.yaml"),
+			cache:       filepath.Join(blocked, "cache"),
+			tmpDir:      blocked,
+			expectedErr: aws.String("repository config directory is not writable"),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			os.Setenv("TMPDIR", d.tmpDir)
+			settings := cli.New()
+			settings.RepositoryConfig = d.config
+			settings.RepositoryCache = d.cache
+			err := checkHelmDirs(settings)
+			if d.expectedErr != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, d.eConfig, settings.RepositoryConfig)
+				assert.Equal(t, d.eCache, settings.RepositoryCache)
+			}
+		})
+	}
+}
+
 // TestHelmInstall to test HelmInstall
 func TestHelmInstall(t *testing.T) {
-	defer os.Remove(chartLocalPath)
 	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
 	defer func() { testServer.Close() }()
 	c := NewMockClient(t, nil)
 	tests := map[string]struct {
-		m           *Model
-		config      *Config
-		vals        map[string]interface{}
+		m           *Model
+		config      *Config
+		vals        map[string]interface{}
+		expectedErr *string
+	}{
+		"HTTPRepo": {
+			m: &Model{Chart: aws.String(testServer.URL + "/test.tgz")},
+			config: &Config{
+				Name:      aws.String("httprepo"),
+				Namespace: aws.String("default"),
+			},
+		},
+		"WrongChartFile": {
+			m: &Model{Chart: aws.String(testServer.URL + "/testt.tgz")},
+			config: &Config{
+				Name:      aws.String("test"),
+				Namespace: aws.String("default"),
+			},
+			expectedErr: aws.String("At Downloading file"),
+		},
+		"RemoteRepo": {
+			m: &Model{Chart: aws.String("stable/coscale")},
+			config: &Config{
+				Name:      aws.String("remoterepo"),
+				Namespace: aws.String("default"),
+			},
+		},
+		"WrongRemoteRepo": {
+			m: &Model{Chart: aws.String("test/test")},
+			config: &Config{
+				Name:      aws.String("test"),
+				Namespace: aws.String("default"),
+			},
+			expectedErr: aws.String("failed to download"),
+		},
+		"Dependency": {
+			m: &Model{Chart: aws.String(testServer.URL + "/dep-0.1.0.tgz")},
+			config: &Config{
+				Name:      aws.String("dependency"),
+				Namespace: aws.String("default"),
+			},
+		},
+		"ExpectedAppVersion": {
+			m: &Model{Chart: aws.String(testServer.URL + "/dep-0.1.0.tgz"), ExpectedAppVersion: aws.String("1.16.0")},
+			config: &Config{
+				Name:      aws.String("appversion"),
+				Namespace: aws.String("default"),
+			},
+		},
+		"WrongExpectedAppVersion": {
+			m: &Model{Chart: aws.String(testServer.URL + "/dep-0.1.0.tgz"), ExpectedAppVersion: aws.String("2.0.0")},
+			config: &Config{
+				Name:      aws.String("wrongappversion"),
+				Namespace: aws.String("default"),
+			},
+			expectedErr: aws.String("does not match expected appVersion"),
+		},
+	}
+
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			ch, _ := c.getChartDetails(d.m)
+			err := c.HelmInstall(d.config, d.vals, ch, "mock-id")
+			if err != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+			}
+		})
+	}
+}
+
+// TestHelmInstallOperationID to test the operation ID annotation on HelmInstall
+func TestHelmInstallOperationID(t *testing.T) {
+	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
+	defer func() { testServer.Close() }()
+	c := NewMockClient(t, nil)
+	ch, _ := c.getChartDetails(&Model{Chart: aws.String(testServer.URL + "/dep-0.1.0.tgz")})
+	config := &Config{
+		Name:        aws.String("operationid"),
+		Namespace:   aws.String("default"),
+		OperationID: aws.String("test-operation-id"),
+	}
+	err := c.HelmInstall(config, nil, ch, "mock-id")
+	assert.Nil(t, err)
+	rel, err := c.HelmClient.Releases.Last("operationid")
+	assert.Nil(t, err)
+	assert.Contains(t, rel.Manifest, OperationIDAnnotation+": test-operation-id")
+}
+
+// flakyKubeClient builds the manifests as a config map not found in the cluster and fails its first creates with the
+// error, then creates it
+type flakyKubeClient struct {
+	kubefake.FailingKubeClient
+	failures int
+	err      error
+	creates  int
+}
+
+// Build returns a config map the cluster does not have, so the install creates it
+func (f *flakyKubeClient) Build(_ io.Reader, _ bool) (kube.ResourceList, error) {
+	client := &restfake.RESTClient{
+		NegotiatedSerializer: scheme.Codecs.WithoutConversion(),
+		Resp:                 &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewBufferString(""))},
+	}
+	return kube.ResourceList{{
+		Name:      "retry",
+		Namespace: "default",
+		Client:    client,
+		Mapping:   &meta.RESTMapping{Resource: schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}, Scope: meta.RESTScopeNamespace},
+		Object:    &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "retry", Namespace: "default"}},
+	}}, nil
+}
+
+// Create fails while failures remain, otherwise it prints the resources
+func (f *flakyKubeClient) Create(resources kube.ResourceList) (*kube.Result, error) {
+	f.creates++
+	if f.creates <= f.failures {
+		return nil, f.err
+	}
+	return f.FailingKubeClient.Create(resources)
+}
+
+// TestHelmInstallRetry to test an install failing with a retryable error is removed, keeping the release lock for
+// the retry of a later callback
+func TestHelmInstallRetry(t *testing.T) {
+	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
+	defer testServer.Close()
+	webhookErr := errors.New(`Internal error occurred: failed calling webhook "validate.nginx.ingress.kubernetes.io": Post "https://ingress-nginx-controller-admission.ingress-nginx.svc:443/networking/v1beta1/ingresses?timeout=10s": dial tcp 10.100.12.9:443: connect: connection refused`)
+	tests := map[string]struct {
+		retryable []string
+		eLocked   bool
+	}{
+		"Retryable": {
+			retryable: []string{"failed calling webhook"},
+			eLocked:   true,
+		},
+		"NotRetryable": {
+			retryable: []string{"the server is currently unable to handle the request"},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewMockClient(t, nil)
+			kc := &flakyKubeClient{
+				FailingKubeClient: kubefake.FailingKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: ioutil.Discard}},
+				failures:          1,
+				err:               webhookErr,
+			}
+			c.HelmClient.KubeClient = kc
+			ch, err := c.getChartDetails(&Model{Chart: aws.String(testServer.URL + "/dep-0.1.0.tgz")})
+			assert.Nil(t, err)
+			config := &Config{Name: aws.String("retry"), Namespace: aws.String("default"), RetryableErrors: d.retryable, OperationID: aws.String("op-1")}
+			err = c.HelmInstall(config, nil, ch, "mock-id")
+			assert.NotNil(t, err)
+			assert.Contains(t, err.Error(), "failed calling webhook")
+			assert.Equal(t, 1, kc.creates)
+			_, err = c.ClientSet.CoreV1().ConfigMaps("default").Get(context.Background(), releaseLockPrefix+"retry", metav1.GetOptions{})
+			assert.Equal(t, d.eLocked, err == nil)
+			if !d.eLocked {
+				return
+			}
+			_, err = c.HelmClient.Releases.Last("retry")
+			assert.NotNil(t, err)
+
+			// The retry of the next callback installs the release
+			assert.Nil(t, c.HelmInstall(config, nil, ch, "mock-id"))
+			assert.Equal(t, 2, kc.creates)
+			rel, err := c.HelmClient.Releases.Last("retry")
+			assert.Nil(t, err)
+			assert.Equal(t, release.StatusDeployed, rel.Info.Status)
+			assert.Equal(t, 1, rel.Version)
+		})
+	}
+}
+
+// TestDiffManifests to test the resources added, changed and removed by the rendered manifest
+func TestDiffManifests(t *testing.T) {
+	deployed := `---
+# Source: test/templates/cm.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: same
+  annotations:
+    awsqs.kubernetes.helm/operation-id: op-1
+data:
+  a: "1"
+---
+# Source: test/templates/changed.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: changed
+data:
+  a: "1"
+---
+# Source: test/templates/svc.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: removed
+`
+	rendered := `---
+# Source: test/templates/cm.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: same
+  annotations:
+    awsqs.kubernetes.helm/operation-id: op-2
+data:
+  a: "1"
+---
+# Source: test/templates/changed.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: changed
+data:
+  a: "2"
+---
+# Source: test/templates/deploy.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: added
+`
+	assert.Equal(t, []string{"~ ConfigMap/changed", "+ Deployment/added", "- Service/removed"}, diffManifests(deployed, rendered))
+	assert.Nil(t, diffManifests(deployed, deployed))
+}
+
+// TestHelmChartDigest to test the chart digest recorded on the release and returned on Read
+func TestHelmChartDigest(t *testing.T) {
+	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
+	defer testServer.Close()
+	c := NewMockClient(t, nil)
+	expected, err := provenance.DigestFile(TestFolder + "/dep-0.1.0.tgz")
+	assert.Nil(t, err)
+	ch, _ := c.getChartDetails(&Model{Chart: aws.String(testServer.URL + "/dep-0.1.0.tgz")})
+	config := &Config{Name: aws.String("digest"), Namespace: aws.String("default")}
+	assert.Nil(t, c.HelmInstall(config, nil, ch, "mock-id"))
+	s, err := c.HelmStatus("digest")
+	assert.Nil(t, err)
+	assert.Equal(t, expected, s.ChartDigest)
+	m := &Model{}
+	assert.Nil(t, c.setReleaseAttributes(m, s))
+	assert.Equal(t, expected, aws.StringValue(m.ResolvedChartDigest))
+	assert.Equal(t, "0.1.0", aws.StringValue(m.ResolvedChartVersion))
+}
+
+// TestPinChartVersion to test pinChartVersion
+func TestPinChartVersion(t *testing.T) {
+	s := &HelmStatusData{ChartName: "nginx", ChartVersion: "1.2.3", ChartDigest: "abc"}
+	tests := map[string]struct {
+		chart    *Chart
+		eVersion *string
+		eDigest  *string
+	}{
+		"MovingVersion": {
+			chart:    &Chart{ChartType: aws.String("Remote"), ChartName: aws.String("nginx")},
+			eVersion: aws.String("1.2.3"),
+			eDigest:  aws.String("abc"),
+		},
+		"ExplicitVersion": {
+			chart:    &Chart{ChartType: aws.String("Remote"), ChartName: aws.String("nginx"), ChartVersion: aws.String("2.0.0")},
+			eVersion: aws.String("2.0.0"),
+		},
+		"ExplicitDigest": {
+			chart:    &Chart{ChartType: aws.String("Remote"), ChartName: aws.String("nginx"), ChartDigest: aws.String("def")},
+			eVersion: aws.String("1.2.3"),
+			eDigest:  aws.String("def"),
+		},
+		"OtherChart": {
+			chart: &Chart{ChartType: aws.String("Remote"), ChartName: aws.String("redis")},
+		},
+		"URLChart": {
+			chart: &Chart{ChartType: aws.String("Local"), ChartName: aws.String("nginx")},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			pinChartVersion(d.chart, s)
+			assert.EqualValues(t, d.eVersion, d.chart.ChartVersion)
+			assert.EqualValues(t, d.eDigest, d.chart.ChartDigest)
+		})
+	}
+}
+
+// TestHelmSkipHooks to test SkipHooks on HelmInstall and HelmUpgrade
+func TestHelmSkipHooks(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "hooks")
+	defer os.RemoveAll(dir)
+	hook := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: seed\n  annotations:\n    \"helm.sh/hook\": %s\n"
+	ch := buildChart(func(o *chartOptions) {
+		o.Templates = []*chart.File{
+			{Name: "templates/install.yaml", Data: []byte(fmt.Sprintf(hook, "post-install"))},
+			{Name: "templates/upgrade.yaml", Data: []byte(fmt.Sprintf(hook, "post-upgrade"))},
+		}
+	})
+	archive, err := chartutil.Save(ch, dir)
+	assert.Nil(t, err)
+	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(dir))))
+	defer testServer.Close()
+	tests := map[string]struct {
+		skipHooks   *string
+		installRuns bool
+		upgradeRuns bool
+	}{
+		"Default": {
+			installRuns: true,
+			upgradeRuns: true,
+		},
+		"SkipUpgrade": {
+			skipHooks:   aws.String("Upgrade"),
+			installRuns: true,
+		},
+		"SkipInstall": {
+			skipHooks:   aws.String("Install"),
+			upgradeRuns: true,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewMockClient(t, nil)
+			cd, err := c.getChartDetails(&Model{Chart: aws.String(testServer.URL + "/" + filepath.Base(archive))})
+			assert.Nil(t, err)
+			config := &Config{Name: aws.String("hooks"), Namespace: aws.String("default"), SkipHooks: d.skipHooks}
+			assert.Nil(t, c.HelmInstall(config, nil, cd, "mock-id"))
+			rel, err := c.HelmClient.Releases.Last("hooks")
+			assert.Nil(t, err)
+			assert.EqualValues(t, d.installRuns, hookRan(rel, release.HookPostInstall))
+			assert.Nil(t, c.HelmUpgrade("hooks", config, nil, cd, "mock-id"))
+			rel, err = c.HelmClient.Releases.Last("hooks")
+			assert.Nil(t, err)
+			assert.EqualValues(t, d.upgradeRuns, hookRan(rel, release.HookPostUpgrade))
+		})
+	}
+}
+
+// hookRan checks whether the release ran a hook for the event.
+func hookRan(rel *release.Release, event release.HookEvent) bool {
+	for _, h := range rel.Hooks {
+		for _, e := range h.Events {
+			if e == event && !h.LastRun.StartedAt.IsZero() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TestHelmSetDescription to test the release description across stages
+func TestHelmSetDescription(t *testing.T) {
+	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
+	defer func() { testServer.Close() }()
+	c := NewMockClient(t, nil)
+	ch, _ := c.getChartDetails(&Model{Chart: aws.String(testServer.URL + "/dep-0.1.0.tgz")})
+	config := &Config{
+		Name:      aws.String("description"),
+		Namespace: aws.String("default"),
+	}
+	err := c.HelmInstall(config, nil, ch, "mock-id")
+	assert.Nil(t, err)
+	rel, _ := c.HelmClient.Releases.Last("description")
+	assert.Equal(t, "mock-id: "+DescriptionInstall, rel.Info.Description)
+	for _, stage := range []string{DescriptionPending, DescriptionComplete} {
+		t.Run(stage, func(t *testing.T) {
+			err := c.HelmSetDescription("description", stage)
+			assert.Nil(t, err)
+			rel, _ := c.HelmClient.Releases.Last("description")
+			assert.Equal(t, "mock-id: "+stage, rel.Info.Description)
+			state, err := c.HelmVerifyRelease("description", "mock-id")
+			assert.Nil(t, err)
+			assert.Equal(t, ReleaseFound, state)
+		})
+	}
+	err = c.HelmSetDescription("nonext", DescriptionPending)
+	assert.Contains(t, err.Error(), "not found")
+}
+
+// TestReleaseID to test releaseID
+func TestReleaseID(t *testing.T) {
+	tests := map[string]string{
+		"umock-id": "umock-id",
+		releaseDescription("umock-id", DescriptionPending): "umock-id",
+		"": "",
+	}
+	for description, eID := range tests {
+		assert.Equal(t, eID, releaseID(description))
+	}
+}
+
+// TestAnnotationPostRenderer to test annotationPostRenderer
+func TestAnnotationPostRenderer(t *testing.T) {
+	manifest := `---
+apiVersion: v1
+kind: Service
+metadata:
+  name: my-service
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: nginx-deployment
+  annotations:
+    existing: value
+`
+	p := &annotationPostRenderer{annotations: map[string]string{OperationIDAnnotation: "test-operation-id"}}
+	out, err := p.Run(bytes.NewBufferString(manifest))
+	assert.Nil(t, err)
+	for _, m := range releaseutil.SplitManifests(out.String()) {
+		obj := map[string]interface{}{}
+		assert.Nil(t, yaml.Unmarshal([]byte(m), &obj))
+		annotations := obj["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+		assert.Equal(t, "test-operation-id", annotations[OperationIDAnnotation])
+		if obj["kind"] == "Deployment" {
+			assert.Equal(t, "value", annotations["existing"])
+		}
+	}
+}
+
+// TestCommonMetadata to test the common annotations and labels added to every object of the release
+func TestCommonMetadata(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "common")
+	defer os.RemoveAll(dir)
+	ch := buildChart(func(o *chartOptions) {
+		o.Templates = []*chart.File{
+			{Name: "templates/deployment.yaml", Data: []byte("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: {{ .Release.Name }}-web\n  labels:\n    app: web\n")},
+			{Name: "templates/service.yaml", Data: []byte("apiVersion: v1\nkind: Service\nmetadata:\n  name: {{ .Release.Name }}-web\n")},
+			{Name: "templates/configmap.yaml", Data: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: {{ .Release.Name }}-config\n  annotations:\n    team: chart\n")},
+		}
+	})
+	archive, err := chartutil.Save(ch, dir)
+	assert.Nil(t, err)
+	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(dir))))
+	defer testServer.Close()
+	c := NewMockClient(t, nil)
+	cd, err := c.getChartDetails(&Model{Chart: aws.String(testServer.URL + "/" + filepath.Base(archive))})
+	assert.Nil(t, err)
+	config := &Config{
+		Name:              aws.String("common"),
+		Namespace:         aws.String("default"),
+		OperationID:       aws.String("test-operation-id"),
+		CommonAnnotations: map[string]string{"team": "platform", OperationIDAnnotation: "ignored"},
+		CommonLabels:      map[string]string{"owner": "platform"},
+	}
+	assert.Nil(t, c.HelmInstall(config, nil, cd, "mock-id"))
+	rel, err := c.HelmClient.Releases.Last("common")
+	assert.Nil(t, err)
+	manifests := releaseutil.SplitManifests(rel.Manifest)
+	assert.Len(t, manifests, 3)
+	for _, m := range manifests {
+		obj := map[string]interface{}{}
+		assert.Nil(t, yaml.Unmarshal([]byte(m), &obj))
+		metadata := obj["metadata"].(map[string]interface{})
+		annotations := metadata["annotations"].(map[string]interface{})
+		labels := metadata["labels"].(map[string]interface{})
+		assert.Equal(t, "platform", annotations["team"])
+		assert.Equal(t, "test-operation-id", annotations[OperationIDAnnotation])
+		assert.Equal(t, "platform", labels["owner"])
+		if obj["kind"] == "Deployment" {
+			assert.Equal(t, "web", labels["app"])
+		}
+	}
+}
+
+// TestOverlappingResources to test resources defined by several subcharts of an umbrella chart fail the install,
+// or keep one definition
+func TestOverlappingResources(t *testing.T) {
+	subchart := func(name string) *chart.Chart {
+		return buildChart(func(o *chartOptions) {
+			o.Metadata = &chart.Metadata{APIVersion: chart.APIVersionV2, Name: name, Version: "0.1.0"}
+			o.Templates = []*chart.File{
+				{Name: "templates/crd.yaml", Data: []byte("apiVersion: apiextensions.k8s.io/v1\nkind: CustomResourceDefinition\nmetadata:\n  name: widgets.example.com\n  labels:\n    chart: " + name + "\n")},
+				{Name: "templates/configmap.yaml", Data: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: {{ .Release.Name }}-" + name + "\n")},
+			}
+		})
+	}
+	dir, _ := ioutil.TempDir("", "umbrella")
+	defer os.RemoveAll(dir)
+	ch := buildChart(func(o *chartOptions) {
+		o.Metadata = &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "umbrella", Version: "0.1.0", Dependencies: []*chart.Dependency{
+			{Name: "a", Version: "0.1.0"},
+			{Name: "b", Version: "0.1.0"},
+		}}
+		o.Templates = nil
+	})
+	ch.AddDependency(subchart("a"), subchart("b"))
+	archive, err := chartutil.Save(ch, dir)
+	assert.Nil(t, err)
+	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(dir))))
+	defer testServer.Close()
+	c := NewMockClient(t, nil)
+	tests := map[string]struct {
+		mode        *string
+		expected    []string
+		expectedErr string
+	}{
+		"Unchecked": {
+			expected: []string{"chart: a", "chart: b"},
+		},
+		"Fail": {
+			mode:        aws.String("Fail"),
+			expectedErr: "overlapping resources: CustomResourceDefinition widgets.example.com is defined by umbrella/charts/a/templates/crd.yaml and umbrella/charts/b/templates/crd.yaml",
+		},
+		"KeepFirst": {
+			mode:     aws.String("KeepFirst"),
+			expected: []string{"chart: a"},
+		},
+		"KeepLast": {
+			mode:     aws.String("KeepLast"),
+			expected: []string{"chart: b"},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			release := strings.ToLower(name)
+			cd, err := c.getChartDetails(&Model{Chart: aws.String(testServer.URL + "/" + filepath.Base(archive))})
+			assert.Nil(t, err)
+			err = c.HelmInstall(&Config{Name: aws.String(release), Namespace: aws.String("default"), OverlappingResources: d.mode, CommonLabels: map[string]string{"team": "web"}}, map[string]interface{}{}, cd, "mock-id")
+			if d.expectedErr != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), d.expectedErr)
+				return
+			}
+			assert.Nil(t, err)
+			rel, err := c.HelmClient.Releases.Last(release)
+			if !assert.Nil(t, err) {
+				return
+			}
+			assert.Len(t, releaseutil.SplitManifests(rel.Manifest), len(d.expected)+2)
+			for _, e := range d.expected {
+				assert.Contains(t, rel.Manifest, e+"\n")
+			}
+			assert.Contains(t, rel.Manifest, "name: "+release+"-a\n")
+			assert.Contains(t, rel.Manifest, "name: "+release+"-b\n")
+		})
+	}
+}
+
+// TestDependencyConditions to test subcharts enabled and disabled by tags and conditions, and the condition check
+func TestDependencyConditions(t *testing.T) {
+	subchart := func(name string) *chart.Chart {
+		return buildChart(func(o *chartOptions) {
+			o.Metadata = &chart.Metadata{APIVersion: chart.APIVersionV2, Name: name, Version: "0.1.0"}
+			o.Values = map[string]interface{}{"enabled": true}
+			o.Raw = []*chart.File{{Name: chartutil.ValuesfileName, Data: []byte("enabled: true\n")}}
+			o.Templates = []*chart.File{
+				{Name: "templates/configmap.yaml", Data: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: {{ .Release.Name }}-" + name + "\n")},
+			}
+		})
+	}
+	dir, _ := ioutil.TempDir("", "umbrella")
+	defer os.RemoveAll(dir)
+	umbrella := func(condition string) string {
+		ch := buildChart(func(o *chartOptions) {
+			o.Metadata = &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "umbrella", Version: "0.1.0", Dependencies: []*chart.Dependency{
+				{Name: "web", Version: "0.1.0", Tags: []string{"frontend"}},
+				{Name: "db", Version: "0.1.0", Condition: condition},
+			}}
+			o.Templates = nil
+		})
+		ch.AddDependency(subchart("web"), subchart("db"))
+		sub := filepath.Join(dir, strings.Split(condition, ".")[0])
+		assert.Nil(t, os.MkdirAll(sub, 0755))
+		archive, err := chartutil.Save(ch, sub)
+		assert.Nil(t, err)
+		rel, _ := filepath.Rel(dir, archive)
+		return "/" + filepath.ToSlash(rel)
+	}
+	archive := umbrella("db.enabled")
+	typo := umbrella("database.enabled")
+	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(dir))))
+	defer testServer.Close()
+	c := NewMockClient(t, nil)
+	tests := map[string]struct {
+		archive     string
+		vals        map[string]interface{}
+		check       bool
+		expected    []string
+		expectedErr string
+	}{
+		"Default": {
+			archive:  archive,
+			check:    true,
+			expected: []string{"default-web", "default-db"},
+		},
+		"TagDisabled": {
+			archive:  archive,
+			vals:     map[string]interface{}{"tags": map[string]interface{}{"frontend": false}},
+			check:    true,
+			expected: []string{"tagdisabled-db"},
+		},
+		"ConditionDisabled": {
+			archive:  archive,
+			vals:     map[string]interface{}{"db": map[string]interface{}{"enabled": false}},
+			check:    true,
+			expected: []string{"conditiondisabled-web"},
+		},
+		"UnknownCondition": {
+			archive:     typo,
+			check:       true,
+			expectedErr: "condition database.enabled of dependency db in chart umbrella does not match any value",
+		},
+		"UnknownConditionUnchecked": {
+			archive:  typo,
+			expected: []string{"unknownconditionunchecked-web", "unknownconditionunchecked-db"},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			release := strings.ToLower(name)
+			cd, err := c.getChartDetails(&Model{Chart: aws.String(testServer.URL + d.archive), CheckDependencyConditions: aws.Bool(d.check)})
+			assert.Nil(t, err)
+			vals := d.vals
+			if vals == nil {
+				vals = map[string]interface{}{}
+			}
+			err = c.HelmInstall(&Config{Name: aws.String(release), Namespace: aws.String("default")}, vals, cd, "mock-id")
+			if d.expectedErr != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), d.expectedErr)
+				return
+			}
+			assert.Nil(t, err)
+			rel, err := c.HelmClient.Releases.Last(release)
+			if !assert.Nil(t, err) {
+				return
+			}
+			assert.Len(t, releaseutil.SplitManifests(rel.Manifest), len(d.expected))
+			for _, e := range d.expected {
+				assert.Contains(t, rel.Manifest, "name: "+e+"\n")
+			}
+		})
+	}
+}
+
+// TestManifestResources to test manifestResources against the rendered chart objects
+func TestManifestResources(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "resources")
+	defer os.RemoveAll(dir)
+	ch := buildChart(func(o *chartOptions) {
+		o.Templates = []*chart.File{
+			{Name: "templates/deployment.yaml", Data: []byte("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: {{ .Release.Name }}-web\n")},
+			{Name: "templates/service.yaml", Data: []byte("apiVersion: v1\nkind: Service\nmetadata:\n  name: {{ .Release.Name }}-web\n  namespace: web\n")},
+			{Name: "templates/secret.yaml", Data: []byte("apiVersion: v1\nkind: Secret\nmetadata:\n  name: {{ .Release.Name }}-creds\nstringData:\n  password: s3cr3t\n")},
+		}
+	})
+	archive, err := chartutil.Save(ch, dir)
+	assert.Nil(t, err)
+	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(dir))))
+	defer testServer.Close()
+	c := NewMockClient(t, nil)
+	cd, err := c.getChartDetails(&Model{Chart: aws.String(testServer.URL + "/" + filepath.Base(archive))})
+	assert.Nil(t, err)
+	assert.Nil(t, c.HelmInstall(&Config{Name: aws.String("resources"), Namespace: aws.String("default")}, nil, cd, "mock-id"))
+	s, err := c.HelmStatus("resources")
+	assert.Nil(t, err)
+	expected := map[string]interface{}{
+		"Deployment": map[string]interface{}{"resources-web": map[string]interface{}{"Namespace": "default"}},
+		"Secret":     map[string]interface{}{"resources-creds": map[string]interface{}{"Namespace": "default"}},
+		"Service":    map[string]interface{}{"resources-web": map[string]interface{}{"Namespace": "web"}},
+	}
+	resources := manifestResources(s.Manifest, s.Namespace)
+	assert.EqualValues(t, expected, resources)
+	b, _ := json.Marshal(resources)
+	assert.NotContains(t, string(b), "s3cr3t")
+}
+
+// TestCheckReleaseOwner to test checkReleaseOwner
+func TestCheckReleaseOwner(t *testing.T) {
+	c := NewMockClient(t, nil)
+	// The owner is recorded on the release, even without rendered objects
+	owned := namedRelease("owned", release.StatusDeployed)
+	owned.Namespace = "default"
+	owned.Manifest = ""
+	recordStackID(owned.Chart, aws.String("arn:aws:cloudformation:us-east-1:1234567890:stack/owner/1"))
+	_ = c.HelmClient.Releases.Create(owned)
+	tests := map[string]struct {
+		name        string
+		config      *Config
+		expectedErr *string
+	}{
+		"MatchingOwner": {
+			name:   "owned",
+			config: &Config{StackID: aws.String("arn:aws:cloudformation:us-east-1:1234567890:stack/owner/1")},
+		},
+		"DifferentOwner": {
+			name:        "owned",
+			config:      &Config{StackID: aws.String("arn:aws:cloudformation:us-east-1:1234567890:stack/other/1")},
+			expectedErr: aws.String("release owned owned by another stack arn:aws:cloudformation:us-east-1:1234567890:stack/owner/1"),
+		},
+		"Override": {
+			name:   "owned",
+			config: &Config{StackID: aws.String("arn:aws:cloudformation:us-east-1:1234567890:stack/other/1"), OverrideOwnership: aws.Bool(true)},
+		},
+		"NoOwner": {
+			name:   "one",
+			config: &Config{StackID: aws.String("arn:aws:cloudformation:us-east-1:1234567890:stack/other/1")},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := c.checkReleaseOwner(d.name, d.config)
+			if d.expectedErr != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+// TestHelmInstallOwnership to test the install records the stack ID on the release and never takes over a release
+// owned by another stack, even with the ownership override
+func TestHelmInstallOwnership(t *testing.T) {
+	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
+	defer testServer.Close()
+	owner := aws.String("arn:aws:cloudformation:us-east-1:1234567890:stack/owner/1")
+	other := aws.String("arn:aws:cloudformation:us-east-1:1234567890:stack/other/1")
+	c := NewMockClient(t, nil)
+	ch, err := c.getChartDetails(&Model{Chart: aws.String(testServer.URL + "/test.tgz")})
+	assert.Nil(t, err)
+	config := &Config{Name: aws.String("owned"), Namespace: aws.String("default"), StackID: owner}
+	assert.Nil(t, c.HelmInstall(config, nil, ch, "owned-id"))
+	rel, err := c.HelmClient.Releases.Last("owned")
+	assert.Nil(t, err)
+	assert.Equal(t, *owner, releaseStackID(rel))
+
+	config = &Config{Name: aws.String("owned"), Namespace: aws.String("default"), StackID: other, OverrideOwnership: aws.Bool(true)}
+	err = c.HelmInstall(config, nil, ch, "owned-id")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "release owned owned by another stack "+*owner)
+}
+
+// TestExternallyManaged to test update and delete of an externally managed release are refused unless overridden
+func TestExternallyManaged(t *testing.T) {
+	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
+	defer testServer.Close()
+	manifest := func(key string, value string) string {
+		return "---\napiVersion: v1\nkind: Service\nmetadata:\n  name: web\n  annotations:\n    " + key + ": \"" + value + "\"\n"
+	}
+	tests := map[string]struct {
+		manifest    string
+		delete      bool
+		config      *Config
+		expectedErr *string
+	}{
+		"UpdateRefused": {
+			manifest:    manifest(ExternallyManagedAnnotation, "true"),
+			config:      &Config{},
+			expectedErr: aws.String("release gitops is externally managed, its resources are annotated " + ExternallyManagedAnnotation),
+		},
+		"DeleteRefused": {
+			manifest:    manifest(ExternallyManagedAnnotation, "true"),
+			delete:      true,
+			expectedErr: aws.String("release gitops is externally managed"),
+		},
+		"UpdateOverride": {
+			manifest: manifest(ExternallyManagedAnnotation, "true"),
+			config:   &Config{OverrideExternallyManaged: aws.Bool(true)},
+		},
+		"DeleteOverride": {
+			manifest: manifest(ExternallyManagedAnnotation, "true"),
+			delete:   true,
+			config:   &Config{OverrideExternallyManaged: aws.Bool(true)},
+		},
+		"CustomAnnotation": {
+			manifest:    manifest("fluxcd.io/managed", "yes"),
+			delete:      true,
+			config:      &Config{ExternallyManagedAnnotation: aws.String("fluxcd.io/managed")},
+			expectedErr: aws.String("annotated fluxcd.io/managed"),
+		},
+		"Disabled": {
+			manifest: manifest(ExternallyManagedAnnotation, "false"),
+			delete:   true,
+		},
+		"NotAnnotated": {
+			manifest: manifest(StackIDAnnotation, "arn:aws:cloudformation:us-east-1:1234567890:stack/owner/1"),
+			config:   &Config{},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewMockClient(t, nil)
+			rel := namedRelease("gitops", release.StatusDeployed)
+			rel.Namespace = "default"
+			rel.Version = 1
+			rel.Manifest = d.manifest
+			assert.Nil(t, c.HelmClient.Releases.Create(rel))
+			var err error
+			if d.delete {
+				err = c.HelmUninstall("gitops", d.config)
+			} else {
+				ch, cerr := c.getChartDetails(&Model{Chart: aws.String(testServer.URL + "/test.tgz")})
+				assert.Nil(t, cerr)
+				d.config.Name, d.config.Namespace = aws.String("gitops"), aws.String("default")
+				err = c.HelmUpgrade("gitops", d.config, nil, ch, "umock-id")
+			}
+			last, lerr := c.HelmClient.Releases.Last("gitops")
+			if d.expectedErr != nil {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), *d.expectedErr)
+				assert.Nil(t, lerr)
+				assert.Equal(t, 1, last.Version)
+				return
+			}
+			assert.Nil(t, err)
+			if !d.delete {
+				assert.Nil(t, lerr)
+				assert.Equal(t, 2, last.Version)
+			}
+		})
+	}
+}
+
+// TestCheckChartDependencies to test checkChartDependencies
+func TestCheckChartDependencies(t *testing.T) {
+	c := NewMockClient(t, nil)
+	dep, _ := loader.Load(TestFolder + "/dep-0.1.0.tgz")
+	tests := map[string]struct {
+		path        string
+		chart       *chart.Chart
+		update      bool
+		eUpdated    bool
+		expectedErr *string
+	}{
+		"NoDependencies": {
+			path:   TestFolder + "/test.tgz",
+			chart:  buildChart(),
+			update: true,
+		},
+		"DependenciesPresent": {
+			path:   TestFolder + "/dep-0.1.0.tgz",
+			chart:  dep,
+			update: true,
+		},
+		"PackagedMissingDependencies": {
+			path: TestFolder + "/test.tgz",
+			chart: buildChart(func(o *chartOptions) {
+				o.Metadata.Dependencies = []*chart.Dependency{{Name: "missing", Version: "0.1.0"}}
+			}),
+			update:      true,
+			expectedErr: aws.String("found in Chart.yaml, but missing in charts/ directory"),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			ch, updated, err := c.checkChartDependencies(d.path, d.chart, d.update, "", chartIgnore{})
+			assert.Equal(t, d.eUpdated, updated)
+			if d.expectedErr != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, d.chart, ch)
+			}
+		})
+	}
+}
+
+// TestVerifyChartDigest to test verifyChartDigest
+func TestVerifyChartDigest(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "digest")
+	defer os.RemoveAll(dir)
+	cp := TestFolder + "/test.tgz"
+	ch, _ := loader.Load(cp)
+	digest, _ := provenance.DigestFile(cp)
+	writeIndex := func(name string, d string) string {
+		idx := repo.NewIndexFile()
+		_ = idx.MustAdd(ch.Metadata, "test.tgz", "https://charts.test.com", d)
+		f := filepath.Join(dir, name)
+		_ = idx.WriteFile(f, 0644)
+		return f
+	}
+	matching := writeIndex("matching-index.yaml", digest)
+	mismatching := writeIndex("mismatching-index.yaml", "0000")
+	tests := map[string]struct {
+		index       string
+		digest      string
+		expectedErr *string
+	}{
+		"MatchingIndexDigest": {
+			index:  matching,
+			digest: digest,
+		},
+		"PrefixedDigest": {
+			index:  matching,
+			digest: "sha256:" + digest,
+		},
+		"PinnedDigestMismatch": {
+			index:       matching,
+			digest:      "1111",
+			expectedErr: aws.String("repository index digest " + digest + " for chart jenkins-" + ch.Metadata.Version + " does not match ChartDigest 1111"),
+		},
+		"ArchiveMismatch": {
+			index:       mismatching,
+			digest:      "0000",
+			expectedErr: aws.String("chart archive digest " + digest + " does not match expected digest 0000"),
+		},
+		"NoIndex": {
+			digest: digest,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := verifyChartDigest(cp, d.index, ch, d.digest)
+			if d.expectedErr != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+// TestCheckAppVersion to test checkAppVersion
+// writeChartArchive writes a chart archive with the given Chart.yaml and a single template.
+func writeChartArchive(t *testing.T, path string, chartYaml string) {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, data := range map[string]string{
+		"mychart/Chart.yaml":            chartYaml,
+		"mychart/templates/config.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: config\n",
+	} {
+		assert.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}))
+		_, err := tw.Write([]byte(data))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, tw.Close())
+	assert.Nil(t, gz.Close())
+	assert.Nil(t, ioutil.WriteFile(path, buf.Bytes(), 0644))
+}
+
+func TestLoadChart(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "chart")
+	defer os.RemoveAll(dir)
+	tests := map[string]struct {
+		chartYaml          string
+		defaultVersion     *string
+		expectedVersion    string
+		expectedAppVersion string
+		expectedErr        *string
+	}{
+		"Versioned": {
+			chartYaml:          "apiVersion: v2\nname: mychart\nversion: 1.2.0\nappVersion: \"2.0\"\n",
+			defaultVersion:     aws.String("0.0.1-dev"),
+			expectedVersion:    "1.2.0",
+			expectedAppVersion: "2.0",
+		},
+		"VersionlessStrict": {
+			chartYaml:   "apiVersion: v2\nname: mychart\n",
+			expectedErr: aws.String("chart mychart has no version in Chart.yaml"),
+		},
+		"VersionlessInjected": {
+			chartYaml:          "apiVersion: v2\nname: mychart\n",
+			defaultVersion:     aws.String("0.0.1-dev"),
+			expectedVersion:    "0.0.1-dev",
+			expectedAppVersion: "0.0.1-dev",
+		},
+		"InjectedKeepsAppVersion": {
+			chartYaml:          "apiVersion: v2\nname: mychart\nappVersion: \"2.0\"\n",
+			defaultVersion:     aws.String("0.0.1-dev"),
+			expectedVersion:    "0.0.1-dev",
+			expectedAppVersion: "2.0",
+		},
+		"InvalidVersion": {
+			chartYaml:   "apiVersion: v2\nname: mychart\nversion: latest\n",
+			expectedErr: aws.String("chart mychart: validation: chart.metadata.version \"latest\" is invalid"),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			cp := filepath.Join(dir, name+".tgz")
+			writeChartArchive(t, cp, d.chartYaml)
+			ch, err := loadChart(cp, d.defaultVersion, chartIgnore{})
+			if d.expectedErr != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+			} else {
+				assert.Nil(t, err)
+				assert.EqualValues(t, d.expectedVersion, ch.Metadata.Version)
+				assert.EqualValues(t, d.expectedAppVersion, ch.Metadata.AppVersion)
+				assert.Len(t, ch.Templates, 1)
+			}
+		})
+	}
+}
+
+// TestLoadChartDir is to test the .helmignore of a chart directory is honored, extended or skipped
+func TestLoadChartDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chartdir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"Chart.yaml":        "apiVersion: v2\nname: mychart\nversion: 1.0.0\n",
+		"templates/cm.yaml": "kind: ConfigMap\n",
+		helmIgnoreFile:      "secret.txt\n",
+		"secret.txt":        "secret",
+		"debug.log":         "debug",
+		"notes/release.txt": "notes",
+	}
+	for name, data := range files {
+		assert.Nil(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644))
+	}
+	tests := map[string]struct {
+		ignore   chartIgnore
+		expected []string
+	}{
+		"HelmIgnore": {
+			expected: []string{helmIgnoreFile, "debug.log", "notes/release.txt"},
+		},
+		"Patterns": {
+			ignore:   chartIgnore{patterns: []string{"*.log", "notes/"}},
+			expected: []string{helmIgnoreFile},
+		},
+		"Disabled": {
+			ignore:   chartIgnore{disabled: true},
+			expected: []string{helmIgnoreFile, "debug.log", "notes/release.txt", "secret.txt"},
+		},
+		"DisabledWithPatterns": {
+			ignore:   chartIgnore{patterns: []string{"*.log"}, disabled: true},
+			expected: []string{helmIgnoreFile, "notes/release.txt", "secret.txt"},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			ch, err := loadChart(dir, nil, d.ignore)
+			assert.Nil(t, err)
+			var names []string
+			for _, f := range ch.Files {
+				names = append(names, f.Name)
+			}
+			assert.ElementsMatch(t, d.expected, names)
+			assert.Len(t, ch.Templates, 1)
+			// The chart directory is left unchanged
+			data, err := ioutil.ReadFile(filepath.Join(dir, helmIgnoreFile))
+			assert.Nil(t, err)
+			assert.Equal(t, "secret.txt\n", string(data))
+		})
+	}
+}
+
+// TestLoadChartSymlinks is to test the symlinks of a chart directory are followed within the chart and rejected outside of it
+func TestLoadChartSymlinks(t *testing.T) {
+	outside, err := ioutil.TempDir("", "outside")
+	assert.Nil(t, err)
+	defer os.RemoveAll(outside)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644))
+	tests := map[string]struct {
+		links       map[string]string
+		ignore      chartIgnore
+		expected    map[string]string
+		expectedErr string
+	}{
+		"InBounds": {
+			links:    map[string]string{"files/shared.yaml": "../config/shared.yaml", "files/config": "../config"},
+			expected: map[string]string{"config/shared.yaml": "shared", "files/shared.yaml": "shared", "files/config/shared.yaml": "shared"},
+		},
+		"InBoundsIgnore": {
+			links:    map[string]string{"files/shared.yaml": "../config/shared.yaml", "files/config": "../config"},
+			ignore:   chartIgnore{patterns: []string{"*.log"}},
+			expected: map[string]string{"config/shared.yaml": "shared", "files/shared.yaml": "shared", "files/config/shared.yaml": "shared"},
+		},
+		"OutOfBounds": {
+			links:       map[string]string{"files/secret.txt": filepath.Join(outside, "secret.txt")},
+			expectedErr: "chart symlink files/secret.txt points outside the chart",
+		},
+		"RelativeOutOfBounds": {
+			links:       map[string]string{"files/outside": "../../../" + filepath.Base(outside)},
+			expectedErr: "chart symlink files/outside points outside the chart",
+		},
+		"Loop": {
+			links:       map[string]string{"files/loop": ".."},
+			expectedErr: "chart symlink files/loop points to a directory containing it",
+		},
+		"Dangling": {
+			links:       map[string]string{"files/missing.yaml": "../config/missing.yaml"},
+			expectedErr: "chart symlink files/missing.yaml cannot be resolved",
+		},
+		"Reject": {
+			links:       map[string]string{"files/shared.yaml": "../config/shared.yaml"},
+			ignore:      chartIgnore{symlinks: chartSymlinksReject},
+			expectedErr: "chart symlink files/shared.yaml is not allowed",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			parent, err := ioutil.TempDir(filepath.Dir(outside), "chartlinks")
+			assert.Nil(t, err)
+			defer os.RemoveAll(parent)
+			dir := filepath.Join(parent, "mychart")
+			files := map[string]string{
+				"Chart.yaml":         "apiVersion: v2\nname: mychart\nversion: 1.0.0\n",
+				"templates/cm.yaml":  "kind: ConfigMap\n",
+				"config/shared.yaml": "shared",
+			}
+			for name, data := range files {
+				assert.Nil(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755))
+				assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644))
+			}
+			assert.Nil(t, os.MkdirAll(filepath.Join(dir, "files"), 0755))
+			for name, target := range d.links {
+				assert.Nil(t, os.Symlink(target, filepath.Join(dir, name)))
+			}
+			ch, err := loadChart(dir, nil, d.ignore)
+			if d.expectedErr != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), d.expectedErr)
+				return
+			}
+			assert.Nil(t, err)
+			loaded := map[string]string{}
+			for _, f := range ch.Files {
+				if f.Name != helmIgnoreFile {
+					loaded[f.Name] = string(f.Data)
+				}
+			}
+			assert.Equal(t, d.expected, loaded)
+		})
+	}
+}
+
+func TestGenerateReleaseName(t *testing.T) {
+	tests := map[string]struct {
+		prefix      string
+		expected    string
+		expectedErr *string
+	}{
+		"Prefix": {
+			prefix:   "web",
+			expected: `^web-\d+$`,
+		},
+		"Template": {
+			prefix:   `{{ "api" | upper | lower }}`,
+			expected: `^api-\d+$`,
+		},
+		"Invalid": {
+			prefix:      "Web_App",
+			expectedErr: aws.String("invalid release name"),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, err := generateReleaseName(d.prefix)
+			if d.expectedErr != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+			} else {
+				assert.Nil(t, err)
+				assert.Regexp(t, d.expected, aws.StringValue(result))
+			}
+		})
+	}
+}
+
+func TestCheckHelmCapabilities(t *testing.T) {
+	tests := map[string]struct {
+		template    string
+		expectedErr *string
+	}{
+		"Supported": {
+			template: `{{ .Values | toYaml }}{{ lookup "v1" "Namespace" "" "default" }}`,
+		},
+		"NewerHelmFunction": {
+			template:    `{{ fromToml "a = 1" }}`,
+			expectedErr: aws.String("chart hello uses template function \"fromToml\" which is not supported by the bundled helm"),
+		},
+		"MissingRequiredValue": {
+			template: `{{ required "image is required" .Values.image }}`,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			ch := buildChart(func(o *chartOptions) {
+				o.Templates = []*chart.File{{Name: "templates/cm.yaml", Data: []byte(d.template)}}
+			})
+			err := checkHelmCapabilities(ch, chartutil.DefaultCapabilities)
+			if d.expectedErr != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+// TestHelmCapabilities is to test that API-version-gated templates render according to the discovered capabilities
+func TestHelmCapabilities(t *testing.T) {
+	monitoring := []*metav1.APIResourceList{{
+		GroupVersion: "monitoring.coreos.com/v1",
+		APIResources: []metav1.APIResource{{Name: "servicemonitors", Kind: "ServiceMonitor"}},
+	}}
+	tests := map[string]struct {
+		resources []*metav1.APIResourceList
+		extra     []string
+		offline   bool
+		rendered  bool
+		set       bool
+	}{
+		"Discovered": {
+			resources: monitoring,
+			rendered:  true,
+			set:       true,
+		},
+		"NotDiscovered": {
+			set: true,
+		},
+		"Extra": {
+			extra:    []string{"monitoring.coreos.com/v1/ServiceMonitor"},
+			rendered: true,
+			set:      true,
+		},
+		"Offline": {
+			extra:    []string{"monitoring.coreos.com/v1/ServiceMonitor"},
+			offline:  true,
+			rendered: true,
+		},
+	}
+	ch := buildChart(func(o *chartOptions) {
+		o.Templates = []*chart.File{{Name: "templates/sm.yaml", Data: []byte(`{{ if .Capabilities.APIVersions.Has "monitoring.coreos.com/v1/ServiceMonitor" }}kind: ServiceMonitor{{ end }}`)}}
+	})
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewMockClient(t, nil)
+			c.HelmClient.Capabilities = nil
+			c.ClientSet.Discovery().(*fakediscovery.FakeDiscovery).Resources = d.resources
+			if d.offline {
+				c.ClientSet = nil
+			}
+			caps := c.helmCapabilities(d.extra, nil)
+			vals, err := chartutil.ToRenderValues(ch, map[string]interface{}{}, chartutil.ReleaseOptions{Name: "test"}, caps)
+			assert.Nil(t, err)
+			out, err := engine.Render(ch, vals)
+			assert.Nil(t, err)
+			assert.Equal(t, d.rendered, strings.Contains(out["hello/templates/sm.yaml"], "ServiceMonitor"))
+			if d.set {
+				assert.Equal(t, caps, c.HelmClient.Capabilities)
+			} else {
+				assert.Nil(t, c.HelmClient.Capabilities)
+			}
+		})
+	}
+}
+
+// TestHelmCapabilitiesKubeVersionOverride to test a chart gated on the kube version renders offline with the override
+func TestHelmCapabilitiesKubeVersionOverride(t *testing.T) {
+	tests := map[string]struct {
+		override *string
+		offline  bool
+		expected string
+	}{
+		"Offline": {
+			override: aws.String("1.22.3"),
+			offline:  true,
+			expected: "networking.k8s.io/v1",
+		},
+		"OfflinePrefixed": {
+			override: aws.String("v1.19.0"),
+			offline:  true,
+			expected: "networking.k8s.io/v1beta1",
+		},
+		"OfflineDefault": {
+			offline:  true,
+			expected: "networking.k8s.io/v1beta1",
+		},
+		"Discovered": {
+			override: aws.String("1.22.3"),
+			expected: "extensions/v1beta1",
+		},
+	}
+	ch := buildChart(func(o *chartOptions) {
+		o.Templates = []*chart.File{{Name: "templates/ingress.yaml", Data: []byte(`{{ if semverCompare ">=1.22-0" .Capabilities.KubeVersion.Version }}networking.k8s.io/v1{{ else if semverCompare ">=1.19-0" .Capabilities.KubeVersion.Version }}networking.k8s.io/v1beta1{{ else }}extensions/v1beta1{{ end }}`)}}
+	})
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewMockClient(t, nil)
+			c.HelmClient.Capabilities = nil
+			c.ClientSet.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &k8sversion.Info{GitVersion: "v1.18.9", Major: "1", Minor: "18"}
+			if d.offline {
+				c.ClientSet = nil
+			}
+			kubeVersion, err := parseKubeVersion(d.override)
+			assert.Nil(t, err)
+			vals, err := chartutil.ToRenderValues(ch, map[string]interface{}{}, chartutil.ReleaseOptions{Name: "test"}, c.helmCapabilities(nil, kubeVersion))
+			assert.Nil(t, err)
+			out, err := engine.Render(ch, vals)
+			assert.Nil(t, err)
+			assert.Equal(t, d.expected, out["hello/templates/ingress.yaml"])
+		})
+	}
+}
+
+// TestParseKubeVersion to test parseKubeVersion
+func TestParseKubeVersion(t *testing.T) {
+	tests := map[string]struct {
+		override    *string
+		expected    *chartutil.KubeVersion
+		expectedErr string
+	}{
+		"Unset": {},
+		"Version": {
+			override: aws.String("1.21.2"),
+			expected: &chartutil.KubeVersion{Version: "v1.21.2", Major: "1", Minor: "21"},
+		},
+		"Prefixed": {
+			override: aws.String("v1.21.2-eks-0389ca3"),
+			expected: &chartutil.KubeVersion{Version: "v1.21.2-eks-0389ca3", Major: "1", Minor: "21"},
+		},
+		"MissingPatch": {
+			override:    aws.String("1.21"),
+			expectedErr: `invalid KubeVersionOverride "1.21", expected a semantic version such as 1.20.4`,
+		},
+		"Invalid": {
+			override:    aws.String("latest"),
+			expectedErr: `invalid KubeVersionOverride "latest"`,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			kv, err := parseKubeVersion(d.override)
+			if d.expectedErr != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), d.expectedErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, d.expected, kv)
+		})
+	}
+}
+
+func TestCheckAppVersion(t *testing.T) {
+	ch := buildChart(func(o *chartOptions) {
+		o.Metadata.AppVersion = "1.16.0"
+	})
+	tests := map[string]struct {
+		expected    *string
 		expectedErr *string
 	}{
-		"HTTPRepo": {
-			m: &Model{Chart: aws.String(testServer.URL + "/test.tgz")},
-			config: &Config{
-				Name:      aws.String("httprepo"),
-				Namespace: aws.String("default"),
-			},
+		"NotSet": {},
+		"Match": {
+			expected: aws.String("1.16.0"),
 		},
-		"WrongChartFile": {
-			m: &Model{Chart: aws.String(testServer.URL + "/testt.tgz")},
-			config: &Config{
-				Name:      aws.String("test"),
-				Namespace: aws.String("default"),
-			},
-			expectedErr: aws.String("At Downloading file"),
+		"Mismatch": {
+			expected:    aws.String("1.17.0"),
+			expectedErr: aws.String("appVersion \"1.16.0\" does not match expected appVersion \"1.17.0\""),
 		},
-		"RemoteRepo": {
-			m: &Model{Chart: aws.String("stable/coscale")},
-			config: &Config{
-				Name:      aws.String("remoterepo"),
-				Namespace: aws.String("default"),
-			},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := checkAppVersion(ch, d.expected)
+			if d.expectedErr != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+// TestCheckChartAPIVersion to test checkChartAPIVersion with v1 and v2 charts
+func TestCheckChartAPIVersion(t *testing.T) {
+	v1 := buildChart()
+	v2 := buildChart(func(o *chartOptions) {
+		o.Metadata.APIVersion = chart.APIVersionV2
+	})
+	umbrella := buildChart(func(o *chartOptions) {
+		o.Metadata = &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "umbrella", Version: "0.1.0"}
+	})
+	umbrella.AddDependency(buildChart())
+	tests := map[string]struct {
+		ch          *chart.Chart
+		required    *string
+		expectedErr *string
+	}{
+		"NotSetV1": {
+			ch: v1,
 		},
-		"WrongRemoteRepo": {
-			m: &Model{Chart: aws.String("test/test")},
-			config: &Config{
-				Name:      aws.String("test"),
-				Namespace: aws.String("default"),
-			},
-			expectedErr: aws.String("failed to download"),
+		"V2": {
+			ch:       v2,
+			required: aws.String("v2"),
 		},
-		"Dependency": {
-			m: &Model{Chart: aws.String(testServer.URL + "/dep-0.1.0.tgz")},
-			config: &Config{
-				Name:      aws.String("dependency"),
-				Namespace: aws.String("default"),
-			},
+		"V1Mismatch": {
+			ch:          v1,
+			required:    aws.String("v2"),
+			expectedErr: aws.String("chart hello has apiVersion \"v1\" but apiVersion \"v2\" is required"),
+		},
+		"V1Subchart": {
+			ch:          umbrella,
+			required:    aws.String("v2"),
+			expectedErr: aws.String("chart umbrella/charts/hello has apiVersion \"v1\" but apiVersion \"v2\" is required"),
 		},
+		"V1": {
+			ch:       v1,
+			required: aws.String("v1"),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := checkChartAPIVersion(d.ch, d.required)
+			if d.expectedErr != nil {
+				assert.EqualError(t, err, aws.StringValue(d.expectedErr))
+			} else {
+				assert.Nil(t, err)
+			}
+		})
 	}
+}
 
+// TestApplyValuesProfile to test applyValuesProfile
+func TestApplyValuesProfile(t *testing.T) {
+	ch := buildChart(func(o *chartOptions) {
+		o.Files = []*chart.File{
+			{Name: "values-prod.yaml", Data: []byte("replicas: 3\nimage:\n  tag: stable\n  pullPolicy: Always\n")},
+			{Name: "values-dev.yaml", Data: []byte("replicas: 1\nimage:\n  tag: latest\n")},
+			{Name: "values-bad.yaml", Data: []byte("replicas")},
+		}
+	})
+	tests := map[string]struct {
+		profile     *string
+		values      map[string]interface{}
+		eValues     map[string]interface{}
+		expectedErr *string
+	}{
+		"NoProfile": {
+			values:  map[string]interface{}{"replicas": 2},
+			eValues: map[string]interface{}{"replicas": 2},
+		},
+		"Prod": {
+			profile: aws.String("prod"),
+			values:  map[string]interface{}{"image": map[string]interface{}{"tag": "v1"}},
+			eValues: map[string]interface{}{"replicas": float64(3), "image": map[string]interface{}{"tag": "v1", "pullPolicy": "Always"}},
+		},
+		"Dev": {
+			profile: aws.String("dev"),
+			eValues: map[string]interface{}{"replicas": float64(1), "image": map[string]interface{}{"tag": "latest"}},
+		},
+		"Missing": {
+			profile:     aws.String("staging"),
+			expectedErr: aws.String("values profile values-staging.yaml not found"),
+		},
+		"Invalid": {
+			profile:     aws.String("bad"),
+			expectedErr: aws.String("values profile values-bad.yaml: values must be a map of keys, not a scalar at the root"),
+		},
+	}
 	for name, d := range tests {
 		t.Run(name, func(t *testing.T) {
-			ch, _ := c.getChartDetails(d.m)
-			err := c.HelmInstall(d.config, d.vals, ch, "mock-id")
-			if err != nil {
+			vals, err := applyValuesProfile(ch, d.profile, d.values)
+			if d.expectedErr != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+			} else {
+				assert.Nil(t, err)
+				assert.EqualValues(t, d.eValues, vals)
+			}
+		})
+	}
+}
+
+// TestApplyChartFileValues is to test values set from files relative to the chart root
+func TestApplyChartFileValues(t *testing.T) {
+	ch := buildChart(func(o *chartOptions) {
+		o.Files = []*chart.File{
+			{Name: "files/nginx.conf", Data: []byte("server {\n  listen 80;\n}\n")},
+			{Name: "files/banner.txt", Data: []byte("hello, world")},
+		}
+	})
+	tests := map[string]struct {
+		files       map[string]string
+		values      map[string]interface{}
+		eValues     map[string]interface{}
+		expectedErr *string
+	}{
+		"NoFiles": {
+			values:  map[string]interface{}{"replicas": 2},
+			eValues: map[string]interface{}{"replicas": 2},
+		},
+		"ChartRelative": {
+			files:   map[string]string{"config.nginx": "files/nginx.conf", "banner": "./files/../files/banner.txt"},
+			values:  map[string]interface{}{"config": map[string]interface{}{"port": 80}},
+			eValues: map[string]interface{}{"config": map[string]interface{}{"port": 80, "nginx": "server {\n  listen 80;\n}\n"}, "banner": "hello, world"},
+		},
+		"Missing": {
+			files:       map[string]string{"config": "files/missing.conf"},
+			values:      map[string]interface{}{},
+			expectedErr: aws.String("chart file files/missing.conf of value config not found in chart hello"),
+		},
+		"OutsideChart": {
+			files:       map[string]string{"config": "../values.yaml"},
+			values:      map[string]interface{}{},
+			expectedErr: aws.String("chart file ../values.yaml of value config must be relative to the chart root"),
+		},
+		"Absolute": {
+			files:       map[string]string{"config": "/etc/passwd"},
+			values:      map[string]interface{}{},
+			expectedErr: aws.String("must be relative to the chart root"),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			vals, err := applyChartFileValues(ch, d.files, d.values)
+			if d.expectedErr != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+			} else {
+				assert.Nil(t, err)
+				assert.EqualValues(t, d.eValues, vals)
+			}
+		})
+	}
+}
+
+// TestApplyHelmFlags to test applyHelmFlags
+func TestApplyHelmFlags(t *testing.T) {
+	c := NewMockClient(t, nil)
+	tests := map[string]struct {
+		client      interface{}
+		flags       map[string]string
+		expectedErr *string
+	}{
+		"Install": {
+			client: action.NewInstall(c.HelmClient),
+			flags:  map[string]string{"skip-crds": "true", "timeout": "5m"},
+		},
+		"Upgrade": {
+			client: action.NewUpgrade(c.HelmClient),
+			flags:  map[string]string{"force": "true", "max-history": "10"},
+		},
+		"UnknownFlag": {
+			client:      action.NewInstall(c.HelmClient),
+			flags:       map[string]string{"post-renderer": "/bin/sh"},
+			expectedErr: aws.String("unsupported helm flag \"post-renderer\" for install"),
+		},
+		"UpgradeOnlyFlag": {
+			client:      action.NewInstall(c.HelmClient),
+			flags:       map[string]string{"force": "true"},
+			expectedErr: aws.String("unsupported helm flag \"force\" for install"),
+		},
+		"InvalidValue": {
+			client:      action.NewUpgrade(c.HelmClient),
+			flags:       map[string]string{"wait": "yes please"},
+			expectedErr: aws.String("invalid value \"yes please\" for helm flag \"wait\""),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := applyHelmFlags(d.client, d.flags)
+			if d.expectedErr != nil {
 				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+				return
+			}
+			assert.Nil(t, err)
+			switch cl := d.client.(type) {
+			case *action.Install:
+				assert.True(t, cl.SkipCRDs)
+				assert.Equal(t, 5*time.Minute, cl.Timeout)
+			case *action.Upgrade:
+				assert.True(t, cl.Force)
+				assert.Equal(t, 10, cl.MaxHistory)
 			}
 		})
 	}
@@ -133,7 +2009,7 @@ func TestHelmUninstall(t *testing.T) {
 	releases := []string{"one", "five"}
 	for _, rel := range releases {
 		t.Run(rel, func(t *testing.T) {
-			err := c.HelmUninstall(rel)
+			err := c.HelmUninstall(rel, nil)
 			if err != nil {
 				assert.Contains(t, err.Error(), expectedErr)
 			}
@@ -141,6 +2017,133 @@ func TestHelmUninstall(t *testing.T) {
 	}
 }
 
+// TestHelmUninstallPreview to test the resources an uninstall would delete are listed without deleting them
+func TestHelmUninstallPreview(t *testing.T) {
+	c := NewMockClient(t, nil)
+	c.HelmClient.KubeClient.(*kubefake.FailingKubeClient).DeleteError = errors.New("resources deleted")
+	keep := namedRelease("keep", release.StatusDeployed)
+	keep.Namespace = "default"
+	keep.Version = 1
+	keep.Manifest = "---\n# Source: keep/templates/pvc.yaml\napiVersion: v1\nkind: PersistentVolumeClaim\nmetadata:\n  name: data\n  annotations:\n    helm.sh/resource-policy: keep\n---\n# Source: keep/templates/svc.yaml\napiVersion: v1\nkind: Service\nmetadata:\n  name: web\n"
+	assert.Nil(t, c.HelmClient.Releases.Create(keep))
+	tests := map[string]struct {
+		name        string
+		expected    []string
+		expectedErr string
+	}{
+		"Release": {
+			name:     "one",
+			expected: []string{"Ingress test-ingress", "Service my-service", "Service lb-service", "StatefulSet nginx-ss", "DaemonSet nginx-ds", "Deployment nginx-deployment"},
+		},
+		"KeepPolicy": {
+			name:     "keep",
+			expected: []string{"Service web"},
+		},
+		"NotFound": {
+			name:        "missing",
+			expectedErr: ErrCodeNotFound,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			resources, err := c.HelmUninstallPreview(d.name)
+			if d.expectedErr != "" {
+				assert.EqualError(t, err, d.expectedErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.ElementsMatch(t, d.expected, resources)
+			rel, err := c.HelmClient.Releases.Last(d.name)
+			assert.Nil(t, err)
+			assert.Equal(t, release.StatusDeployed, rel.Info.Status)
+		})
+	}
+}
+
+// TestDeletedNamespace to test Read, Update and Delete of a release whose namespace was deleted
+func TestDeletedNamespace(t *testing.T) {
+	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
+	defer testServer.Close()
+	tests := map[string]struct {
+		namespace *v1.Namespace
+	}{
+		"Deleted": {},
+		"Terminating": {
+			namespace: &v1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{Name: "default"},
+				Status:     v1.NamespaceStatus{Phase: v1.NamespaceTerminating},
+			},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewMockClient(t, nil)
+			rejectMissingNamespaceWrites(c)
+			assert.Nil(t, c.ClientSet.CoreV1().Namespaces().Delete(context.Background(), "default", metav1.DeleteOptions{}))
+			if d.namespace != nil {
+				_, err := c.ClientSet.CoreV1().Namespaces().Create(context.Background(), d.namespace, metav1.CreateOptions{})
+				assert.Nil(t, err)
+			}
+			_, err := c.HelmStatus("one")
+			assert.EqualError(t, err, ErrCodeNotFound)
+			ch, _ := c.getChartDetails(&Model{Chart: aws.String(testServer.URL + "/test.tgz")})
+			// The release lock is not taken in the deleted namespace
+			config := &Config{Name: aws.String("one"), Namespace: aws.String("default"), OperationID: aws.String("req-1")}
+			err = c.HelmUpgrade("one", config, nil, ch, "umock-id")
+			assert.Contains(t, err.Error(), "namespace default of release one was deleted, please delete and re-create the resource")
+			assert.Nil(t, c.HelmUninstall("one", config))
+		})
+	}
+}
+
+// TestHelmStatusLegacy to test HelmStatus with Helm 2 and undecodable release storage
+func TestHelmStatusLegacy(t *testing.T) {
+	valid := base64.StdEncoding.EncodeToString([]byte(`{"name":"legacy","version":1}`))
+	tests := map[string]struct {
+		obj         runtime.Object
+		expectedErr string
+	}{
+		"Tiller": {
+			obj: &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+				Name:      "legacy.v1",
+				Namespace: "kube-system",
+				Labels:    map[string]string{"OWNER": "TILLER", "NAME": "legacy"},
+			}},
+			expectedErr: "release legacy was deployed by Helm 2 (Tiller), please migrate it to Helm 3 with the helm-2to3 plugin, see " + helmMigrationGuide,
+		},
+		"Malformed": {
+			obj: &v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "sh.helm.release.v1.legacy.v1",
+					Namespace: "default",
+					Labels:    map[string]string{"owner": "helm", "name": "legacy"},
+				},
+				Data: map[string][]byte{"release": []byte("not base64!")},
+			},
+			expectedErr: "release legacy storage secret sh.helm.release.v1.legacy.v1 could not be decoded",
+		},
+		"Decodable": {
+			obj: &v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "sh.helm.release.v1.legacy.v1",
+					Namespace: "default",
+					Labels:    map[string]string{"owner": "helm", "name": "legacy"},
+				},
+				Data: map[string][]byte{"release": []byte(valid)},
+			},
+			expectedErr: ErrCodeNotFound,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewMockClient(t, nil)
+			assert.Nil(t, c.ClientSet.(*fakeclientset.Clientset).Tracker().Add(d.obj))
+			_, err := c.HelmStatus("legacy")
+			assert.Contains(t, err.Error(), d.expectedErr)
+		})
+	}
+}
+
 // TestHelmStatus to test HelmStatus
 func TestHelmStatus(t *testing.T) {
 	c := NewMockClient(t, nil)
@@ -159,6 +2162,8 @@ func TestHelmStatus(t *testing.T) {
 				ChartVersion: "0.1.0",
 				Description:  "umock-id",
 				Manifest:     TestManifest,
+				Revision:     1,
+				Values:       map[string]interface{}{},
 			},
 		},
 		"NonExt": {
@@ -178,6 +2183,50 @@ func TestHelmStatus(t *testing.T) {
 	}
 }
 
+func TestHelmStatusNotes(t *testing.T) {
+	c := NewMockClient(t, nil)
+	ch := buildChart(func(o *chartOptions) {
+		o.Templates = append(o.Templates, &chart.File{Name: "templates/NOTES.txt", Data: []byte("Visit https://{{ .Values.host }}\nadmin password: {{ .Values.password }}")})
+	})
+	client := action.NewInstall(c.HelmClient)
+	client.ReleaseName = "notes"
+	client.Namespace = "default"
+	_, err := client.Run(ch, map[string]interface{}{"host": "example.com", "password": "s3cr3t"})
+	assert.Nil(t, err)
+	h, err := c.HelmStatus("notes")
+	assert.Nil(t, err)
+	assert.EqualValues(t, "Visit https://example.com\nadmin password: s3cr3t", h.Notes)
+	assert.Equal(t, map[string]interface{}{"host": "example.com", "password": "s3cr3t"}, h.Values)
+	tests := map[string]struct {
+		pattern     *string
+		expected    *string
+		expectedErr *string
+	}{
+		"Verbatim": {
+			expected: aws.String("Visit https://example.com\nadmin password: s3cr3t"),
+		},
+		"Redacted": {
+			pattern:  aws.String("(?i)password"),
+			expected: aws.String("Visit https://example.com\n[REDACTED]"),
+		},
+		"InvalidPattern": {
+			pattern:     aws.String("("),
+			expectedErr: aws.String("missing closing )"),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			notes, err := releaseNotes(h.Notes, d.pattern)
+			if d.expectedErr != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+			} else {
+				assert.Nil(t, err)
+				assert.EqualValues(t, d.expected, notes)
+			}
+		})
+	}
+}
+
 // TestHelmList to test HelmList
 func TestHelmList(t *testing.T) {
 	c := NewMockClient(t, nil)
@@ -218,9 +2267,140 @@ func TestHelmList(t *testing.T) {
 	}
 }
 
+// TestUpgradeConflictError to test the conflicting resources and fields named in upgrade errors
+func TestUpgradeConflictError(t *testing.T) {
+	tests := map[string]struct {
+		err      string
+		expected []string
+	}{
+		"ImmutableField": {
+			err:      `cannot patch "web" with kind Deployment: Deployment.apps "web" is invalid: spec.selector: Invalid value: v1.LabelSelector{MatchLabels:map[string]string{"app":"web"}}: field is immutable`,
+			expected: []string{`Deployment "web" field spec.selector conflicts with its live state, set the force helm flag to replace it`},
+		},
+		"Modified": {
+			err:      `cannot patch "web" with kind Service: Operation cannot be fulfilled on services "web": the object has been modified`,
+			expected: []string{`Service "web" conflicts with its live state`},
+		},
+		"Multiple": {
+			err: `cannot patch "web" with kind Deployment: Deployment.apps "web" is invalid: spec.selector: Invalid value: "x": field is immutable && ` +
+				`cannot patch "db" with kind StatefulSet: StatefulSet.apps "db" is invalid: spec: Forbidden: updates to statefulset spec are forbidden`,
+			expected: []string{`Deployment "web" field spec.selector conflicts`, `StatefulSet "db" field spec conflicts`},
+		},
+		"Ownership": {
+			err: `rendered manifests contain a new resource that already exists. Unable to continue with update: ConfigMap "seed" in namespace "default" exists and cannot be imported into the current release: invalid ownership metadata`,
+			expected: []string{
+				`ConfigMap "seed" in namespace "default" is not part of release web`,
+				"label it app.kubernetes.io/managed-by=Helm and annotate it meta.helm.sh/release-name=web and meta.helm.sh/release-namespace=default",
+			},
+		},
+		"Other": {
+			err:      "timed out waiting for the condition",
+			expected: []string{"timed out waiting for the condition"},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := upgradeConflictError(errors.New(d.err), "web", "default")
+			assert.Contains(t, err.Error(), d.err)
+			for _, e := range d.expected {
+				assert.Contains(t, err.Error(), e)
+			}
+		})
+	}
+}
+
+// TestHelmUpgradeConflict to test the upgrade error when the three-way merge patch conflicts with the live resources
+func TestHelmUpgradeConflict(t *testing.T) {
+	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
+	defer testServer.Close()
+	c := NewMockClient(t, nil)
+	c.HelmClient.KubeClient.(*kubefake.FailingKubeClient).UpdateError = errors.New(`cannot patch "one" with kind Deployment: Deployment.apps "one" is invalid: spec.selector: Invalid value: "x": field is immutable`)
+	ch, err := c.getChartDetails(&Model{Chart: aws.String(testServer.URL + "/test.tgz")})
+	assert.Nil(t, err)
+	err = c.HelmUpgrade("one", &Config{Name: aws.String("one"), Namespace: aws.String("default")}, nil, ch, "umock-id")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), `Deployment "one" field spec.selector conflicts with its live state, set the force helm flag to replace it`)
+}
+
+// TestHelmUpgradePreservedSecretValues to test a password generated on install persists across an upgrade
+func TestHelmUpgradePreservedSecretValues(t *testing.T) {
+	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
+	defer testServer.Close()
+	c := NewMockClient(t, nil)
+	_, err := c.ClientSet.CoreV1().Secrets("default").Create(context.Background(), &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "one-auth", Namespace: "default"},
+		Data:       map[string][]byte{"password": []byte("g3n3rat3d")},
+	}, metav1.CreateOptions{})
+	assert.Nil(t, err)
+	ch, err := c.getChartDetails(&Model{Chart: aws.String(testServer.URL + "/test.tgz")})
+	assert.Nil(t, err)
+	config := &Config{Name: aws.String("one"), Namespace: aws.String("default"), PreservedSecretValues: map[string]string{"auth.password": "one-auth/password"}}
+	assert.Nil(t, c.HelmUpgrade("one", config, map[string]interface{}{"replicas": 2}, ch, "umock-id"))
+	rel, err := c.HelmClient.Releases.Last("one")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"auth": map[string]interface{}{"password": "g3n3rat3d"}, "replicas": 2}, rel.Config)
+}
+
+// TestApplyValuesStrategy to test the values of an upgrade to a chart version changing its defaults for each strategy
+func TestApplyValuesStrategy(t *testing.T) {
+	chartVersion := func(version string, values map[string]interface{}) *chart.Chart {
+		return buildChart(func(o *chartOptions) {
+			o.Metadata.Version = version
+			o.Values = values
+		})
+	}
+	tests := map[string]struct {
+		strategy    *string
+		expected    map[string]interface{}
+		expectedErr string
+	}{
+		"Default": {
+			expected: map[string]interface{}{"replicas": 3, "image": map[string]interface{}{"tag": "2.0.0"}, "resources": map[string]interface{}{"cpu": "100m"}},
+		},
+		"ResetValues": {
+			strategy: aws.String(valuesReset),
+			expected: map[string]interface{}{"replicas": 3, "image": map[string]interface{}{"tag": "2.0.0"}, "resources": map[string]interface{}{"cpu": "100m"}},
+		},
+		"ReuseValues": {
+			strategy: aws.String(valuesReuse),
+			expected: map[string]interface{}{"replicas": 3, "image": map[string]interface{}{"tag": "1.0.0"}, "ingress": map[string]interface{}{"enabled": true}},
+		},
+		"ResetThenReuseValues": {
+			strategy: aws.String(valuesResetThenReuse),
+			expected: map[string]interface{}{"replicas": 3, "image": map[string]interface{}{"tag": "2.0.0"}, "resources": map[string]interface{}{"cpu": "100m"}, "ingress": map[string]interface{}{"enabled": true}},
+		},
+		"Invalid": {
+			strategy:    aws.String("Merge"),
+			expectedErr: `invalid ValuesStrategy "Merge", expected ReuseValues, ResetValues or ResetThenReuseValues`,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewMockClient(t, nil)
+			rel := namedRelease("bump", release.StatusDeployed)
+			rel.Namespace = "default"
+			rel.Chart = chartVersion("1.0.0", map[string]interface{}{"replicas": 1, "image": map[string]interface{}{"tag": "1.0.0"}})
+			rel.Config = map[string]interface{}{"ingress": map[string]interface{}{"enabled": true}}
+			assert.Nil(t, c.HelmClient.Releases.Create(rel))
+			client := action.NewUpgrade(c.HelmClient)
+			values, err := c.applyValuesStrategy(client, "bump", d.strategy, map[string]interface{}{"replicas": 3})
+			if d.expectedErr != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), d.expectedErr)
+				return
+			}
+			assert.Nil(t, err)
+			upgraded, err := client.Run("bump", chartVersion("2.0.0", map[string]interface{}{"replicas": 2, "image": map[string]interface{}{"tag": "2.0.0"}, "resources": map[string]interface{}{"cpu": "100m"}}), values)
+			assert.Nil(t, err)
+			computed, err := chartutil.CoalesceValues(upgraded.Chart, upgraded.Config)
+			assert.Nil(t, err)
+			assert.Equal(t, d.expected, computed.AsMap())
+		})
+	}
+}
+
 // TestHelmUpgrade to test HelmUpgrade
 func TestHelmUpgrade(t *testing.T) {
-	defer os.Remove(chartLocalPath)
 	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
 	defer func() { testServer.Close() }()
 	c := NewMockClient(t, nil)
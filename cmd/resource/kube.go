@@ -1,55 +1,112 @@
 package resource
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
 	"helm.sh/helm/v3/pkg/kube"
+	"helm.sh/helm/v3/pkg/releaseutil"
 	appsv1 "k8s.io/api/apps/v1"
 	appsv1beta1 "k8s.io/api/apps/v1beta1"
 	appsv1beta2 "k8s.io/api/apps/v1beta2"
+	authorizationv1 "k8s.io/api/authorization/v1"
 	corev1 "k8s.io/api/core/v1"
 	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
 	networkingv1beta1 "k8s.io/api/networking/v1beta1"
 	apiextv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	apiextv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/cli-runtime/pkg/resource"
 	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/clientcmd/api"
 	kubeconfigutil "k8s.io/kubernetes/cmd/kubeadm/app/util/kubeconfig"
+	"sigs.k8s.io/yaml"
 )
 
 const (
-	KubeConfigLocalPath = "/tmp/kubeConfig"
-	TempManifest        = "/tmp/manifest.yaml"
 	chunkSize           = 500
 	ResourcesOutputSize = 12288 // Set 12 KB as resources output limit
+	kubeEndpointTimeout = 5 * time.Second
+	// defaultExecAPIVersion is the client authentication API version of the kubeconfig exec plugin
+	defaultExecAPIVersion = "client.authentication.k8s.io/v1alpha1"
+	// DefaultNetworkPolicy selects the deny-all with allow-DNS network policy
+	DefaultNetworkPolicy = "Default"
+	// NetworkPolicyReleaseLabel tracks the network policies created for a release
+	NetworkPolicyReleaseLabel = "awsqs.kubernetes.helm/release"
+	// NamespaceReleaseLabel tracks the namespaces created for a release
+	NamespaceReleaseLabel = "awsqs.kubernetes.helm/release"
+	// CleanupNamespace and CleanupNetworkPolicy select the resources created for a release that are deleted with it
+	CleanupNamespace     = "Namespace"
+	CleanupNetworkPolicy = "NetworkPolicy"
+	// releaseLockPrefix is the name prefix of the ConfigMaps locking the releases
+	releaseLockPrefix = "awsqs-helm-lock-"
+	// releaseLockTTL is how long a release lock is held before other operations can take it over, when the operation
+	// has no deadline
+	releaseLockTTL = 15 * time.Minute
+	// tillerNamespace is where Helm 2 stored the release ConfigMaps
+	tillerNamespace = "kube-system"
+	// helmMigrationGuide describes migrating the releases deployed by Helm 2
+	helmMigrationGuide = "https://helm.sh/docs/topics/v2_v3_migration/"
+	// SuspendedReplicasAnnotation records the replicas of a workload scaled to zero by Suspend
+	SuspendedReplicasAnnotation = "awsqs.kubernetes.helm/suspended-replicas"
+	// caCheckWarn and caCheckFail log or fail on a KubeConfig CA that does not match the EKS cluster CA
+	caCheckWarn = "Warn"
+	caCheckFail = "Fail"
 )
 
 var (
+	KubeConfigLocalPath         = filepath.Join(tempDir, "kubeConfig")
+	TempManifest                = filepath.Join(tempDir, "manifest.yaml")
 	ResourcesOutputIgnoredTypes = []string{"*v1.ConfigMap", "*v1.Secret"}
 	ResourcesOutputIncludedSpec = []string{"*v1.Service"}
+	// kubeEndpointBackoff is the initial delay between retries while the cluster endpoint is not ready
+	kubeEndpointBackoff = 5 * time.Second
+	// stageTimeOut bounds the time a handler invocation waits before returning to CloudFormation
+	stageTimeOut = time.Minute
 )
 
 type ReleaseData struct {
-	Name, Chart, Namespace, Manifest string `json:",omitempty"`
+	Name, Chart, Namespace, Manifest, Description, ServiceAccount string `json:",omitempty"`
+	// ReadinessThreshold is the percentage of ready replicas across the workloads for the release to be ready
+	ReadinessThreshold int `json:",omitempty"`
+	// LockOwner is the operation ID holding the release lock
+	LockOwner string `json:",omitempty"`
 }
 
 // createKubeConfig create kubeconfig from ClusterID or Secret manager.
-func createKubeConfig(esvc EKSAPI, ssvc STSAPI, secsvc SecretsManagerAPI, cluster *string, kubeconfig *string, customKubeconfig []byte) error {
+// When authExec is set, the kubeconfig generated from the cluster uses the exec plugin instead of an EKS token.
+func createKubeConfig(esvc EKSAPI, ssvc STSAPI, secsvc SecretsManagerAPI, cluster *string, kubeconfig *string, customKubeconfig []byte, authExec *KubeAuthExec) error {
 	switch {
 	case cluster != nil && kubeconfig != nil:
 		return errors.New("both ClusterID or KubeConfig can not be specified")
 	case cluster != nil:
 		defaultConfig := api.NewConfig()
 		c, err := getClusterDetails(esvc, *cluster)
+		if err == errDescribeClusterDenied {
+			return describeClusterDeniedError(ssvc, *cluster)
+		}
 		if err != nil {
 			return genericError("Getting Cluster details", err)
 		}
@@ -57,12 +114,21 @@ func createKubeConfig(esvc EKSAPI, ssvc STSAPI, secsvc SecretsManagerAPI, cluste
 			Server:                   c.endpoint,
 			CertificateAuthorityData: []byte(c.CAData),
 		}
-		token, err := generateKubeToken(ssvc, cluster)
-		if err != nil {
-			return err
-		}
-		defaultConfig.AuthInfos["aws"] = &api.AuthInfo{
-			Token: *token,
+		if authExec != nil {
+			if authExec.Command == nil {
+				return errors.New("KubeAuthExec Command must be specified")
+			}
+			defaultConfig.AuthInfos["aws"] = &api.AuthInfo{
+				Exec: kubeExecConfig(authExec),
+			}
+		} else {
+			token, err := generateKubeToken(ssvc, cluster)
+			if err != nil {
+				return err
+			}
+			defaultConfig.AuthInfos["aws"] = &api.AuthInfo{
+				Token: *token,
+			}
 		}
 		defaultConfig.Contexts["aws"] = &api.Context{
 			Cluster:  *cluster,
@@ -99,9 +165,102 @@ func createKubeConfig(esvc EKSAPI, ssvc STSAPI, secsvc SecretsManagerAPI, cluste
 	}
 }
 
-// createNamespace create NS if not exists
-func (c *Clients) createNamespace(namespace string) error {
-	nsSpec := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
+// checkKubeConfigCA compares the certificate authority of the current cluster of the kubeconfig with the one EKS
+// reports for the cluster, named by its EKS cluster ARN, as written by aws eks update-kubeconfig, or by its name.
+func (c *Clients) checkKubeConfigCA(path string) error {
+	config, err := clientcmd.LoadFromFile(path)
+	if err != nil {
+		return genericError("Loading kubeconfig", err)
+	}
+	current, ok := config.Contexts[config.CurrentContext]
+	if !ok {
+		return fmt.Errorf("kubeconfig current context %q not found", config.CurrentContext)
+	}
+	cluster, ok := config.Clusters[current.Cluster]
+	if !ok {
+		return fmt.Errorf("kubeconfig cluster %q not found", current.Cluster)
+	}
+	if len(cluster.CertificateAuthorityData) == 0 {
+		return fmt.Errorf("kubeconfig cluster %s has no certificate-authority-data to check", current.Cluster)
+	}
+	name, region := current.Cluster, (*string)(nil)
+	if a, err := arn.Parse(current.Cluster); err == nil && a.Service == "eks" && strings.HasPrefix(a.Resource, "cluster/") {
+		name, region = strings.TrimPrefix(a.Resource, "cluster/"), aws.String(a.Region)
+	}
+	d, err := getClusterDetails(c.AWSClients.EKSClient(region, nil), name)
+	if err != nil {
+		return genericError("Getting Cluster details", err)
+	}
+	if !bytes.Equal(bytes.TrimSpace(cluster.CertificateAuthorityData), bytes.TrimSpace(d.CAData)) {
+		return fmt.Errorf("the certificate authority of cluster %s in the kubeconfig does not match the one EKS reports, the kubeconfig may be stale after a CA rotation", name)
+	}
+	log.Printf("Kubeconfig certificate authority matches EKS cluster %s", logID(name, logPhysicalID))
+	return nil
+}
+
+// kubeExecConfig builds the kubeconfig exec plugin config for the cluster credentials.
+func kubeExecConfig(authExec *KubeAuthExec) *api.ExecConfig {
+	e := &api.ExecConfig{
+		Command:    *authExec.Command,
+		Args:       authExec.Args,
+		APIVersion: defaultExecAPIVersion,
+	}
+	if authExec.APIVersion != nil {
+		e.APIVersion = *authExec.APIVersion
+	}
+	keys := make([]string, 0, len(authExec.Env))
+	for k := range authExec.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		e.Env = append(e.Env, api.ExecEnvVar{Name: k, Value: authExec.Env[k]})
+	}
+	return e
+}
+
+// waitForKubeEndpoint retries the probe while the cluster endpoint DNS does not resolve or refuses connections, until
+// the deadline. Newly created clusters may report ACTIVE before the endpoint is reachable. Other errors are left to
+// the kube calls.
+func waitForKubeEndpoint(probe func() error, deadline *time.Time) error {
+	delay := kubeEndpointBackoff
+	for count := 0; ; count++ {
+		err := probe()
+		if err == nil || !endpointNotReady(err) {
+			return nil
+		}
+		if count >= retryCount || !beforeDeadline(deadline, delay) {
+			return genericError("Kubernetes endpoint", fmt.Errorf("cluster endpoint not ready: %s", err))
+		}
+		log.Printf("Cluster endpoint not ready: %s. Retrying in %s...", err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func endpointNotReady(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	return strings.Contains(err.Error(), "no such host") || strings.Contains(err.Error(), "connection refused")
+}
+
+// namespaceGone checks whether the namespace was deleted or is being deleted
+func (c *Clients) namespaceGone(namespace string) (bool, error) {
+	ns, err := c.ClientSet.CoreV1().Namespaces().Get(context.Background(), namespace, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, genericError("Get NS", err)
+	}
+	return ns.Status.Phase == corev1.NamespaceTerminating, nil
+}
+
+// createNamespace create NS if not exists, labelling it with the release it is created for
+func (c *Clients) createNamespace(namespace string, release string) error {
+	nsSpec := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace, Labels: map[string]string{NamespaceReleaseLabel: release}}}
 	_, err := c.ClientSet.CoreV1().Namespaces().Create(context.Background(), nsSpec, metav1.CreateOptions{})
 	switch err {
 	case nil:
@@ -117,12 +276,235 @@ func (c *Clients) createNamespace(namespace string) error {
 	}
 }
 
+// defaultNetworkPolicy denies all ingress and egress traffic for the namespace pods, except DNS.
+func defaultNetworkPolicy(release string) *networkingv1.NetworkPolicy {
+	port := intstr.FromInt(53)
+	udp, tcp := corev1.ProtocolUDP, corev1.ProtocolTCP
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: release + "-default-deny"},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+			Egress: []networkingv1.NetworkPolicyEgressRule{{
+				Ports: []networkingv1.NetworkPolicyPort{{Protocol: &udp, Port: &port}, {Protocol: &tcp, Port: &port}},
+			}},
+		},
+	}
+}
+
+// applyNetworkPolicy creates or updates the default or supplied network policy in the release namespace.
+func (c *Clients) applyNetworkPolicy(namespace string, release string, policy *string) error {
+	if IsZero(policy) {
+		return nil
+	}
+	np := defaultNetworkPolicy(release)
+	if *policy != DefaultNetworkPolicy {
+		np = &networkingv1.NetworkPolicy{}
+		if err := yaml.Unmarshal([]byte(*policy), np); err != nil {
+			return genericError("Parsing NetworkPolicy", err)
+		}
+		if np.Name == "" {
+			return genericError("Parsing NetworkPolicy", errors.New("metadata.name is required"))
+		}
+	}
+	np.Namespace = namespace
+	if np.Labels == nil {
+		np.Labels = map[string]string{}
+	}
+	np.Labels[NetworkPolicyReleaseLabel] = release
+	client := c.ClientSet.NetworkingV1().NetworkPolicies(namespace)
+	_, err := client.Create(context.Background(), np, metav1.CreateOptions{})
+	if kerrors.IsAlreadyExists(err) {
+		_, err = client.Update(context.Background(), np, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return genericError("Apply NetworkPolicy", err)
+	}
+	log.Printf("Applied NetworkPolicy %s/%s", namespace, np.Name)
+	return nil
+}
+
+// deleteNetworkPolicies deletes the network policies created for the release.
+func (c *Clients) deleteNetworkPolicies(namespace string, release string) error {
+	client := c.ClientSet.NetworkingV1().NetworkPolicies(namespace)
+	list, err := client.List(context.Background(), metav1.ListOptions{LabelSelector: NetworkPolicyReleaseLabel + "=" + release})
+	if err != nil {
+		return genericError("Delete NetworkPolicy", err)
+	}
+	for _, np := range list.Items {
+		err := client.Delete(context.Background(), np.Name, metav1.DeleteOptions{})
+		if err != nil && !kerrors.IsNotFound(err) {
+			return genericError("Delete NetworkPolicy", err)
+		}
+		log.Printf("Deleted NetworkPolicy %s/%s", namespace, np.Name)
+	}
+	return nil
+}
+
+// deleteReleaseNamespace deletes the namespace when it was created for the release and no other helm release is stored in it.
+// Namespaces that existed before the release was installed are kept.
+func (c *Clients) deleteReleaseNamespace(namespace string, release string) error {
+	ns, err := c.ClientSet.CoreV1().Namespaces().Get(context.Background(), namespace, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return genericError("Delete NS", err)
+	}
+	if ns.Labels[NamespaceReleaseLabel] != release {
+		log.Printf("Namespace %s was not created for release %s, keeping it", namespace, release)
+		return nil
+	}
+	opts := metav1.ListOptions{LabelSelector: "owner=helm,name!=" + release}
+	secrets, err := c.ClientSet.CoreV1().Secrets(namespace).List(context.Background(), opts)
+	if err != nil {
+		return genericError("Delete NS", err)
+	}
+	configMaps, err := c.ClientSet.CoreV1().ConfigMaps(namespace).List(context.Background(), opts)
+	if err != nil {
+		return genericError("Delete NS", err)
+	}
+	if len(secrets.Items) > 0 || len(configMaps.Items) > 0 {
+		log.Printf("Namespace %s holds other releases, keeping it", namespace)
+		return nil
+	}
+	err = c.ClientSet.CoreV1().Namespaces().Delete(context.Background(), namespace, metav1.DeleteOptions{})
+	if err != nil && !kerrors.IsNotFound(err) {
+		return genericError("Delete NS", err)
+	}
+	log.Printf("Deleted namespace %s", namespace)
+	return nil
+}
+
+// acquireReleaseLock takes the lock ConfigMap of the release for the owner, so overlapping operations on the release are rejected.
+// The lock is refreshed until the expiry when already held by the owner and taken over when expired.
+func (c *Clients) acquireReleaseLock(namespace string, release string, owner string, expiry time.Time) error {
+	client := c.ClientSet.CoreV1().ConfigMaps(namespace)
+	name := releaseLockPrefix + release
+	expires := expiry.UTC().Format(time.RFC3339)
+	cm, err := client.Get(context.Background(), name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		_, err = client.Create(context.Background(), &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Data:       map[string]string{"owner": owner, "expires": expires},
+		}, metav1.CreateOptions{})
+		if kerrors.IsAlreadyExists(err) {
+			return fmt.Errorf("release %s is locked by another operation", release)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if cm.Data["owner"] != owner {
+		expiry, err := time.Parse(time.RFC3339, cm.Data["expires"])
+		if err == nil && time.Now().Before(expiry) {
+			return fmt.Errorf("release %s is locked by operation %s until %s", release, cm.Data["owner"], cm.Data["expires"])
+		}
+		log.Printf("Taking over stale lock of release %s from operation %s", release, cm.Data["owner"])
+	}
+	cm.Data = map[string]string{"owner": owner, "expires": expires}
+	_, err = client.Update(context.Background(), cm, metav1.UpdateOptions{})
+	if kerrors.IsConflict(err) {
+		return fmt.Errorf("release %s is locked by another operation", release)
+	}
+	return err
+}
+
+// releaseReleaseLock deletes the lock ConfigMap of the release if held by the owner.
+func (c *Clients) releaseReleaseLock(namespace string, release string, owner string) error {
+	client := c.ClientSet.CoreV1().ConfigMaps(namespace)
+	name := releaseLockPrefix + release
+	cm, err := client.Get(context.Background(), name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if cm.Data["owner"] != owner {
+		return nil
+	}
+	err = client.Delete(context.Background(), name, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{ResourceVersion: &cm.ResourceVersion}})
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// checkLegacyRelease errors when the release was deployed by Helm 2 or its Helm 3 storage cannot be decoded,
+// which the helm client otherwise reports as a missing release revision.
+func (c *Clients) checkLegacyRelease(namespace string, release string) error {
+	cms, err := c.ClientSet.CoreV1().ConfigMaps(tillerNamespace).List(context.Background(), metav1.ListOptions{LabelSelector: "OWNER=TILLER,NAME=" + release})
+	if err != nil && !kerrors.IsNotFound(err) && !kerrors.IsForbidden(err) {
+		return genericError("Checking legacy release", err)
+	}
+	if err == nil && len(cms.Items) > 0 {
+		return fmt.Errorf("release %s was deployed by Helm 2 (Tiller), please migrate it to Helm 3 with the helm-2to3 plugin, see %s", release, helmMigrationGuide)
+	}
+	secrets, err := c.ClientSet.CoreV1().Secrets(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: "owner=helm,name=" + release})
+	if err != nil {
+		return genericError("Checking legacy release", err)
+	}
+	for _, s := range secrets.Items {
+		if err := decodeReleaseData(s.Data["release"]); err != nil {
+			return fmt.Errorf("release %s storage secret %s could not be decoded (%s), it may have been written by an incompatible Helm version, see %s", release, s.Name, err, helmMigrationGuide)
+		}
+	}
+	return nil
+}
+
+// decodeReleaseData decodes the base64 encoded, optionally gzipped, JSON release stored by helm.
+func decodeReleaseData(data []byte) error {
+	b, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return err
+	}
+	if len(b) > 2 && b[0] == 0x1f && b[1] == 0x8b {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if b, err = ioutil.ReadAll(r); err != nil {
+			return err
+		}
+	}
+	rel := map[string]interface{}{}
+	return json.Unmarshal(b, &rel)
+}
+
+// lockRelease acquires the release lock for the operation until the operation deadline, so the lock is held across the
+// callbacks stabilizing the release. Operations without an operation ID run unlocked.
+func (c *Clients) lockRelease(config *Config, release string) error {
+	if config == nil || IsZero(config.OperationID) || IsZero(config.Namespace) {
+		return nil
+	}
+	expiry := time.Now().Add(releaseLockTTL)
+	if config.Deadline != nil {
+		expiry = *config.Deadline
+	}
+	return c.acquireReleaseLock(*config.Namespace, release, *config.OperationID, expiry)
+}
+
+// UnlockRelease releases the lock of the release held by the operation of the release data, once the operation is
+// complete or failed. Failures are only logged as the lock expires at the operation deadline.
+func (c *Clients) UnlockRelease(r *ReleaseData) {
+	if r == nil || r.LockOwner == "" || r.Namespace == "" {
+		return
+	}
+	if err := c.releaseReleaseLock(r.Namespace, r.Name, r.LockOwner); err != nil {
+		log.Printf("Failed to release lock of release %s: %v", r.Name, err)
+	}
+}
+
 // CheckPendingResources checks pending resources in for the specific release.
 func (c *Clients) CheckPendingResources(r *ReleaseData) (bool, error) {
 	log.Printf("Checking pending resources in %s", r.Name)
 	var err error
 	var errCount int
 	var pArray []bool
+	var readyReplicas, desiredReplicas int32
 	if r.Manifest == "" {
 		return true, errors.New("Manifest not provided in the request")
 	}
@@ -146,6 +528,11 @@ func (c *Clients) CheckPendingResources(r *ReleaseData) (bool, error) {
 			if currentDeployment.Spec.Paused {
 				continue
 			}
+			readyReplicas += currentDeployment.Status.ReadyReplicas
+			desiredReplicas += *currentDeployment.Spec.Replicas
+			if r.ReadinessThreshold > 0 {
+				continue
+			}
 			if !deploymentReady(currentDeployment) {
 				pArray = append(pArray, false)
 			}
@@ -165,6 +552,11 @@ func (c *Clients) CheckPendingResources(r *ReleaseData) (bool, error) {
 				errCount++
 				continue
 			}
+			readyReplicas += ds.Status.NumberReady
+			desiredReplicas += ds.Status.DesiredNumberScheduled
+			if r.ReadinessThreshold > 0 {
+				continue
+			}
 			if !daemonSetReady(ds) {
 				pArray = append(pArray, false)
 			}
@@ -175,6 +567,16 @@ func (c *Clients) CheckPendingResources(r *ReleaseData) (bool, error) {
 				errCount++
 				continue
 			}
+			// 1 is the default for replicas if not set
+			replicas := int32(1)
+			if sts.Spec.Replicas != nil {
+				replicas = *sts.Spec.Replicas
+			}
+			readyReplicas += sts.Status.ReadyReplicas
+			desiredReplicas += replicas
+			if r.ReadinessThreshold > 0 {
+				continue
+			}
 			if !statefulSetReady(sts) {
 				pArray = append(pArray, false)
 			}
@@ -214,12 +616,285 @@ func (c *Clients) CheckPendingResources(r *ReleaseData) (bool, error) {
 			}
 		}
 	}
+	if r.ReadinessThreshold > 0 && !workloadsReady(r.Name, readyReplicas, desiredReplicas, r.ReadinessThreshold) {
+		pArray = append(pArray, false)
+	}
+	if r.ServiceAccount != "" {
+		ready, err := c.serviceAccountSecretReady(r.Namespace, r.ServiceAccount)
+		if err != nil {
+			return true, err
+		}
+		if !ready {
+			log.Printf("Waiting for ServiceAccount %s/%s token secret", r.Namespace, r.ServiceAccount)
+			pArray = append(pArray, false)
+		}
+	}
+	ProgressDetail = ""
+	if desiredReplicas > 0 && readyReplicas < desiredReplicas {
+		ProgressDetail = fmt.Sprintf("%d/%d pods ready", readyReplicas, desiredReplicas)
+	}
 	if len(pArray) > 0 || errCount != 0 {
 		return true, err
 	}
 	return false, err
 }
 
+// serviceAccountSecretReady checks the ServiceAccount exists and its token secret has been populated.
+func (c *Clients) serviceAccountSecretReady(namespace string, name string) (bool, error) {
+	sa, err := c.ClientSet.CoreV1().ServiceAccounts(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	refs := map[string]bool{}
+	for _, ref := range sa.Secrets {
+		refs[ref.Name] = true
+	}
+	secrets, err := c.ClientSet.CoreV1().Secrets(namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return false, err
+	}
+	for _, secret := range secrets.Items {
+		if secret.Type != corev1.SecretTypeServiceAccountToken {
+			continue
+		}
+		if !refs[secret.Name] && secret.Annotations[corev1.ServiceAccountNameKey] != name {
+			continue
+		}
+		if len(secret.Data[corev1.ServiceAccountTokenKey]) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkRequiredResources checks the Secrets and ConfigMaps the chart expects to already exist.
+// References are in the form Kind/Name, or Kind/Namespace/Name for another namespace.
+func (c *Clients) checkRequiredResources(namespace string, refs []string) error {
+	var missing []string
+	for _, ref := range refs {
+		parts := strings.Split(ref, "/")
+		ns, name := namespace, ""
+		switch len(parts) {
+		case 2:
+			name = parts[1]
+		case 3:
+			ns, name = parts[1], parts[2]
+		default:
+			return fmt.Errorf("invalid resource reference %q, expected Kind/Name or Kind/Namespace/Name", ref)
+		}
+		var err error
+		switch strings.ToLower(parts[0]) {
+		case "secret":
+			_, err = c.ClientSet.CoreV1().Secrets(ns).Get(context.Background(), name, metav1.GetOptions{})
+		case "configmap":
+			_, err = c.ClientSet.CoreV1().ConfigMaps(ns).Get(context.Background(), name, metav1.GetOptions{})
+		default:
+			return fmt.Errorf("unsupported kind %q in %q, only Secret and ConfigMap are supported", parts[0], ref)
+		}
+		if kerrors.IsNotFound(err) {
+			missing = append(missing, ref)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("required resources not found in namespace %s: %s", namespace, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// preserveSecretValues sets the value paths the values leave unset to the data of the Secret keys, referenced as
+// secret-name/key in the release namespace, so values the chart generated on install are carried forward on upgrade.
+// Secrets or keys that do not exist yet are skipped.
+func (c *Clients) preserveSecretValues(namespace string, refs map[string]string, values map[string]interface{}) (map[string]interface{}, error) {
+	if len(refs) == 0 {
+		return values, nil
+	}
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+	paths := make([]string, 0, len(refs))
+	for p := range refs {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		parts := strings.Split(refs[p], "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid Secret reference %q of value %s, expected secret-name/key", refs[p], p)
+		}
+		if hasValuePath(values, p) {
+			log.Printf("Value %s is set, not preserving it from Secret %s/%s", p, namespace, parts[0])
+			continue
+		}
+		secret, err := c.ClientSet.CoreV1().Secrets(namespace).Get(context.Background(), parts[0], metav1.GetOptions{})
+		if kerrors.IsNotFound(err) {
+			log.Printf("Secret %s/%s not found, not preserving value %s", namespace, parts[0], p)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, ok := secret.Data[parts[1]]
+		if !ok {
+			log.Printf("Secret %s/%s has no key %s, not preserving value %s", namespace, parts[0], parts[1], p)
+			continue
+		}
+		if err := setValuePath(values, p, string(data)); err != nil {
+			return nil, err
+		}
+		log.Printf("Preserved value %s from Secret %s/%s", p, namespace, parts[0])
+	}
+	return values, nil
+}
+
+// checkPermissions reviews with SelfSubjectAccessReviews whether the identity may use the verbs on the kinds of the
+// rendered manifests, and returns all the missing permissions at once. Kinds the cluster does not serve yet, like
+// custom resources of CRDs in the same chart, are skipped.
+func (c *Clients) checkPermissions(manifests string, namespace string, verbs []string) error {
+	groups, err := restmapper.GetAPIGroupResources(c.ClientSet.Discovery())
+	if err != nil {
+		return err
+	}
+	mapper := restmapper.NewDiscoveryRESTMapper(groups)
+	reviewed := map[authorizationv1.ResourceAttributes]bool{}
+	var missing []string
+	for _, m := range releaseutil.SplitManifests(manifests) {
+		obj := &metav1.PartialObjectMetadata{}
+		if err := yaml.Unmarshal([]byte(m), obj); err != nil {
+			return err
+		}
+		if obj.Kind == "" {
+			continue
+		}
+		gvk := obj.GroupVersionKind()
+		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			log.Printf("Skipping permission check of %s: %s", gvk.Kind, err)
+			continue
+		}
+		ns := ""
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			ns = namespace
+			if obj.Namespace != "" {
+				ns = obj.Namespace
+			}
+		}
+		for _, verb := range verbs {
+			attr := authorizationv1.ResourceAttributes{Namespace: ns, Verb: verb, Group: mapping.Resource.Group, Resource: mapping.Resource.Resource}
+			if reviewed[attr] {
+				continue
+			}
+			reviewed[attr] = true
+			review, err := c.ClientSet.AuthorizationV1().SelfSubjectAccessReviews().Create(context.Background(), &authorizationv1.SelfSubjectAccessReview{
+				Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: &attr},
+			}, metav1.CreateOptions{})
+			if err != nil {
+				return err
+			}
+			if review.Status.Allowed {
+				continue
+			}
+			perm := fmt.Sprintf("%s %s", verb, mapping.Resource.GroupResource())
+			if ns != "" {
+				perm += " in namespace " + ns
+			}
+			missing = append(missing, perm)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("missing permissions to deploy the release: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// scaleWorkloads scales the deployments and statefulsets of the release manifest to zero replicas when suspend is set,
+// recording their replicas in the SuspendedReplicasAnnotation, and restores the recorded replicas otherwise.
+func (c *Clients) scaleWorkloads(manifest string, namespace string, suspend bool) error {
+	ctx := context.Background()
+	for _, m := range releaseutil.SplitManifests(manifest) {
+		obj := &metav1.PartialObjectMetadata{}
+		if err := yaml.Unmarshal([]byte(m), obj); err != nil {
+			return genericError("Scaling workloads", err)
+		}
+		ns := namespace
+		if obj.Namespace != "" {
+			ns = obj.Namespace
+		}
+		var err error
+		switch obj.Kind {
+		case "Deployment":
+			client := c.ClientSet.AppsV1().Deployments(ns)
+			var dep *appsv1.Deployment
+			if dep, err = client.Get(ctx, obj.Name, metav1.GetOptions{}); err == nil {
+				var changed bool
+				if changed, err = scaleReplicas("Deployment "+ns+"/"+obj.Name, &dep.ObjectMeta, &dep.Spec.Replicas, suspend); changed {
+					_, err = client.Update(ctx, dep, metav1.UpdateOptions{})
+				}
+			}
+		case "StatefulSet":
+			client := c.ClientSet.AppsV1().StatefulSets(ns)
+			var sts *appsv1.StatefulSet
+			if sts, err = client.Get(ctx, obj.Name, metav1.GetOptions{}); err == nil {
+				var changed bool
+				if changed, err = scaleReplicas("StatefulSet "+ns+"/"+obj.Name, &sts.ObjectMeta, &sts.Spec.Replicas, suspend); changed {
+					_, err = client.Update(ctx, sts, metav1.UpdateOptions{})
+				}
+			}
+		}
+		if kerrors.IsNotFound(err) {
+			log.Printf("Skipping scaling of %s %s/%s: %s", obj.Kind, ns, obj.Name, err)
+			continue
+		}
+		if err != nil {
+			return genericError("Scaling workloads", err)
+		}
+	}
+	return nil
+}
+
+// scaleReplicas sets the replicas to zero when suspend is set, recording them in the annotations when the workload is
+// not suspended yet, and restores the recorded replicas when suspend is unset. Upgrades of a suspended workload reset
+// its replicas to those of the chart, so they are set to zero again while the recorded replicas are kept. It reports
+// whether the workload changed.
+func scaleReplicas(workload string, meta *metav1.ObjectMeta, replicas **int32, suspend bool) (bool, error) {
+	recorded, suspended := meta.Annotations[SuspendedReplicasAnnotation]
+	// 1 is the default for replicas if not set
+	current := int32(1)
+	if *replicas != nil {
+		current = **replicas
+	}
+	switch {
+	case suspend && !suspended:
+		if meta.Annotations == nil {
+			meta.Annotations = map[string]string{}
+		}
+		meta.Annotations[SuspendedReplicasAnnotation] = strconv.Itoa(int(current))
+		*replicas = aws.Int32(0)
+		log.Printf("Suspending %s, scaling %d replicas to zero", workload, current)
+	case suspend && current != 0:
+		*replicas = aws.Int32(0)
+		log.Printf("Keeping %s suspended, scaling %d replicas back to zero", workload, current)
+	case !suspend && suspended:
+		n, err := strconv.ParseInt(recorded, 10, 32)
+		if err != nil {
+			return false, fmt.Errorf("invalid %s annotation %q of %s", SuspendedReplicasAnnotation, recorded, workload)
+		}
+		delete(meta.Annotations, SuspendedReplicasAnnotation)
+		*replicas = aws.Int32(int32(n))
+		log.Printf("Resuming %s, restoring %d replicas", workload, n)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
 // GetKubeResources get resources for the specific release.
 func (c *Clients) GetKubeResources(r *ReleaseData) (map[string]interface{}, error) {
 	log.Printf("Getting resources for %s", r.Name)
@@ -375,6 +1050,18 @@ func serviceReady(s *corev1.Service) bool {
 	return true
 }
 
+// workloadsReady checks the ready replicas across the release workloads meet the threshold percentage of the desired replicas.
+func workloadsReady(release string, ready int32, desired int32, threshold int) bool {
+	if int64(ready)*100 < int64(desired)*int64(threshold) {
+		msg := fmt.Sprintf("Workloads are not ready: %s. %d out of %d expected pods are ready, %d%% required", release, ready, desired, threshold)
+		log.Printf(msg)
+		pushLastKnownError(msg)
+		return false
+	}
+	popLastKnownError(release)
+	return true
+}
+
 func deploymentReady(dep *appsv1.Deployment) bool {
 	if !(dep.Status.ReadyReplicas >= *dep.Spec.Replicas) {
 		msg := fmt.Sprintf("Deployment is not ready: %s/%s. %d out of %d expected pods are ready", dep.Namespace, dep.Name, dep.Status.ReadyReplicas, *dep.Spec.Replicas)
@@ -1,17 +1,38 @@
 package resource
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
 	appsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/api/extensions/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
 	networkingv1beta1 "k8s.io/api/networking/v1beta1"
 	apiextv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	apiextv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
-	"os"
-	"testing"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/stretchr/testify/assert"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
 )
 
 // TestCreateKubeConfig to test createKubeConfig
@@ -44,6 +65,10 @@ func TestCreateKubeConfig(t *testing.T) {
 			kubeconfig:  aws.String("arn:aws:secretsmanager:us-east-2:1234567890:secret:kubeconfig-Wt"),
 			expectedErr: "",
 		},
+		"DescribeClusterDenied": {
+			cluster:     aws.String("denied"),
+			expectedErr: "role arn:aws:iam::1234567890:role/TestRole is not authorized to perform eks:DescribeCluster on cluster denied",
+		},
 		"NilValues": {
 			expectedErr: "either ClusterID or KubeConfig must be specified",
 		},
@@ -54,7 +79,7 @@ func TestCreateKubeConfig(t *testing.T) {
 	}
 	for name, d := range tests {
 		t.Run(name, func(t *testing.T) {
-			err := createKubeConfig(mockEKSSvc, mockSTSSvc, mockSMSvc, d.cluster, d.kubeconfig, d.customKubeconfig)
+			err := createKubeConfig(mockEKSSvc, mockSTSSvc, mockSMSvc, d.cluster, d.kubeconfig, d.customKubeconfig, nil)
 			if err != nil {
 				assert.Contains(t, err.Error(), d.expectedErr)
 			} else {
@@ -64,11 +89,136 @@ func TestCreateKubeConfig(t *testing.T) {
 	}
 }
 
+// TestCreateKubeConfigExec to test createKubeConfig with an exec plugin
+func TestCreateKubeConfigExec(t *testing.T) {
+	defer os.Remove(KubeConfigLocalPath)
+	tests := map[string]struct {
+		authExec    *KubeAuthExec
+		apiVersion  string
+		expectedErr string
+	}{
+		"DefaultAPIVersion": {
+			authExec: &KubeAuthExec{
+				Command: aws.String("aws-iam-authenticator"),
+				Args:    []string{"token", "-i", "eks"},
+				Env:     map[string]string{"AWS_PROFILE": "dev", "AWS_REGION": "us-east-1"},
+			},
+			apiVersion: "client.authentication.k8s.io/v1alpha1",
+		},
+		"CustomAPIVersion": {
+			authExec: &KubeAuthExec{
+				Command:    aws.String("aws-iam-authenticator"),
+				Args:       []string{"token", "-i", "eks"},
+				APIVersion: aws.String("client.authentication.k8s.io/v1beta1"),
+			},
+			apiVersion: "client.authentication.k8s.io/v1beta1",
+		},
+		"NoCommand": {
+			authExec:    &KubeAuthExec{},
+			expectedErr: "KubeAuthExec Command must be specified",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := createKubeConfig(&mockEKSClient{}, &mockSTSClient{}, &mockSecretsManagerClient{}, aws.String("eks"), nil, nil, d.authExec)
+			if d.expectedErr != "" {
+				assert.EqualError(t, err, d.expectedErr)
+				return
+			}
+			assert.Nil(t, err)
+			config, err := clientcmd.LoadFromFile(KubeConfigLocalPath)
+			assert.Nil(t, err)
+			auth := config.AuthInfos["aws"]
+			assert.Empty(t, auth.Token)
+			assert.EqualValues(t, "aws-iam-authenticator", auth.Exec.Command)
+			assert.EqualValues(t, []string{"token", "-i", "eks"}, auth.Exec.Args)
+			assert.EqualValues(t, d.apiVersion, auth.Exec.APIVersion)
+			for _, env := range auth.Exec.Env {
+				assert.EqualValues(t, d.authExec.Env[env.Name], env.Value)
+			}
+			assert.Len(t, auth.Exec.Env, len(d.authExec.Env))
+		})
+	}
+}
+
+// TestWaitForKubeEndpoint to test waitForKubeEndpoint
+func TestWaitForKubeEndpoint(t *testing.T) {
+	backoff := kubeEndpointBackoff
+	kubeEndpointBackoff = time.Millisecond
+	defer func() { kubeEndpointBackoff = backoff }()
+	dnsErr := &url.Error{Op: "Get", URL: "https://eks.test.com/version", Err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "eks.test.com", IsNotFound: true}}}
+	tests := map[string]struct {
+		failures    int
+		err         error
+		deadline    *time.Time
+		eCalls      int
+		expectedErr *string
+	}{
+		"Ready": {
+			eCalls: 1,
+		},
+		"ResolvesOnRetry": {
+			failures: 2,
+			err:      dnsErr,
+			eCalls:   3,
+		},
+		"ConnectionRefused": {
+			failures: 1,
+			err:      errors.New("dial tcp 10.0.0.1:443: connect: connection refused"),
+			eCalls:   2,
+		},
+		"NeverResolves": {
+			failures:    retryCount + 1,
+			err:         dnsErr,
+			eCalls:      retryCount + 1,
+			expectedErr: aws.String("cluster endpoint not ready"),
+		},
+		"OtherError": {
+			failures: 1,
+			err:      errors.New("Unauthorized"),
+			eCalls:   1,
+		},
+		"PastStageDeadline": {
+			failures:    2,
+			err:         dnsErr,
+			deadline:    aws.Time(time.Now()),
+			eCalls:      1,
+			expectedErr: aws.String("cluster endpoint not ready"),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			calls := 0
+			err := waitForKubeEndpoint(func() error {
+				calls++
+				if calls <= d.failures {
+					return d.err
+				}
+				return nil
+			}, d.deadline)
+			assert.Equal(t, d.eCalls, calls)
+			if d.expectedErr != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
 // TestCreateNamespace to test createNamespace
 func TestCreateNamespace(t *testing.T) {
 	c := NewMockClient(t, nil)
-	err := c.createNamespace("test")
+	err := c.createNamespace("test", "one")
+	assert.NoError(t, err)
+	ns, err := c.ClientSet.CoreV1().Namespaces().Get(context.Background(), "test", metav1.GetOptions{})
 	assert.NoError(t, err)
+	assert.EqualValues(t, "one", ns.Labels[NamespaceReleaseLabel])
+	// An existing namespace is not labelled for the release
+	assert.NoError(t, c.createNamespace("default", "one"))
+	ns, err = c.ClientSet.CoreV1().Namespaces().Get(context.Background(), "default", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, ns.Labels[NamespaceReleaseLabel])
 }
 
 // TestCheckPendingResources to test CheckPendingResources
@@ -102,6 +252,461 @@ func TestCheckPendingResources(t *testing.T) {
 	}
 }
 
+// TestCheckPendingResourcesThreshold to test CheckPendingResources with a readiness threshold
+func TestCheckPendingResourcesThreshold(t *testing.T) {
+	defer os.Remove(TempManifest)
+	tests := map[string]struct {
+		threshold int
+		ready     int32
+		assertion assert.BoolAssertionFunc
+		detail    string
+	}{
+		"BelowThreshold": {
+			threshold: 90,
+			ready:     8,
+			assertion: assert.True,
+			detail:    "8/10 pods ready",
+		},
+		"AtThreshold": {
+			threshold: 90,
+			ready:     9,
+			assertion: assert.False,
+			detail:    "9/10 pods ready",
+		},
+		"AllReady": {
+			threshold: 90,
+			ready:     10,
+			assertion: assert.False,
+		},
+		"NoThreshold": {
+			ready:     9,
+			assertion: assert.True,
+			detail:    "9/10 pods ready",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewMockClient(t, nil)
+			dep, err := c.ClientSet.AppsV1().Deployments("default").Get(context.Background(), "nginx-deployment-foo", metav1.GetOptions{})
+			assert.Nil(t, err)
+			dep.Spec.Replicas = aws.Int32(10)
+			dep.Status.ReadyReplicas = d.ready
+			_, err = c.ClientSet.AppsV1().Deployments("default").Update(context.Background(), dep, metav1.UpdateOptions{})
+			assert.Nil(t, err)
+			rd := &ReleaseData{Name: "test", Namespace: "default", Manifest: TestPendingManifest, ReadinessThreshold: d.threshold}
+			result, err := c.CheckPendingResources(rd)
+			assert.Nil(t, err)
+			d.assertion(t, result)
+			assert.Equal(t, d.detail, ProgressDetail)
+		})
+	}
+}
+
+// TestServiceAccountSecretReady to test serviceAccountSecretReady
+func TestServiceAccountSecretReady(t *testing.T) {
+	polls := 3
+	tests := map[string]struct {
+		sa     *corev1.ServiceAccount
+		secret *corev1.Secret
+	}{
+		"ReferencedSecret": {
+			sa: &corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+				Secrets:    []corev1.ObjectReference{{Name: "app-token-abcde"}},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "app-token-abcde", Namespace: "default"},
+				Type:       corev1.SecretTypeServiceAccountToken,
+				Data:       map[string][]byte{corev1.ServiceAccountTokenKey: []byte("token")},
+			},
+		},
+		"AnnotatedSecret": {
+			sa: &corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "app-token",
+					Namespace:   "default",
+					Annotations: map[string]string{corev1.ServiceAccountNameKey: "app"},
+				},
+				Type: corev1.SecretTypeServiceAccountToken,
+				Data: map[string][]byte{corev1.ServiceAccountTokenKey: []byte("token")},
+			},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewMockClient(t, nil)
+			ready, err := c.serviceAccountSecretReady("default", "app")
+			assert.Nil(t, err)
+			assert.False(t, ready)
+			_, _ = c.ClientSet.CoreV1().ServiceAccounts("default").Create(context.Background(), d.sa, metav1.CreateOptions{})
+			// The token secret is populated by another controller after a few polls
+			for i := 1; i <= polls; i++ {
+				if i == polls {
+					_, _ = c.ClientSet.CoreV1().Secrets("default").Create(context.Background(), d.secret, metav1.CreateOptions{})
+				}
+				ready, err := c.serviceAccountSecretReady("default", "app")
+				assert.Nil(t, err)
+				assert.Equal(t, i == polls, ready)
+			}
+			pending, err := c.CheckPendingResources(&ReleaseData{Name: "test", Namespace: "default", Manifest: TestManifest, ServiceAccount: "app"})
+			assert.Nil(t, err)
+			assert.False(t, pending)
+		})
+	}
+}
+
+func TestCheckRequiredResources(t *testing.T) {
+	tests := map[string]struct {
+		refs        []string
+		expectedErr *string
+	}{
+		"NoRefs": {},
+		"Existing": {
+			refs: []string{"Secret/db-creds", "ConfigMap/app-config", "secret/kube-system/registry"},
+		},
+		"MissingSecret": {
+			refs:        []string{"Secret/db-creds", "Secret/api-key", "ConfigMap/app-config", "ConfigMap/other"},
+			expectedErr: aws.String("required resources not found in namespace default: Secret/api-key, ConfigMap/other"),
+		},
+		"InvalidRef": {
+			refs:        []string{"db-creds"},
+			expectedErr: aws.String("invalid resource reference \"db-creds\""),
+		},
+		"UnsupportedKind": {
+			refs:        []string{"Deployment/web"},
+			expectedErr: aws.String("unsupported kind \"Deployment\""),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewMockClient(t, nil)
+			_, _ = c.ClientSet.CoreV1().Secrets("default").Create(context.Background(), &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "db-creds", Namespace: "default"}}, metav1.CreateOptions{})
+			_, _ = c.ClientSet.CoreV1().Secrets("kube-system").Create(context.Background(), &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "registry", Namespace: "kube-system"}}, metav1.CreateOptions{})
+			_, _ = c.ClientSet.CoreV1().ConfigMaps("default").Create(context.Background(), &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "app-config", Namespace: "default"}}, metav1.CreateOptions{})
+			err := c.checkRequiredResources("default", d.refs)
+			if d.expectedErr != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+// TestCheckPermissions to test checkPermissions with a fake authorizer denying some verbs and resources
+func TestCheckPermissions(t *testing.T) {
+	manifests := `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: web
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: web-tls
+  namespace: kube-system
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: web-ca
+  namespace: kube-system
+---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: web
+`
+	tests := map[string]struct {
+		verbs           []string
+		denied          []string
+		expectedReviews int
+		expectedErr     *string
+	}{
+		"Allowed": {
+			verbs:           []string{"create"},
+			expectedReviews: 3,
+		},
+		"DeniedClusterScoped": {
+			verbs:           []string{"create"},
+			denied:          []string{"create clusterroles"},
+			expectedReviews: 3,
+			expectedErr:     aws.String("missing permissions to deploy the release: create clusterroles.rbac.authorization.k8s.io"),
+		},
+		"DeniedUpgrade": {
+			verbs:           []string{"create", "patch"},
+			denied:          []string{"patch deployments", "create secrets"},
+			expectedReviews: 6,
+			expectedErr:     aws.String("missing permissions to deploy the release: create secrets in namespace kube-system, patch deployments.apps in namespace default"),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewMockClient(t, nil)
+			c.ClientSet.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+				{GroupVersion: "v1", APIResources: []metav1.APIResource{{Name: "secrets", Kind: "Secret", Namespaced: true}}},
+				{GroupVersion: "apps/v1", APIResources: []metav1.APIResource{{Name: "deployments", Kind: "Deployment", Namespaced: true}}},
+				{GroupVersion: "rbac.authorization.k8s.io/v1", APIResources: []metav1.APIResource{{Name: "clusterroles", Kind: "ClusterRole"}}},
+			}
+			reviews := 0
+			c.ClientSet.(*fakeclientset.Clientset).PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+				attr := review.Spec.ResourceAttributes
+				reviews++
+				review.Status.Allowed = true
+				for _, deny := range d.denied {
+					if deny == attr.Verb+" "+attr.Resource {
+						review.Status.Allowed = false
+					}
+				}
+				return true, review, nil
+			})
+			err := c.checkPermissions(manifests, "default", d.verbs)
+			if d.expectedErr != nil {
+				assert.EqualError(t, err, aws.StringValue(d.expectedErr))
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, d.expectedReviews, reviews)
+		})
+	}
+}
+
+func TestNetworkPolicy(t *testing.T) {
+	custom := `metadata:
+  name: allow-web
+spec:
+  podSelector:
+    matchLabels:
+      app: web
+  policyTypes: [Ingress]`
+	tests := map[string]struct {
+		policy       *string
+		expectedName string
+		expectedErr  *string
+	}{
+		"Default": {
+			policy:       aws.String(DefaultNetworkPolicy),
+			expectedName: "one-default-deny",
+		},
+		"Supplied": {
+			policy:       aws.String(custom),
+			expectedName: "allow-web",
+		},
+		"NoName": {
+			policy:      aws.String("spec:\n  podSelector: {}"),
+			expectedErr: aws.String("metadata.name is required"),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewMockClient(t, nil)
+			other := &networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"}}
+			_, _ = c.ClientSet.NetworkingV1().NetworkPolicies("default").Create(context.Background(), other, metav1.CreateOptions{})
+			err := c.applyNetworkPolicy("default", "one", d.policy)
+			if d.expectedErr != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+				return
+			}
+			assert.Nil(t, err)
+			np, err := c.ClientSet.NetworkingV1().NetworkPolicies("default").Get(context.Background(), d.expectedName, metav1.GetOptions{})
+			assert.Nil(t, err)
+			assert.EqualValues(t, "one", np.Labels[NetworkPolicyReleaseLabel])
+			if name == "Default" {
+				assert.ElementsMatch(t, []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress}, np.Spec.PolicyTypes)
+				assert.Len(t, np.Spec.Egress[0].Ports, 2)
+			}
+			// Applying again updates the existing policy
+			assert.Nil(t, c.applyNetworkPolicy("default", "one", d.policy))
+			assert.Nil(t, c.HelmUninstall("one", nil))
+			list, err := c.ClientSet.NetworkingV1().NetworkPolicies("default").List(context.Background(), metav1.ListOptions{})
+			assert.Nil(t, err)
+			assert.Len(t, list.Items, 1)
+			assert.EqualValues(t, "other", list.Items[0].Name)
+		})
+	}
+}
+
+// TestCleanupOnDelete to test the resources created for the release are deleted with it while user-owned ones are kept
+func TestCleanupOnDelete(t *testing.T) {
+	tests := map[string]struct {
+		cleanup      []string
+		label        string
+		otherRelease bool
+		nsDeleted    bool
+		npDeleted    bool
+	}{
+		"Default": {
+			label:     "one",
+			npDeleted: true,
+		},
+		"Namespace": {
+			cleanup:   []string{CleanupNamespace, CleanupNetworkPolicy},
+			label:     "one",
+			nsDeleted: true,
+			npDeleted: true,
+		},
+		"UserNamespace": {
+			cleanup: []string{CleanupNamespace},
+		},
+		"OtherReleaseNamespace": {
+			cleanup: []string{CleanupNamespace},
+			label:   "two",
+		},
+		"SharedNamespace": {
+			cleanup:      []string{CleanupNamespace},
+			label:        "one",
+			otherRelease: true,
+		},
+		"None": {
+			cleanup: []string{},
+			label:   "one",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewMockClient(t, nil)
+			namespaces := c.ClientSet.CoreV1().Namespaces()
+			ns, err := namespaces.Get(context.Background(), "default", metav1.GetOptions{})
+			assert.Nil(t, err)
+			if d.label != "" {
+				ns.Labels = map[string]string{NamespaceReleaseLabel: d.label}
+				_, err = namespaces.Update(context.Background(), ns, metav1.UpdateOptions{})
+				assert.Nil(t, err)
+			}
+			if d.otherRelease {
+				secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "sh.helm.release.v1.two.v1", Namespace: "default", Labels: map[string]string{"owner": "helm", "name": "two"}}}
+				_, err = c.ClientSet.CoreV1().Secrets("default").Create(context.Background(), secret, metav1.CreateOptions{})
+				assert.Nil(t, err)
+			}
+			assert.Nil(t, c.applyNetworkPolicy("default", "one", aws.String(DefaultNetworkPolicy)))
+			assert.Nil(t, c.HelmUninstall("one", &Config{CleanupOnDelete: d.cleanup}))
+			_, err = namespaces.Get(context.Background(), "default", metav1.GetOptions{})
+			assert.Equal(t, d.nsDeleted, kerrors.IsNotFound(err))
+			_, err = c.ClientSet.NetworkingV1().NetworkPolicies("default").Get(context.Background(), "one-default-deny", metav1.GetOptions{})
+			assert.Equal(t, d.npDeleted, kerrors.IsNotFound(err))
+		})
+	}
+}
+
+// TestReleaseLock to test acquireReleaseLock and releaseReleaseLock
+func TestReleaseLock(t *testing.T) {
+	tests := map[string]struct {
+		owner       string
+		expires     time.Time
+		expectedErr *string
+	}{
+		"Free": {},
+		"HeldBySameOwner": {
+			owner:   "req-1",
+			expires: time.Now().Add(time.Minute),
+		},
+		"Contention": {
+			owner:       "req-2",
+			expires:     time.Now().Add(time.Minute),
+			expectedErr: aws.String("release one is locked by operation req-2"),
+		},
+		"StaleTakeover": {
+			owner:   "req-2",
+			expires: time.Now().Add(-time.Minute),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewMockClient(t, nil)
+			configMaps := c.ClientSet.CoreV1().ConfigMaps("default")
+			if d.owner != "" {
+				cm := &corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Name: releaseLockPrefix + "one"},
+					Data:       map[string]string{"owner": d.owner, "expires": d.expires.UTC().Format(time.RFC3339)},
+				}
+				_, err := configMaps.Create(context.Background(), cm, metav1.CreateOptions{})
+				assert.Nil(t, err)
+			}
+			err := c.acquireReleaseLock("default", "one", "req-1", time.Now().Add(time.Minute))
+			if d.expectedErr != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+				// The lock of another operation is left in place
+				assert.Nil(t, c.releaseReleaseLock("default", "one", "req-1"))
+				cm, err := configMaps.Get(context.Background(), releaseLockPrefix+"one", metav1.GetOptions{})
+				assert.Nil(t, err)
+				assert.EqualValues(t, d.owner, cm.Data["owner"])
+				return
+			}
+			assert.Nil(t, err)
+			cm, err := configMaps.Get(context.Background(), releaseLockPrefix+"one", metav1.GetOptions{})
+			assert.Nil(t, err)
+			assert.EqualValues(t, "req-1", cm.Data["owner"])
+			expiry, err := time.Parse(time.RFC3339, cm.Data["expires"])
+			assert.Nil(t, err)
+			assert.True(t, expiry.After(time.Now()))
+			assert.Nil(t, c.releaseReleaseLock("default", "one", "req-1"))
+			_, err = configMaps.Get(context.Background(), releaseLockPrefix+"one", metav1.GetOptions{})
+			assert.True(t, kerrors.IsNotFound(err))
+		})
+	}
+	t.Run("LockedUninstall", func(t *testing.T) {
+		c := NewMockClient(t, nil)
+		assert.Nil(t, c.acquireReleaseLock("default", "locked", "req-2", time.Now().Add(time.Minute)))
+		config := &Config{Name: aws.String("locked"), Namespace: aws.String("default"), OperationID: aws.String("req-1")}
+		err := c.HelmUninstall("locked", config)
+		assert.Contains(t, err.Error(), "release locked is locked by operation req-2")
+	})
+	t.Run("InstallNewNamespace", func(t *testing.T) {
+		testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
+		defer testServer.Close()
+		c := NewMockClient(t, nil)
+		rejectMissingNamespaceWrites(c)
+		ch, err := c.getChartDetails(&Model{Chart: aws.String(testServer.URL + "/dep-0.1.0.tgz")})
+		assert.Nil(t, err)
+		deadline := time.Now().Add(time.Hour).Truncate(time.Second)
+		config := &Config{Name: aws.String("locked"), Namespace: aws.String("new-ns"), OperationID: aws.String("req-1"), Deadline: &deadline}
+		assert.Nil(t, c.HelmInstall(config, nil, ch, "mock-id"))
+		// The lock outlives the install until the release stabilizes
+		configMaps := c.ClientSet.CoreV1().ConfigMaps("new-ns")
+		cm, err := configMaps.Get(context.Background(), releaseLockPrefix+"locked", metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.EqualValues(t, map[string]string{"owner": "req-1", "expires": deadline.UTC().Format(time.RFC3339)}, cm.Data)
+		c.UnlockRelease(&ReleaseData{Name: "locked", Namespace: "new-ns", LockOwner: "req-1"})
+		_, err = configMaps.Get(context.Background(), releaseLockPrefix+"locked", metav1.GetOptions{})
+		assert.True(t, kerrors.IsNotFound(err))
+	})
+	t.Run("MissingNamespace", func(t *testing.T) {
+		c := NewMockClient(t, nil)
+		rejectMissingNamespaceWrites(c)
+		err := c.acquireReleaseLock("new-ns", "locked", "req-1", time.Now().Add(time.Minute))
+		assert.True(t, kerrors.IsNotFound(err))
+	})
+}
+
+// rejectMissingNamespaceWrites makes the fake clientset reject creating objects in a missing or terminating namespace,
+// like the API server
+func rejectMissingNamespaceWrites(c *Clients) {
+	cs := c.ClientSet.(*fakeclientset.Clientset)
+	cs.PrependReactor("create", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() == "" {
+			return false, nil, nil
+		}
+		obj, err := cs.Tracker().Get(corev1.SchemeGroupVersion.WithResource("namespaces"), "", action.GetNamespace())
+		if err != nil {
+			return true, nil, err
+		}
+		if obj.(*corev1.Namespace).Status.Phase == corev1.NamespaceTerminating {
+			return true, nil, kerrors.NewForbidden(action.GetResource().GroupResource(), "", fmt.Errorf("namespace %s is being terminated", action.GetNamespace()))
+		}
+		return false, nil, nil
+	})
+}
+
 // TestGetKubeResources to test GetKubeResources
 func TestGetKubeResources(t *testing.T) {
 	defer os.Remove(TempManifest)
@@ -175,6 +780,176 @@ func TestGetManifestDetails(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+// TestCheckKubeConfigCA to test the kubeconfig CA is compared with the EKS cluster CA
+func TestCheckKubeConfigCA(t *testing.T) {
+	ca, err := base64.StdEncoding.DecodeString("LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0tCi0tLS0tRU5EIENFUlRJRklDQVRFLS0tLS0=")
+	assert.Nil(t, err)
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	c := NewMockClient(t, nil)
+	tests := map[string]struct {
+		cluster     string
+		ca          []byte
+		expectedErr string
+	}{
+		"MatchingARN": {
+			cluster: "arn:aws:eks:us-east-2:1234567890:cluster/eks",
+			ca:      ca,
+		},
+		"MatchingName": {
+			cluster: "eks",
+			ca:      append(ca, '\n'),
+		},
+		"Mismatched": {
+			cluster:     "arn:aws:eks:us-east-2:1234567890:cluster/eks",
+			ca:          []byte("-----BEGIN CERTIFICATE-----\nrotated\n-----END CERTIFICATE-----"),
+			expectedErr: "the certificate authority of cluster eks in the kubeconfig does not match the one EKS reports",
+		},
+		"NoCA": {
+			cluster:     "eks",
+			expectedErr: "kubeconfig cluster eks has no certificate-authority-data to check",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := api.NewConfig()
+			config.Clusters[d.cluster] = &api.Cluster{Server: "https://EKS.yl4.us-east-2.eks.amazonaws.com", CertificateAuthorityData: d.ca}
+			config.Contexts["aws"] = &api.Context{Cluster: d.cluster, AuthInfo: "aws"}
+			config.CurrentContext = "aws"
+			path := filepath.Join(dir, name)
+			assert.Nil(t, clientcmd.WriteToFile(*config, path))
+			err := c.checkKubeConfigCA(path)
+			if d.expectedErr != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), d.expectedErr)
+				return
+			}
+			assert.Nil(t, err)
+		})
+	}
+}
+
+// TestPreserveSecretValues to test the unset value paths are set from the Secret keys
+func TestPreserveSecretValues(t *testing.T) {
+	c := NewMockClient(t, nil)
+	_, err := c.ClientSet.CoreV1().Secrets("default").Create(context.Background(), &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-db", Namespace: "default"},
+		Data:       map[string][]byte{"password": []byte("g3n3rat3d")},
+	}, metav1.CreateOptions{})
+	assert.Nil(t, err)
+	tests := map[string]struct {
+		refs        map[string]string
+		values      map[string]interface{}
+		expected    map[string]interface{}
+		expectedErr string
+	}{
+		"Preserved": {
+			refs:     map[string]string{"auth.password": "web-db/password"},
+			values:   map[string]interface{}{"auth": map[string]interface{}{"user": "app"}},
+			expected: map[string]interface{}{"auth": map[string]interface{}{"user": "app", "password": "g3n3rat3d"}},
+		},
+		"NilValues": {
+			refs:     map[string]string{"auth.password": "web-db/password"},
+			expected: map[string]interface{}{"auth": map[string]interface{}{"password": "g3n3rat3d"}},
+		},
+		"Set": {
+			refs:     map[string]string{"auth.password": "web-db/password"},
+			values:   map[string]interface{}{"auth": map[string]interface{}{"password": "chosen"}},
+			expected: map[string]interface{}{"auth": map[string]interface{}{"password": "chosen"}},
+		},
+		"FirstInstall": {
+			refs:     map[string]string{"auth.password": "other-db/password", "auth.token": "web-db/token"},
+			values:   map[string]interface{}{},
+			expected: map[string]interface{}{},
+		},
+		"InvalidReference": {
+			refs:        map[string]string{"auth.password": "web-db"},
+			expectedErr: `invalid Secret reference "web-db" of value auth.password, expected secret-name/key`,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			values, err := c.preserveSecretValues("default", d.refs, d.values)
+			if d.expectedErr != "" {
+				assert.EqualError(t, err, d.expectedErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, d.expected, values)
+		})
+	}
+}
+
+// TestScaleWorkloads to test the workloads are scaled to zero on suspend and restored on resume
+func TestScaleWorkloads(t *testing.T) {
+	c := NewMockClient(t, nil)
+	ctx := context.Background()
+	dep, err := c.ClientSet.AppsV1().Deployments("default").Get(ctx, "nginx-deployment", metav1.GetOptions{})
+	assert.Nil(t, err)
+	dep.Spec.Replicas = aws.Int32(3)
+	_, err = c.ClientSet.AppsV1().Deployments("default").Update(ctx, dep, metav1.UpdateOptions{})
+	assert.Nil(t, err)
+	manifest := TestManifest + "\n---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: deleted\n"
+	tests := []struct {
+		name      string
+		suspend   bool
+		upgraded  *int32
+		eReplicas map[string]int32
+		eRecorded map[string]string
+	}{
+		{
+			name:      "Suspend",
+			suspend:   true,
+			eReplicas: map[string]int32{"Deployment": 0, "StatefulSet": 0},
+			eRecorded: map[string]string{"Deployment": "3", "StatefulSet": "2"},
+		},
+		{
+			name:      "SuspendAgain",
+			suspend:   true,
+			eReplicas: map[string]int32{"Deployment": 0, "StatefulSet": 0},
+			eRecorded: map[string]string{"Deployment": "3", "StatefulSet": "2"},
+		},
+		{
+			// The upgrade resets the deployment replicas to those of the chart
+			name:      "SuspendAfterUpgrade",
+			suspend:   true,
+			upgraded:  aws.Int32(5),
+			eReplicas: map[string]int32{"Deployment": 0, "StatefulSet": 0},
+			eRecorded: map[string]string{"Deployment": "3", "StatefulSet": "2"},
+		},
+		{
+			name:      "Resume",
+			eReplicas: map[string]int32{"Deployment": 3, "StatefulSet": 2},
+			eRecorded: map[string]string{},
+		},
+	}
+	for _, d := range tests {
+		t.Run(d.name, func(t *testing.T) {
+			if d.upgraded != nil {
+				dep, err := c.ClientSet.AppsV1().Deployments("default").Get(ctx, "nginx-deployment", metav1.GetOptions{})
+				assert.Nil(t, err)
+				dep.Spec.Replicas = d.upgraded
+				_, err = c.ClientSet.AppsV1().Deployments("default").Update(ctx, dep, metav1.UpdateOptions{})
+				assert.Nil(t, err)
+			}
+			assert.Nil(t, c.scaleWorkloads(manifest, "default", d.suspend))
+			dep, err := c.ClientSet.AppsV1().Deployments("default").Get(ctx, "nginx-deployment", metav1.GetOptions{})
+			assert.Nil(t, err)
+			sts, err := c.ClientSet.AppsV1().StatefulSets("default").Get(ctx, "nginx-ss", metav1.GetOptions{})
+			assert.Nil(t, err)
+			assert.Equal(t, d.eReplicas["Deployment"], *dep.Spec.Replicas)
+			assert.Equal(t, d.eReplicas["StatefulSet"], *sts.Spec.Replicas)
+			recorded, ok := dep.Annotations[SuspendedReplicasAnnotation]
+			assert.Equal(t, d.eRecorded["Deployment"], recorded)
+			assert.Equal(t, d.suspend, ok)
+			recorded, ok = sts.Annotations[SuspendedReplicasAnnotation]
+			assert.Equal(t, d.eRecorded["StatefulSet"], recorded)
+			assert.Equal(t, d.suspend, ok)
+		})
+	}
+}
+
 // TestReady to test ingressReady, volumeReady and deploymentReady
 func TestReady(t *testing.T) {
 	tests := map[string]struct {
@@ -0,0 +1,153 @@
+package resource
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/postrender"
+	"k8s.io/cli-runtime/pkg/kustomize"
+	"sigs.k8s.io/kustomize/pkg/fs"
+	"sigs.k8s.io/kustomize/pkg/image"
+	"sigs.k8s.io/kustomize/pkg/patch"
+	"sigs.k8s.io/kustomize/pkg/types"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// kustomizeDir is the directory of the in memory file system the kustomization is built in
+	kustomizeDir = "/kustomize"
+	// kustomizeManifestsFile is the file of the rendered manifests, the only resource of the kustomization
+	kustomizeManifestsFile = "manifests.yaml"
+)
+
+// inlineKustomization is the part of a kustomization supported by Kustomization, with the patches inline instead of
+// in files. Other fields, such as resources, bases or generators, are rejected.
+type inlineKustomization struct {
+	APIVersion            string            `json:"apiVersion,omitempty"`
+	Kind                  string            `json:"kind,omitempty"`
+	CommonLabels          map[string]string `json:"commonLabels,omitempty"`
+	CommonAnnotations     map[string]string `json:"commonAnnotations,omitempty"`
+	Images                []image.Image     `json:"images,omitempty"`
+	PatchesStrategicMerge []string          `json:"patchesStrategicMerge,omitempty"`
+	PatchesJSON6902       []inlineJSONPatch `json:"patchesJson6902,omitempty"`
+}
+
+// inlineJSONPatch is a JSON 6902 patch of the target resource
+type inlineJSONPatch struct {
+	Target *patch.Target `json:"target"`
+	Patch  string        `json:"patch"`
+}
+
+// kustomizePostRenderer applies an inline kustomization to the rendered manifests, then runs the next post renderer if any
+type kustomizePostRenderer struct {
+	kustomization *inlineKustomization
+	next          postrender.PostRenderer
+}
+
+// parseKustomization parses and validates the inline kustomization.
+func parseKustomization(s string) (*inlineKustomization, error) {
+	k := &inlineKustomization{}
+	if err := yaml.UnmarshalStrict([]byte(s), k); err != nil {
+		return nil, fmt.Errorf("invalid Kustomization: %s", err)
+	}
+	if k.Kind != "" && k.Kind != types.KustomizationKind {
+		return nil, fmt.Errorf("invalid Kustomization: unexpected kind %s", k.Kind)
+	}
+	for i, img := range k.Images {
+		if img.Name == "" {
+			return nil, fmt.Errorf("invalid Kustomization: images[%d] has no name", i)
+		}
+		if img.NewName == "" && img.NewTag == "" && img.Digest == "" {
+			return nil, fmt.Errorf("invalid Kustomization: images[%d] sets none of newName, newTag and digest", i)
+		}
+	}
+	for i, p := range k.PatchesStrategicMerge {
+		obj := map[string]interface{}{}
+		if err := yaml.Unmarshal([]byte(p), &obj); err != nil {
+			return nil, fmt.Errorf("invalid Kustomization: patchesStrategicMerge[%d]: %s", i, err)
+		}
+		metadata, _ := obj["metadata"].(map[string]interface{})
+		if obj["apiVersion"] == nil || obj["kind"] == nil || metadata["name"] == nil {
+			return nil, fmt.Errorf("invalid Kustomization: patchesStrategicMerge[%d] needs apiVersion, kind and metadata.name", i)
+		}
+	}
+	for i, p := range k.PatchesJSON6902 {
+		if p.Target == nil || p.Target.Kind == "" || p.Target.Name == "" {
+			return nil, fmt.Errorf("invalid Kustomization: patchesJson6902[%d] needs a target kind and name", i)
+		}
+		var ops []map[string]interface{}
+		if err := yaml.Unmarshal([]byte(p.Patch), &ops); err != nil || len(ops) == 0 {
+			return nil, fmt.Errorf("invalid Kustomization: patchesJson6902[%d] patch is not a list of operations", i)
+		}
+	}
+	return k, nil
+}
+
+// newKustomizePostRenderer returns a post renderer applying the kustomization, validating it first.
+func newKustomizePostRenderer(s string, next postrender.PostRenderer) (*kustomizePostRenderer, error) {
+	k, err := parseKustomization(s)
+	if err != nil {
+		return nil, err
+	}
+	return &kustomizePostRenderer{kustomization: k, next: next}, nil
+}
+
+// Run builds the kustomization over the rendered manifests in memory, then runs the next post renderer if any
+func (p *kustomizePostRenderer) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	out := renderedManifests
+	if strings.TrimSpace(renderedManifests.String()) != "" {
+		var err error
+		if out, err = kustomizeManifests(p.kustomization, renderedManifests.Bytes()); err != nil {
+			return nil, genericError("Applying kustomization", err)
+		}
+	}
+	if p.next != nil {
+		return p.next.Run(out)
+	}
+	return out, nil
+}
+
+// kustomizeManifests writes the manifests, the patches and the generated kustomization to an in memory file system
+// and builds it with kustomize, so no kustomize executable is needed.
+func kustomizeManifests(k *inlineKustomization, manifests []byte) (*bytes.Buffer, error) {
+	fSys := fs.MakeFakeFS()
+	kust := &types.Kustomization{
+		TypeMeta:          types.TypeMeta{APIVersion: types.KustomizationVersion, Kind: types.KustomizationKind},
+		Resources:         []string{kustomizeManifestsFile},
+		CommonLabels:      k.CommonLabels,
+		CommonAnnotations: k.CommonAnnotations,
+		Images:            k.Images,
+	}
+	files := map[string][]byte{kustomizeManifestsFile: manifests}
+	for i, p := range k.PatchesStrategicMerge {
+		name := fmt.Sprintf("patch-%d.yaml", i)
+		files[name] = []byte(p)
+		kust.PatchesStrategicMerge = append(kust.PatchesStrategicMerge, patch.StrategicMerge(name))
+	}
+	for i, p := range k.PatchesJSON6902 {
+		name := fmt.Sprintf("json-patch-%d.yaml", i)
+		files[name] = []byte(p.Patch)
+		kust.PatchesJson6902 = append(kust.PatchesJson6902, patch.Json6902{Target: p.Target, Path: name})
+	}
+	b, err := yaml.Marshal(kust)
+	if err != nil {
+		return nil, err
+	}
+	files["kustomization.yaml"] = b
+	for name, data := range files {
+		if err := fSys.WriteFile(path.Join(kustomizeDir, name), data); err != nil {
+			return nil, err
+		}
+	}
+	out := new(bytes.Buffer)
+	if err := kustomize.RunKustomizeBuild(out, fSys, kustomizeDir); err != nil {
+		return nil, err
+	}
+	if out.Len() == 0 {
+		return nil, errors.New("kustomize built no manifests")
+	}
+	return out, nil
+}
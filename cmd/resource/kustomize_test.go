@@ -0,0 +1,159 @@
+package resource
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/yaml"
+)
+
+const kustomizeTestManifests = `---
+# Source: web/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: web
+  template:
+    metadata:
+      labels:
+        app: web
+    spec:
+      containers:
+      - name: web
+        image: nginx:1.19
+---
+# Source: web/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+spec:
+  ports:
+  - port: 80
+`
+
+// TestParseKustomization to test validating the inline kustomization
+func TestParseKustomization(t *testing.T) {
+	tests := map[string]struct {
+		kustomization string
+		expectedErr   string
+	}{
+		"Valid": {
+			kustomization: "apiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\ncommonLabels:\n  team: web\nimages:\n- name: nginx\n  newTag: \"1.20\"\n",
+		},
+		"Resources": {
+			kustomization: "resources:\n- other.yaml\n",
+			expectedErr:   "invalid Kustomization: error unmarshaling JSON",
+		},
+		"Kind": {
+			kustomization: "kind: Component\n",
+			expectedErr:   "unexpected kind Component",
+		},
+		"ImageWithoutName": {
+			kustomization: "images:\n- newTag: \"1.20\"\n",
+			expectedErr:   "images[0] has no name",
+		},
+		"ImageWithoutChange": {
+			kustomization: "images:\n- name: nginx\n",
+			expectedErr:   "images[0] sets none of newName, newTag and digest",
+		},
+		"PatchWithoutName": {
+			kustomization: "patchesStrategicMerge:\n- |\n  apiVersion: apps/v1\n  kind: Deployment\n",
+			expectedErr:   "patchesStrategicMerge[0] needs apiVersion, kind and metadata.name",
+		},
+		"JSONPatchWithoutTarget": {
+			kustomization: "patchesJson6902:\n- patch: |\n    - op: remove\n      path: /spec/replicas\n",
+			expectedErr:   "patchesJson6902[0] needs a target kind and name",
+		},
+		"JSONPatchNotOperations": {
+			kustomization: "patchesJson6902:\n- target:\n    kind: Deployment\n    name: web\n  patch: \"op: remove\"\n",
+			expectedErr:   "patchesJson6902[0] patch is not a list of operations",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseKustomization(d.kustomization)
+			if d.expectedErr != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), d.expectedErr)
+				return
+			}
+			assert.Nil(t, err)
+		})
+	}
+}
+
+// TestKustomizePostRenderer to test applying the inline kustomization to the rendered manifests
+func TestKustomizePostRenderer(t *testing.T) {
+	tests := map[string]struct {
+		kustomization string
+		check         func(t *testing.T, deployment, service map[string]interface{})
+	}{
+		"Image": {
+			kustomization: "images:\n- name: nginx\n  newName: registry.example.com/nginx\n  newTag: \"1.20\"\n",
+			check: func(t *testing.T, deployment, service map[string]interface{}) {
+				containers := deployment["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})["containers"].([]interface{})
+				assert.Equal(t, "registry.example.com/nginx:1.20", containers[0].(map[string]interface{})["image"])
+			},
+		},
+		"StrategicMergePatch": {
+			kustomization: "patchesStrategicMerge:\n- |\n  apiVersion: apps/v1\n  kind: Deployment\n  metadata:\n    name: web\n  spec:\n    replicas: 3\n    template:\n      spec:\n        containers:\n        - name: web\n          resources:\n            limits:\n              memory: 128Mi\n",
+			check: func(t *testing.T, deployment, service map[string]interface{}) {
+				spec := deployment["spec"].(map[string]interface{})
+				assert.Equal(t, float64(3), spec["replicas"])
+				container := spec["template"].(map[string]interface{})["spec"].(map[string]interface{})["containers"].([]interface{})[0].(map[string]interface{})
+				assert.Equal(t, "nginx:1.19", container["image"])
+				assert.Equal(t, map[string]interface{}{"limits": map[string]interface{}{"memory": "128Mi"}}, container["resources"])
+			},
+		},
+		"JSONPatch": {
+			kustomization: "patchesJson6902:\n- target:\n    version: v1\n    kind: Service\n    name: web\n  patch: |\n    - op: add\n      path: /spec/type\n      value: NodePort\n",
+			check: func(t *testing.T, deployment, service map[string]interface{}) {
+				assert.Equal(t, "NodePort", service["spec"].(map[string]interface{})["type"])
+			},
+		},
+		"CommonLabels": {
+			kustomization: "commonLabels:\n  team: web\n",
+			check: func(t *testing.T, deployment, service map[string]interface{}) {
+				assert.Equal(t, "web", deployment["metadata"].(map[string]interface{})["labels"].(map[string]interface{})["team"])
+				assert.Equal(t, "web", service["metadata"].(map[string]interface{})["labels"].(map[string]interface{})["team"])
+			},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := newKustomizePostRenderer(d.kustomization, nil)
+			assert.Nil(t, err)
+			out, err := p.Run(bytes.NewBufferString(kustomizeTestManifests))
+			assert.Nil(t, err)
+			objs := map[string]map[string]interface{}{}
+			for _, m := range bytes.Split(out.Bytes(), []byte("\n---\n")) {
+				obj := map[string]interface{}{}
+				assert.Nil(t, yaml.Unmarshal(m, &obj))
+				objs[obj["kind"].(string)] = obj
+			}
+			assert.Len(t, objs, 2)
+			d.check(t, objs["Deployment"], objs["Service"])
+		})
+	}
+}
+
+// TestKustomizePostRendererNext to test the kustomized manifests are handed to the next post renderer
+func TestKustomizePostRendererNext(t *testing.T) {
+	p, err := newKustomizePostRenderer("images:\n- name: nginx\n  newTag: \"1.20\"\n", &annotationPostRenderer{annotations: map[string]string{"owner": "stack"}})
+	assert.Nil(t, err)
+	out, err := p.Run(bytes.NewBufferString(kustomizeTestManifests))
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), "image: nginx:1.20")
+	assert.Contains(t, out.String(), "owner: stack")
+
+	out, err = p.Run(bytes.NewBufferString(""))
+	assert.Nil(t, err)
+	assert.Equal(t, "", out.String())
+}
@@ -47,6 +47,10 @@ const (
 	GetResourcesAction     Action = "GetResources"
 	UninstallReleaseAction Action = "UninstallRelease"
 	ListReleaseAction      Action = "ListRelease"
+	SetDescriptionAction   Action = "SetDescription"
+	PreviewUninstallAction Action = "PreviewUninstall"
+	UnlockReleaseAction    Action = "UnlockRelease"
+	DiffReleaseAction      Action = "DiffRelease"
 )
 
 type lambdaResource struct {
@@ -65,6 +69,9 @@ type LambdaResponse struct {
 	Resources        map[string]interface{} `json:",omitempty"`
 	PendingResources bool                   `json:",omitempty"`
 	LastKnownErrors  []string               `json:",omitempty"`
+	ProgressDetail   string                 `json:",omitempty"`
+	UninstallPreview []string               `json:",omitempty"`
+	Diff             []string               `json:",omitempty"`
 }
 
 type State string
@@ -202,6 +209,49 @@ func checklambdaState(svc LambdaAPI, functionName *string) (State, error) {
 	return State(*o.Configuration.State), nil
 }
 
+// EventLog returns the event JSON for logging. The physical ID, the cluster identifiers it decodes to
+// and the kubeconfig are masked unless the model enables LogPhysicalID for debugging. The values resolved from secrets,
+// the values at the MaskValuePaths and the chart credentials and headers are always masked.
+func EventLog(e *Event) string {
+	ev := *e
+	if ev.Model == nil || !aws.BoolValue(ev.Model.LogPhysicalID) {
+		if ev.Model != nil {
+			m := *ev.Model
+			m.ID = redactString(m.ID)
+			m.ClusterID = redactString(m.ClusterID)
+			m.KubeConfig = redactString(m.KubeConfig)
+			ev.Model = &m
+		}
+		if ev.ID != nil {
+			id := *ev.ID
+			id.ClusterID = redactString(id.ClusterID)
+			id.KubeConfig = redactString(id.KubeConfig)
+			ev.ID = &id
+		}
+		if ev.Kubeconfig != nil {
+			ev.Kubeconfig = []byte(redactedValue)
+		}
+	}
+	if ev.Model != nil && len(ev.Model.MaskValuePaths) > 0 {
+		m := *ev.Model
+		m.Values, m.ValueYaml, m.ValuesTOML = maskInlineValues(&m)
+		ev.Model = &m
+	}
+	if ev.Inputs != nil {
+		in := *ev.Inputs
+		in.ChartDetails = redactChart(in.ChartDetails)
+		if paths := maskValuePaths(ev.Model, ev.Inputs.ResolvedValuePaths); len(paths) > 0 {
+			in.ValueOpts = redactValuePaths(in.ValueOpts, paths)
+		}
+		ev.Inputs = &in
+	}
+	b, err := canonicalJSON(ev)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
 func invokeLambda(svc LambdaAPI, functionName *string, event *Event) (*LambdaResponse, error) {
 	log.Printf("Invoking VPC connector %s for action: %s", *functionName, event.Action)
 	eventJSON, err := json.Marshal(event)
@@ -284,6 +284,55 @@ func TestInvokeLambda(t *testing.T) {
 	}
 }
 
+func TestEventLog(t *testing.T) {
+	id := "eyJDbHVzdGVySUQiOiJla3MtcHJvZCJ9"
+	tests := map[string]struct {
+		debug      *bool
+		contains   []string
+		excludes   []string
+		expectedID string
+	}{
+		"Masked": {
+			contains:   []string{`"ID":"[REDACTED]"`, `"ClusterID":"[REDACTED]"`, `"Name":"one"`, `"password":"[REDACTED]"`, `"ChartPassword":"[REDACTED]"`},
+			excludes:   []string{id, "eks-prod", "server: https://", "s3cr3t", "chartuser", "p4ssw0rd", "t0ken"},
+			expectedID: "[REDACTED]",
+		},
+		"Debug": {
+			debug:      aws.Bool(true),
+			contains:   []string{id, "eks-prod", `"password":"[REDACTED]"`, `"ChartPassword":"[REDACTED]"`},
+			excludes:   []string{"s3cr3t", "chartuser", "p4ssw0rd", "t0ken"},
+			expectedID: id,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			e := &Event{
+				Kubeconfig: []byte("server: https://ABCDEF.eks.amazonaws.com"),
+				Model:      &Model{ID: aws.String(id), ClusterID: aws.String("eks-prod"), Name: aws.String("one"), LogPhysicalID: d.debug},
+				ID:         &ID{ClusterID: aws.String("eks-prod"), Name: aws.String("one")},
+				Action:     CheckReleaseAction,
+				Inputs: &Inputs{
+					ValueOpts:          map[string]interface{}{"db": map[string]interface{}{"host": "db.local", "password": "s3cr3t"}},
+					ResolvedValuePaths: [][]string{{"db", "password"}},
+					ChartDetails:       &Chart{ChartUsername: aws.String("chartuser"), ChartPassword: aws.String("p4ssw0rd"), ChartHeaders: map[string]string{"Authorization": "Bearer t0ken"}},
+				},
+			}
+			out := EventLog(e)
+			for _, c := range d.contains {
+				assert.Contains(t, out, c)
+			}
+			for _, c := range d.excludes {
+				assert.NotContains(t, out, c)
+			}
+			// The event itself is left untouched
+			assert.EqualValues(t, id, aws.StringValue(e.Model.ID))
+			assert.EqualValues(t, "eks-prod", aws.StringValue(e.ID.ClusterID))
+			assert.EqualValues(t, "s3cr3t", e.Inputs.ValueOpts["db"].(map[string]interface{})["password"])
+			assert.EqualValues(t, d.expectedID, logID(id, d.debug))
+		})
+	}
+}
+
 // TestGetZip to test getZip
 func TestGetZip(t *testing.T) {
 	tests := map[string]struct {
@@ -4,22 +4,108 @@ package resource
 
 // Model is autogenerated from the json schema
 type Model struct {
-	ClusterID         *string                `json:",omitempty"`
-	KubeConfig        *string                `json:",omitempty"`
-	RoleArn           *string                `json:",omitempty"`
-	Repository        *string                `json:",omitempty"`
-	RepositoryOptions *RepositoryOptions     `json:",omitempty"`
-	Chart             *string                `json:",omitempty"`
-	Namespace         *string                `json:",omitempty"`
-	Name              *string                `json:",omitempty"`
-	Values            map[string]string      `json:",omitempty"`
-	ValueYaml         *string                `json:",omitempty"`
-	Version           *string                `json:",omitempty"`
-	ValueOverrideURL  *string                `json:",omitempty"`
-	ID                *string                `json:",omitempty"`
-	Resources         map[string]interface{} `json:",omitempty"`
-	TimeOut           *int                   `json:",omitempty"`
-	VPCConfiguration  *VPCConfiguration      `json:",omitempty"`
+	ClusterID                   *string                `json:",omitempty"`
+	KubeConfig                  *string                `json:",omitempty"`
+	RoleArn                     *string                `json:",omitempty"`
+	Repository                  *string                `json:",omitempty"`
+	RepositoryOptions           *RepositoryOptions     `json:",omitempty"`
+	Chart                       *string                `json:",omitempty"`
+	Namespace                   *string                `json:",omitempty"`
+	Name                        *string                `json:",omitempty"`
+	Values                      map[string]string      `json:",omitempty"`
+	ValueYaml                   *string                `json:",omitempty"`
+	Version                     *string                `json:",omitempty"`
+	ValueOverrideURL            *string                `json:",omitempty"`
+	ID                          *string                `json:",omitempty"`
+	Resources                   map[string]interface{} `json:",omitempty"`
+	TimeOut                     *int                   `json:",omitempty"`
+	VPCConfiguration            *VPCConfiguration      `json:",omitempty"`
+	DependencyUpdate            *bool                  `json:",omitempty"`
+	SFTPOptions                 *SFTPOptions           `json:",omitempty"`
+	ExpectedAppVersion          *string                `json:",omitempty"`
+	ValueOverrideMergePrefix    *bool                  `json:",omitempty"`
+	ValuesProfile               *string                `json:",omitempty"`
+	HelmFlags                   map[string]string      `json:",omitempty"`
+	OverrideStackOwnership      *bool                  `json:",omitempty"`
+	WaitForServiceAccountSecret *string                `json:",omitempty"`
+	ChartDigest                 *string                `json:",omitempty"`
+	StartupGracePeriod          *int                   `json:",omitempty"`
+	NotificationTopicArn        *string                `json:",omitempty"`
+	GenerateNamePrefix          *string                `json:",omitempty"`
+	RequireExisting             []string               `json:",omitempty"`
+	NodeSelector                map[string]string      `json:",omitempty"`
+	Tolerations                 []Toleration           `json:",omitempty"`
+	Affinity                    *string                `json:",omitempty"`
+	SchedulingValuePaths        *SchedulingValuePaths  `json:",omitempty"`
+	DefaultChartVersion         *string                `json:",omitempty"`
+	NotesRedactPattern          *string                `json:",omitempty"`
+	Notes                       *string                `json:",omitempty"`
+	HealthCheckURL              *string                `json:",omitempty"`
+	HealthCheckExpectedStatus   *int                   `json:",omitempty"`
+	LogPhysicalID               *bool                  `json:",omitempty"`
+	NetworkPolicy               *string                `json:",omitempty"`
+	RejectDuplicateValues       *bool                  `json:",omitempty"`
+	Revision                    *int                   `json:",omitempty"`
+	Status                      *string                `json:",omitempty"`
+	ReturnAttributes            []string               `json:",omitempty"`
+	KubeAuthExec                *KubeAuthExec          `json:",omitempty"`
+	ReadinessThreshold          *int                   `json:",omitempty"`
+	SkipHooks                   *string                `json:",omitempty"`
+	ValuesTOML                  *string                `json:",omitempty"`
+	ValuesMaxSize               *int                   `json:",omitempty"`
+	ValuesMaxDepth              *int                   `json:",omitempty"`
+	ChartUserAgent              *string                `json:",omitempty"`
+	ChartHTTPHeaders            map[string]string      `json:",omitempty"`
+	RequiredValues              []string               `json:",omitempty"`
+	PinChartVersion             *bool                  `json:",omitempty"`
+	ResolvedChartVersion        *string                `json:",omitempty"`
+	ResolvedChartDigest         *string                `json:",omitempty"`
+	APIVersions                 []string               `json:",omitempty"`
+	CleanupOnDelete             []string               `json:",omitempty"`
+	ChartIgnore                 []string               `json:",omitempty"`
+	DisableChartIgnore          *bool                  `json:",omitempty"`
+	ChartFileValues             map[string]string      `json:",omitempty"`
+	CommonAnnotations           map[string]string      `json:",omitempty"`
+	CommonLabels                map[string]string      `json:",omitempty"`
+	Explain                     *bool                  `json:",omitempty"`
+	Explanation                 *string                `json:",omitempty"`
+	CheckDependencyConditions   *bool                  `json:",omitempty"`
+	ValuesWebhookURL            *string                `json:",omitempty"`
+	ValuesWebhookExcludeSecrets *bool                  `json:",omitempty"`
+	ValuesSOPS                  *string                `json:",omitempty"`
+	CheckPermissions            *bool                  `json:",omitempty"`
+	TimeOutUnit                 *string                `json:",omitempty"`
+	ValuesFromGit               *ValuesFromGit         `json:",omitempty"`
+	OverlappingResources        *string                `json:",omitempty"`
+	ChartAPIVersion             *string                `json:",omitempty"`
+	PreviewDelete               *bool                  `json:",omitempty"`
+	RepositoryMirrors           []string               `json:",omitempty"`
+	CallerIdentity              *string                `json:",omitempty"`
+	SecretValuePaths            []string               `json:",omitempty"`
+	Suspend                     *bool                  `json:",omitempty"`
+	PreservedSecretValues       map[string]string      `json:",omitempty"`
+	KubeConfigCACheck           *string                `json:",omitempty"`
+	ComputedValues              *string                `json:",omitempty"`
+	ValuesSummary               *string                `json:",omitempty"`
+	ComputedValuesMaxSize       *int                   `json:",omitempty"`
+	ComputedValuesS3URI         *string                `json:",omitempty"`
+	FallbackVersion             *string                `json:",omitempty"`
+	ExternallyManagedAnnotation *string                `json:",omitempty"`
+	OverrideExternallyManaged   *bool                  `json:",omitempty"`
+	ValueKeyAliases             map[string]string      `json:",omitempty"`
+	AuditTableArn               *string                `json:",omitempty"`
+	KubeVersionOverride         *string                `json:",omitempty"`
+	ValuesStrategy              *string                `json:",omitempty"`
+	Kustomization               *string                `json:",omitempty"`
+	Region                      *string                `json:",omitempty"`
+	ChartWarnings               *string                `json:",omitempty"`
+	ReadRoleArn                 *string                `json:",omitempty"`
+	WriteRoleArn                *string                `json:",omitempty"`
+	ChartSymlinks               *string                `json:",omitempty"`
+	RetryableErrors             []string               `json:",omitempty"`
+	ApprovalParameter           *string                `json:",omitempty"`
+	CheckValueTypes             *bool                  `json:",omitempty"`
+	MaskValuePaths              []string               `json:",omitempty"`
 }
 
 // RepositoryOptions is autogenerated from the json schema
@@ -28,6 +114,7 @@ type RepositoryOptions struct {
 	Password              *string `json:",omitempty"`
 	CAFile                *string `json:",omitempty"`
 	InsecureSkipTLSVerify *bool   `json:",omitempty"`
+	CredentialsSecretArn  *string `json:",omitempty"`
 }
 
 // VPCConfiguration is autogenerated from the json schema
@@ -35,3 +122,41 @@ type VPCConfiguration struct {
 	SecurityGroupIds []string `json:",omitempty"`
 	SubnetIds        []string `json:",omitempty"`
 }
+
+// SFTPOptions is autogenerated from the json schema
+type SFTPOptions struct {
+	Credentials *string `json:",omitempty"`
+	KnownHosts  *string `json:",omitempty"`
+}
+
+// Toleration is autogenerated from the json schema
+type Toleration struct {
+	Key               *string `json:",omitempty"`
+	Operator          *string `json:",omitempty"`
+	Value             *string `json:",omitempty"`
+	Effect            *string `json:",omitempty"`
+	TolerationSeconds *int    `json:",omitempty"`
+}
+
+// SchedulingValuePaths is autogenerated from the json schema
+type SchedulingValuePaths struct {
+	NodeSelector *string `json:",omitempty"`
+	Tolerations  *string `json:",omitempty"`
+	Affinity     *string `json:",omitempty"`
+}
+
+// KubeAuthExec is autogenerated from the json schema
+type KubeAuthExec struct {
+	Command    *string           `json:",omitempty"`
+	Args       []string          `json:",omitempty"`
+	Env        map[string]string `json:",omitempty"`
+	APIVersion *string           `json:",omitempty"`
+}
+
+// ValuesFromGit is autogenerated from the json schema
+type ValuesFromGit struct {
+	Repository     *string `json:",omitempty"`
+	Ref            *string `json:",omitempty"`
+	Path           *string `json:",omitempty"`
+	TokenSecretArn *string `json:",omitempty"`
+}
@@ -0,0 +1,138 @@
+package resource
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/deislabs/oras/pkg/content"
+	"github.com/deislabs/oras/pkg/oras"
+)
+
+const (
+	// ociScheme prefixes the references of the charts stored in an OCI registry
+	ociScheme = "oci://"
+	// ociChartLayerMediaType is the media type of the chart archive layer pushed by the helm 3 registry commands
+	ociChartLayerMediaType = "application/tar+gzip"
+	// ociChartContentMediaType is the media type of the chart archive layer pushed by later helm versions
+	ociChartContentMediaType = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+)
+
+// ecrRegistryHost matches the host of an ECR registry, capturing the registry ID and the region
+var ecrRegistryHost = regexp.MustCompile(`^(\d{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// ociRegistryHosts configures the registry hosts the chart is pulled from
+var ociRegistryHosts = docker.ConfigureDefaultRegistries
+
+// ociChartRef returns the reference of the chart in the registry without the scheme, its name and its tag. The tag is
+// the Version when the reference has none, with a + of the semver build metadata replaced by _ as registry tags
+// cannot contain it.
+func ociChartRef(chart string, version *string) (string, string, string, error) {
+	ref := chart[len(ociScheme):]
+	slash := strings.LastIndex(ref, "/")
+	if slash < 1 || slash == len(ref)-1 {
+		return "", "", "", fmt.Errorf("invalid OCI chart %s, expected oci://registry/repository/chart:version", chart)
+	}
+	name, tag := ref[slash+1:], ""
+	switch {
+	case strings.Contains(name, "@"):
+		name = name[:strings.Index(name, "@")]
+	case strings.Contains(name, ":"):
+		i := strings.Index(name, ":")
+		name, tag = name[:i], name[i+1:]
+		if version != nil && strings.Replace(*version, "+", "_", -1) != tag {
+			return "", "", "", fmt.Errorf("Version %s does not match the tag %s of the OCI chart %s", *version, tag, chart)
+		}
+	case version != nil:
+		tag = strings.Replace(*version, "+", "_", -1)
+		ref += ":" + tag
+	default:
+		return "", "", "", fmt.Errorf("OCI chart %s has no version, set Version or add the tag to the reference", chart)
+	}
+	return ref, name, tag, nil
+}
+
+// ociCredentials returns the credentials for the registry: an authorization token for an ECR registry, obtained with
+// the session of the provider, otherwise the repository username and password if any.
+func (c *Clients) ociCredentials(host string, chart *Chart) (string, string, error) {
+	m := ecrRegistryHost.FindStringSubmatch(host)
+	if m == nil {
+		return aws.StringValue(chart.ChartUsername), aws.StringValue(chart.ChartPassword), nil
+	}
+	log.Printf("Getting ECR authorization token for registry %s...", m[1])
+	out, err := c.AWSClients.ECRClient(aws.String(m[2]), nil).GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{
+		RegistryIds: []*string{aws.String(m[1])},
+	})
+	if err != nil {
+		return "", "", AWSError(err)
+	}
+	if len(out.AuthorizationData) == 0 {
+		return "", "", fmt.Errorf("no ECR authorization token for registry %s", m[1])
+	}
+	b, err := base64.StdEncoding.DecodeString(aws.StringValue(out.AuthorizationData[0].AuthorizationToken))
+	if err != nil {
+		return "", "", fmt.Errorf("invalid ECR authorization token: %s", err)
+	}
+	creds := strings.SplitN(string(b), ":", 2)
+	if len(creds) != 2 {
+		return "", "", errors.New("invalid ECR authorization token")
+	}
+	return creds[0], creds[1], nil
+}
+
+// pullOCIChart pulls the chart archive from the OCI registry to a temp file, logging in to ECR registries with an
+// authorization token, and returns the file.
+func (c *Clients) pullOCIChart(chart *Chart) (string, error) {
+	ref := aws.StringValue(chart.ChartPath)
+	user, password, err := c.ociCredentials(strings.SplitN(ref, "/", 2)[0], chart)
+	if err != nil {
+		return "", genericError("Pulling OCI chart", err)
+	}
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: ociRegistryHosts(
+			docker.WithClient(downloadClient),
+			docker.WithPlainHTTP(docker.MatchLocalhost),
+			docker.WithAuthorizer(docker.NewDockerAuthorizer(
+				docker.WithAuthClient(downloadClient),
+				docker.WithAuthCreds(func(string) (string, string, error) {
+					return user, password, nil
+				}),
+			)),
+		),
+	})
+	log.Printf("Pulling chart %s...", ref)
+	store := content.NewMemoryStore()
+	_, layers, err := oras.Pull(context.Background(), resolver, ref, store,
+		oras.WithAllowedMediaTypes([]string{ociChartLayerMediaType, ociChartContentMediaType}),
+		oras.WithPullEmptyNameAllowed(),
+	)
+	if err != nil {
+		return "", genericError("Pulling OCI chart", err)
+	}
+	if len(layers) == 0 {
+		return "", genericError("Pulling OCI chart", fmt.Errorf("%s has no chart layer", ref))
+	}
+	_, data, ok := store.Get(layers[0])
+	if !ok {
+		return "", genericError("Pulling OCI chart", fmt.Errorf("chart layer of %s was not pulled", ref))
+	}
+	tmp, err := ioutil.TempFile(tempDir, chartTempPattern)
+	if err != nil {
+		return "", genericError("Pulling OCI chart", err)
+	}
+	defer tmp.Close()
+	if _, err := tmp.Write(data); err != nil {
+		os.Remove(tmp.Name())
+		return "", genericError("Pulling OCI chart", err)
+	}
+	return tmp.Name(), nil
+}
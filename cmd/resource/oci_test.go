@@ -0,0 +1,194 @@
+package resource
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/chart/loader"
+)
+
+// newTestRegistry serves the chart archive as charts/dep:0.1.0 in an OCI registry requiring the basic credentials
+func newTestRegistry(t *testing.T, archive, user, password string) *httptest.Server {
+	layer, err := ioutil.ReadFile(archive)
+	assert.Nil(t, err)
+	config := []byte(`{"name":"dep","version":"0.1.0"}`)
+	sum := func(b []byte) string { return fmt.Sprintf("sha256:%x", sha256.Sum256(b)) }
+	manifest, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"config":        map[string]interface{}{"mediaType": "application/vnd.cncf.helm.config.v1+json", "digest": sum(config), "size": len(config)},
+		"layers":        []interface{}{map[string]interface{}{"mediaType": ociChartLayerMediaType, "digest": sum(layer), "size": len(layer)}},
+	})
+	blobs := map[string][]byte{sum(config): config, sum(layer): layer}
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != auth {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var body []byte
+		switch {
+		case r.URL.Path == "/v2/charts/dep/manifests/0.1.0" || r.URL.Path == "/v2/charts/dep/manifests/"+sum(manifest):
+			body = manifest
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Docker-Content-Digest", sum(manifest))
+		case strings.HasPrefix(r.URL.Path, "/v2/charts/dep/blobs/") && blobs[strings.TrimPrefix(r.URL.Path, "/v2/charts/dep/blobs/")] != nil:
+			body = blobs[strings.TrimPrefix(r.URL.Path, "/v2/charts/dep/blobs/")]
+			w.Header().Set("Content-Type", "application/octet-stream")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		if r.Method != http.MethodHead {
+			_, _ = w.Write(body)
+		}
+	}))
+}
+
+// TestOCIChartRef to test parsing the OCI chart reference and its version
+func TestOCIChartRef(t *testing.T) {
+	tests := map[string]struct {
+		chart       string
+		version     *string
+		expectedRef string
+		expectedTag string
+		expectedErr string
+	}{
+		"Tag": {
+			chart:       "oci://123456789012.dkr.ecr.us-east-1.amazonaws.com/charts/my-chart:1.2.0",
+			expectedRef: "123456789012.dkr.ecr.us-east-1.amazonaws.com/charts/my-chart:1.2.0",
+			expectedTag: "1.2.0",
+		},
+		"Version": {
+			chart:       "oci://123456789012.dkr.ecr.us-east-1.amazonaws.com/my-chart",
+			version:     aws.String("1.2.0+build.1"),
+			expectedRef: "123456789012.dkr.ecr.us-east-1.amazonaws.com/my-chart:1.2.0_build.1",
+			expectedTag: "1.2.0_build.1",
+		},
+		"Digest": {
+			chart:       "oci://registry.example.com/my-chart@sha256:0123",
+			expectedRef: "registry.example.com/my-chart@sha256:0123",
+		},
+		"MismatchedVersion": {
+			chart:       "oci://registry.example.com/my-chart:1.2.0",
+			version:     aws.String("1.3.0"),
+			expectedErr: "Version 1.3.0 does not match the tag 1.2.0 of the OCI chart",
+		},
+		"NoVersion": {
+			chart:       "oci://registry.example.com/my-chart",
+			expectedErr: "has no version, set Version or add the tag to the reference",
+		},
+		"NoRepository": {
+			chart:       "oci://registry.example.com",
+			expectedErr: "expected oci://registry/repository/chart:version",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			ref, chartName, tag, err := ociChartRef(d.chart, d.version)
+			if d.expectedErr != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), d.expectedErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, d.expectedRef, ref)
+			assert.Equal(t, "my-chart", chartName)
+			assert.Equal(t, d.expectedTag, tag)
+		})
+	}
+}
+
+// TestPullOCIChart to test pulling a chart from an ECR registry with an authorization token and from another
+// registry with the repository credentials
+func TestPullOCIChart(t *testing.T) {
+	ecrRegistry := newTestRegistry(t, TestFolder+"/dep-0.1.0.tgz", "AWS", "ecr-t0ken")
+	defer ecrRegistry.Close()
+	registry := newTestRegistry(t, TestFolder+"/dep-0.1.0.tgz", "user", "s3cr3t")
+	defer registry.Close()
+	hosts := ociRegistryHosts
+	defer func() { ociRegistryHosts = hosts }()
+	// The ECR registry is served locally
+	ociRegistryHosts = func(opts ...docker.RegistryOpt) docker.RegistryHosts {
+		configured := docker.ConfigureDefaultRegistries(opts...)
+		return func(host string) ([]docker.RegistryHost, error) {
+			h, err := configured(host)
+			for i := range h {
+				if ecrRegistryHost.MatchString(host) {
+					h[i].Host, h[i].Scheme = strings.TrimPrefix(ecrRegistry.URL, "http://"), "http"
+				}
+			}
+			return h, err
+		}
+	}
+	local := strings.TrimPrefix(registry.URL, "http://")
+	tests := map[string]struct {
+		m           *Model
+		expectedECR []string
+		expectedErr string
+	}{
+		"ECR": {
+			m:           &Model{Chart: aws.String("oci://123456789012.dkr.ecr.eu-west-1.amazonaws.com/charts/dep:0.1.0")},
+			expectedECR: []string{"eu-west-1/123456789012"},
+		},
+		"ECRVersion": {
+			m:           &Model{Chart: aws.String("oci://123456789012.dkr.ecr.eu-west-1.amazonaws.com/charts/dep"), Version: aws.String("0.1.0")},
+			expectedECR: []string{"eu-west-1/123456789012"},
+		},
+		"BasicAuth": {
+			m: &Model{Chart: aws.String("oci://" + local + "/charts/dep:0.1.0"), RepositoryOptions: &RepositoryOptions{Username: aws.String("user"), Password: aws.String("s3cr3t")}},
+		},
+		"Unauthorized": {
+			m:           &Model{Chart: aws.String("oci://" + local + "/charts/dep:0.1.0")},
+			expectedErr: "At Pulling OCI chart",
+		},
+		"NotFound": {
+			m:           &Model{Chart: aws.String("oci://123456789012.dkr.ecr.eu-west-1.amazonaws.com/charts/dep:0.2.0")},
+			expectedECR: []string{"eu-west-1/123456789012"},
+			expectedErr: "not found",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			ecrTokenRequests = nil
+			c := NewMockClient(t, d.m)
+			cd, err := c.getChartDetails(d.m)
+			assert.Nil(t, err)
+			assert.Equal(t, "OCI", aws.StringValue(cd.ChartType))
+			assert.Equal(t, "dep", aws.StringValue(cd.ChartName))
+			cp, err := c.pullOCIChart(cd)
+			assert.Equal(t, d.expectedECR, ecrTokenRequests)
+			if d.expectedErr != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), d.expectedErr)
+				return
+			}
+			assert.Nil(t, err)
+			defer os.Remove(cp)
+			ch, err := loader.Load(cp)
+			assert.Nil(t, err)
+			assert.Equal(t, "dep", ch.Name())
+			assert.Equal(t, "0.1.0", ch.Metadata.Version)
+		})
+	}
+
+	c := NewMockClient(t, nil)
+	cd, err := c.getChartDetails(&Model{Chart: aws.String("oci://123456789012.dkr.ecr.eu-west-1.amazonaws.com/charts/dep:0.1.0")})
+	assert.Nil(t, err)
+	assert.Nil(t, c.HelmInstall(&Config{Name: aws.String("oci"), Namespace: aws.String("default")}, map[string]interface{}{}, cd, "mock-id"))
+	rel, err := c.HelmClient.Releases.Last("oci")
+	assert.Nil(t, err)
+	assert.Equal(t, "dep", rel.Chart.Name())
+}
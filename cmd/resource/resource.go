@@ -22,19 +22,35 @@ func init() {
 }
 
 // Create handles the Create event from the CloudFormation service.
-func Create(req handler.Request, _ *Model, currentModel *Model) (handler.ProgressEvent, error) {
+func Create(req handler.Request, _ *Model, currentModel *Model) (event handler.ProgressEvent, err error) {
 	defer LogPanic()
+	defer func() {
+		notifyDeployment(&AWSClients{AWSSession: req.Session}, currentModel, InstallReleaseAction, event)
+		auditDeployment(&AWSClients{AWSSession: req.Session}, currentModel, InstallReleaseAction, event)
+	}()
+	logPhysicalID = currentModel.LogPhysicalID
 	stage := getStage(req.CallbackContext)
+	setOperationID(req.CallbackContext, req.RequestContext.StackID, req.LogicalResourceID)
+	ResolvedChart = getResolvedChartContext(req.CallbackContext)
+	InstallRetries = getInstallRetriesContext(req.CallbackContext)
+	os.Setenv("StackID", req.RequestContext.StackID)
+	ses, err := modelSession(req.Session, currentModel)
+	if err != nil {
+		return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error())), nil
+	}
 	switch stage {
-	case InitStage, LambdaStabilize:
+	case InitStage, LambdaStabilize, ApprovalStabilize:
 		log.Printf("Starting %s...", stage)
 		if currentModel.Name == nil {
 			currentModel.Name = getReleaseNameContext(req.CallbackContext)
 		}
-		return initialize(req.Session, currentModel, InstallReleaseAction), nil
+		return initialize(ses, currentModel, InstallReleaseAction), nil
 	case ReleaseStabilize:
 		log.Printf("Starting %s...", stage)
-		return checkReleaseStatus(req.Session, currentModel, CompleteStage), nil
+		return checkReleaseStatus(ses, currentModel, CompleteStage), nil
+	case VerifyStabilize:
+		log.Printf("Starting %s...", stage)
+		return verifyRelease(currentModel, CompleteStage), nil
 	default:
 		log.Println("Failed to identify stage.")
 		return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, fmt.Sprintf("unhandled stage %s", stage))), nil
@@ -43,6 +59,7 @@ func Create(req handler.Request, _ *Model, currentModel *Model) (handler.Progres
 
 // Read handles the Read event from the CloudFormation service.
 func Read(req handler.Request, _ *Model, currentModel *Model) (handler.ProgressEvent, error) {
+	logPhysicalID = currentModel.LogPhysicalID
 	data, err := DecodeID(currentModel.ID)
 	if err != nil {
 		return makeEvent(nil, NoStage, NewError(ErrCodeInvalidException, err.Error())), nil
@@ -53,13 +70,19 @@ func Read(req handler.Request, _ *Model, currentModel *Model) (handler.ProgressE
 	currentModel.ClusterID = data.ClusterID
 	currentModel.KubeConfig = data.KubeConfig
 	currentModel.VPCConfiguration = data.VPCConfiguration
+	ses, err := regionSession(req.Session, data, currentModel)
+	if err != nil {
+		return makeEvent(nil, NoStage, NewError(ErrCodeInvalidException, err.Error())), nil
+	}
 
-	client, err := NewClients(currentModel.ClusterID, currentModel.KubeConfig, data.Namespace, req.Session, currentModel.RoleArn, nil, currentModel.VPCConfiguration)
+	role := operationRole(currentModel, true)
+	client, err := NewClients(currentModel.ClusterID, currentModel.KubeConfig, data.Namespace, ses, role, nil, currentModel.VPCConfiguration, currentModel.KubeAuthExec, stageDeadline(currentModel))
 	if err != nil {
 		return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error())), nil
 	}
+	client.captureCallerIdentity(currentModel, role)
 	if IsZero(currentModel.VPCConfiguration) && currentModel.ClusterID != nil {
-		currentModel.VPCConfiguration, err = getVpcConfig(client.AWSClients.EKSClient(nil, nil), client.AWSClients.EC2Client(nil, nil), currentModel)
+		currentModel.VPCConfiguration, err = getVpcConfig(client.AWSClients.EKSClient(nil, nil), client.AWSClients.EC2Client(nil, nil), client.AWSClients.STSClient(nil, nil), currentModel)
 		if err != nil {
 			return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error())), nil
 		}
@@ -88,13 +111,16 @@ func Read(req handler.Request, _ *Model, currentModel *Model) (handler.ProgressE
 		}
 	}
 	e.Action = CheckReleaseAction
-	_, err = client.helmStatusWrapper(currentModel.Name, e, client.LambdaResource.functionName, vpc)
+	s, err := client.helmStatusWrapper(currentModel.Name, e, client.LambdaResource.functionName, vpc)
 	if err != nil {
 		if err.Error() == ErrCodeNotFound {
 			return makeEvent(nil, NoStage, NewError(ErrCodeNotFound, err.Error())), nil
 		}
 		return makeEvent(nil, NoStage, NewError(ErrCodeHelmActionException, err.Error())), nil
 	}
+	if err := client.setReleaseAttributes(currentModel, s); err != nil {
+		return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error())), nil
+	}
 	//currentModel.Chart = aws.String(s.ChartName)
 	//currentModel.Version = aws.String(s.ChartVersion)
 	/* Disable fetching resources created by helm
@@ -113,19 +139,35 @@ func Read(req handler.Request, _ *Model, currentModel *Model) (handler.ProgressE
 }
 
 // Update handles the Update event from the CloudFormation service.
-func Update(req handler.Request, _ *Model, currentModel *Model) (handler.ProgressEvent, error) {
+func Update(req handler.Request, _ *Model, currentModel *Model) (event handler.ProgressEvent, err error) {
 	defer LogPanic()
+	defer func() {
+		notifyDeployment(&AWSClients{AWSSession: req.Session}, currentModel, UpdateReleaseAction, event)
+		auditDeployment(&AWSClients{AWSSession: req.Session}, currentModel, UpdateReleaseAction, event)
+	}()
+	logPhysicalID = currentModel.LogPhysicalID
 	stage := getStage(req.CallbackContext)
+	setOperationID(req.CallbackContext, req.RequestContext.StackID, req.LogicalResourceID)
+	ResolvedChart = getResolvedChartContext(req.CallbackContext)
+	InstallRetries = getInstallRetriesContext(req.CallbackContext)
+	os.Setenv("StackID", req.RequestContext.StackID)
+	ses, err := modelSession(req.Session, currentModel)
+	if err != nil {
+		return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, err.Error())), nil
+	}
 	switch stage {
-	case InitStage, LambdaStabilize:
+	case InitStage, LambdaStabilize, ApprovalStabilize:
 		log.Printf("Starting %s...", stage)
 		if currentModel.Name == nil {
 			currentModel.Name = getReleaseNameContext(req.CallbackContext)
 		}
-		return initialize(req.Session, currentModel, UpdateReleaseAction), nil
+		return initialize(ses, currentModel, UpdateReleaseAction), nil
 	case ReleaseStabilize:
 		log.Printf("Starting %s...", stage)
-		return checkReleaseStatus(req.Session, currentModel, CompleteStage), nil
+		return checkReleaseStatus(ses, currentModel, CompleteStage), nil
+	case VerifyStabilize:
+		log.Printf("Starting %s...", stage)
+		return verifyRelease(currentModel, CompleteStage), nil
 	default:
 		log.Println("Failed to identify stage.")
 		return makeEvent(currentModel, NoStage, NewError(ErrCodeInvalidException, fmt.Sprintf("unhandled stage %s", stage))), nil
@@ -133,13 +175,26 @@ func Update(req handler.Request, _ *Model, currentModel *Model) (handler.Progres
 }
 
 // Delete handles the Delete event from the CloudFormation service.
-func Delete(req handler.Request, _ *Model, currentModel *Model) (handler.ProgressEvent, error) {
+func Delete(req handler.Request, _ *Model, currentModel *Model) (event handler.ProgressEvent, err error) {
 	defer LogPanic()
+	defer func() {
+		notifyDeployment(&AWSClients{AWSSession: req.Session}, currentModel, UninstallReleaseAction, event)
+		auditDeployment(&AWSClients{AWSSession: req.Session}, currentModel, UninstallReleaseAction, event)
+	}()
+	logPhysicalID = currentModel.LogPhysicalID
 	stage := getStage(req.CallbackContext)
+	setOperationID(req.CallbackContext, req.RequestContext.StackID, req.LogicalResourceID)
+	ResolvedChart = getResolvedChartContext(req.CallbackContext)
+	InstallRetries = getInstallRetriesContext(req.CallbackContext)
+	os.Setenv("StackID", req.RequestContext.StackID)
 	switch stage {
 	case InitStage, LambdaStabilize, UninstallRelease, ReleaseStabilize:
 		log.Printf("Starting %s...", stage)
-		return initialize(req.Session, currentModel, UninstallReleaseAction), nil
+		ses, err := modelSession(req.Session, currentModel)
+		if err != nil {
+			return makeEvent(nil, NoStage, NewError(ErrCodeInvalidException, err.Error())), nil
+		}
+		return initialize(ses, currentModel, UninstallReleaseAction), nil
 	default:
 		log.Println("Failed to identify stage.")
 		return makeEvent(nil, NoStage, NewError(ErrCodeInvalidException, fmt.Sprintf("unhandled stage %s", stage))), nil
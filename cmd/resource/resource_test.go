@@ -2,6 +2,7 @@ package resource
 
 import (
 	"testing"
+	"time"
 
 	"github.com/aws-cloudformation/cloudformation-cli-go-plugin/cfn/handler"
 	"github.com/aws/aws-sdk-go/aws"
@@ -63,7 +64,7 @@ func TestCreate(t *testing.T) {
 					"Stage": aws.StringValue(d.stage),
 				}
 			}
-			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration) (*Clients, error) {
+			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, authExec *KubeAuthExec, deadline *time.Time) (*Clients, error) {
 				return NewMockClient(t, d.model), nil
 			}
 			_, err := Create(req, &Model{}, d.model)
@@ -102,7 +103,7 @@ func TestRead(t *testing.T) {
 
 	for name, d := range tests {
 		t.Run(name, func(t *testing.T) {
-			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration) (*Clients, error) {
+			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, authExec *KubeAuthExec, deadline *time.Time) (*Clients, error) {
 				return NewMockClient(t, d.model), nil
 			}
 			_, err := Read(req, &Model{}, d.model)
@@ -163,7 +164,7 @@ func TestUpdate(t *testing.T) {
 					"Stage": aws.StringValue(d.stage),
 				}
 			}
-			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration) (*Clients, error) {
+			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, authExec *KubeAuthExec, deadline *time.Time) (*Clients, error) {
 				return NewMockClient(t, d.model), nil
 			}
 			_, err := Update(req, &Model{}, d.model)
@@ -215,7 +216,7 @@ func TestDelete(t *testing.T) {
 					"Stage": aws.StringValue(d.stage),
 				}
 			}
-			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration) (*Clients, error) {
+			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, authExec *KubeAuthExec, deadline *time.Time) (*Clients, error) {
 				return NewMockClient(t, d.model), nil
 			}
 			_, err := Delete(req, &Model{}, d.model)
@@ -224,6 +225,99 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestDeleteRegion(t *testing.T) {
+	model := &Model{
+		ID:        aws.String("eyJDbHVzdGVySUQiOiJla3MiLCJSZWdpb24iOiJldS13ZXN0LTEiLCJOYW1lIjoib25lIiwiTmFtZXNwYWNlIjoiZGVmYXVsdCJ9"),
+		ClusterID: aws.String("eks"),
+	}
+	req := handler.Request{
+		LogicalResourceID: "TestHelm",
+		Session:           MockSession,
+	}
+	var region *string
+	NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, authExec *KubeAuthExec, deadline *time.Time) (*Clients, error) {
+		region = ses.Config.Region
+		return NewMockClient(t, model), nil
+	}
+	_, err := Delete(req, &Model{}, model)
+	assert.Nil(t, err)
+	assert.Equal(t, "eu-west-1", aws.StringValue(region))
+}
+
+// TestDeleteResolvedChart to test Delete takes the resolved chart from the callback context, not an earlier invocation
+func TestDeleteResolvedChart(t *testing.T) {
+	defer func() { ResolvedChart = nil }()
+	ResolvedChart = &HelmStatusData{ChartName: "stale", ChartVersion: "0.0.1"}
+	req := handler.Request{
+		LogicalResourceID: "TestHelm",
+		CallbackContext:   map[string]interface{}{"Stage": "Unknown"},
+		Session:           MockSession,
+	}
+	_, err := Delete(req, &Model{}, &Model{Namespace: aws.String("default")})
+	assert.Nil(t, err)
+	assert.Nil(t, ResolvedChart)
+
+	req.CallbackContext = map[string]interface{}{"Stage": "Unknown", "ChartName": "nginx", "ChartVersion": "1.2.3", "ValuesHash": "def"}
+	_, err = Delete(req, &Model{}, &Model{Namespace: aws.String("default")})
+	assert.Nil(t, err)
+	assert.Equal(t, &HelmStatusData{ChartName: "nginx", ChartVersion: "1.2.3", ValuesHash: "def"}, ResolvedChart)
+}
+
+// TestOperationRole to test the role assumed by the Read and Create handlers
+func TestOperationRole(t *testing.T) {
+	tests := map[string]struct {
+		model        *Model
+		expectedRead string
+		expectedCrud string
+	}{
+		"SingleRole": {
+			model:        &Model{RoleArn: aws.String("arn:aws:iam::1234567890:role/Helm")},
+			expectedRead: "arn:aws:iam::1234567890:role/Helm",
+			expectedCrud: "arn:aws:iam::1234567890:role/Helm",
+		},
+		"ReadRole": {
+			model:        &Model{RoleArn: aws.String("arn:aws:iam::1234567890:role/Helm"), ReadRoleArn: aws.String("arn:aws:iam::1234567890:role/HelmRead")},
+			expectedRead: "arn:aws:iam::1234567890:role/HelmRead",
+			expectedCrud: "arn:aws:iam::1234567890:role/Helm",
+		},
+		"ReadAndWriteRoles": {
+			model:        &Model{ReadRoleArn: aws.String("arn:aws:iam::1234567890:role/HelmRead"), WriteRoleArn: aws.String("arn:aws:iam::1234567890:role/HelmWrite")},
+			expectedRead: "arn:aws:iam::1234567890:role/HelmRead",
+			expectedCrud: "arn:aws:iam::1234567890:role/HelmWrite",
+		},
+		"NoRole": {
+			model: &Model{},
+		},
+	}
+	req := handler.Request{
+		LogicalResourceID: "TestHelm",
+		Session:           MockSession,
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			var assumed *string
+			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, authExec *KubeAuthExec, deadline *time.Time) (*Clients, error) {
+				assumed = role
+				return NewMockClient(t, d.model), nil
+			}
+			m := *d.model
+			m.ID = aws.String("eyJDbHVzdGVySUQiOiJla3MiLCJSZWdpb24iOiJldS13ZXN0LTEiLCJOYW1lIjoib25lIiwiTmFtZXNwYWNlIjoiZGVmYXVsdCJ9")
+			m.ClusterID = aws.String("eks")
+			_, err := Read(req, &Model{}, &m)
+			assert.Nil(t, err)
+			assert.Equal(t, d.expectedRead, aws.StringValue(assumed))
+
+			m = *d.model
+			m.ClusterID = aws.String("eks")
+			m.Chart = aws.String("stable/coscale")
+			m.Namespace = aws.String("default")
+			_, err = Create(req, &Model{}, &m)
+			assert.Nil(t, err)
+			assert.Equal(t, d.expectedCrud, aws.StringValue(assumed))
+		})
+	}
+}
+
 func TestList(t *testing.T) {
 	eError := "not implemented: List"
 	req := handler.Request{
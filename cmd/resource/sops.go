@@ -0,0 +1,266 @@
+package resource
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	yamlv3 "gopkg.in/yaml.v3"
+	"sigs.k8s.io/yaml"
+)
+
+// sopsMetadataKey is the top level key of the sops metadata in an encrypted values file
+const sopsMetadataKey = "sops"
+
+// sopsEncryptedValue matches a value encrypted by sops, capturing the data, IV, tag and type of the value
+var sopsEncryptedValue = regexp.MustCompile(`^ENC\[AES256_GCM,data:([^,]*),iv:([^,]*),tag:([^,]*),type:([a-z]+)\]$`)
+
+// sopsMetadata is the part of the sops metadata needed to decrypt the values with AWS KMS
+type sopsMetadata struct {
+	KMS              []sopsKMSKey `yaml:"kms"`
+	LastModified     string       `yaml:"lastmodified"`
+	MAC              string       `yaml:"mac"`
+	MACOnlyEncrypted bool         `yaml:"mac_only_encrypted"`
+}
+
+// sopsKMSKey is an AWS KMS encryption of the sops data key
+type sopsKMSKey struct {
+	ARN     string             `yaml:"arn"`
+	Role    string             `yaml:"role"`
+	Context map[string]*string `yaml:"context"`
+	Enc     string             `yaml:"enc"`
+}
+
+// loadSOPSValues decrypts inline sops encrypted values, or downloads them first when given an S3 or SFTP URL.
+// It returns the paths of the decrypted values along with the values, and errors when the document exceeds the limits.
+func (c *Clients) loadSOPSValues(source string, sftp *SFTPOptions, limits valuesLimits) (map[string]interface{}, [][]string, error) {
+	data, err := c.readValuesSource(source, sftp, valuesSOPSFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkValuesSize(data, limits, "SOPS"); err != nil {
+		return nil, nil, genericError("Decrypting SOPS values", err)
+	}
+	values, paths, err := c.decryptSOPSValues(data)
+	if err != nil {
+		return nil, nil, genericError("Decrypting SOPS values", err)
+	}
+	if err := checkValuesDepth(values, nil, limits, "SOPS"); err != nil {
+		return nil, nil, genericError("Decrypting SOPS values", err)
+	}
+	return values, paths, nil
+}
+
+// decryptSOPSValues decrypts the values encrypted by sops with the data key of the AWS KMS keys in the sops
+// metadata, verifying the message authentication code of the file.
+func (c *Clients) decryptSOPSValues(data []byte) (map[string]interface{}, [][]string, error) {
+	doc := &yamlv3.Node{}
+	if err := yamlv3.Unmarshal(data, doc); err != nil {
+		return nil, nil, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yamlv3.MappingNode {
+		return nil, nil, errors.New("values must be a YAML map")
+	}
+	root := doc.Content[0]
+	meta := &sopsMetadata{}
+	found := false
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == sopsMetadataKey {
+			if err := root.Content[i+1].Decode(meta); err != nil {
+				return nil, nil, fmt.Errorf("invalid sops metadata: %s", err)
+			}
+			root.Content = append(root.Content[:i], root.Content[i+2:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, nil, errors.New("sops metadata not found")
+	}
+	key, err := c.sopsDataKey(meta.KMS)
+	if err != nil {
+		return nil, nil, err
+	}
+	hash := sha512.New()
+	var decrypted [][]string
+	err = walkSOPSNodes(root, nil, nil, func(n *yamlv3.Node, path []string, aad []string) error {
+		m := sopsEncryptedValue.FindStringSubmatch(n.Value)
+		if m == nil {
+			if meta.MACOnlyEncrypted {
+				return nil
+			}
+			var v interface{}
+			if err := n.Decode(&v); err != nil {
+				return err
+			}
+			hash.Write(sopsMACBytes(v))
+			return nil
+		}
+		v, err := decryptSOPSValue(m, key, strings.Join(aad, ":")+":")
+		if err != nil {
+			return fmt.Errorf("value %s: %s", strings.Join(path, "."), err)
+		}
+		hash.Write(sopsMACBytes(v))
+		n.Value, n.Style = fmt.Sprint(v), 0
+		switch v.(type) {
+		case string:
+			n.Tag, n.Style = "!!str", yamlv3.DoubleQuotedStyle
+		case int:
+			n.Tag = "!!int"
+		case float64:
+			n.Tag, n.Value = "!!float", strconv.FormatFloat(v.(float64), 'f', -1, 64)
+		case bool:
+			n.Tag = "!!bool"
+		}
+		decrypted = append(decrypted, path)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	m := sopsEncryptedValue.FindStringSubmatch(meta.MAC)
+	if m == nil {
+		return nil, nil, errors.New("sops metadata has no message authentication code")
+	}
+	mac, err := decryptSOPSValue(m, key, meta.LastModified)
+	if err != nil {
+		return nil, nil, fmt.Errorf("message authentication code: %s", err)
+	}
+	if fmt.Sprint(mac) != fmt.Sprintf("%X", hash.Sum(nil)) {
+		return nil, nil, errors.New("message authentication code mismatch, the values were modified after encryption")
+	}
+	log.Printf("Decrypted %d SOPS values", len(decrypted))
+	out, err := yamlv3.Marshal(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(out, &values); err != nil {
+		return nil, nil, err
+	}
+	return values, decrypted, nil
+}
+
+// sopsDataKey decrypts the sops data key with the first of the AWS KMS keys that succeeds.
+func (c *Clients) sopsDataKey(keys []sopsKMSKey) ([]byte, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("sops metadata has no AWS KMS key")
+	}
+	var errs []string
+	for _, k := range keys {
+		blob, err := base64.StdEncoding.DecodeString(k.Enc)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", k.ARN, err))
+			continue
+		}
+		var region, role *string
+		if a, err := arn.Parse(k.ARN); err == nil {
+			region = aws.String(a.Region)
+		}
+		if k.Role != "" {
+			role = aws.String(k.Role)
+		}
+		key, err := decryptKMS(c.AWSClients.KMSClient(region, role), blob, k.Context)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", k.ARN, err))
+			continue
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("could not decrypt the sops data key: %s", strings.Join(errs, "; "))
+}
+
+// decryptSOPSValue decrypts the data of a sops encrypted value match with AES-GCM and returns it with its type.
+func decryptSOPSValue(m []string, key []byte, aad string) (interface{}, error) {
+	data, err := base64.StdEncoding.DecodeString(m[1])
+	if err != nil {
+		return nil, err
+	}
+	iv, err := base64.StdEncoding.DecodeString(m[2])
+	if err != nil {
+		return nil, err
+	}
+	tag, err := base64.StdEncoding.DecodeString(m[3])
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, iv, append(data, tag...), []byte(aad))
+	if err != nil {
+		return nil, errors.New("could not decrypt the value with the data key")
+	}
+	s := string(plain)
+	switch m[4] {
+	case "str", "bytes":
+		return s, nil
+	case "int":
+		return strconv.Atoi(s)
+	case "float":
+		return strconv.ParseFloat(s, 64)
+	case "bool":
+		return strings.ToLower(s) == "true", nil
+	}
+	return nil, fmt.Errorf("unsupported value type %s", m[4])
+}
+
+// sopsMACBytes returns the bytes of the value hashed into the sops message authentication code
+func sopsMACBytes(v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		return []byte(v)
+	case int:
+		return []byte(strconv.Itoa(v))
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64))
+	case bool:
+		if v {
+			return []byte("True")
+		}
+		return []byte("False")
+	case nil:
+		return nil
+	}
+	return []byte(fmt.Sprint(v))
+}
+
+// walkSOPSNodes calls fn with the path of each scalar node of the values YAML, and the path of map keys that sops
+// authenticates the node with, which leaves out the list indexes.
+func walkSOPSNodes(n *yamlv3.Node, path []string, aad []string, fn func(*yamlv3.Node, []string, []string) error) error {
+	switch n.Kind {
+	case yamlv3.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k := n.Content[i].Value
+			p := append(append([]string{}, path...), k)
+			a := append(append([]string{}, aad...), k)
+			if err := walkSOPSNodes(n.Content[i+1], p, a, fn); err != nil {
+				return err
+			}
+		}
+	case yamlv3.SequenceNode:
+		for i, c := range n.Content {
+			p := append(append([]string{}, path...), strconv.Itoa(i))
+			if err := walkSOPSNodes(c, p, aad, fn); err != nil {
+				return err
+			}
+		}
+	case yamlv3.ScalarNode:
+		return fn(n, path, aad)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package resource
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+// sopsEncrypt encrypts the value as sops does, authenticated with the path of its map keys
+func sopsEncrypt(t *testing.T, key []byte, plain string, typ string, aad string) string {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	assert.Nil(t, err)
+	iv := []byte(strings.Repeat("i", 32))
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	assert.Nil(t, err)
+	out := gcm.Seal(nil, iv, []byte(plain), []byte(aad))
+	data, tag := out[:len(out)-gcm.Overhead()], out[len(out)-gcm.Overhead():]
+	enc := base64.StdEncoding.EncodeToString
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]", enc(data), enc(iv), enc(tag), typ)
+}
+
+// sopsValues returns a sops encrypted values file, with the plain values hashed into the MAC in document order
+func sopsValues(t *testing.T, key []byte, encryptedKey string, hashed ...string) string {
+	t.Helper()
+	hash := sha512.New()
+	for _, h := range hashed {
+		hash.Write([]byte(h))
+	}
+	lastModified := "2021-05-10T12:00:00Z"
+	return fmt.Sprintf(`db:
+    password: %s
+    port: %s
+    tls: %s
+    host_unencrypted: db.example.com
+hosts:
+    - %s
+    - %s
+sops:
+    kms:
+        - arn: arn:aws:kms:us-east-1:1234567890:key/abcd
+          context:
+            app: web
+          enc: %s
+    lastmodified: "%s"
+    mac: %s
+    version: 3.7.1
+`,
+		sopsEncrypt(t, key, "s3cr3t", "str", "db:password:"),
+		sopsEncrypt(t, key, "5432", "int", "db:port:"),
+		sopsEncrypt(t, key, "True", "bool", "db:tls:"),
+		sopsEncrypt(t, key, "a.example.com", "str", "hosts:"),
+		sopsEncrypt(t, key, "b.example.com", "str", "hosts:"),
+		base64.StdEncoding.EncodeToString([]byte(encryptedKey)),
+		lastModified,
+		sopsEncrypt(t, key, fmt.Sprintf("%X", hash.Sum(nil)), "str", lastModified),
+	)
+}
+
+// TestDecryptSOPSValues to test decrypting sops encrypted values with a mocked KMS data key
+func TestDecryptSOPSValues(t *testing.T) {
+	c := NewMockClient(t, nil)
+	hashed := []string{"s3cr3t", "5432", "True", "db.example.com", "a.example.com", "b.example.com"}
+	tests := map[string]struct {
+		data          string
+		expected      map[string]interface{}
+		expectedPaths [][]string
+		expectedErr   string
+	}{
+		"Decrypt": {
+			data: sopsValues(t, mockSOPSDataKey, mockSOPSEncryptedKey, hashed...),
+			expected: map[string]interface{}{
+				"db": map[string]interface{}{
+					"password":         "s3cr3t",
+					"port":             float64(5432),
+					"tls":              true,
+					"host_unencrypted": "db.example.com",
+				},
+				"hosts": []interface{}{"a.example.com", "b.example.com"},
+			},
+			expectedPaths: [][]string{{"db", "password"}, {"db", "port"}, {"db", "tls"}, {"hosts", "0"}, {"hosts", "1"}},
+		},
+		"Tampered": {
+			data:        strings.Replace(sopsValues(t, mockSOPSDataKey, mockSOPSEncryptedKey, hashed...), "db.example.com", "evil.example.com", 1),
+			expectedErr: "message authentication code mismatch",
+		},
+		"WrongKMSKey": {
+			data:        sopsValues(t, mockSOPSDataKey, "other-data-key", hashed...),
+			expectedErr: "could not decrypt the sops data key: arn:aws:kms:us-east-1:1234567890:key/abcd",
+		},
+		"WrongDataKey": {
+			data:        sopsValues(t, []byte(strings.Repeat("k", 32)), mockSOPSEncryptedKey, hashed...),
+			expectedErr: "value db.password: could not decrypt the value with the data key",
+		},
+		"NotEncrypted": {
+			data:        "db:\n  password: s3cr3t\n",
+			expectedErr: "sops metadata not found",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			values, paths, err := c.decryptSOPSValues([]byte(d.data))
+			if d.expectedErr != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), d.expectedErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, d.expected, values)
+			assert.Equal(t, d.expectedPaths, paths)
+		})
+	}
+}
+
+// TestProcessSOPSValues to test merging and redacting the decrypted sops values
+func TestProcessSOPSValues(t *testing.T) {
+	c := NewMockClient(t, nil)
+	data := sopsValues(t, mockSOPSDataKey, mockSOPSEncryptedKey, "s3cr3t", "5432", "True", "db.example.com", "a.example.com", "b.example.com")
+	m := &Model{
+		ValueYaml:  aws.String("db:\n  name: app\n  password: placeholder\n"),
+		ValuesSOPS: aws.String(data),
+	}
+	values, paths, err := c.processValues(m)
+	assert.Nil(t, err)
+	db := values["db"].(map[string]interface{})
+	assert.Equal(t, "app", db["name"])
+	assert.Equal(t, "s3cr3t", db["password"])
+	e := &Event{Inputs: &Inputs{ValueOpts: values, ResolvedValuePaths: paths}}
+	log := EventLog(e)
+	assert.NotContains(t, log, "s3cr3t")
+	assert.NotContains(t, log, "a.example.com")
+	assert.Contains(t, log, redactedValue)
+
+	// The sops document is held to the values limits
+	_, _, err = c.processValues(&Model{ValuesSOPS: aws.String(data), ValuesMaxSize: aws.Int(64)})
+	assert.Contains(t, err.Error(), fmt.Sprintf("values SOPS of %d bytes exceeds the 64 bytes limit", len(data)))
+	_, _, err = c.processValues(&Model{ValuesSOPS: aws.String(data), ValuesMaxDepth: aws.Int(1)})
+	assert.Contains(t, err.Error(), "values SOPS nesting depth exceeds the limit of 1")
+}
@@ -177,6 +177,7 @@ func NewMockClient(t *testing.T, m *Model) *Clients {
 	c := &Clients{
 		ResourceBuilder: newFakeBuilder(t),
 		ClientSet: fakeclientset.NewSimpleClientset(
+			ns("default"),
 			dep("nginx-deployment", "default", false),
 			dep("nginx-deployment-foo", "default", true),
 			svc("my-service", "default", v1.ServiceTypeClusterIP),
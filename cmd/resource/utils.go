@@ -2,6 +2,7 @@ package resource
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/base64"
 	"encoding/gob"
@@ -12,19 +13,31 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	yamlv3 "gopkg.in/yaml.v3"
 	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/cli"
 	"helm.sh/helm/v3/pkg/strvals"
 	"k8s.io/cli-runtime/pkg/resource"
@@ -32,11 +45,69 @@ import (
 	"sigs.k8s.io/yaml"
 )
 
+// tempDir is where the provider writes its temp files, TMPDIR when set
+var tempDir = os.TempDir()
+
+var (
+	valuesYamlFile      = filepath.Join(tempDir, "values.yaml")
+	valuesTOMLFile      = filepath.Join(tempDir, "values.toml")
+	valuesSOPSFile      = filepath.Join(tempDir, "values.sops.yaml")
+	knownHostsLocalPath = filepath.Join(tempDir, "known_hosts")
+)
+
 const (
-	valuesYamlFile = "/tmp/values.yaml"
-	defaultTimeOut = 60
+	defaultTimeOut   = 60
+	staleTempFileAge = 15 * time.Minute
+	// timeOutMinutes, the default, and timeOutSeconds are the units of the TimeOut property
+	timeOutMinutes = "Minutes"
+	timeOutSeconds = "Seconds"
+	// minTempDirSpace is the free space in bytes required in the temp directory for the chart, values and kubeconfig
+	minTempDirSpace = 64 << 20
+	// ssmValueTag and secretsManagerValueTag tag the values resolved from SSM parameters and Secrets Manager secrets
+	ssmValueTag            = "!ssm"
+	secretsManagerValueTag = "!secretsmanager"
+	// defaultValuesMaxSize and defaultValuesMaxDepth limit the size in bytes and the nesting depth of each values YAML document
+	defaultValuesMaxSize  = 1048576
+	defaultValuesMaxDepth = 64
+	// downloadMaxIdleConnsPerHost and downloadIdleConnTimeout size the pool of kept-alive connections reused across downloads
+	downloadMaxIdleConnsPerHost = 10
+	downloadIdleConnTimeout     = 90 * time.Second
+	// valuesWebhookTimeout limits the time the values webhook has to return its decision
+	valuesWebhookTimeout = 30 * time.Second
+	// releaseNameMaxLength is the helm release name limit, releaseNameHashLength the length of the hash of sanitized names
+	releaseNameMaxLength  = 53
+	releaseNameHashLength = 8
+	// defaultComputedValuesMaxSize caps the size in bytes of the ComputedValues attribute
+	defaultComputedValuesMaxSize = 4096
+	// chartTempPattern names the temp file each chart archive is downloaded to
+	chartTempPattern = "chart-*.tgz"
 )
 
+// tempFiles are the temp files written by the provider, pruned when left behind by crashed invocations
+var tempFiles = []string{valuesYamlFile, valuesTOMLFile, valuesSOPSFile, knownHostsLocalPath, filepath.Join(tempDir, chartTempPattern), caLocalPath, KubeConfigLocalPath, TempManifest}
+
+// downloadClient is shared by the URL downloads of an invocation, so that repeated downloads from a host reuse connections
+var downloadClient = &http.Client{Transport: newDownloadTransport()}
+
+// newDownloadTransport returns a transport keeping idle connections alive for reuse by later downloads
+func newDownloadTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DisableKeepAlives = false
+	t.MaxIdleConnsPerHost = downloadMaxIdleConnsPerHost
+	t.IdleConnTimeout = downloadIdleConnTimeout
+	return t
+}
+
+// Explanation is the resolved input of an operation in explain mode
+type Explanation struct {
+	Action          Action
+	Name, Namespace string
+	Config          *Config                `json:",omitempty"`
+	Chart           *Chart                 `json:",omitempty"`
+	Values          map[string]interface{} `json:",omitempty"`
+	ValuesHash      string                 `json:",omitempty"`
+}
+
 // ID struct for CFN physical resource
 type ID struct {
 	ClusterID        *string           `json:",omitempty"`
@@ -59,15 +130,80 @@ type Clients struct {
 	LambdaResource  *lambdaResource
 }
 
+// redactedValue replaces the secrets and the masked identifiers in logs and outputs
+const redactedValue = "[REDACTED]"
+
+// truncatedValue replaces the top-level values that do not fit in the ComputedValues attribute
+const truncatedValue = "[TRUNCATED]"
+
+// minMaskedLength is the length from which the values at the MaskValuePaths are masked in the messages
+const minMaskedLength = 4
+
 // Config for processed inputs
 type Config struct {
-	Name, Namespace *string `json:",omitempty"`
+	Name, Namespace, OperationID, StackID *string           `json:",omitempty"`
+	OverrideOwnership                     *bool             `json:",omitempty"`
+	ExternallyManagedAnnotation           *string           `json:",omitempty"`
+	OverrideExternallyManaged             *bool             `json:",omitempty"`
+	KubeVersionOverride                   *string           `json:",omitempty"`
+	ValuesStrategy                        *string           `json:",omitempty"`
+	Kustomization                         *string           `json:",omitempty"`
+	ChartWarnings                         *string           `json:",omitempty"`
+	RetryableErrors                       []string          `json:",omitempty"`
+	Deadline                              *time.Time        `json:",omitempty"`
+	HelmFlags                             map[string]string `json:",omitempty"`
+	RequireExisting                       []string          `json:",omitempty"`
+	LogPhysicalID                         *bool             `json:",omitempty"`
+	NetworkPolicy                         *string           `json:",omitempty"`
+	SkipHooks                             *string           `json:",omitempty"`
+	APIVersions                           []string          `json:",omitempty"`
+	CleanupOnDelete                       []string          `json:",omitempty"`
+	CommonAnnotations                     map[string]string `json:",omitempty"`
+	CommonLabels                          map[string]string `json:",omitempty"`
+	CheckPermissions                      *bool             `json:",omitempty"`
+	OverlappingResources                  *string           `json:",omitempty"`
+	Suspend                               *bool             `json:",omitempty"`
+	PreservedSecretValues                 map[string]string `json:",omitempty"`
 }
 
 // Chart for chart data
 type Chart struct {
-	Chart, ChartName, ChartPath, ChartType, ChartRepo, ChartVersion, ChartRepoURL, ChartUsername, ChartPassword *string `json:",omitempty"`
-	ChartSkipTLSVerify, ChartLocalCA                                                                            *bool   `json:",omitempty"`
+	Chart, ChartName, ChartPath, ChartType, ChartRepo, ChartVersion, ChartRepoURL, ChartUsername, ChartPassword, ChartExpectedAppVersion, ChartValuesProfile, ChartDigest, ChartDefaultVersion *string `json:",omitempty"`
+	ChartSkipTLSVerify, ChartLocalCA, ChartDependencyUpdate                                                                                                                                    *bool   `json:",omitempty"`
+	// ChartHeaders are the HTTP headers, including the User-Agent, sent when downloading the chart from a URL
+	ChartHeaders map[string]string `json:",omitempty"`
+	// ChartFileValues are the value paths set to the contents of the chart files at the relative paths
+	ChartFileValues map[string]string `json:",omitempty"`
+	// ChartIgnore are the .helmignore patterns added when loading a chart directory, ChartIgnoreDisabled skips its .helmignore
+	ChartIgnore         []string `json:",omitempty"`
+	ChartIgnoreDisabled *bool    `json:",omitempty"`
+	// ChartSymlinks is how the symlinks of a chart directory are handled, Resolve or Reject
+	ChartSymlinks *string `json:",omitempty"`
+	// ChartConditionsChecked requires the conditions of the chart dependencies to match a value path
+	ChartConditionsChecked *bool `json:",omitempty"`
+	// ChartValueTypesChecked requires the values to have the types of the chart defaults
+	ChartValueTypesChecked *bool `json:",omitempty"`
+	// ChartAPIVersion is the apiVersion the chart and its subcharts are required to declare
+	ChartAPIVersion *string `json:",omitempty"`
+	// ChartRepoMirrors are the URLs of the mirrors of the chart repository, tried in order when it cannot be reached
+	ChartRepoMirrors []string `json:",omitempty"`
+	// ChartFallbackVersion is the semver constraint of the lower versions installed when ChartVersion is missing from the repository
+	ChartFallbackVersion *string `json:",omitempty"`
+}
+
+// ignoreRules returns the ignore and symlink rules for loading the chart from a directory
+func (c *Chart) ignoreRules() chartIgnore {
+	return chartIgnore{patterns: c.ChartIgnore, disabled: aws.BoolValue(c.ChartIgnoreDisabled), symlinks: aws.StringValue(c.ChartSymlinks)}
+}
+
+// sftpCredentials for SFTP authentication stored in Secrets Manager
+type sftpCredentials struct {
+	Username, Password, PrivateKey string `json:",omitempty"`
+}
+
+// repositoryCredentials for chart repository basic authentication stored in Secrets Manager
+type repositoryCredentials struct {
+	Username, Password string `json:",omitempty"`
 }
 
 //Inputs for Config and Values for helm
@@ -75,20 +211,42 @@ type Inputs struct {
 	Config       *Config                `json:",omitempty"`
 	ChartDetails *Chart                 `json:",omitempty"`
 	ValueOpts    map[string]interface{} `json:",omitempty"`
+	// ResolvedValuePaths are the paths in ValueOpts of the values resolved from SSM or Secrets Manager
+	ResolvedValuePaths [][]string `json:",omitempty"`
+}
+
+// valuesLimits bounds the size in bytes and the nesting depth of the values YAML documents
+type valuesLimits struct {
+	size, depth int
+}
+
+// chartIgnore are the .helmignore patterns added when loading a chart directory, whether its own .helmignore is skipped
+// and how its symlinks are handled
+type chartIgnore struct {
+	patterns []string
+	disabled bool
+	symlinks string
 }
 
 // NewClients is for generate clients for helm, kube and AWS
-var NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration) (*Clients, error) {
+var NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, authExec *KubeAuthExec, deadline *time.Time) (*Clients, error) {
 	var err error
 	c := &Clients{}
+	if err := checkTempDir(tempDir, minTempDirSpace); err != nil {
+		return nil, err
+	}
+	pruneTempFiles(tempFiles, staleTempFileAge)
 	if ses == nil {
 		ses, err = session.NewSession()
 		if err != nil {
 			return nil, err
 		}
+		if ses, err = regionSession(ses, nil, nil); err != nil {
+			return nil, err
+		}
 	}
 	c.AWSClients = &AWSClients{AWSSession: ses}
-	if err := createKubeConfig(c.AWSClients.EKSClient(nil, nil), c.AWSClients.STSClient(nil, role), c.AWSClients.SecretsManagerClient(nil, nil), cluster, kubeconfig, customKubeconfig); err != nil {
+	if err := createKubeConfig(c.AWSClients.EKSClient(nil, nil), c.AWSClients.STSClient(nil, role), c.AWSClients.SecretsManagerClient(nil, nil), cluster, kubeconfig, customKubeconfig, authExec); err != nil {
 		return nil, err
 	}
 	if namespace == nil {
@@ -96,6 +254,9 @@ var NewClients = func(cluster *string, kubeconfig *string, namespace *string, se
 	}
 	os.Setenv("HELM_NAMESPACE", aws.StringValue(namespace))
 	c.Settings = cli.New()
+	if err := checkHelmDirs(c.Settings); err != nil {
+		return nil, err
+	}
 	c.HelmClient, err = helmClientInvoke(namespace, c.Settings.RESTClientGetter())
 	if err != nil {
 		return nil, err
@@ -104,6 +265,14 @@ var NewClients = func(cluster *string, kubeconfig *string, namespace *string, se
 	if err != nil {
 		return nil, err
 	}
+	if cluster != nil && IsZero(vpcConfig) {
+		err = waitForKubeEndpoint(func() error {
+			return c.ClientSet.Discovery().RESTClient().Get().AbsPath("/version").Timeout(kubeEndpointTimeout).Do(context.TODO()).Error()
+		}, deadline)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	c.ResourceBuilder = func() *resource.Builder {
 		return resource.NewBuilder(c.Settings.RESTClientGetter())
@@ -112,49 +281,716 @@ var NewClients = func(cluster *string, kubeconfig *string, namespace *string, se
 	return c, nil
 }
 
+// NewAWSClients is for generate the clients for AWS only, without connecting to the cluster
+var NewAWSClients = func(ses *session.Session) (*Clients, error) {
+	if ses == nil {
+		return nil, errors.New("no AWS session")
+	}
+	return &Clients{AWSClients: &AWSClients{AWSSession: ses}}, nil
+}
+
 //Process the values in the input
-func (c *Clients) processValues(m *Model) (map[string]interface{}, error) {
+func (c *Clients) processValues(m *Model) (map[string]interface{}, [][]string, error) {
+	values, resolved, err := c.mergeValues(m)
+	if err != nil || IsZero(m.ValuesWebhookURL) {
+		return values, resolved, err
+	}
+	values, err = callValuesWebhook(*m.ValuesWebhookURL, m, values, resolved)
+	if err != nil {
+		return nil, nil, genericError("Values webhook", err)
+	}
+	return values, resolved, nil
+}
+
+// mergeValues merges the values of the model sources, returning the paths of the values resolved from secrets
+func (c *Clients) mergeValues(m *Model) (map[string]interface{}, [][]string, error) {
 	values := map[string]interface{}{}
 	valueYaml := map[string]interface{}{}
 	currentMap := map[string]interface{}{}
+	var resolved [][]string
+	limits := valuesLimits{size: defaultValuesMaxSize, depth: defaultValuesMaxDepth}
+	if m.ValuesMaxSize != nil {
+		limits.size = *m.ValuesMaxSize
+	}
+	if m.ValuesMaxDepth != nil {
+		limits.depth = *m.ValuesMaxDepth
+	}
 	if m.ValueYaml != nil {
-		err := yaml.Unmarshal([]byte(*m.ValueYaml), &valueYaml)
+		data, paths, err := c.resolveValueRefs([]byte(*m.ValueYaml), limits)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		resolved = append(resolved, paths...)
+		valueYaml, err = unmarshalValues(data, "ValueYaml")
+		if err != nil {
+			return nil, nil, err
 		}
+		// The secret value paths are checked against the normalized values and resolved paths
+		valueYaml = normalizeValueKeys(valueYaml, m.ValueKeyAliases)
+		paths = normalizeValuePaths(paths, m.ValueKeyAliases)
+		if err := checkSecretValuePaths(valueYaml, m.SecretValuePaths, paths, "ValueYaml"); err != nil {
+			return nil, nil, err
+		}
+	}
+	if m.ValuesFromGit != nil {
+		data, err := c.loadGitValues(m.ValuesFromGit)
+		if err != nil {
+			return nil, nil, err
+		}
+		data, paths, err := c.resolveValueRefs(data, limits)
+		if err != nil {
+			return nil, nil, err
+		}
+		resolved = append(resolved, paths...)
+		gitValues, err := unmarshalValues(data, "ValuesFromGit "+aws.StringValue(m.ValuesFromGit.Path))
+		if err != nil {
+			return nil, nil, err
+		}
+		valueYaml = mergeMaps(valueYaml, normalizeValueKeys(gitValues, m.ValueKeyAliases))
+	}
+	if m.ValuesTOML != nil {
+		valuesTOML, err := c.loadTOMLValues(*m.ValuesTOML, m.SFTPOptions, limits)
+		if err != nil {
+			return nil, nil, err
+		}
+		valuesTOML = normalizeValueKeys(valuesTOML, m.ValueKeyAliases)
+		if inlineValuesSource(*m.ValuesTOML) {
+			if err := checkSecretValuePaths(valuesTOML, m.SecretValuePaths, nil, "ValuesTOML"); err != nil {
+				return nil, nil, err
+			}
+		}
+		valueYaml = mergeMaps(valueYaml, valuesTOML)
+	}
+	if m.ValuesSOPS != nil {
+		valuesSOPS, paths, err := c.loadSOPSValues(*m.ValuesSOPS, m.SFTPOptions, limits)
+		if err != nil {
+			return nil, nil, err
+		}
+		resolved = append(resolved, paths...)
+		valueYaml = mergeMaps(valueYaml, normalizeValueKeys(valuesSOPS, m.ValueKeyAliases))
 	}
 	if m.Values != nil {
-		for k, v := range m.Values {
-			if err := strvals.ParseInto(fmt.Sprintf("%s=%s", k, v), values); err != nil {
-				return nil, genericError("Processing values", err)
+		if aws.BoolValue(m.RejectDuplicateValues) {
+			if err := checkDuplicateValues(m.Values); err != nil {
+				return nil, nil, genericError("Processing values", err)
 			}
 		}
+		// Parse in key order so overlapping keys always merge the same way
+		keys := make([]string, 0, len(m.Values))
+		for k := range m.Values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := strvals.ParseInto(fmt.Sprintf("%s=%s", k, m.Values[k]), values); err != nil {
+				return nil, nil, genericError("Processing values", err)
+			}
+		}
+		values = normalizeValueKeys(values, m.ValueKeyAliases)
+		if err := checkSecretValuePaths(values, m.SecretValuePaths, nil, "Values"); err != nil {
+			return nil, nil, err
+		}
 	}
 	base := mergeMaps(valueYaml, values)
 	if m.ValueOverrideURL != nil {
 		u, err := url.Parse(*m.ValueOverrideURL)
 		if err != nil {
-			return nil, genericError("Process ValueOverrideURL ", err)
+			return nil, nil, genericError("Process ValueOverrideURL ", err)
+		}
+		var paths [][]string
+		switch strings.ToLower(u.Scheme) {
+		case "sftp":
+			err = c.downloadSFTP(u, m.SFTPOptions, valuesYamlFile)
+			if err != nil {
+				return nil, nil, err
+			}
+			currentMap, paths, err = c.readValueOverrideFile(*m.ValueOverrideURL, limits)
+		default:
+			bucket := u.Host
+			key := strings.TrimLeft(u.Path, "/")
+			prefix := key == "" || strings.HasSuffix(key, "/")
+			if prefix && !aws.BoolValue(m.ValueOverrideMergePrefix) {
+				return nil, nil, genericError("Process ValueOverrideURL", fmt.Errorf("%s is an S3 prefix, please specify a values file object or set ValueOverrideMergePrefix", *m.ValueOverrideURL))
+			}
+			var region *string
+			region, err = getBucketRegion(c.AWSClients.S3Client(nil, nil), bucket)
+			if err != nil {
+				return nil, nil, err
+			}
+			if prefix {
+				currentMap, paths, err = c.mergeS3Prefix(c.AWSClients.S3Client(region, nil), bucket, key, limits)
+				break
+			}
+			err = downloadS3(c.AWSClients.S3Client(region, nil), bucket, key, valuesYamlFile)
+			if err != nil {
+				return nil, nil, err
+			}
+			currentMap, paths, err = c.readValueOverrideFile(*m.ValueOverrideURL, limits)
 		}
-		bucket := u.Host
-		key := strings.TrimLeft(u.Path, "/")
-		region, err := getBucketRegion(c.AWSClients.S3Client(nil, nil), bucket)
 		if err != nil {
+			return nil, nil, err
+		}
+		resolved = append(resolved, paths...)
+		currentMap = normalizeValueKeys(currentMap, m.ValueKeyAliases)
+	}
+	values, err := applyScheduling(m, mergeMaps(base, currentMap))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkRequiredValues(values, m.RequiredValues); err != nil {
+		return nil, nil, err
+	}
+	return values, normalizeValuePaths(resolved, m.ValueKeyAliases), nil
+}
+
+// readValueOverrideFile reads the downloaded ValueOverrideURL values file, resolving its value references
+func (c *Clients) readValueOverrideFile(source string, limits valuesLimits) (map[string]interface{}, [][]string, error) {
+	byteKey, err := ioutil.ReadFile(valuesYamlFile)
+	if err != nil {
+		return nil, nil, genericError("Reading custom yaml", err)
+	}
+	byteKey, paths, err := c.resolveValueRefs(byteKey, limits)
+	if err != nil {
+		return nil, nil, err
+	}
+	values, err := unmarshalValues(byteKey, "ValueOverrideURL "+source)
+	if err != nil {
+		return nil, nil, err
+	}
+	return values, paths, nil
+}
+
+// loadTOMLValues parses inline TOML values, or downloads them first when given an S3 or SFTP URL.
+// It errors when the TOML exceeds the limits.
+func (c *Clients) loadTOMLValues(source string, sftp *SFTPOptions, limits valuesLimits) (map[string]interface{}, error) {
+	data, err := c.readValuesSource(source, sftp, valuesTOMLFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkValuesSize(data, limits, "TOML"); err != nil {
+		return nil, genericError("Parsing TOML values", err)
+	}
+	values, err := parseTOMLValues(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkValuesDepth(values, nil, limits, "TOML"); err != nil {
+		return nil, genericError("Parsing TOML values", err)
+	}
+	return values, nil
+}
+
+// checkValuesSize errors when the values document in the format exceeds the size limit.
+func checkValuesSize(data []byte, limits valuesLimits, format string) error {
+	if len(data) > limits.size {
+		return fmt.Errorf("values %s of %d bytes exceeds the %d bytes limit", format, len(data), limits.size)
+	}
+	return nil
+}
+
+// checkValuesDepth errors when a value at the path, empty maps and lists included, is nested deeper than the depth limit.
+func checkValuesDepth(v interface{}, path []string, limits valuesLimits, format string) error {
+	if len(path) > limits.depth {
+		return fmt.Errorf("values %s nesting depth exceeds the limit of %d at %s", format, limits.depth, strings.Join(path[:limits.depth], "."))
+	}
+	switch node := v.(type) {
+	case map[string]interface{}:
+		for k, c := range node {
+			if err := checkValuesDepth(c, append(append([]string{}, path...), k), limits, format); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, c := range node {
+			if err := checkValuesDepth(c, append(append([]string{}, path...), strconv.Itoa(i)), limits, format); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// inlineValuesSource returns whether the values source is the values document itself rather than an S3 or SFTP URL.
+func inlineValuesSource(source string) bool {
+	u, err := url.Parse(source)
+	if err != nil {
+		return true
+	}
+	scheme := strings.ToLower(u.Scheme)
+	return scheme != "sftp" && scheme != "s3"
+}
+
+// readValuesSource returns the inline values document, or downloads it to the file first when given an S3 or SFTP URL.
+func (c *Clients) readValuesSource(source string, sftp *SFTPOptions, file string) ([]byte, error) {
+	if inlineValuesSource(source) {
+		return []byte(source), nil
+	}
+	u, _ := url.Parse(source)
+	switch strings.ToLower(u.Scheme) {
+	case "sftp":
+		if err := c.downloadSFTP(u, sftp, file); err != nil {
 			return nil, err
 		}
-		err = downloadS3(c.AWSClients.S3Client(region, nil), bucket, key, valuesYamlFile)
+	case "s3":
+		region, err := getBucketRegion(c.AWSClients.S3Client(nil, nil), u.Host)
 		if err != nil {
 			return nil, err
 		}
+		if err := downloadS3(c.AWSClients.S3Client(region, nil), u.Host, strings.TrimLeft(u.Path, "/"), file); err != nil {
+			return nil, err
+		}
+	}
+	defer os.Remove(file)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, genericError("Reading values", err)
+	}
+	return data, nil
+}
+
+// parseTOMLValues decodes TOML into values with the same types as values parsed from YAML.
+func parseTOMLValues(data []byte) (map[string]interface{}, error) {
+	vals := map[string]interface{}{}
+	if _, err := toml.Decode(string(data), &vals); err != nil {
+		return nil, genericError("Parsing TOML values", err)
+	}
+	b, err := json.Marshal(vals)
+	if err != nil {
+		return nil, genericError("Parsing TOML values", err)
+	}
+	out := map[string]interface{}{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, genericError("Parsing TOML values", err)
+	}
+	return out, nil
+}
+
+// checkDuplicateValues errors when more than one Values entry sets the same key, including
+// keys set through comma separated values and keys nested under another entry's value.
+func checkDuplicateValues(vals map[string]string) error {
+	var keys []string
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	seen := map[string]string{}
+	for _, k := range keys {
+		entry := map[string]interface{}{}
+		if err := strvals.ParseInto(fmt.Sprintf("%s=%s", k, vals[k]), entry); err != nil {
+			return err
+		}
+		var paths []string
+		leafPaths("", entry, &paths)
+		for _, p := range paths {
+			for sp, sk := range seen {
+				if sp == p || strings.HasPrefix(sp, p+".") || strings.HasPrefix(p, sp+".") {
+					return fmt.Errorf("duplicate key %s set by values %q and %q", p, sk, k)
+				}
+			}
+		}
+		for _, p := range paths {
+			seen[p] = k
+		}
+	}
+	return nil
+}
+
+// leafPaths collects the dotted paths of the leaf values, with list indexes as path elements.
+func leafPaths(prefix string, v interface{}, paths *[]string) {
+	join := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + "." + k
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			leafPaths(join(k), t[k], paths)
+		}
+	case []interface{}:
+		for i, val := range t {
+			if val != nil {
+				leafPaths(join(strconv.Itoa(i)), val, paths)
+			}
+		}
+	default:
+		*paths = append(*paths, prefix)
+	}
+}
+
+// mergeS3Prefix merges all the YAML objects under the S3 prefix in lexical order.
+func (c *Clients) mergeS3Prefix(svc S3API, bucket string, prefix string, limits valuesLimits) (map[string]interface{}, [][]string, error) {
+	keys, err := listS3Objects(svc, bucket, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	values := map[string]interface{}{}
+	var resolved [][]string
+	for _, key := range keys {
+		ext := strings.ToLower(filepath.Ext(key))
+		if ext != ".yaml" && ext != ".yml" {
+			log.Printf("Skipping non YAML object %s", key)
+			continue
+		}
+		err = downloadS3(svc, bucket, key, valuesYamlFile)
+		if err != nil {
+			return nil, nil, err
+		}
 		byteKey, err := ioutil.ReadFile(valuesYamlFile)
 		if err != nil {
-			return nil, genericError("Reading custom yaml", err)
+			return nil, nil, genericError("Reading custom yaml", err)
 		}
-		if err := yaml.Unmarshal(byteKey, &currentMap); err != nil {
-			return nil, genericError("Parsing yaml", err)
+		byteKey, paths, err := c.resolveValueRefs(byteKey, limits)
+		if err != nil {
+			return nil, nil, err
+		}
+		resolved = append(resolved, paths...)
+		currentMap, err := unmarshalValues(byteKey, fmt.Sprintf("s3://%s/%s", bucket, key))
+		if err != nil {
+			return nil, nil, err
 		}
+		values = mergeMaps(values, currentMap)
+	}
+	return values, resolved, nil
+}
+
+// unmarshalValues parses the values YAML of the source, erroring with the source when the document is not a map.
+func unmarshalValues(data []byte, source string) (map[string]interface{}, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, genericError("Parsing yaml", fmt.Errorf("%s: %s", source, err))
+	}
+	switch v := doc.(type) {
+	case nil:
+		return map[string]interface{}{}, nil
+	case map[string]interface{}:
+		return v, nil
+	case []interface{}:
+		return nil, genericError("Parsing yaml", fmt.Errorf("%s: values must be a map of keys, not a list at the root", source))
 	}
-	return mergeMaps(base, currentMap), nil
+	return nil, genericError("Parsing yaml", fmt.Errorf("%s: values must be a map of keys, not a scalar at the root", source))
+}
+
+// resolveValueRefs replaces the values YAML scalars tagged !ssm or !secretsmanager with the parameter or secret value,
+// e.g. `password: !ssm /app/password` or `token: !secretsmanager arn:aws:secretsmanager:...`.
+// It returns the resolved YAML with the paths of the resolved values, and errors when the YAML exceeds the limits.
+func (c *Clients) resolveValueRefs(data []byte, limits valuesLimits) ([]byte, [][]string, error) {
+	if err := checkValuesSize(data, limits, "YAML"); err != nil {
+		return nil, nil, genericError("Parsing yaml", err)
+	}
+	doc := &yamlv3.Node{}
+	if err := yamlv3.Unmarshal(data, doc); err != nil {
+		return nil, nil, genericError("Parsing yaml", err)
+	}
+	var resolved [][]string
+	err := walkValueNodes(doc, nil, func(n *yamlv3.Node, path []string) error {
+		if len(path) > limits.depth {
+			return genericError("Parsing yaml", fmt.Errorf("values YAML nesting depth exceeds the limit of %d at %s", limits.depth, strings.Join(path[:limits.depth], ".")))
+		}
+		var v string
+		var err error
+		switch n.Tag {
+		case ssmValueTag:
+			v, err = getSSMParameter(c.AWSClients.SSMClient(nil, nil), n.Value)
+		case secretsManagerValueTag:
+			var b []byte
+			b, err = getSecretsManager(c.AWSClients.SecretsManagerClient(nil, nil), aws.String(n.Value))
+			v = string(b)
+		default:
+			return nil
+		}
+		if err != nil {
+			return genericError(fmt.Sprintf("Resolving %s value %s", n.Tag, strings.Join(path, ".")), err)
+		}
+		log.Printf("Resolved %s value %s", n.Tag, strings.Join(path, "."))
+		n.Tag, n.Value, n.Style = "!!str", v, yamlv3.DoubleQuotedStyle
+		resolved = append(resolved, path)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(resolved) == 0 {
+		return data, nil, nil
+	}
+	out, err := yamlv3.Marshal(doc)
+	if err != nil {
+		return nil, nil, genericError("Parsing yaml", err)
+	}
+	return out, resolved, nil
+}
+
+// walkValueNodes calls fn with the path of each scalar node of the values YAML, and of each empty map and list so
+// their nesting depth is checked as well.
+func walkValueNodes(n *yamlv3.Node, path []string, fn func(*yamlv3.Node, []string) error) error {
+	switch n.Kind {
+	case yamlv3.DocumentNode:
+		for _, c := range n.Content {
+			if err := walkValueNodes(c, path, fn); err != nil {
+				return err
+			}
+		}
+	case yamlv3.MappingNode:
+		if len(n.Content) == 0 {
+			return fn(n, path)
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			p := append(append([]string{}, path...), n.Content[i].Value)
+			if err := walkValueNodes(n.Content[i+1], p, fn); err != nil {
+				return err
+			}
+		}
+	case yamlv3.SequenceNode:
+		if len(n.Content) == 0 {
+			return fn(n, path)
+		}
+		for i, c := range n.Content {
+			p := append(append([]string{}, path...), strconv.Itoa(i))
+			if err := walkValueNodes(c, p, fn); err != nil {
+				return err
+			}
+		}
+	case yamlv3.ScalarNode:
+		return fn(n, path)
+	}
+	return nil
+}
+
+// redactValuePaths returns a copy of the values with the values at the paths redacted.
+func redactValuePaths(values map[string]interface{}, paths [][]string) map[string]interface{} {
+	out := copyValue(values).(map[string]interface{})
+	for _, path := range paths {
+		var current interface{} = out
+		for i, k := range path {
+			last := i == len(path)-1
+			switch node := current.(type) {
+			case map[string]interface{}:
+				if _, ok := node[k]; ok && last {
+					node[k] = redactedValue
+				}
+				current = node[k]
+			case []interface{}:
+				idx, err := strconv.Atoi(k)
+				if err != nil || idx >= len(node) {
+					current = nil
+					continue
+				}
+				if last {
+					node[idx] = redactedValue
+				}
+				current = node[idx]
+			}
+		}
+	}
+	return out
+}
+
+// maskValuePaths returns the paths with the MaskValuePaths of the model added, the value paths masked in the logs,
+// the outputs and the values sent out of the provider.
+func maskValuePaths(m *Model, paths [][]string) [][]string {
+	if m == nil || len(m.MaskValuePaths) == 0 {
+		return paths
+	}
+	out := append([][]string(nil), paths...)
+	for _, p := range m.MaskValuePaths {
+		out = append(out, strings.Split(p, "."))
+	}
+	return out
+}
+
+// maskInlineValues returns copies of the Values, ValueYaml and inline ValuesTOML of the model with the values at the
+// MaskValuePaths masked. ValueYaml and ValuesTOML that do not parse are masked whole.
+func maskInlineValues(m *Model) (map[string]string, *string, *string) {
+	values := make(map[string]string, len(m.Values))
+	for k, v := range m.Values {
+		values[k] = v
+		for _, p := range m.MaskValuePaths {
+			if k == p || strings.HasPrefix(k, p+".") {
+				values[k] = redactedValue
+			}
+		}
+	}
+	return values, maskInlineValueYaml(m), maskInlineValuesTOML(m)
+}
+
+// maskInlineValueYaml returns a copy of the ValueYaml of the model with the values at the MaskValuePaths masked
+func maskInlineValueYaml(m *Model) *string {
+	if m.ValueYaml == nil {
+		return nil
+	}
+	valueYaml := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(*m.ValueYaml), &valueYaml); err != nil {
+		return aws.String(redactedValue)
+	}
+	b, err := yaml.Marshal(redactValuePaths(valueYaml, maskValuePaths(m, nil)))
+	if err != nil {
+		return aws.String(redactedValue)
+	}
+	return aws.String(string(b))
+}
+
+// maskInlineValuesTOML returns a copy of the inline ValuesTOML of the model with the values at the MaskValuePaths
+// masked. A ValuesTOML URL is returned as is.
+func maskInlineValuesTOML(m *Model) *string {
+	if m.ValuesTOML == nil || !inlineValuesSource(*m.ValuesTOML) {
+		return m.ValuesTOML
+	}
+	valuesTOML, err := parseTOMLValues([]byte(*m.ValuesTOML))
+	if err != nil {
+		return aws.String(redactedValue)
+	}
+	var b bytes.Buffer
+	if err := toml.NewEncoder(&b).Encode(redactValuePaths(valuesTOML, maskValuePaths(m, nil))); err != nil {
+		return aws.String(redactedValue)
+	}
+	return aws.String(b.String())
+}
+
+// maskedValueStrings returns the strings of at least minMaskedLength characters the model sets at or under its
+// MaskValuePaths in Values, ValueYaml and inline ValuesTOML, masked in the messages. Shorter values, e.g. booleans and small numbers,
+// would mask unrelated text.
+func maskedValueStrings(m *Model) []string {
+	if m == nil || len(m.MaskValuePaths) == 0 {
+		return nil
+	}
+	var out []string
+	add := func(v interface{}) {
+		walkValueStrings(v, func(s string) {
+			if len(s) >= minMaskedLength {
+				out = append(out, s)
+			}
+		})
+	}
+	valueYaml := map[string]interface{}{}
+	if m.ValueYaml != nil {
+		if err := yaml.Unmarshal([]byte(*m.ValueYaml), &valueYaml); err != nil {
+			valueYaml = nil
+		}
+	}
+	var valuesTOML map[string]interface{}
+	if m.ValuesTOML != nil && inlineValuesSource(*m.ValuesTOML) {
+		valuesTOML, _ = parseTOMLValues([]byte(*m.ValuesTOML))
+	}
+	for _, p := range m.MaskValuePaths {
+		for k, v := range m.Values {
+			if k == p || strings.HasPrefix(k, p+".") {
+				add(v)
+			}
+		}
+		if v, ok := lookupValuePath(valueYaml, strings.Split(p, ".")); ok {
+			add(v)
+		}
+		if v, ok := lookupValuePath(valuesTOML, strings.Split(p, ".")); ok {
+			add(v)
+		}
+	}
+	return out
+}
+
+// walkValueStrings calls fn with the string of each scalar of the value
+func walkValueStrings(v interface{}, fn func(string)) {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		for _, e := range node {
+			walkValueStrings(e, fn)
+		}
+	case []interface{}:
+		for _, e := range node {
+			walkValueStrings(e, fn)
+		}
+	case nil:
+	default:
+		fn(fmt.Sprint(node))
+	}
+}
+
+// truncateValues returns the canonical JSON of the values within the size in bytes, replacing the top-level values,
+// in key order, that do not fit with truncatedValue.
+func truncateValues(values map[string]interface{}, size int) ([]byte, error) {
+	keys := make([]string, 0, len(values))
+	out := make(map[string]interface{}, len(values))
+	for k := range values {
+		keys = append(keys, k)
+		out[k] = truncatedValue
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		out[k] = values[k]
+		b, err := canonicalJSON(out)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > size {
+			out[k] = truncatedValue
+		}
+	}
+	return canonicalJSON(out)
+}
+
+// copyValue deep copies the maps and slices of the values.
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[k] = copyValue(e)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = copyValue(e)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// getRepositoryCredentials returns the basic authentication username and password of the repository, fetched from the
+// CredentialsSecretArn secret when set, otherwise the Username and Password of the repository options.
+func (c *Clients) getRepositoryCredentials(o *RepositoryOptions) (*string, *string, error) {
+	if IsZero(o) {
+		return nil, nil, nil
+	}
+	if IsZero(o.CredentialsSecretArn) {
+		return o.Username, o.Password, nil
+	}
+	s, err := getSecretsManager(c.AWSClients.SecretsManagerClient(nil, nil), o.CredentialsSecretArn)
+	if err != nil {
+		return nil, nil, err
+	}
+	creds := &repositoryCredentials{}
+	if err := json.Unmarshal(s, creds); err != nil {
+		return nil, nil, genericError("Parsing repository credentials", err)
+	}
+	if creds.Username == "" || creds.Password == "" {
+		return nil, nil, genericError("Parsing repository credentials", errors.New("the secret must have a Username and a Password"))
+	}
+	return aws.String(creds.Username), aws.String(creds.Password), nil
+}
+
+// chartRequestHeaders returns the headers sent when downloading the chart from a URL, with the basic authentication of
+// the repository credentials unless an Authorization header is set.
+func chartRequestHeaders(chart *Chart) map[string]string {
+	if IsZero(chart.ChartUsername) || IsZero(chart.ChartPassword) {
+		return chart.ChartHeaders
+	}
+	headers := map[string]string{}
+	for k, v := range chart.ChartHeaders {
+		if strings.EqualFold(k, "Authorization") {
+			return chart.ChartHeaders
+		}
+		headers[k] = v
+	}
+	headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(*chart.ChartUsername+":"+*chart.ChartPassword))
+	return headers
 }
 
 // getChartDetails parse chart
@@ -170,10 +1006,31 @@ func (c *Clients) getChartDetails(m *Model) (*Chart, error) {
 		if err != nil {
 			return nil, genericError("Process chart", err)
 		}
+		username, password, err := c.getRepositoryCredentials(m.RepositoryOptions)
+		if err != nil {
+			return nil, err
+		}
 		switch {
+		case strings.ToLower(u.Scheme) == "oci":
+			ref, name, tag, err := ociChartRef(*m.Chart, m.Version)
+			if err != nil {
+				return nil, genericError("Process chart", err)
+			}
+			cd.ChartType = aws.String("OCI")
+			cd.Chart = m.Chart
+			cd.ChartPath = aws.String(ref)
+			cd.ChartName = aws.String(name)
+			if tag != "" && m.Version == nil {
+				cd.ChartVersion = aws.String(tag)
+			}
+			if !IsZero(username) && !IsZero(password) {
+				log.Printf("Using basic authentication with username: %s for registry", *username)
+				cd.ChartUsername = username
+				cd.ChartPassword = password
+			}
 		case u.Host != "":
 			cd.ChartType = aws.String("Local")
-			cd.Chart = aws.String(chartLocalPath)
+			cd.Chart = m.Chart
 			cd.ChartPath = m.Chart
 			var chart string
 			sa := strings.Split(u.Path, "/")
@@ -185,6 +1042,11 @@ func (c *Clients) getChartDetails(m *Model) (*Chart, error) {
 			}
 			re := regexp.MustCompile(`[A-Za-z]+`)
 			cd.ChartName = aws.String(re.FindAllString(chart, 1)[0])
+			if !IsZero(username) && !IsZero(password) {
+				log.Printf("Using basic authentication with username: %s for chart URL", *username)
+				cd.ChartUsername = username
+				cd.ChartPassword = password
+			}
 		default:
 			// Get repo name and chart
 			sa := strings.Split(*m.Chart, "/")
@@ -200,10 +1062,10 @@ func (c *Clients) getChartDetails(m *Model) (*Chart, error) {
 			cd.ChartSkipTLSVerify = aws.Bool(false)
 			cd.ChartLocalCA = aws.Bool(false)
 			if !IsZero(m.RepositoryOptions) {
-				if !IsZero(m.RepositoryOptions.Username) && !IsZero(m.RepositoryOptions.Password) {
-					log.Printf("Using basic authentication with username: %s for repository", *m.RepositoryOptions.Username)
-					cd.ChartUsername = m.RepositoryOptions.Username
-					cd.ChartPassword = m.RepositoryOptions.Password
+				if !IsZero(username) && !IsZero(password) {
+					log.Printf("Using basic authentication with username: %s for repository", *username)
+					cd.ChartUsername = username
+					cd.ChartPassword = password
 				}
 				// IsZero on bool if false
 				if !IsZero(m.RepositoryOptions.InsecureSkipTLSVerify) {
@@ -239,6 +1101,43 @@ func (c *Clients) getChartDetails(m *Model) (*Chart, error) {
 	if m.Version != nil {
 		cd.ChartVersion = m.Version
 	}
+	if m.DependencyUpdate != nil {
+		cd.ChartDependencyUpdate = m.DependencyUpdate
+	}
+	if m.ExpectedAppVersion != nil {
+		cd.ChartExpectedAppVersion = m.ExpectedAppVersion
+	}
+	if m.ChartAPIVersion != nil {
+		cd.ChartAPIVersion = m.ChartAPIVersion
+	}
+	if m.ValuesProfile != nil {
+		cd.ChartValuesProfile = m.ValuesProfile
+	}
+	if m.ChartDigest != nil {
+		cd.ChartDigest = m.ChartDigest
+	}
+	if m.DefaultChartVersion != nil {
+		cd.ChartDefaultVersion = m.DefaultChartVersion
+	}
+	if m.FallbackVersion != nil {
+		cd.ChartFallbackVersion = m.FallbackVersion
+	}
+	cd.ChartFileValues = m.ChartFileValues
+	cd.ChartIgnore = m.ChartIgnore
+	cd.ChartIgnoreDisabled = m.DisableChartIgnore
+	cd.ChartSymlinks = m.ChartSymlinks
+	cd.ChartConditionsChecked = m.CheckDependencyConditions
+	cd.ChartValueTypesChecked = m.CheckValueTypes
+	cd.ChartRepoMirrors = m.RepositoryMirrors
+	if m.ChartHTTPHeaders != nil || m.ChartUserAgent != nil {
+		cd.ChartHeaders = map[string]string{}
+		for k, v := range m.ChartHTTPHeaders {
+			cd.ChartHeaders[k] = v
+		}
+		if m.ChartUserAgent != nil {
+			cd.ChartHeaders["User-Agent"] = *m.ChartUserAgent
+		}
+	}
 	switch m.Repository {
 	case nil:
 		cd.ChartRepoURL = aws.String(stableRepoURL)
@@ -267,7 +1166,56 @@ func getReleaseNameContext(context map[string]interface{}) *string {
 	if context["Name"] == nil {
 		return nil
 	}
-	return aws.String(fmt.Sprint(context["Name"]))
+	return aws.String(sanitizeReleaseName(fmt.Sprint(context["Name"])))
+}
+
+// invalidReleaseNameChars matches the runs of characters not allowed in a sanitized release name
+var invalidReleaseNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// sanitizeReleaseName returns a valid release name for the name. Invalid names, e.g. too long ones derived from
+// nested stack names, are lowercased, stripped of invalid characters and truncated, with a hash of the name
+// appended so that distinct names stay distinct and the same name always gives the same release name.
+func sanitizeReleaseName(name string) string {
+	if chartutil.ValidateReleaseName(name) == nil {
+		return name
+	}
+	hash := aws.StringValue(getHash(name))[:releaseNameHashLength]
+	s := invalidReleaseNameChars.ReplaceAllString(strings.ToLower(name), "-")
+	s = strings.Trim(s, "-")
+	if max := releaseNameMaxLength - releaseNameHashLength - 1; len(s) > max {
+		s = strings.TrimRight(s[:max], "-")
+	}
+	if s == "" {
+		s = "release"
+	}
+	return s + "-" + hash
+}
+
+// getResolvedChartContext returns the chart deployed by an earlier stage, if any.
+func getResolvedChartContext(context map[string]interface{}) *HelmStatusData {
+	if context == nil || context["ChartName"] == nil || context["ChartVersion"] == nil {
+		return nil
+	}
+	s := &HelmStatusData{ChartName: fmt.Sprint(context["ChartName"]), ChartVersion: fmt.Sprint(context["ChartVersion"])}
+	if context["ChartDigest"] != nil {
+		s.ChartDigest = fmt.Sprint(context["ChartDigest"])
+	}
+	if context["ValuesHash"] != nil {
+		s.ValuesHash = fmt.Sprint(context["ValuesHash"])
+	}
+	return s
+}
+
+// getInstallRetriesContext returns the number of installs retried by earlier callbacks.
+func getInstallRetriesContext(context map[string]interface{}) int {
+	if context == nil || context["InstallRetries"] == nil {
+		return 0
+	}
+	n, err := strconv.Atoi(fmt.Sprint(context["InstallRetries"]))
+	if err != nil {
+		return 0
+	}
+	return n
 }
 
 func getReleaseNameSpace(n *string) *string {
@@ -288,22 +1236,151 @@ func AWSError(err error) error {
 		// Get error details
 		log.Printf("AWS Error: %s - %s %v - %v\n", awsErr.Code(), awsErr.Message(), awsErr.OrigErr(), awsErr.Error())
 
-		// Prints out full error message, including original error if there was one.
-		log.Printf("Error: %v", awsErr.Error())
+		// Prints out full error message, including original error if there was one.
+		log.Printf("Error: %v", awsErr.Error())
+
+		// Get original error
+		if origErr := awsErr.OrigErr(); origErr != nil {
+			// operate on original error.
+		}
+		return fmt.Errorf("AWS Error: %s - %s %v-%v", awsErr.Code(), awsErr.Message(), awsErr.OrigErr(), awsErr.Error())
+	}
+	return fmt.Errorf(err.Error())
+}
+
+//genericError takes  error, log it and return new err.
+func genericError(source string, err error) error {
+	log.Printf("Error: At %s - %s \n", source, err)
+	return fmt.Errorf("Error: At %s - %s ", source, err)
+}
+
+// applyScheduling sets the resource level scheduling options at their values paths, replacing what the values define.
+func applyScheduling(m *Model, values map[string]interface{}) (map[string]interface{}, error) {
+	paths := &SchedulingValuePaths{}
+	if m.SchedulingValuePaths != nil {
+		paths = m.SchedulingValuePaths
+	}
+	if m.NodeSelector != nil {
+		selector := map[string]interface{}{}
+		for k, v := range m.NodeSelector {
+			selector[k] = v
+		}
+		if err := setValuePath(values, schedulingPath(paths.NodeSelector, "nodeSelector"), selector); err != nil {
+			return nil, genericError("Processing NodeSelector", err)
+		}
+	}
+	if m.Tolerations != nil {
+		var tolerations []interface{}
+		for _, t := range m.Tolerations {
+			toleration := map[string]interface{}{}
+			for k, v := range map[string]*string{"key": t.Key, "operator": t.Operator, "value": t.Value, "effect": t.Effect} {
+				if v != nil {
+					toleration[k] = *v
+				}
+			}
+			if t.TolerationSeconds != nil {
+				toleration["tolerationSeconds"] = *t.TolerationSeconds
+			}
+			tolerations = append(tolerations, toleration)
+		}
+		if err := setValuePath(values, schedulingPath(paths.Tolerations, "tolerations"), tolerations); err != nil {
+			return nil, genericError("Processing Tolerations", err)
+		}
+	}
+	if m.Affinity != nil {
+		affinity := map[string]interface{}{}
+		if err := yaml.Unmarshal([]byte(*m.Affinity), &affinity); err != nil {
+			return nil, genericError("Processing Affinity", err)
+		}
+		if err := setValuePath(values, schedulingPath(paths.Affinity, "affinity"), affinity); err != nil {
+			return nil, genericError("Processing Affinity", err)
+		}
+	}
+	return values, nil
+}
+
+func schedulingPath(path *string, def string) string {
+	if IsZero(path) {
+		return def
+	}
+	return *path
+}
+
+// setValuePath sets the value at the dotted path, creating the parent maps as needed.
+func setValuePath(values map[string]interface{}, path string, value interface{}) error {
+	keys := strings.Split(path, ".")
+	current := values
+	for _, k := range keys[:len(keys)-1] {
+		switch next := current[k].(type) {
+		case map[string]interface{}:
+			current = next
+		case nil:
+			m := map[string]interface{}{}
+			current[k] = m
+			current = m
+		default:
+			return fmt.Errorf("%s in path %s is not a map", k, path)
+		}
+	}
+	current[keys[len(keys)-1]] = value
+	return nil
+}
+
+// hasValuePath checks whether the merged values set a non null value at the dotted path, with list indexes as path elements.
+func hasValuePath(values map[string]interface{}, path string) bool {
+	var current interface{} = values
+	for _, k := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			current = node[k]
+		case []interface{}:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(node) {
+				return false
+			}
+			current = node[i]
+		default:
+			return false
+		}
+	}
+	return current != nil
+}
 
-		// Get original error
-		if origErr := awsErr.OrigErr(); origErr != nil {
-			// operate on original error.
+// checkRequiredValues errors listing the required value paths missing from the merged values.
+func checkRequiredValues(values map[string]interface{}, required []string) error {
+	var missing []string
+	for _, p := range required {
+		if !hasValuePath(values, p) {
+			missing = append(missing, p)
 		}
-		return fmt.Errorf("AWS Error: %s - %s %v-%v", awsErr.Code(), awsErr.Message(), awsErr.OrigErr(), awsErr.Error())
 	}
-	return fmt.Errorf(err.Error())
+	if len(missing) > 0 {
+		return genericError("Processing values", fmt.Errorf("required values missing: %s", strings.Join(missing, ", ")))
+	}
+	return nil
 }
 
-//genericError takes  error, log it and return new err.
-func genericError(source string, err error) error {
-	log.Printf("Error: At %s - %s \n", source, err)
-	return fmt.Errorf("Error: At %s - %s ", source, err)
+// checkSecretValuePaths errors when the inline values source sets a value at or under the secret value paths,
+// other than the values resolved from Secrets Manager or SSM at the resolved paths.
+func checkSecretValuePaths(values map[string]interface{}, secret []string, resolved [][]string, source string) error {
+	fromAWS := map[string]bool{}
+	for _, p := range resolved {
+		fromAWS[strings.Join(p, ".")] = true
+	}
+	for _, p := range secret {
+		v, ok := lookupValuePath(values, strings.Split(p, "."))
+		if !ok {
+			continue
+		}
+		var leaves []string
+		leafPaths(p, v, &leaves)
+		for _, l := range leaves {
+			if !fromAWS[l] {
+				return genericError("Processing values", fmt.Errorf("%s sets %s inline, values under %s must come from Secrets Manager or SSM", source, l, p))
+			}
+		}
+	}
+	return nil
 }
 
 // Merge values maps
@@ -326,19 +1403,297 @@ func mergeMaps(a, b map[string]interface{}) map[string]interface{} {
 	return out
 }
 
-// downloadHTTP downloads the file to specified path
-func downloadHTTP(url string, filepath string) error {
+// normalizeValueKeys renames the keys of the values found in the aliases to their canonical key, at any depth, so
+// equivalent keys of a source coalesce before the sources are merged. A canonical key takes precedence over its aliases.
+func normalizeValueKeys(values map[string]interface{}, aliases map[string]string) map[string]interface{} {
+	if len(aliases) == 0 || values == nil {
+		return values
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make(map[string]interface{}, len(values))
+	// Aliased keys first, so the canonical keys are merged over them
+	for _, canonical := range []bool{false, true} {
+		for _, k := range keys {
+			name, aliased := aliases[k]
+			if aliased == canonical {
+				continue
+			}
+			if !aliased {
+				name = k
+			}
+			v := normalizeValueKeysIn(values[k], aliases)
+			if vm, ok := v.(map[string]interface{}); ok {
+				if om, ok := out[name].(map[string]interface{}); ok {
+					v = mergeMaps(om, vm)
+				}
+			}
+			out[name] = v
+		}
+	}
+	return out
+}
+
+// normalizeValueKeysIn normalizes the keys of the maps nested in the value, including maps in lists
+func normalizeValueKeysIn(v interface{}, aliases map[string]string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return normalizeValueKeys(v, aliases)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = normalizeValueKeysIn(e, aliases)
+		}
+		return out
+	}
+	return v
+}
+
+// normalizeValuePaths renames the aliased keys of the value paths to match the normalized values
+func normalizeValuePaths(paths [][]string, aliases map[string]string) [][]string {
+	if len(aliases) == 0 {
+		return paths
+	}
+	for _, p := range paths {
+		for i, k := range p {
+			if name, ok := aliases[k]; ok {
+				p[i] = name
+			}
+		}
+	}
+	return paths
+}
+
+// downloadHTTP downloads the file to specified path, sending the headers with the request
+func downloadHTTP(url string, filepath string, headers map[string]string) error {
 	log.Printf("Getting file from URL...")
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return genericError("Downloading file", err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
 	// Get the data
-	resp, err := http.Get(url)
+	resp, err := downloadClient.Do(req)
 	if err != nil {
 		return genericError("Downloading file", err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
+		// Drain the body so the connection is returned to the pool
+		io.Copy(ioutil.Discard, resp.Body)
 		return genericError("Downloading file", fmt.Errorf("got response %v", resp.StatusCode))
 	}
 
+	// Create the file
+	out, err := os.Create(filepath)
+	if err != nil {
+		return genericError("Creating file", err)
+	}
+	defer out.Close()
+
+	// Write the body to file
+	_, err = io.Copy(out, resp.Body)
+	if err != nil {
+		return genericError("Writing file", err)
+	}
+	log.Printf("Downloaded %s ", out.Name())
+	return nil
+}
+
+// ValuesWebhookRequest is posted to the values webhook with the merged values of the release
+type ValuesWebhookRequest struct {
+	Release, Namespace, Chart string
+	Values                    map[string]interface{}
+}
+
+// ValuesWebhookResponse is the decision of the values webhook, with the values to deploy when allowed.
+// The values sent are deployed unchanged when the response has none.
+type ValuesWebhookResponse struct {
+	Allowed bool
+	Reason  string                 `json:",omitempty"`
+	Values  map[string]interface{} `json:",omitempty"`
+}
+
+// callValuesWebhook posts the values to the webhook and returns the values it allows. When the model excludes
+// secrets, the values resolved from secrets are sent redacted and restored where the returned values keep them redacted.
+func callValuesWebhook(url string, m *Model, values map[string]interface{}, resolved [][]string) (map[string]interface{}, error) {
+	log.Printf("Posting values to webhook...")
+	var masked [][]string
+	if aws.BoolValue(m.ValuesWebhookExcludeSecrets) {
+		masked = resolved
+	}
+	masked = maskValuePaths(m, masked)
+	sent := values
+	if len(masked) > 0 {
+		sent = redactValuePaths(values, masked)
+	}
+	body, err := json.Marshal(&ValuesWebhookRequest{
+		Release:   aws.StringValue(m.Name),
+		Namespace: aws.StringValue(getReleaseNameSpace(m.Namespace)),
+		Chart:     aws.StringValue(m.Chart),
+		Values:    sent,
+	})
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: downloadClient.Transport, Timeout: valuesWebhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("got response %v", resp.StatusCode)
+	}
+	decision := &ValuesWebhookResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(decision); err != nil {
+		return nil, fmt.Errorf("invalid response: %s", err)
+	}
+	if !decision.Allowed {
+		return nil, fmt.Errorf("values denied: %s", decision.Reason)
+	}
+	if decision.Values == nil {
+		return values, nil
+	}
+	if len(masked) > 0 {
+		restoreValuePaths(decision.Values, values, masked)
+	}
+	return decision.Values, nil
+}
+
+// restoreValuePaths puts back the original values at the paths where the values are still redacted.
+func restoreValuePaths(values map[string]interface{}, original map[string]interface{}, paths [][]string) {
+	for _, path := range paths {
+		if len(path) == 0 {
+			continue
+		}
+		v, ok := lookupValuePath(original, path)
+		if !ok {
+			continue
+		}
+		parent, ok := lookupValuePath(values, path[:len(path)-1])
+		if !ok {
+			continue
+		}
+		k := path[len(path)-1]
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			if node[k] == redactedValue {
+				node[k] = v
+			}
+		case []interface{}:
+			if idx, err := strconv.Atoi(k); err == nil && idx >= 0 && idx < len(node) && node[idx] == redactedValue {
+				node[idx] = v
+			}
+		}
+	}
+}
+
+// lookupValuePath returns the value at the path, with the list indexes as path elements.
+func lookupValuePath(v interface{}, path []string) (interface{}, bool) {
+	for _, k := range path {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = node[k]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			idx, err := strconv.Atoi(k)
+			if err != nil || idx < 0 || idx >= len(node) {
+				return nil, false
+			}
+			v = node[idx]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// checkHealth requests the health check URL and reports whether it returned the expected status.
+func checkHealth(url string, expected int) (bool, error) {
+	client := &http.Client{Timeout: healthCheckTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return false, genericError("Health check", err)
+	}
 	defer resp.Body.Close()
+	if resp.StatusCode != expected {
+		log.Printf("Health check %s returned %v, expected %v", url, resp.StatusCode, expected)
+		return false, nil
+	}
+	return true, nil
+}
+
+// downloadSFTP downloads the file from SFTP server to specified path
+func (c *Clients) downloadSFTP(u *url.URL, o *SFTPOptions, filepath string) error {
+	log.Printf("Getting file from SFTP...")
+	if IsZero(o) || IsZero(o.KnownHosts) {
+		return genericError("Downloading file", errors.New("SFTPOptions.KnownHosts is required to verify the SFTP host key"))
+	}
+	creds := &sftpCredentials{}
+	if !IsZero(o.Credentials) {
+		s, err := getSecretsManager(c.AWSClients.SecretsManagerClient(nil, nil), o.Credentials)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(s, creds); err != nil {
+			return genericError("Parsing SFTP credentials", err)
+		}
+	}
+	if u.User != nil && u.User.Username() != "" {
+		creds.Username = u.User.Username()
+	}
+	err := ioutil.WriteFile(knownHostsLocalPath, []byte(*o.KnownHosts), 0600)
+	if err != nil {
+		return genericError("Write file: ", err)
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsLocalPath)
+	if err != nil {
+		return genericError("Parsing known hosts", err)
+	}
+	config := &ssh.ClientConfig{
+		User:            creds.Username,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}
+	if creds.PrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(creds.PrivateKey))
+		if err != nil {
+			return genericError("Parsing SFTP private key", err)
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+	if creds.Password != "" {
+		config.Auth = append(config.Auth, ssh.Password(creds.Password))
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "22")
+	}
+	conn, err := ssh.Dial("tcp", host, config)
+	if err != nil {
+		return genericError("Connecting to SFTP", err)
+	}
+	defer conn.Close()
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		return genericError("Connecting to SFTP", err)
+	}
+	defer client.Close()
+
+	src, err := client.Open(u.Path)
+	if err != nil {
+		return genericError("Downloading file", err)
+	}
+	defer src.Close()
 
 	// Create the file
 	out, err := os.Create(filepath)
@@ -348,7 +1703,7 @@ func downloadHTTP(url string, filepath string) error {
 	defer out.Close()
 
 	// Write the body to file
-	_, err = io.Copy(out, resp.Body)
+	_, err = io.Copy(out, src)
 	if err != nil {
 		return genericError("Writing file", err)
 	}
@@ -400,42 +1755,153 @@ func DecodeID(id *string) (*ID, error) {
 	return i, nil
 }
 
-// downloadChart downloads the chart
-func (c *Clients) downloadChart(ur string, f string) error {
+// resolveRegion returns the region of the resource and where it comes from. In order, it is the Region of the model,
+// the region decoded from the resource ID, the region of the session, the AWS_REGION and AWS_DEFAULT_REGION environment
+// variables and the EC2 instance metadata. It fails when none of them set a region rather than leave it to the SDK.
+func resolveRegion(ses *session.Session, data *ID, m *Model) (string, string, error) {
+	if m != nil && !IsZero(m.Region) {
+		return *m.Region, "Region", nil
+	}
+	if data != nil && !IsZero(data.Region) {
+		return *data.Region, "the resource ID", nil
+	}
+	if r := aws.StringValue(ses.Config.Region); r != "" {
+		return r, "the session", nil
+	}
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if r := os.Getenv(env); r != "" {
+			return r, env, nil
+		}
+	}
+	r, err := metadataRegion(ses)
+	if err == nil && r != "" {
+		return r, "the EC2 instance metadata", nil
+	}
+	return "", "", errors.New("could not determine the AWS region, set Region or the AWS_REGION environment variable")
+}
+
+// regionSession returns a session in the region resolved by resolveRegion. The region of the model or the resource ID
+// is the source of truth for where the resource lives, the region and partition of a KubeConfig secret ARN in the model
+// must match it.
+func regionSession(ses *session.Session, data *ID, m *Model) (*session.Session, error) {
+	region, source, err := resolveRegion(ses, data, m)
+	if err != nil {
+		return nil, err
+	}
+	partition, err := regionPartition(region)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil && m.KubeConfig != nil {
+		if a, err := arn.Parse(*m.KubeConfig); err == nil {
+			if a.Region != "" && a.Region != region {
+				return nil, fmt.Errorf("KubeConfig region %s does not match the resource region %s", a.Region, region)
+			}
+			if a.Partition != partition {
+				return nil, fmt.Errorf("KubeConfig partition %s does not match the partition %s of region %s", a.Partition, partition, region)
+			}
+		}
+	}
+	r := aws.StringValue(ses.Config.Region)
+	if r == region {
+		return ses, nil
+	}
+	if r != "" {
+		// Credentials are scoped to a partition, a session cannot be moved across partitions.
+		if p, err := regionPartition(r); err == nil && p != partition {
+			return nil, fmt.Errorf("resource region %s in partition %s cannot be managed from region %s in partition %s", region, partition, r, p)
+		}
+	}
+	log.Printf("Using region %s from %s", region, source)
+	return ses.Copy(&aws.Config{Region: aws.String(region)}), nil
+}
+
+// modelSession returns the session in the region of the model, decoding the region of its ID when it has one.
+func modelSession(ses *session.Session, m *Model) (*session.Session, error) {
+	data := &ID{}
+	if m.ID != nil {
+		var err error
+		if data, err = DecodeID(m.ID); err != nil {
+			return nil, err
+		}
+	}
+	return regionSession(ses, data, m)
+}
+
+// downloadChart downloads the chart to a new temp file, sending the headers with HTTP requests, and returns its path.
+// Each download has its own file so concurrent installs never share one, the caller removes it once the chart is loaded.
+func (c *Clients) downloadChart(ur string, headers map[string]string) (string, error) {
 	u, err := url.Parse(ur)
 	if err != nil {
-		return genericError("Process url", err)
+		return "", genericError("Process url", err)
+	}
+	tmp, err := ioutil.TempFile(tempDir, chartTempPattern)
+	if err != nil {
+		return "", genericError("Downloading chart", err)
 	}
+	f := tmp.Name()
+	tmp.Close()
 	switch {
 	case strings.ToLower(u.Scheme) == "s3":
 		bucket := u.Host
 		key := strings.TrimLeft(u.Path, "/")
-		region, err := getBucketRegion(c.AWSClients.S3Client(nil, nil), bucket)
-		if err != nil {
-			return err
-		}
-		err = downloadS3(c.AWSClients.S3Client(region, nil), bucket, key, f)
-		if err != nil {
-			return err
+		var region *string
+		region, err = getBucketRegion(c.AWSClients.S3Client(nil, nil), bucket)
+		if err == nil {
+			err = downloadS3(c.AWSClients.S3Client(region, nil), bucket, key, f)
 		}
 	default:
-		err = downloadHTTP(ur, f)
-		if err != nil {
-			return err
-		}
+		err = downloadHTTP(ur, f, headers)
+	}
+	if err != nil {
+		os.Remove(f)
+		return "", err
+	}
+	return f, nil
+}
+
+// checkTempDir verifies the temp directory is writable and has the minimum free space in bytes.
+func checkTempDir(dir string, minSpace uint64) error {
+	if err := checkWritableDir(dir); err != nil {
+		return genericError("Temp directory", fmt.Errorf("%s is not writable: %v. Please set TMPDIR to a writable directory", dir, err))
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return genericError("Temp directory", err)
+	}
+	if free := uint64(st.Bavail) * uint64(st.Bsize); free < minSpace {
+		return genericError("Temp directory", fmt.Errorf("%s has %d bytes free, at least %d are required. Please set TMPDIR to a directory with more space", dir, free, minSpace))
 	}
 	return nil
 }
 
+// pruneTempFiles removes the provider temp files, and their partial downloads, older than the max age. The paths may
+// be glob patterns. Only the given paths are considered so files owned by others are never touched.
+func pruneTempFiles(paths []string, maxAge time.Duration) {
+	for _, p := range paths {
+		for _, pattern := range []string{p, p + partialFileSuffix, p + partialStateSuffix} {
+			files, _ := filepath.Glob(pattern)
+			for _, f := range files {
+				fi, err := os.Stat(f)
+				if err != nil || fi.IsDir() || time.Since(fi.ModTime()) < maxAge {
+					continue
+				}
+				log.Printf("Removing stale temp file %s", f)
+				if err := os.Remove(f); err != nil {
+					log.Printf("Warning: Failed to remove stale temp file %s: %s", f, err)
+				}
+			}
+		}
+	}
+}
+
 // checkTimeOut is see if elapsed time crossed the timeout.
-func checkTimeOut(startTime string, timeOut *int) bool {
+func checkTimeOut(startTime string, timeOut *int, unit *string) bool {
 	t, _ := time.Parse(time.RFC3339, startTime)
-	var s time.Duration
-	switch timeOut {
-	case nil:
-		s = defaultTimeOut * 60 * time.Second
-	default:
-		s = time.Duration(*timeOut) * 60 * time.Second
+	s, err := timeOutDuration(timeOut, unit)
+	if err != nil {
+		log.Printf("%s, using the default timeout", err)
+		s = defaultTimeOut * time.Minute
 	}
 	ts := time.Since(t).Seconds()
 	log.Printf("Elapsed Time : %.0f sec, Timeout: %v sec", ts, s.Seconds())
@@ -445,6 +1911,67 @@ func checkTimeOut(startTime string, timeOut *int) bool {
 	return false
 }
 
+// operationStart returns when the operation started, the zero time when unknown.
+func operationStart() time.Time {
+	t, _ := time.Parse(time.RFC3339, os.Getenv("StartTime"))
+	return t
+}
+
+// operationDeadline returns when the operation started at startTime times out, nil when the start time is unknown.
+func operationDeadline(startTime string, timeOut *int, unit *string) *time.Time {
+	t, err := time.Parse(time.RFC3339, startTime)
+	if err != nil {
+		return nil
+	}
+	s, err := timeOutDuration(timeOut, unit)
+	if err != nil {
+		s = defaultTimeOut * time.Minute
+	}
+	deadline := t.Add(s)
+	return &deadline
+}
+
+// stageDeadline returns when the handler invocation must stop waiting, the stage timeout from now or the operation
+// deadline of the model when earlier.
+func stageDeadline(m *Model) *time.Time {
+	deadline := time.Now().Add(stageTimeOut)
+	if d := operationDeadline(os.Getenv("StartTime"), m.TimeOut, m.TimeOutUnit); d != nil && d.Before(deadline) {
+		return d
+	}
+	return &deadline
+}
+
+// timeOutDuration returns the duration of the timeout, counted in minutes unless the unit is Seconds.
+func timeOutDuration(timeOut *int, unit *string) (time.Duration, error) {
+	scale, name := time.Minute, timeOutMinutes
+	switch aws.StringValue(unit) {
+	case "", timeOutMinutes:
+	case timeOutSeconds:
+		scale, name = time.Second, timeOutSeconds
+	default:
+		return 0, fmt.Errorf("invalid TimeOutUnit %q, expected %s or %s", aws.StringValue(unit), timeOutMinutes, timeOutSeconds)
+	}
+	if timeOut == nil {
+		return defaultTimeOut * time.Minute, nil
+	}
+	if *timeOut <= 0 {
+		return 0, fmt.Errorf("invalid TimeOut %d, expected a positive number of %s", *timeOut, strings.ToLower(name))
+	}
+	return time.Duration(*timeOut) * scale, nil
+}
+
+// inGracePeriod is to see if the elapsed time is still within the startup grace period, in seconds.
+func inGracePeriod(startTime string, grace *int) bool {
+	if grace == nil || *grace <= 0 {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339, startTime)
+	if err != nil {
+		return false
+	}
+	return time.Since(t) < time.Duration(*grace)*time.Second
+}
+
 func getStage(context map[string]interface{}) Stage {
 	if context == nil {
 		os.Setenv("StartTime", time.Now().Format(time.RFC3339))
@@ -459,12 +1986,70 @@ func getStage(context map[string]interface{}) Stage {
 	return Stage(fmt.Sprint(context["Stage"]))
 }
 
+// setOperationID sets the ID of the operation, a hash of the stack, the logical resource and the operation start
+// time, carried across stages in the callback context. It is not the CloudFormation request ID, which changes with
+// every handler invocation.
+func setOperationID(context map[string]interface{}, stackID string, logicalID string) {
+	if context != nil && context["OperationID"] != nil {
+		os.Setenv("OperationID", fmt.Sprint(context["OperationID"]))
+		return
+	}
+	os.Setenv("OperationID", aws.StringValue(getHash(stackID+logicalID+os.Getenv("StartTime"))))
+}
+
 func getHash(data string) *string {
 	hasher := md5.New()
 	hasher.Write([]byte(data))
 	return aws.String(hex.EncodeToString(hasher.Sum(nil)))
 }
 
+// canonicalJSON serializes the value with the map keys sorted at every level, converting the maps with
+// non string keys decoded from YAML, so equal values always serialize to the same bytes.
+func canonicalJSON(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(canonicalValue(v)); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// canonicalValue converts the maps with non string keys of the value to string keyed maps, which encoding/json
+// marshals in key order.
+func canonicalValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			out[fmt.Sprint(k)] = canonicalValue(val)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			out[k] = canonicalValue(val)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, val := range t {
+			out[i] = canonicalValue(val)
+		}
+		return out
+	}
+	return v
+}
+
+// valuesHash returns the hash of the canonical serialization of the values
+func valuesHash(values map[string]interface{}) (*string, error) {
+	b, err := canonicalJSON(values)
+	if err != nil {
+		return nil, err
+	}
+	return getHash(string(b)), nil
+}
+
 func LogPanic() {
 	if r := recover(); r != nil {
 		log.Println(string(debug.Stack()))
@@ -700,6 +2285,47 @@ func stringify(v interface{}) interface{} {
 	}
 }
 
+// redactString masks a set value.
+func redactString(v *string) *string {
+	if v == nil {
+		return nil
+	}
+	return aws.String(redactedValue)
+}
+
+// redactChart returns a copy of the chart details with the repository credentials and the HTTP headers, but the
+// User-Agent, redacted.
+func redactChart(chart *Chart) *Chart {
+	if chart == nil {
+		return nil
+	}
+	out := *chart
+	out.ChartUsername = redactString(chart.ChartUsername)
+	out.ChartPassword = redactString(chart.ChartPassword)
+	if chart.ChartHeaders != nil {
+		out.ChartHeaders = map[string]string{}
+		for k, v := range chart.ChartHeaders {
+			if !strings.EqualFold(k, "User-Agent") {
+				v = redactedValue
+			}
+			out.ChartHeaders[k] = v
+		}
+	}
+	return &out
+}
+
+// logPhysicalID is the LogPhysicalID of the model handled by the invocation, set by the handlers for the logs written
+// while creating the clients, before the model reaches the operation config
+var logPhysicalID *bool
+
+// logID returns the physical ID for logging, masked unless debug is set.
+func logID(id string, debug *bool) string {
+	if aws.BoolValue(debug) {
+		return id
+	}
+	return redactedValue
+}
+
 // pushLastKnownError to push to slice of string to send ot CFN
 func pushLastKnownError(msg string) {
 	if !stringInSlice(msg, LastKnownErrors) {
@@ -2,16 +2,33 @@ package resource
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/aws-cloudformation/cloudformation-cli-go-plugin/cfn/handler"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/pkg/sftp"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
 )
 
 type TestDetailParam struct {
@@ -51,6 +68,109 @@ func TestMergeMaps(t *testing.T) {
 	assert.EqualValues(t, expectedMap, result)
 }
 
+// TestNormalizeValueKeys to test aliased keys coalesce into their canonical key
+func TestNormalizeValueKeys(t *testing.T) {
+	aliases := map[string]string{"replica_count": "replicaCount", "replica-count": "replicaCount", "image_tag": "imageTag"}
+	tests := map[string]struct {
+		values   map[string]interface{}
+		expected map[string]interface{}
+	}{
+		"Renamed": {
+			values:   map[string]interface{}{"replica_count": 2, "name": "web"},
+			expected: map[string]interface{}{"replicaCount": 2, "name": "web"},
+		},
+		"CanonicalWins": {
+			values:   map[string]interface{}{"replica_count": 2, "replica-count": 3, "replicaCount": 4},
+			expected: map[string]interface{}{"replicaCount": 4},
+		},
+		"Nested": {
+			values: map[string]interface{}{
+				"web":        map[string]interface{}{"replica_count": 2, "sidecars": []interface{}{map[string]interface{}{"image_tag": "1.0"}}},
+				"web_config": map[string]interface{}{"image_tag": "2.0"},
+			},
+			expected: map[string]interface{}{
+				"web":        map[string]interface{}{"replicaCount": 2, "sidecars": []interface{}{map[string]interface{}{"imageTag": "1.0"}}},
+				"web_config": map[string]interface{}{"imageTag": "2.0"},
+			},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, d.expected, normalizeValueKeys(d.values, aliases))
+		})
+	}
+	values := map[string]interface{}{"replica_count": 2}
+	assert.Equal(t, values, normalizeValueKeys(values, nil))
+	assert.Equal(t, [][]string{{"db", "imageTag"}}, normalizeValuePaths([][]string{{"db", "image_tag"}}, aliases))
+}
+
+func TestApplyScheduling(t *testing.T) {
+	affinity := `nodeAffinity:
+  requiredDuringSchedulingIgnoredDuringExecution:
+    nodeSelectorTerms:
+    - matchExpressions:
+      - key: tier
+        operator: In
+        values: [platform]`
+	expectedAffinity := map[string]interface{}{"nodeAffinity": map[string]interface{}{"requiredDuringSchedulingIgnoredDuringExecution": map[string]interface{}{"nodeSelectorTerms": []interface{}{map[string]interface{}{"matchExpressions": []interface{}{map[string]interface{}{"key": "tier", "operator": "In", "values": []interface{}{"platform"}}}}}}}}
+	scheduling := &Model{
+		NodeSelector: map[string]string{"tier": "platform"},
+		Tolerations:  []Toleration{{Key: aws.String("dedicated"), Operator: aws.String("Equal"), Value: aws.String("platform"), Effect: aws.String("NoSchedule")}},
+		Affinity:     aws.String(affinity),
+	}
+	expectedTolerations := []interface{}{map[string]interface{}{"key": "dedicated", "operator": "Equal", "value": "platform", "effect": "NoSchedule"}}
+	tests := map[string]struct {
+		paths  *SchedulingValuePaths
+		values map[string]interface{}
+		eRes   map[string]interface{}
+		eErr   string
+	}{
+		"DefaultPaths": {
+			values: map[string]interface{}{"nodeSelector": map[string]interface{}{"disk": "ssd"}, "replicas": 2},
+			eRes: map[string]interface{}{
+				"nodeSelector": map[string]interface{}{"tier": "platform"},
+				"tolerations":  expectedTolerations,
+				"affinity":     expectedAffinity,
+				"replicas":     2,
+			},
+		},
+		"CustomPaths": {
+			paths: &SchedulingValuePaths{
+				NodeSelector: aws.String("controller.nodeSelector"),
+				Tolerations:  aws.String("controller.tolerations"),
+				Affinity:     aws.String("controller.scheduling.affinity"),
+			},
+			values: map[string]interface{}{"controller": map[string]interface{}{"replicas": 2}},
+			eRes: map[string]interface{}{
+				"controller": map[string]interface{}{
+					"replicas":     2,
+					"nodeSelector": map[string]interface{}{"tier": "platform"},
+					"tolerations":  expectedTolerations,
+					"scheduling":   map[string]interface{}{"affinity": expectedAffinity},
+				},
+			},
+		},
+		"NotMap": {
+			paths:  &SchedulingValuePaths{NodeSelector: aws.String("controller.nodeSelector")},
+			values: map[string]interface{}{"controller": "nginx"},
+			eErr:   "controller in path controller.nodeSelector is not a map",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := *scheduling
+			m.SchedulingValuePaths = d.paths
+			result, err := applyScheduling(&m, d.values)
+			if d.eErr != "" {
+				assert.Contains(t, err.Error(), d.eErr)
+			} else {
+				assert.Nil(t, err)
+				assert.EqualValues(t, d.eRes, result)
+			}
+		})
+	}
+}
+
 func TestProcessValues(t *testing.T) {
 	stringYaml := `root:
   firstlevel: value
@@ -75,7 +195,126 @@ func TestProcessValues(t *testing.T) {
 			m: &Model{
 				ValueYaml: aws.String("stringYaml"),
 			},
-			eErr: "error unmarshaling JSON",
+			eErr: "ValueYaml: values must be a map of keys, not a scalar at the root",
+		},
+		"RootList": {
+			m: &Model{
+				ValueYaml: aws.String("- name: web\n  replicas: 2\n- name: db\n"),
+			},
+			eErr: "ValueYaml: values must be a map of keys, not a list at the root",
+		},
+		"Anchors": {
+			m: &Model{
+				ValueYaml: aws.String("defaults: &defaults\n  replicas: 1\n  image: nginx\nprod:\n  <<: *defaults\n  replicas: 3\nsidecars:\n- *defaults\n"),
+			},
+			eRes: map[string]interface{}{
+				"defaults": map[string]interface{}{"replicas": float64(1), "image": "nginx"},
+				"prod":     map[string]interface{}{"replicas": float64(3), "image": "nginx"},
+				"sidecars": []interface{}{map[string]interface{}{"replicas": float64(1), "image": "nginx"}},
+			},
+		},
+		"DuplicatePermissive": {
+			m: &Model{
+				Values: map[string]string{"replicas": "3", "name": "web,replicas=3"},
+			},
+			eRes: map[string]interface{}{"name": "web", "replicas": int64(3)},
+		},
+		"DuplicateCommaStrict": {
+			m: &Model{
+				Values:                map[string]string{"replicas": "2", "name": "web,replicas=3"},
+				RejectDuplicateValues: aws.Bool(true),
+			},
+			eErr: "duplicate key replicas set by values \"name\" and \"replicas\"",
+		},
+		"NestedConflictStrict": {
+			m: &Model{
+				Values:                map[string]string{"resources": "none", "resources.limits.cpu": "1"},
+				RejectDuplicateValues: aws.Bool(true),
+			},
+			eErr: "duplicate key resources.limits.cpu set by values \"resources\" and \"resources.limits.cpu\"",
+		},
+		"UniqueStrict": {
+			m: &Model{
+				Values:                map[string]string{"image.tag": "1.0", "image.repository": "nginx", "ports[0]": "80", "ports[1]": "443"},
+				RejectDuplicateValues: aws.Bool(true),
+			},
+			eRes: map[string]interface{}{"image": map[string]interface{}{"tag": "1.0", "repository": "nginx"}, "ports": []interface{}{int64(80), int64(443)}},
+		},
+		"TOML": {
+			m: &Model{
+				ValueYaml:  aws.String(stringYaml),
+				ValuesTOML: aws.String("[root]\nfirstlevel = \"toml\"\n\n[root.nested]\nreplicas = 2\nenabled = true\n"),
+				Values:     map[string]string{"root.string": "false"},
+			},
+			eRes: map[string]interface{}{"root": map[string]interface{}{"firstlevel": "toml", "nested": map[string]interface{}{"replicas": float64(2), "enabled": true}, "secondlevel": []interface{}{"a1", "a2"}, "string": false}},
+		},
+		"TooLarge": {
+			m: &Model{
+				ValueYaml:     aws.String("image: " + strings.Repeat("a", 64)),
+				ValuesMaxSize: aws.Int(32),
+			},
+			eErr: "values YAML of 71 bytes exceeds the 32 bytes limit",
+		},
+		"TooDeep": {
+			m: &Model{
+				ValueYaml:      aws.String("a:\n  b:\n    c:\n      d: 1\n"),
+				ValuesMaxDepth: aws.Int(3),
+			},
+			eErr: "values YAML nesting depth exceeds the limit of 3 at a.b.c",
+		},
+		"TooDeepEmptyMap": {
+			m: &Model{
+				ValueYaml:      aws.String("a:\n  b:\n    c:\n      d: {}\n"),
+				ValuesMaxDepth: aws.Int(3),
+			},
+			eErr: "values YAML nesting depth exceeds the limit of 3 at a.b.c",
+		},
+		"TOMLTooLarge": {
+			m: &Model{
+				ValuesTOML:    aws.String("image = \"" + strings.Repeat("a", 64) + "\"\n"),
+				ValuesMaxSize: aws.Int(32),
+			},
+			eErr: "values TOML of 75 bytes exceeds the 32 bytes limit",
+		},
+		"TOMLTooDeep": {
+			m: &Model{
+				ValuesTOML:     aws.String("[a.b.c.d]\n"),
+				ValuesMaxDepth: aws.Int(3),
+			},
+			eErr: "values TOML nesting depth exceeds the limit of 3 at a.b.c",
+		},
+		"DefaultDepthLimit": {
+			m: &Model{
+				ValueYaml: aws.String(strings.Repeat("{a: ", defaultValuesMaxDepth+1) + "1" + strings.Repeat("}", defaultValuesMaxDepth+1)),
+			},
+			eErr: "values YAML nesting depth exceeds the limit of 64",
+		},
+		"RequiredPresent": {
+			m: &Model{
+				ValueYaml:      aws.String(stringYaml),
+				Values:         map[string]string{"image.tag": "1.0"},
+				RequiredValues: []string{"image.tag", "root.firstlevel", "root.secondlevel.1"},
+			},
+			eRes: map[string]interface{}{"image": map[string]interface{}{"tag": "1.0"}, "root": map[string]interface{}{"firstlevel": "value", "secondlevel": []interface{}{"a1", "a2"}, "string": true}},
+		},
+		"RequiredMissing": {
+			m: &Model{
+				ValueYaml:      aws.String(stringYaml),
+				RequiredValues: []string{"image.tag", "root.firstlevel", "root.secondlevel.2", "root.firstlevel.name"},
+			},
+			eErr: "required values missing: image.tag, root.secondlevel.2, root.firstlevel.name",
+		},
+		"RequiredEmpty": {
+			m: &Model{
+				RequiredValues: []string{"image.tag"},
+			},
+			eErr: "required values missing: image.tag",
+		},
+		"WrongTOML": {
+			m: &Model{
+				ValuesTOML: aws.String("[root\nkey = 1"),
+			},
+			eErr: "Parsing TOML values",
 		},
 		"WrongPath": {
 			m: &Model{
@@ -83,6 +322,34 @@ func TestProcessValues(t *testing.T) {
 			},
 			eErr: "InvalidParameter",
 		},
+		"EmptyKey": {
+			m: &Model{
+				ValueOverrideURL: aws.String("s3://test"),
+			},
+			eErr: "is an S3 prefix, please specify a values file object",
+		},
+		"PrefixKey": {
+			m: &Model{
+				ValueOverrideURL: aws.String("s3://test/values/"),
+			},
+			eErr: "is an S3 prefix, please specify a values file object",
+		},
+		"PrefixMerge": {
+			m: &Model{
+				ValueYaml:                aws.String(stringYaml),
+				ValueOverrideURL:         aws.String("s3://test/values/"),
+				ValueOverrideMergePrefix: aws.Bool(true),
+			},
+			eRes: map[string]interface{}{"root": map[string]interface{}{"firstlevel": "a", "prefix": "b", "secondlevel": []interface{}{"a1", "a2"}, "string": true}},
+		},
+		"PrefixMergeLimit": {
+			m: &Model{
+				ValueOverrideURL:         aws.String("s3://test/values/"),
+				ValueOverrideMergePrefix: aws.Bool(true),
+				ValuesMaxDepth:           aws.Int(1),
+			},
+			eErr: "values YAML nesting depth exceeds the limit of 1",
+		},
 	}
 	data, _ := ioutil.ReadFile(TestFolder + "/test.yaml")
 	_, _ = dlLoggingSvcNoChunk(data)
@@ -90,7 +357,7 @@ func TestProcessValues(t *testing.T) {
 	c := NewMockClient(t, nil)
 	for name, d := range tests {
 		t.Run(name, func(t *testing.T) {
-			result, err := c.processValues(d.m)
+			result, _, err := c.processValues(d.m)
 			if err != nil {
 				assert.Contains(t, err.Error(), d.eErr)
 			}
@@ -99,6 +366,132 @@ func TestProcessValues(t *testing.T) {
 	}
 }
 
+func TestResolveValueRefs(t *testing.T) {
+	tests := map[string]struct {
+		valueYaml string
+		eRes      map[string]interface{}
+		ePaths    [][]string
+		eErr      string
+	}{
+		"Nested": {
+			valueYaml: `db:
+  host: db.local
+  port: !ssm /app/db/port
+  auth:
+    password: !ssm /app/db/password
+kubeconfig: !secretsmanager arn:aws:secretsmanager:us-east-2:1234567890:secret:kubeconfig-Wt
+hosts:
+  - a.local
+  - !ssm /app/db/password`,
+			eRes: map[string]interface{}{
+				"db":         map[string]interface{}{"host": "db.local", "port": "5432", "auth": map[string]interface{}{"password": "s3cr3t"}},
+				"kubeconfig": "Test",
+				"hosts":      []interface{}{"a.local", "s3cr3t"},
+			},
+			ePaths: [][]string{{"db", "port"}, {"db", "auth", "password"}, {"kubeconfig"}, {"hosts", "1"}},
+		},
+		"NoRefs": {
+			valueYaml: "replicas: 2\nimage:\n  tag: \"1.0\"",
+			eRes:      map[string]interface{}{"replicas": float64(2), "image": map[string]interface{}{"tag": "1.0"}},
+		},
+		"MissingParameter": {
+			valueYaml: "password: !ssm /app/missing",
+			eErr:      "Resolving !ssm value password",
+		},
+	}
+	c := NewMockClient(t, nil)
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, paths, err := c.processValues(&Model{ValueYaml: aws.String(d.valueYaml)})
+			if d.eErr != "" {
+				assert.Contains(t, err.Error(), d.eErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.EqualValues(t, d.eRes, result)
+			assert.EqualValues(t, d.ePaths, paths)
+			redacted := redactValuePaths(result, paths)
+			for _, p := range paths {
+				var v interface{} = redacted
+				for _, k := range p {
+					switch n := v.(type) {
+					case map[string]interface{}:
+						v = n[k]
+					case []interface{}:
+						i, _ := strconv.Atoi(k)
+						v = n[i]
+					}
+				}
+				assert.EqualValues(t, redactedValue, v)
+			}
+		})
+	}
+}
+
+// TestSecretValuePaths to test the secret value paths are rejected when set inline and accepted when resolved
+func TestSecretValuePaths(t *testing.T) {
+	tests := map[string]struct {
+		valueYaml  *string
+		values     map[string]string
+		valuesTOML *string
+		eErr       string
+	}{
+		"FromSSM": {
+			valueYaml: aws.String("db:\n  host: db.local\n  password: !ssm /app/db/password"),
+		},
+		"FromSecretsManager": {
+			valueYaml: aws.String("db:\n  password: !secretsmanager arn:aws:secretsmanager:us-east-2:1234567890:secret:kubeconfig-Wt"),
+		},
+		"Unset": {
+			values: map[string]string{"db.host": "db.local"},
+		},
+		"InlineValueYaml": {
+			valueYaml: aws.String("db:\n  password: s3cr3t"),
+			eErr:      "ValueYaml sets db.password inline, values under db.password must come from Secrets Manager or SSM",
+		},
+		"InlineValues": {
+			valueYaml: aws.String("db:\n  password: !ssm /app/db/password"),
+			values:    map[string]string{"db.password": "s3cr3t"},
+			eErr:      "Values sets db.password inline",
+		},
+		"InlineValuesTOML": {
+			valueYaml:  aws.String("db:\n  password: !ssm /app/db/password"),
+			valuesTOML: aws.String("[db]\npassword = \"s3cr3t\"\n"),
+			eErr:       "ValuesTOML sets db.password inline",
+		},
+		"ValuesTOMLOutsidePaths": {
+			valuesTOML: aws.String("[db]\nhost = \"db.local\"\n"),
+		},
+		"InlineUnderPath": {
+			valueYaml: aws.String("tls:\n  key: !ssm /app/db/password\n  cert: plain"),
+			eErr:      "ValueYaml sets tls.cert inline, values under tls must come from Secrets Manager or SSM",
+		},
+		"AliasedFromSSM": {
+			valueYaml: aws.String("db:\n  pass: !ssm /app/db/password"),
+		},
+		"AliasedInlineValueYaml": {
+			valueYaml: aws.String("db:\n  pass: s3cr3t"),
+			eErr:      "ValueYaml sets db.password inline",
+		},
+		"AliasedInlineValues": {
+			values: map[string]string{"db.pass": "s3cr3t"},
+			eErr:   "Values sets db.password inline",
+		},
+	}
+	c := NewMockClient(t, nil)
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := c.processValues(&Model{ValueYaml: d.valueYaml, Values: d.values, ValuesTOML: d.valuesTOML, SecretValuePaths: []string{"db.password", "tls"}, ValueKeyAliases: map[string]string{"pass": "password"}})
+			if d.eErr != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), d.eErr)
+				return
+			}
+			assert.Nil(t, err)
+		})
+	}
+}
+
 // TestGetChartDetails is to test getChartDetails
 func TestGetChartDetails(t *testing.T) {
 	tests := map[string]struct {
@@ -151,7 +544,7 @@ func TestGetChartDetails(t *testing.T) {
 				Chart: aws.String("s3://test/chart-1.0.1.tgz"),
 			},
 			expectedChart: &Chart{
-				Chart:        aws.String("/tmp/chart.tgz"),
+				Chart:        aws.String("s3://test/chart-1.0.1.tgz"),
 				ChartName:    aws.String("chart"),
 				ChartType:    aws.String("Local"),
 				ChartPath:    aws.String("s3://test/chart-1.0.1.tgz"),
@@ -201,6 +594,45 @@ func TestGetChartDetails(t *testing.T) {
 			},
 			expectedError: nil,
 		},
+		"CredentialsSecret": {
+			m: &Model{
+				Chart:      aws.String("stable/test"),
+				Repository: aws.String("test.com"),
+				RepositoryOptions: &RepositoryOptions{
+					Username:             aws.String("test"),
+					CredentialsSecretArn: aws.String("arn:aws:secretsmanager:us-east-2:1234567890:secret:repo"),
+				},
+			},
+			expectedChart: &Chart{
+				Chart:              aws.String("stable/test"),
+				ChartRepo:          aws.String("stable"),
+				ChartName:          aws.String("test"),
+				ChartType:          aws.String("Remote"),
+				ChartRepoURL:       aws.String("test.com"),
+				ChartUsername:      aws.String("admin"),
+				ChartPassword:      aws.String("s3cr3t"),
+				ChartSkipTLSVerify: aws.Bool(false),
+				ChartLocalCA:       aws.Bool(false),
+			},
+		},
+		"InvalidCredentialsSecret": {
+			m: &Model{
+				Chart: aws.String("stable/test"),
+				RepositoryOptions: &RepositoryOptions{
+					CredentialsSecretArn: aws.String("arn:aws:secretsmanager:us-east-2:1234567890:secret:repo-invalid"),
+				},
+			},
+			expectedError: aws.String("Error: At Parsing repository credentials - the secret must have a Username and a Password "),
+		},
+		"MissingCredentialsSecret": {
+			m: &Model{
+				Chart: aws.String("stable/test"),
+				RepositoryOptions: &RepositoryOptions{
+					CredentialsSecretArn: aws.String("arn:aws:secretsmanager:us-east-2:1234567890:secret:missing"),
+				},
+			},
+			expectedError: aws.String("Notfound err"),
+		},
 	}
 	c := NewMockClient(t, nil)
 	for name, d := range tests {
@@ -258,8 +690,20 @@ func TestGetReleaseNameContext(t *testing.T) {
 		expectedName *string
 	}{
 		"NameProvided": {
+			context:      map[string]interface{}{"Name": "test"},
+			expectedName: aws.String("test"),
+		},
+		"Uppercase": {
 			context:      map[string]interface{}{"Name": "Test"},
-			expectedName: aws.String("Test"),
+			expectedName: aws.String("test-" + aws.StringValue(getHash("Test"))[:releaseNameHashLength]),
+		},
+		"NestedStackName": {
+			context:      map[string]interface{}{"Name": "Parent-NestedStack-1ABCDEFGHIJKL_MyChart.Release/With Spaces-And-A-Very-Long-Suffix"},
+			expectedName: aws.String("parent-nestedstack-1abcdefghijkl-mychart-rel-" + aws.StringValue(getHash("Parent-NestedStack-1ABCDEFGHIJKL_MyChart.Release/With Spaces-And-A-Very-Long-Suffix"))[:releaseNameHashLength]),
+		},
+		"InvalidOnly": {
+			context:      map[string]interface{}{"Name": "__"},
+			expectedName: aws.String("release-" + aws.StringValue(getHash("__"))[:releaseNameHashLength]),
 		},
 		"Nil": {
 			context:      map[string]interface{}{},
@@ -274,6 +718,10 @@ func TestGetReleaseNameContext(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			result := getReleaseNameContext(d.context)
 			assert.EqualValues(t, aws.StringValue(d.expectedName), aws.StringValue(result))
+			if result != nil {
+				assert.Nil(t, chartutil.ValidateReleaseName(*result))
+				assert.Equal(t, result, getReleaseNameContext(d.context))
+			}
 		})
 	}
 }
@@ -309,7 +757,7 @@ func TestHTTPDownload(t *testing.T) {
 	for _, file := range files {
 		t.Run(file, func(t *testing.T) {
 
-			err := downloadHTTP(testServer.URL+"/"+file, "/dev/null")
+			err := downloadHTTP(testServer.URL+"/"+file, "/dev/null", nil)
 			if err != nil {
 				assert.Contains(t, err.Error(), "At Downloading file")
 			}
@@ -317,6 +765,322 @@ func TestHTTPDownload(t *testing.T) {
 	}
 }
 
+// TestValuesWebhook to test the values webhook mutating and denying the values
+func TestValuesWebhook(t *testing.T) {
+	secret := [][]string{{"db", "password"}}
+	tests := map[string]struct {
+		response       *ValuesWebhookResponse
+		status         int
+		excludeSecrets bool
+		eSent          string
+		expected       map[string]interface{}
+		expectedErr    string
+	}{
+		"Mutate": {
+			response: &ValuesWebhookResponse{Allowed: true, Values: map[string]interface{}{
+				"db":    map[string]interface{}{"password": "s3cr3t"},
+				"image": map[string]interface{}{"tag": "approved"},
+			}},
+			eSent: "s3cr3t",
+			expected: map[string]interface{}{
+				"db":    map[string]interface{}{"password": "s3cr3t"},
+				"image": map[string]interface{}{"tag": "approved"},
+			},
+		},
+		"MutateExcludeSecrets": {
+			response: &ValuesWebhookResponse{Allowed: true, Values: map[string]interface{}{
+				"db":    map[string]interface{}{"password": redactedValue},
+				"image": map[string]interface{}{"tag": "approved"},
+			}},
+			excludeSecrets: true,
+			eSent:          redactedValue,
+			expected: map[string]interface{}{
+				"db":    map[string]interface{}{"password": "s3cr3t"},
+				"image": map[string]interface{}{"tag": "approved"},
+			},
+		},
+		"Unchanged": {
+			response: &ValuesWebhookResponse{Allowed: true},
+			eSent:    "s3cr3t",
+			expected: map[string]interface{}{
+				"db":    map[string]interface{}{"password": "s3cr3t"},
+				"image": map[string]interface{}{"tag": "latest"},
+			},
+		},
+		"Deny": {
+			response:    &ValuesWebhookResponse{Allowed: false, Reason: "image tag latest is not allowed"},
+			eSent:       "s3cr3t",
+			expectedErr: "values denied: image tag latest is not allowed",
+		},
+		"Error": {
+			status:      http.StatusInternalServerError,
+			expectedErr: "got response 500",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			var received *ValuesWebhookRequest
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = &ValuesWebhookRequest{}
+				assert.Nil(t, json.NewDecoder(r.Body).Decode(received))
+				if d.status != 0 {
+					w.WriteHeader(d.status)
+					return
+				}
+				_ = json.NewEncoder(w).Encode(d.response)
+			}))
+			defer ts.Close()
+			m := &Model{
+				Name:                        aws.String("web"),
+				Chart:                       aws.String("stable/nginx"),
+				ValuesWebhookURL:            aws.String(ts.URL),
+				ValuesWebhookExcludeSecrets: aws.Bool(d.excludeSecrets),
+			}
+			values := map[string]interface{}{
+				"db":    map[string]interface{}{"password": "s3cr3t"},
+				"image": map[string]interface{}{"tag": "latest"},
+			}
+			result, err := callValuesWebhook(ts.URL, m, values, secret)
+			assert.Equal(t, "web", received.Release)
+			assert.Equal(t, "default", received.Namespace)
+			assert.Equal(t, "stable/nginx", received.Chart)
+			if d.eSent != "" {
+				assert.Equal(t, d.eSent, received.Values["db"].(map[string]interface{})["password"])
+			}
+			if d.expectedErr != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), d.expectedErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, d.expected, result)
+			assert.Equal(t, "s3cr3t", values["db"].(map[string]interface{})["password"])
+		})
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(&ValuesWebhookResponse{Allowed: false, Reason: "denied"})
+	}))
+	defer ts.Close()
+	c := NewMockClient(t, nil)
+	_, _, err := c.processValues(&Model{Values: map[string]string{"image.tag": "latest"}, ValuesWebhookURL: aws.String(ts.URL)})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "At Values webhook - values denied: denied")
+}
+
+// TestMaskValuePaths to test the values at the MaskValuePaths are masked in the logs, the outputs, the values sent
+// to the webhook and the messages
+func TestMaskValuePaths(t *testing.T) {
+	m := &Model{
+		KubeConfig:     aws.String("arn:aws:secretsmanager:us-east-2:1234567890:secret:kubeconfig"),
+		Chart:          aws.String("stable/coscale"),
+		Name:           aws.String("web"),
+		Namespace:      aws.String("default"),
+		Values:         map[string]string{"db.password": "hunter22", "image.tag": "1.2.3"},
+		ValueYaml:      aws.String("ingress:\n  hosts:\n  - internal.example.com\n"),
+		ValuesTOML:     aws.String("[db]\napiKey = \"t0mlsecret\"\n"),
+		MaskValuePaths: []string{"db.password", "db.apiKey", "ingress.hosts"},
+	}
+	secrets := []string{"hunter22", "internal.example.com", "t0mlsecret"}
+	values := map[string]interface{}{
+		"db":      map[string]interface{}{"password": "hunter22", "apiKey": "t0mlsecret"},
+		"image":   map[string]interface{}{"tag": "1.2.3"},
+		"ingress": map[string]interface{}{"hosts": []interface{}{"internal.example.com"}},
+	}
+	assertMasked := func(t *testing.T, out string) {
+		for _, s := range secrets {
+			assert.NotContains(t, out, s)
+		}
+		assert.Contains(t, out, "1.2.3")
+	}
+
+	t.Run("EventLog", func(t *testing.T) {
+		assertMasked(t, EventLog(&Event{Model: m, Action: InstallReleaseAction, Inputs: &Inputs{ValueOpts: values}}))
+	})
+	t.Run("ComputedValues", func(t *testing.T) {
+		c := NewMockClient(t, m)
+		out, err := c.computedValues(m, &HelmStatusData{Values: values})
+		assert.Nil(t, err)
+		assertMasked(t, aws.StringValue(out))
+	})
+	t.Run("Explain", func(t *testing.T) {
+		e := *m
+		e.Explain = aws.Bool(true)
+		c := NewMockClient(t, &e)
+		NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, authExec *KubeAuthExec, deadline *time.Time) (*Clients, error) {
+			return c, nil
+		}
+		res := initialize(MockSession, &e, InstallReleaseAction)
+		assert.EqualValues(t, handler.Success, res.OperationStatus)
+		assertMasked(t, aws.StringValue(e.Explanation))
+	})
+	t.Run("ValuesWebhook", func(t *testing.T) {
+		var received []byte
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received, _ = ioutil.ReadAll(r.Body)
+			req := &ValuesWebhookRequest{}
+			assert.Nil(t, json.Unmarshal(received, req))
+			_ = json.NewEncoder(w).Encode(&ValuesWebhookResponse{Allowed: true, Values: req.Values})
+		}))
+		defer ts.Close()
+		result, err := callValuesWebhook(ts.URL, m, values, nil)
+		assert.Nil(t, err)
+		assertMasked(t, string(received))
+		assert.Equal(t, values, result)
+	})
+	t.Run("Messages", func(t *testing.T) {
+		msg := redactSecrets("template: web/templates/secret.yaml: invalid password hunter22 for host internal.example.com, key t0mlsecret, image 1.2.3", m, nil)
+		assertMasked(t, msg)
+		assert.Contains(t, msg, "invalid password *** for host ***, key ***")
+	})
+}
+
+// TestHTTPDownloadReuse is to test that repeated downloads from a host reuse the connection
+func TestHTTPDownloadReuse(t *testing.T) {
+	var mu sync.Mutex
+	conns := 0
+	testServer := httptest.NewUnstartedServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
+	testServer.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	testServer.Start()
+	defer testServer.Close()
+	for _, file := range []string{"test.tgz", "nonExt", "test.tgz", "test.tgz"} {
+		_ = downloadHTTP(testServer.URL+"/"+file, "/dev/null", nil)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, conns)
+}
+
+// TestDownloadSFTP is to test downloadSFTP
+func TestDownloadSFTP(t *testing.T) {
+	defer os.Remove(valuesYamlFile)
+	addr, hostKey, l := newSFTPTestServer(t)
+	defer l.Close()
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	otherPub, _ := ssh.NewPublicKey(otherKey)
+	path, _ := filepath.Abs(TestFolder + "/test.yaml")
+	creds := aws.String("arn:aws:secretsmanager:us-east-2:1234567890:secret:sftp")
+	tests := map[string]struct {
+		m    *Model
+		eRes map[string]interface{}
+		eErr string
+	}{
+		"Success": {
+			m: &Model{
+				ValueOverrideURL: aws.String("sftp://" + addr + path),
+				SFTPOptions:      &SFTPOptions{Credentials: creds, KnownHosts: aws.String(hostKey)},
+			},
+			eRes: map[string]interface{}{"root": map[string]interface{}{"file": true, "firstlevel": "value", "secondlevel": []interface{}{"a1", "a2"}}},
+		},
+		"NoKnownHosts": {
+			m: &Model{
+				ValueOverrideURL: aws.String("sftp://" + addr + path),
+				SFTPOptions:      &SFTPOptions{Credentials: creds},
+			},
+			eErr: "KnownHosts is required",
+		},
+		"WrongHostKey": {
+			m: &Model{
+				ValueOverrideURL: aws.String("sftp://" + addr + path),
+				SFTPOptions:      &SFTPOptions{Credentials: creds, KnownHosts: aws.String(knownhosts.Line([]string{knownhosts.Normalize(addr)}, otherPub))},
+			},
+			eErr: "key mismatch",
+		},
+		"WrongUser": {
+			m: &Model{
+				ValueOverrideURL: aws.String("sftp://other@" + addr + path),
+				SFTPOptions:      &SFTPOptions{Credentials: creds, KnownHosts: aws.String(hostKey)},
+			},
+			eErr: "unable to authenticate",
+		},
+	}
+	c := NewMockClient(t, nil)
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, _, err := c.processValues(d.m)
+			if d.eErr != "" {
+				assert.Contains(t, err.Error(), d.eErr)
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.EqualValues(t, d.eRes, result)
+		})
+	}
+}
+
+// newSFTPTestServer starts a local SSH server with sftp subsystem and returns the address with its known_hosts entry
+func newSFTPTestServer(t *testing.T) (string, string, net.Listener) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "test" && string(pass) == "test" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %q", c.User())
+		},
+	}
+	config.AddHostKey(signer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+	addr := l.Addr().String()
+	return addr, knownhosts.Line([]string{knownhosts.Normalize(addr)}, signer.PublicKey()), l
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				req.Reply(req.Type == "subsystem" && string(req.Payload[4:]) == "sftp", nil)
+			}
+		}(requests)
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			return
+		}
+		go func() {
+			server.Serve()
+			server.Close()
+		}()
+	}
+}
+
 // TestGenerateID is to test generateID
 func TestGenerateID(t *testing.T) {
 	eID := aws.String("eyJDbHVzdGVySUQiOiJla3MiLCJSZWdpb24iOiJldS13ZXN0LTEiLCJOYW1lIjoiVGVzdCIsIk5hbWVzcGFjZSI6ImRlZmF1bHQifQ")
@@ -439,36 +1203,297 @@ func TestDownloadChart(t *testing.T) {
 	c := NewMockClient(t, nil)
 	for _, file := range files {
 		t.Run(file, func(t *testing.T) {
-			err := c.downloadChart(file, "/dev/null")
+			f, err := c.downloadChart(file, nil)
+			assert.Nil(t, err)
+			defer os.Remove(f)
+			assert.FileExists(t, f)
+		})
+	}
+}
+
+// TestDownloadChartConcurrent is to test concurrent downloads write to their own file
+func TestDownloadChartConcurrent(t *testing.T) {
+	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
+	defer testServer.Close()
+	c := NewMockClient(t, nil)
+	charts := map[string]string{"test.tgz": "jenkins", "dep-0.1.0.tgz": "dep"}
+	paths := map[string]string{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for file := range charts {
+		wg.Add(1)
+		go func(file string) {
+			defer wg.Done()
+			f, err := c.downloadChart(testServer.URL+"/"+file, nil)
+			assert.Nil(t, err)
+			mu.Lock()
+			defer mu.Unlock()
+			paths[file] = f
+		}(file)
+	}
+	wg.Wait()
+	assert.NotEqual(t, paths["test.tgz"], paths["dep-0.1.0.tgz"])
+	for file, name := range charts {
+		defer os.Remove(paths[file])
+		ch, err := loader.Load(paths[file])
+		assert.Nil(t, err)
+		assert.Equal(t, name, ch.Name())
+	}
+}
+
+// TestDownloadChartFailure is to test a failed download leaves no temp file behind
+func TestDownloadChartFailure(t *testing.T) {
+	testServer := httptest.NewServer(http.NotFoundHandler())
+	defer testServer.Close()
+	c := NewMockClient(t, nil)
+	before, _ := filepath.Glob(filepath.Join(tempDir, chartTempPattern))
+	f, err := c.downloadChart(testServer.URL+"/missing.tgz", nil)
+	assert.NotNil(t, err)
+	assert.Empty(t, f)
+	after, _ := filepath.Glob(filepath.Join(tempDir, chartTempPattern))
+	assert.Equal(t, before, after)
+}
+
+// TestDownloadChartHeaders is to test the User-Agent and headers sent by downloadChart
+func TestDownloadChartHeaders(t *testing.T) {
+	files := http.StripPrefix("/", http.FileServer(http.Dir(TestFolder)))
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.UserAgent(), "Go-http-client") || r.Header.Get("X-Chart-Token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer testServer.Close()
+	c := NewMockClient(t, nil)
+	tests := map[string]struct {
+		m           *Model
+		eHeaders    map[string]string
+		expectedErr *string
+	}{
+		"Default": {
+			m:           &Model{ChartHTTPHeaders: map[string]string{"X-Chart-Token": "secret"}},
+			eHeaders:    map[string]string{"X-Chart-Token": "secret"},
+			expectedErr: aws.String("got response 403"),
+		},
+		"CustomUserAgent": {
+			m:        &Model{ChartUserAgent: aws.String("charts-client/1.0"), ChartHTTPHeaders: map[string]string{"X-Chart-Token": "secret"}},
+			eHeaders: map[string]string{"User-Agent": "charts-client/1.0", "X-Chart-Token": "secret"},
+		},
+		"MissingHeader": {
+			m:           &Model{ChartUserAgent: aws.String("charts-client/1.0")},
+			eHeaders:    map[string]string{"User-Agent": "charts-client/1.0"},
+			expectedErr: aws.String("got response 403"),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			d.m.Chart = aws.String(testServer.URL + "/test.tgz")
+			cd, err := c.getChartDetails(d.m)
+			assert.Nil(t, err)
+			assert.EqualValues(t, d.eHeaders, cd.ChartHeaders)
+			f, err := c.downloadChart(*cd.ChartPath, cd.ChartHeaders)
+			if d.expectedErr != nil {
+				assert.Contains(t, err.Error(), *d.expectedErr)
+			} else {
+				assert.Nil(t, err)
+				os.Remove(f)
+			}
+		})
+	}
+}
+
+// TestDownloadChartBasicAuth to test downloading the chart with the repository credentials
+func TestDownloadChartBasicAuth(t *testing.T) {
+	files := http.StripPrefix("/", http.FileServer(http.Dir(TestFolder)))
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "admin" || p != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer testServer.Close()
+	c := NewMockClient(t, nil)
+	tests := map[string]struct {
+		o           *RepositoryOptions
+		headers     map[string]string
+		expectedErr *string
+	}{
+		"CredentialsSecret": {
+			o: &RepositoryOptions{CredentialsSecretArn: aws.String("arn:aws:secretsmanager:us-east-2:1234567890:secret:repo")},
+		},
+		"Credentials": {
+			o: &RepositoryOptions{Username: aws.String("admin"), Password: aws.String("s3cr3t")},
+		},
+		"NoCredentials": {
+			expectedErr: aws.String("got response 401"),
+		},
+		"AuthorizationHeader": {
+			o:           &RepositoryOptions{CredentialsSecretArn: aws.String("arn:aws:secretsmanager:us-east-2:1234567890:secret:repo")},
+			headers:     map[string]string{"authorization": "Bearer t0ken"},
+			expectedErr: aws.String("got response 401"),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := &Model{Chart: aws.String(testServer.URL + "/test.tgz"), RepositoryOptions: d.o, ChartHTTPHeaders: d.headers}
+			cd, err := c.getChartDetails(m)
 			assert.Nil(t, err)
+			assert.EqualValues(t, d.headers, cd.ChartHeaders)
+			f, err := c.downloadChart(*cd.ChartPath, chartRequestHeaders(cd))
+			if d.expectedErr != nil {
+				assert.Contains(t, err.Error(), *d.expectedErr)
+			} else {
+				assert.Nil(t, err)
+				os.Remove(f)
+			}
 		})
 	}
 }
 
 // TestCheckTimeOut to test checkTimeOut
 func TestCheckTimeOut(t *testing.T) {
-	timeOut := aws.Int(90)
 	tests := map[string]struct {
 		time      string
+		timeOut   *int
+		unit      *string
 		assertion assert.BoolAssertionFunc
 	}{
 		"10M": {
 			time:      time.Now().Add(time.Minute * -10).Format(time.RFC3339),
+			timeOut:   aws.Int(90),
 			assertion: assert.False,
 		},
 		"10H": {
 			time:      time.Now().Add(time.Hour * -10).Format(time.RFC3339),
+			timeOut:   aws.Int(90),
 			assertion: assert.True,
 		},
+		"10MSeconds": {
+			time:      time.Now().Add(time.Minute * -10).Format(time.RFC3339),
+			timeOut:   aws.Int(90),
+			unit:      aws.String("Seconds"),
+			assertion: assert.True,
+		},
+		"InvalidUnitDefault": {
+			time:      time.Now().Add(time.Minute * -10).Format(time.RFC3339),
+			timeOut:   aws.Int(1),
+			unit:      aws.String("Hours"),
+			assertion: assert.False,
+		},
 	}
 	for name, d := range tests {
 		t.Run(name, func(t *testing.T) {
-			result := checkTimeOut(d.time, timeOut)
+			result := checkTimeOut(d.time, d.timeOut, d.unit)
 			d.assertion(t, result)
 		})
 	}
 }
 
+// TestTimeOutDuration to test timeOutDuration
+func TestTimeOutDuration(t *testing.T) {
+	tests := map[string]struct {
+		timeOut     *int
+		unit        *string
+		expected    time.Duration
+		expectedErr string
+	}{
+		"Default": {
+			expected: 60 * time.Minute,
+		},
+		"DefaultSeconds": {
+			unit:     aws.String("Seconds"),
+			expected: 60 * time.Minute,
+		},
+		"Minutes": {
+			timeOut:  aws.Int(90),
+			expected: 90 * time.Minute,
+		},
+		"ExplicitMinutes": {
+			timeOut:  aws.Int(90),
+			unit:     aws.String("Minutes"),
+			expected: 90 * time.Minute,
+		},
+		"Seconds": {
+			timeOut:  aws.Int(90),
+			unit:     aws.String("Seconds"),
+			expected: 90 * time.Second,
+		},
+		"InvalidUnit": {
+			timeOut:     aws.Int(90),
+			unit:        aws.String("Hours"),
+			expectedErr: `invalid TimeOutUnit "Hours", expected Minutes or Seconds`,
+		},
+		"NotPositive": {
+			timeOut:     aws.Int(0),
+			unit:        aws.String("Seconds"),
+			expectedErr: "invalid TimeOut 0, expected a positive number of seconds",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, err := timeOutDuration(d.timeOut, d.unit)
+			if d.expectedErr != "" {
+				assert.EqualError(t, err, d.expectedErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, d.expected, result)
+		})
+	}
+}
+
+// TestOperationDeadline to test the deadline of the operation from its start time and timeout
+func TestOperationDeadline(t *testing.T) {
+	start := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	assert.Nil(t, operationDeadline("", nil, nil))
+	assert.Equal(t, start.Add(defaultTimeOut*time.Minute), *operationDeadline(start.Format(time.RFC3339), nil, nil))
+	assert.Equal(t, start.Add(30*time.Minute), *operationDeadline(start.Format(time.RFC3339), aws.Int(30), nil))
+}
+
+// TestStageDeadline to test stageDeadline
+func TestStageDeadline(t *testing.T) {
+	defer os.Setenv("StartTime", os.Getenv("StartTime"))
+	os.Setenv("StartTime", time.Now().Format(time.RFC3339))
+	assert.WithinDuration(t, time.Now().Add(stageTimeOut), *stageDeadline(&Model{}), time.Second)
+	os.Setenv("StartTime", time.Now().Add(-time.Minute).Format(time.RFC3339))
+	assert.WithinDuration(t, time.Now().Add(30*time.Second), *stageDeadline(&Model{TimeOut: aws.Int(90), TimeOutUnit: aws.String(timeOutSeconds)}), time.Second)
+}
+
+func TestInGracePeriod(t *testing.T) {
+	tests := map[string]struct {
+		time      string
+		grace     *int
+		assertion assert.BoolAssertionFunc
+	}{
+		"Within": {
+			time:      time.Now().Add(time.Second * -30).Format(time.RFC3339),
+			grace:     aws.Int(120),
+			assertion: assert.True,
+		},
+		"Elapsed": {
+			time:      time.Now().Add(time.Minute * -5).Format(time.RFC3339),
+			grace:     aws.Int(120),
+			assertion: assert.False,
+		},
+		"NotSet": {
+			time:      time.Now().Format(time.RFC3339),
+			assertion: assert.False,
+		},
+		"BadTime": {
+			time:      "now",
+			grace:     aws.Int(120),
+			assertion: assert.False,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			d.assertion(t, inGracePeriod(d.time, d.grace))
+		})
+	}
+}
+
 // TestGetStage is to test getStage
 func TestGetStage(t *testing.T) {
 	st := time.Now().Format(time.RFC3339)
@@ -523,6 +1548,322 @@ func TestHash(t *testing.T) {
 	assert.EqualValues(t, aws.StringValue(expectedHash), aws.StringValue(result))
 }
 
+// TestCanonicalJSON is to test canonicalJSON and valuesHash serialize equal values identically
+func TestCanonicalJSON(t *testing.T) {
+	build := func(keys []string) map[string]interface{} {
+		values := map[string]interface{}{}
+		for _, k := range keys {
+			values[k] = map[interface{}]interface{}{"z": k, "a": []interface{}{map[string]interface{}{"y": "<b>", "b": 1}}}
+		}
+		return values
+	}
+	keys := []string{"web", "db", "cache", "queue", "api", "worker"}
+	expected := `{"api":{"a":[{"b":1,"y":"<b>"}],"z":"api"},"cache":{"a":[{"b":1,"y":"<b>"}],"z":"cache"},` +
+		`"db":{"a":[{"b":1,"y":"<b>"}],"z":"db"},"queue":{"a":[{"b":1,"y":"<b>"}],"z":"queue"},` +
+		`"web":{"a":[{"b":1,"y":"<b>"}],"z":"web"},"worker":{"a":[{"b":1,"y":"<b>"}],"z":"worker"}}`
+	expectedHash, err := valuesHash(build(keys))
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		reversed := make([]string, len(keys))
+		for j, k := range keys {
+			reversed[len(keys)-1-j] = k
+		}
+		keys = append(keys[1:], keys[0])
+		for _, order := range [][]string{keys, reversed} {
+			b, err := canonicalJSON(build(order))
+			assert.Nil(t, err)
+			assert.Equal(t, expected, string(b))
+			hash, err := valuesHash(build(order))
+			assert.Nil(t, err)
+			assert.Equal(t, aws.StringValue(expectedHash), aws.StringValue(hash))
+		}
+	}
+}
+
+// TestProcessValuesOrder is to test overlapping Values keys always merge to the same values, or fail the same way
+func TestProcessValuesOrder(t *testing.T) {
+	c := NewMockClient(t, nil)
+	tests := map[string]struct {
+		values      map[string]string
+		expected    string
+		expectedErr string
+	}{
+		"Override": {
+			values:   map[string]string{"replicas": "1,image.tag=latest", "image.tag": "1.2.3", "image.repository": "nginx"},
+			expected: `{"image":{"repository":"nginx","tag":"latest"},"replicas":1}`,
+		},
+		"Conflict": {
+			values:      map[string]string{"image": "nginx", "image.tag": "1.2.3"},
+			expectedErr: "unable to parse key",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				values, _, err := c.processValues(&Model{Values: d.values})
+				if d.expectedErr != "" {
+					assert.Contains(t, err.Error(), d.expectedErr)
+					continue
+				}
+				assert.Nil(t, err)
+				b, err := canonicalJSON(values)
+				assert.Nil(t, err)
+				assert.Equal(t, d.expected, string(b))
+			}
+		})
+	}
+}
+
+// TestProcessValuesKeyAliases is to test equivalent keys of different sources merge into a single value
+func TestProcessValuesKeyAliases(t *testing.T) {
+	c := NewMockClient(t, nil)
+	m := &Model{
+		ValueYaml:       aws.String("replica_count: 2\nimage:\n  pull_policy: Always\n  tag: 1.0.0\n"),
+		Values:          map[string]string{"replicaCount": "3", "image.pullPolicy": "IfNotPresent"},
+		ValueKeyAliases: map[string]string{"replica_count": "replicaCount", "pull_policy": "pullPolicy"},
+	}
+	values, _, err := c.processValues(m)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"replicaCount": int64(3),
+		"image":        map[string]interface{}{"pullPolicy": "IfNotPresent", "tag": "1.0.0"},
+	}, values)
+	m.ValueKeyAliases = nil
+	values, _, err = c.processValues(m)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(2), values["replica_count"])
+	assert.Equal(t, int64(3), values["replicaCount"])
+}
+
+// TestRegionSession is to test regionSession
+func TestRegionSession(t *testing.T) {
+	defaultMetadataRegion := metadataRegion
+	defer func() { metadataRegion = defaultMetadataRegion }()
+	noRegion := MockSession.Copy(&aws.Config{Region: aws.String("")})
+	tests := map[string]struct {
+		ses         *session.Session
+		data        *ID
+		m           *Model
+		env         map[string]string
+		metadata    string
+		eRegion     string
+		expectedErr *string
+	}{
+		"ModelRegion": {
+			data:    &ID{Region: aws.String("eu-west-1")},
+			m:       &Model{Region: aws.String("ap-south-1")},
+			eRegion: "ap-south-1",
+		},
+		"EnvRegion": {
+			ses:     noRegion,
+			data:    &ID{},
+			m:       &Model{},
+			env:     map[string]string{"AWS_REGION": "eu-central-1", "AWS_DEFAULT_REGION": "eu-north-1"},
+			eRegion: "eu-central-1",
+		},
+		"EnvDefaultRegion": {
+			ses:     noRegion,
+			data:    &ID{},
+			m:       &Model{},
+			env:     map[string]string{"AWS_DEFAULT_REGION": "eu-north-1"},
+			eRegion: "eu-north-1",
+		},
+		"MetadataRegion": {
+			ses:      noRegion,
+			metadata: "ca-central-1",
+			eRegion:  "ca-central-1",
+		},
+		"NoRegion": {
+			ses:         noRegion,
+			data:        &ID{},
+			m:           &Model{},
+			expectedErr: aws.String("could not determine the AWS region"),
+		},
+		"UnknownRegion": {
+			data:        &ID{},
+			m:           &Model{Region: aws.String("moon-1")},
+			expectedErr: aws.String("could not determine the AWS partition of region moon-1"),
+		},
+		"IDRegion": {
+			data:    &ID{Region: aws.String("eu-west-1")},
+			m:       &Model{},
+			eRegion: "eu-west-1",
+		},
+		"NoIDRegion": {
+			data:    &ID{},
+			m:       &Model{},
+			eRegion: "us-east-1",
+		},
+		"MatchingKubeConfig": {
+			data:    &ID{Region: aws.String("eu-west-1")},
+			m:       &Model{KubeConfig: aws.String("arn:aws:secretsmanager:eu-west-1:1234567890:secret:kubeconfig")},
+			eRegion: "eu-west-1",
+		},
+		"MismatchKubeConfig": {
+			data:        &ID{Region: aws.String("eu-west-1")},
+			m:           &Model{KubeConfig: aws.String("arn:aws:secretsmanager:us-east-2:1234567890:secret:kubeconfig")},
+			expectedErr: aws.String("KubeConfig region us-east-2 does not match the resource region eu-west-1"),
+		},
+		"SamePartition": {
+			ses:     MockSession.Copy(&aws.Config{Region: aws.String("cn-northwest-1")}),
+			data:    &ID{Region: aws.String("cn-north-1")},
+			m:       &Model{KubeConfig: aws.String("arn:aws-cn:secretsmanager:cn-north-1:1234567890:secret:kubeconfig")},
+			eRegion: "cn-north-1",
+		},
+		"CrossPartition": {
+			data:        &ID{Region: aws.String("cn-north-1")},
+			m:           &Model{},
+			expectedErr: aws.String("resource region cn-north-1 in partition aws-cn cannot be managed from region us-east-1 in partition aws"),
+		},
+		"MismatchKubeConfigPartition": {
+			ses:         MockSession.Copy(&aws.Config{Region: aws.String("us-gov-west-1")}),
+			data:        &ID{Region: aws.String("us-gov-west-1")},
+			m:           &Model{KubeConfig: aws.String("arn:aws:secretsmanager:us-gov-west-1:1234567890:secret:kubeconfig")},
+			expectedErr: aws.String("KubeConfig partition aws does not match the partition aws-us-gov of region us-gov-west-1"),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+				defer os.Setenv(env, os.Getenv(env))
+				os.Setenv(env, d.env[env])
+			}
+			metadataRegion = func(*session.Session) (string, error) {
+				if d.metadata == "" {
+					return "", errors.New("EC2 instance metadata is not available")
+				}
+				return d.metadata, nil
+			}
+			ses := MockSession
+			if d.ses != nil {
+				ses = d.ses
+			}
+			ses, err := regionSession(ses, d.data, d.m)
+			if d.expectedErr != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, d.eRegion, aws.StringValue(ses.Config.Region))
+			}
+		})
+	}
+}
+
+// TestCheckTempDir is to test checkTempDir with TMPDIR pointing at valid and unusable directories
+func TestCheckTempDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tmpdir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	// A directory below a regular file cannot be created, even as root
+	file := filepath.Join(dir, "file")
+	assert.Nil(t, ioutil.WriteFile(file, nil, 0644))
+	tests := map[string]struct {
+		tmpdir      string
+		minSpace    uint64
+		expectedErr *string
+	}{
+		"Valid": {
+			tmpdir:   dir,
+			minSpace: minTempDirSpace,
+		},
+		"Unwritable": {
+			tmpdir:      filepath.Join(file, "tmp"),
+			minSpace:    minTempDirSpace,
+			expectedErr: aws.String("is not writable"),
+		},
+		"NoSpace": {
+			tmpdir:      dir,
+			minSpace:    math.MaxUint64,
+			expectedErr: aws.String("Please set TMPDIR to a directory with more space"),
+		},
+	}
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			os.Setenv("TMPDIR", d.tmpdir)
+			err := checkTempDir(os.TempDir(), d.minSpace)
+			if d.expectedErr != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+// TestPruneTempFiles is to test pruneTempFiles
+func TestPruneTempFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "prune")
+	defer os.RemoveAll(dir)
+	old := time.Now().Add(-time.Hour)
+	files := map[string]struct {
+		provider bool
+		stale    bool
+		removed  bool
+	}{
+		"chart.tgz":      {provider: true, stale: true, removed: true},
+		"chart.tgz.part": {stale: true, removed: true},
+		"chart-1.tgz":    {stale: true, removed: true},
+		"chart-2.tgz":    {},
+		"values.yaml":    {provider: true, stale: false},
+		"kubeConfig":     {provider: true},
+		"other.txt":      {stale: true},
+	}
+	var paths []string
+	for name, d := range files {
+		f := filepath.Join(dir, name)
+		if name == "kubeConfig" {
+			// Missing provider files are ignored
+			paths = append(paths, f)
+			continue
+		}
+		_ = ioutil.WriteFile(f, []byte("test"), 0644)
+		if d.stale {
+			_ = os.Chtimes(f, old, old)
+		}
+		if d.provider {
+			paths = append(paths, f)
+		}
+	}
+	// The downloaded charts are matched by pattern
+	paths = append(paths, filepath.Join(dir, chartTempPattern))
+	pruneTempFiles(paths, 15*time.Minute)
+	for name, d := range files {
+		if name == "kubeConfig" {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			_, err := os.Stat(filepath.Join(dir, name))
+			assert.Equal(t, d.removed, os.IsNotExist(err))
+		})
+	}
+}
+
+// TestSetOperationID is to test setOperationID
+func TestSetOperationID(t *testing.T) {
+	defer os.Unsetenv("OperationID")
+	os.Setenv("StartTime", "2020-01-01T00:00:00Z")
+	tests := map[string]struct {
+		context    map[string]interface{}
+		expectedID string
+	}{
+		"Context": {
+			context:    map[string]interface{}{"OperationID": "test-operation-id"},
+			expectedID: "test-operation-id",
+		},
+		"NoContext": {
+			context:    nil,
+			expectedID: aws.StringValue(getHash("stackLogicalID2020-01-01T00:00:00Z")),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			setOperationID(d.context, "stack", "LogicalID")
+			assert.EqualValues(t, d.expectedID, os.Getenv("OperationID"))
+		})
+	}
+}
+
 func TestZero(t *testing.T) {
 	one, zeroInt := 1, 0
 
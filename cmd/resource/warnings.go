@@ -0,0 +1,118 @@
+package resource
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/postrender"
+	"k8s.io/client-go/rest"
+)
+
+// ChartWarnings handling modes
+const (
+	chartWarningsLog    = "Log"
+	chartWarningsIgnore = "Ignore"
+	chartWarningsFail   = "Fail"
+)
+
+// helmWarningLine matches the warnings helm logs with the standard logger while rendering, e.g. when coalescing the
+// values or evaluating the dependency conditions, capturing the message.
+var helmWarningLine = regexp.MustCompile(`(?i)(?:^|\s)(?:\[warning\]|warning:|conflict:)\s*(.+)$`)
+
+// chartWarnings collects the warnings emitted while a release is rendered and applied: the warnings helm logs, the
+// deprecation of the chart and the deprecation warnings the Kubernetes API server returns.
+type chartWarnings struct {
+	mu       sync.Mutex
+	out      io.Writer
+	warnings []string
+}
+
+// warningPostRenderer fails the release when the chart emitted warnings while rendering, before anything is applied,
+// then runs the next post renderer if any
+type warningPostRenderer struct {
+	warnings *chartWarnings
+	next     postrender.PostRenderer
+}
+
+// captureChartWarnings starts collecting the warnings of the chart until stop is called, unless they are ignored.
+// It returns nil when the warnings are ignored.
+func captureChartWarnings(ch *chart.Chart, mode string) *chartWarnings {
+	if mode == chartWarningsIgnore {
+		return nil
+	}
+	w := &chartWarnings{out: log.Writer()}
+	if ch.Metadata != nil && ch.Metadata.Deprecated {
+		w.add(fmt.Sprintf("chart %s %s is deprecated", ch.Metadata.Name, ch.Metadata.Version))
+	}
+	log.SetOutput(w)
+	rest.SetDefaultWarningHandler(w)
+	return w
+}
+
+// Write collects the warning lines logged while capturing and passes the other lines on to the log output
+func (w *chartWarnings) Write(p []byte) (int, error) {
+	if m := helmWarningLine.FindSubmatch(bytes.TrimRight(p, "\n")); m != nil {
+		w.add(string(m[1]))
+		return len(p), nil
+	}
+	return w.out.Write(p)
+}
+
+// HandleWarningHeader collects the warnings of the Kubernetes API server, such as the deprecation of an API version
+func (w *chartWarnings) HandleWarningHeader(code int, agent string, text string) {
+	if code == 299 && text != "" {
+		w.add(text)
+	}
+}
+
+// add collects the warning once
+func (w *chartWarnings) add(warning string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, v := range w.warnings {
+		if v == warning {
+			return
+		}
+	}
+	w.warnings = append(w.warnings, warning)
+}
+
+// list returns the warnings collected so far
+func (w *chartWarnings) list() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.warnings...)
+}
+
+// stop restores the log output and the warning handler of the Kubernetes clients, then logs the collected warnings
+// at info level, apart from the errors.
+func (w *chartWarnings) stop() []string {
+	if w == nil {
+		return nil
+	}
+	log.SetOutput(w.out)
+	rest.SetDefaultWarningHandler(rest.WarningLogger{})
+	warnings := w.list()
+	for _, v := range warnings {
+		log.Printf("Info: chart warning: %s", v)
+	}
+	return warnings
+}
+
+// Run fails when the chart emitted warnings while rendering, otherwise it runs the next post renderer if any
+func (p *warningPostRenderer) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	if warnings := p.warnings.list(); len(warnings) > 0 {
+		return nil, genericError("Checking chart warnings", errors.New("the chart emitted warnings: "+strings.Join(warnings, "; ")+". Set ChartWarnings to Log to deploy it anyway"))
+	}
+	if p.next != nil {
+		return p.next.Run(renderedManifests)
+	}
+	return renderedManifests, nil
+}
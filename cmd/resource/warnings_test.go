@@ -0,0 +1,98 @@
+package resource
+
+import (
+	"bytes"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+)
+
+// warningChart returns a chart whose image value is a string, deprecated when asked
+func warningChart(deprecated bool) *chart.Chart {
+	return &chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "web", Version: "0.1.0", Deprecated: deprecated},
+		Values:   map[string]interface{}{"image": "nginx:1.19"},
+		Templates: []*chart.File{
+			{Name: "templates/cm.yaml", Data: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: web\ndata:\n  image: {{ .Values.image | quote }}\n")},
+		},
+	}
+}
+
+// TestChartWarnings to test the warnings of a rendered chart are captured apart from the other log lines
+func TestChartWarnings(t *testing.T) {
+	tests := map[string]struct {
+		chart    *chart.Chart
+		mode     string
+		values   map[string]interface{}
+		expected []string
+	}{
+		"Deprecated": {
+			chart:    warningChart(true),
+			mode:     chartWarningsLog,
+			values:   map[string]interface{}{},
+			expected: []string{"chart web 0.1.0 is deprecated"},
+		},
+		"Values": {
+			chart:    warningChart(false),
+			mode:     chartWarningsFail,
+			values:   map[string]interface{}{"image": map[string]interface{}{"tag": "1.20"}},
+			expected: []string{"skipped value for image: Not a table."},
+		},
+		"NoWarnings": {
+			chart:  warningChart(false),
+			values: map[string]interface{}{"image": "nginx:1.20"},
+		},
+		"Ignore": {
+			chart:  warningChart(true),
+			mode:   chartWarningsIgnore,
+			values: map[string]interface{}{"image": map[string]interface{}{"tag": "1.20"}},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			out := new(bytes.Buffer)
+			defer log.SetOutput(log.Writer())
+			log.SetOutput(out)
+			w := captureChartWarnings(d.chart, d.mode)
+			vals, err := chartutil.ToRenderValues(d.chart, d.values, chartutil.ReleaseOptions{Name: "web", Namespace: "default"}, nil)
+			assert.Nil(t, err)
+			_, err = engine.Render(d.chart, vals)
+			assert.Nil(t, err)
+			log.Printf("Release web rendered")
+			assert.Equal(t, d.expected, w.stop())
+			assert.Contains(t, out.String(), "Release web rendered")
+			for _, v := range d.expected {
+				assert.Contains(t, out.String(), "Info: chart warning: "+v)
+			}
+		})
+	}
+}
+
+// TestChartWarningsAPIServer to test the deprecation warnings of the Kubernetes API server are captured once
+func TestChartWarningsAPIServer(t *testing.T) {
+	w := captureChartWarnings(warningChart(false), chartWarningsLog)
+	w.HandleWarningHeader(299, "", "extensions/v1beta1 Ingress is deprecated in v1.14+, unavailable in v1.22+")
+	w.HandleWarningHeader(299, "", "extensions/v1beta1 Ingress is deprecated in v1.14+, unavailable in v1.22+")
+	w.HandleWarningHeader(199, "", "miscellaneous warning")
+	assert.Equal(t, []string{"extensions/v1beta1 Ingress is deprecated in v1.14+, unavailable in v1.22+"}, w.stop())
+}
+
+// TestWarningPostRenderer to test ChartWarnings Fail stops the release before the manifests are applied
+func TestWarningPostRenderer(t *testing.T) {
+	manifests := "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: web\n"
+	w := captureChartWarnings(warningChart(false), chartWarningsFail)
+	p := &warningPostRenderer{warnings: w, next: &annotationPostRenderer{annotations: map[string]string{"owner": "stack"}}}
+	out, err := p.Run(bytes.NewBufferString(manifests))
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), "owner: stack")
+
+	w.add("chart web 0.1.0 is deprecated")
+	_, err = p.Run(bytes.NewBufferString(manifests))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "the chart emitted warnings: chart web 0.1.0 is deprecated. Set ChartWarnings to Log to deploy it anyway")
+	w.stop()
+}
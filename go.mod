@@ -3,13 +3,20 @@ module github.com/aws-quickstart/quickstart-helm-resource-provider
 go 1.13
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/ahmetb/go-linq/v3 v3.2.0
 	github.com/aws-cloudformation/cloudformation-cli-go-plugin v1.0.3
 	github.com/aws/aws-lambda-go v1.22.0
 	github.com/aws/aws-sdk-go v1.37.20
+	github.com/containerd/containerd v1.4.3
+	github.com/deislabs/oras v0.10.0
+	github.com/go-git/go-git/v5 v5.4.2
 	github.com/gofrs/flock v0.8.0
 	github.com/pkg/errors v0.9.1
+	github.com/pkg/sftp v1.12.0
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b
+	gopkg.in/yaml.v3 v3.0.0-20200615113413-eeeca48fe776
 	helm.sh/helm/v3 v3.5.3
 	k8s.io/api v0.20.4
 	k8s.io/apiextensions-apiserver v0.20.4
@@ -19,6 +26,7 @@ require (
 	k8s.io/kubectl v0.20.4
 	k8s.io/kubernetes v1.20.4
 	sigs.k8s.io/aws-iam-authenticator v0.5.2
+	sigs.k8s.io/kustomize v2.0.3+incompatible
 	sigs.k8s.io/yaml v1.2.0
 )
 
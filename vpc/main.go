@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 
 	"github.com/aws-quickstart/quickstart-helm-resource-provider/cmd/resource"
@@ -14,17 +13,13 @@ func HandleRequest(_ context.Context, e resource.Event) (*resource.LambdaRespons
 	defer resource.LogPanic()
 
 	res := &resource.LambdaResponse{}
-	eJson, err := json.Marshal(e)
-	if err != nil {
-		fmt.Println(err)
-	}
-	fmt.Println(string(eJson))
+	fmt.Println(resource.EventLog(&e))
 	data, err := resource.DecodeID(e.Model.ID)
 	if err != nil {
 		return nil, err
 	}
 
-	client, err := resource.NewClients(nil, nil, data.Namespace, nil, nil, e.Kubeconfig, nil)
+	client, err := resource.NewClients(nil, nil, data.Namespace, nil, nil, e.Kubeconfig, nil, nil, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -41,6 +36,7 @@ func HandleRequest(_ context.Context, e resource.Event) (*resource.LambdaRespons
 		fmt.Println("GetPendingAction")
 		res.PendingResources, err = client.CheckPendingResources(e.ReleaseData)
 		res.LastKnownErrors = resource.LastKnownErrors
+		res.ProgressDetail = resource.ProgressDetail
 		return res, err
 	case resource.GetResourcesAction:
 		fmt.Println("GetResourcesAction")
@@ -51,11 +47,26 @@ func HandleRequest(_ context.Context, e resource.Event) (*resource.LambdaRespons
 		return nil, client.HelmUpgrade(aws.StringValue(data.Name), e.Inputs.Config, e.Inputs.ValueOpts, e.Inputs.ChartDetails, *e.Model.ID)
 	case resource.UninstallReleaseAction:
 		fmt.Println("UninstallReleaseAction")
-		return nil, client.HelmUninstall(aws.StringValue(data.Name))
+		return nil, client.HelmUninstall(aws.StringValue(data.Name), e.Inputs.Config)
+	case resource.PreviewUninstallAction:
+		fmt.Println("PreviewUninstallAction")
+		res.UninstallPreview, err = client.HelmUninstallPreview(aws.StringValue(data.Name))
+		return res, err
+	case resource.DiffReleaseAction:
+		fmt.Println("DiffReleaseAction")
+		res.Diff, err = client.HelmDiff(e.Inputs.Config, e.Inputs.ValueOpts, e.Inputs.ChartDetails)
+		return res, err
 	case resource.ListReleaseAction:
 		fmt.Println("ListReleaseAction")
 		res.ListData, err = client.HelmList(e.Inputs.Config, e.Inputs.ChartDetails)
 		return res, err
+	case resource.SetDescriptionAction:
+		fmt.Println("SetDescriptionAction")
+		return nil, client.HelmSetDescription(aws.StringValue(data.Name), e.ReleaseData.Description)
+	case resource.UnlockReleaseAction:
+		fmt.Println("UnlockReleaseAction")
+		client.UnlockRelease(e.ReleaseData)
+		return nil, nil
 	default:
 		return nil, fmt.Errorf("Unhandled stage %s", e.Action)
 	}
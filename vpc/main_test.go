@@ -4,8 +4,8 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
-	"os"
 	"testing"
+	"time"
 
 	"github.com/aws-quickstart/quickstart-helm-resource-provider/cmd/resource"
 	"github.com/aws/aws-sdk-go/aws"
@@ -14,7 +14,6 @@ import (
 )
 
 func TestHandler(t *testing.T) {
-	defer os.Remove("/tmp/chart.tgz")
 	testFolder := "../cmd/resource/testdata"
 	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(testFolder))))
 	defer func() { testServer.Close() }()
@@ -28,7 +27,7 @@ func TestHandler(t *testing.T) {
 			ChartDetails: &resource.Chart{
 				ChartType: aws.String("Local"),
 				ChartPath: aws.String(testServer.URL + "/test.tgz"),
-				Chart:     aws.String("/tmp/chart.tgz"),
+				Chart:     aws.String(testServer.URL + "/test.tgz"),
 				ChartName: aws.String("hello"),
 			},
 		},
@@ -100,7 +99,7 @@ func TestHandler(t *testing.T) {
 			eError: aws.String("At Json Unmarshal"),
 		},
 	}
-	resource.NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *resource.VPCConfiguration) (*resource.Clients, error) {
+	resource.NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *resource.VPCConfiguration, authExec *resource.KubeAuthExec, deadline *time.Time) (*resource.Clients, error) {
 		return resource.NewMockClient(t, nil), nil
 	}
 	for name, d := range tests {